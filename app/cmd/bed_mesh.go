@@ -0,0 +1,92 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+import (
+	"fmt"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// bedMeshCmd represents the bed-mesh command
+var bedMeshCmd = &cobra.Command{
+	Use:   "bed-mesh",
+	Short: "compensate a print for a bed that isn't flat, for printers without mesh bed leveling",
+	Long: `Moves the nozzle up and down to follow a bed height map (--mesh), for printers whose firmware doesn't have
+mesh bed leveling. Moves are split into pieces no longer than --segment-length, and arcs are turned into moves first,
+so that they follow the bed. The compensation fades out going up, until it stops at --fade-height.
+
+The mesh can be a grid of heights (one row per line, from the front of the bed to the back), what Marlin writes for
+M420 V or G29 T, or Klipper's saved [bed_mesh] section or BED_MESH_OUTPUT. Plain grids and Marlin's bilinear grid
+don't say where they are on the bed, so --mesh-min and --mesh-max (the front left and back right probe points) are
+needed for them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		meshFile := viper.GetString("bed-mesh.mesh")
+		if meshFile == "" {
+			die(fmt.Errorf("--mesh is needed"))
+		}
+		var min, max gcodetools.Point
+		if s := viper.GetString("bed-mesh.mesh-min"); s != "" {
+			min = parsePoint(s)
+		}
+		if s := viper.GetString("bed-mesh.mesh-max"); s != "" {
+			max = parsePoint(s)
+		}
+		meshInput := openInput(meshFile)
+		mesh, err := gcodetools.ReadBedMesh(meshInput, min, max)
+		die(err)
+		die(meshInput.Close())
+
+		profile := loadProfile()
+		input := openInput(viper.GetString("bed-mesh.input"))
+		defer input.Close()
+		output := createOutput(viper.GetString("bed-mesh.output"))
+		defer func() { die(output.Close()) }()
+		compensation := gcodetools.MeshCompensation{
+			Dialect:       profile.FirmwareFlavor().Dialect,
+			Mesh:          mesh,
+			FadeHeight:    viper.GetFloat64("bed-mesh.fade-height"),
+			SegmentLength: viper.GetFloat64("bed-mesh.segment-length"),
+		}
+		die(compensation.Compensate(input, output))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(bedMeshCmd)
+
+	bedMeshCmd.Flags().StringP("input", "i", "-", "input file (- for stdin)")
+	die(viper.BindPFlag("bed-mesh.input", bedMeshCmd.Flags().Lookup("input")))
+
+	bedMeshCmd.Flags().StringP("output", "o", "-", "file to write the compensated gcode to (- for stdout)")
+	die(viper.BindPFlag("bed-mesh.output", bedMeshCmd.Flags().Lookup("output")))
+
+	bedMeshCmd.Flags().String("mesh", "", "file with the bed height map")
+	die(viper.BindPFlag("bed-mesh.mesh", bedMeshCmd.Flags().Lookup("mesh")))
+
+	bedMeshCmd.Flags().String("mesh-min", "", "the front left point of the mesh, like 10x10, for meshes that don't say")
+	die(viper.BindPFlag("bed-mesh.mesh-min", bedMeshCmd.Flags().Lookup("mesh-min")))
+
+	bedMeshCmd.Flags().String("mesh-max", "", "the back right point of the mesh, like 210x210, for meshes that don't say")
+	die(viper.BindPFlag("bed-mesh.mesh-max", bedMeshCmd.Flags().Lookup("mesh-max")))
+
+	bedMeshCmd.Flags().Float64("fade-height", 10, "the height that the compensation fades out by, in mm (0 never fades)")
+	die(viper.BindPFlag("bed-mesh.fade-height", bedMeshCmd.Flags().Lookup("fade-height")))
+
+	bedMeshCmd.Flags().Float64("segment-length", 5, "the longest that moves can be, in mm")
+	die(viper.BindPFlag("bed-mesh.segment-length", bedMeshCmd.Flags().Lookup("segment-length")))
+}
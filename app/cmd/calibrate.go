@@ -0,0 +1,211 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/madewithlinux/gcodetools/calibrate"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// calibrateCmd represents the calibrate command
+var calibrateCmd = &cobra.Command{
+	Use:   "calibrate",
+	Short: "generate calibration prints",
+}
+
+type calibrationGenerator func(profile *gcodetools.PrinterProfile, key string) (*gcodetools.GcodeBuilder, error)
+
+// newCalibrateSubcommand makes a subcommand that runs generate and writes the result to the calibrate output file.
+// Its flags are bound to viper under "calibrate.<name>.", so that they can also be set in the config file.
+func newCalibrateSubcommand(name, short string, generate calibrationGenerator) *cobra.Command {
+	key := "calibrate." + name + "."
+	return &cobra.Command{
+		Use:   name,
+		Short: short,
+		Run: func(cmd *cobra.Command, args []string) {
+			profile := loadProfile()
+			builder, err := generate(&profile, key)
+			die(err)
+
+			outputFilename := viper.GetString("calibrate.output")
+			if outputFilename == "-" {
+				die(builder.ToWriter(os.Stdout))
+			} else {
+				die(builder.ToFile(outputFilename))
+			}
+		},
+	}
+}
+
+func addRangeFlags(cmd *cobra.Command, key, name, unit string, defaultRange calibrate.Range) {
+	cmd.Flags().Float64(name+"-start", defaultRange.Start, "first "+name+" to test"+unit)
+	die(viper.BindPFlag(key+name+"-start", cmd.Flags().Lookup(name+"-start")))
+	cmd.Flags().Float64(name+"-end", defaultRange.End, "last "+name+" to test"+unit)
+	die(viper.BindPFlag(key+name+"-end", cmd.Flags().Lookup(name+"-end")))
+	cmd.Flags().Float64(name+"-step", defaultRange.Step, "increment between tested values"+unit)
+	die(viper.BindPFlag(key+name+"-step", cmd.Flags().Lookup(name+"-step")))
+}
+
+func getRange(key, name string) calibrate.Range {
+	return calibrate.Range{
+		Start: viper.GetFloat64(key + name + "-start"),
+		End:   viper.GetFloat64(key + name + "-end"),
+		Step:  viper.GetFloat64(key + name + "-step"),
+	}
+}
+
+func addFloatFlag(cmd *cobra.Command, key, name string, value float64, usage string) {
+	cmd.Flags().Float64(name, value, usage)
+	die(viper.BindPFlag(key+name, cmd.Flags().Lookup(name)))
+}
+
+func addIntFlag(cmd *cobra.Command, key, name string, value int, usage string) {
+	cmd.Flags().Int(name, value, usage)
+	die(viper.BindPFlag(key+name, cmd.Flags().Lookup(name)))
+}
+
+func init() {
+	rootCmd.AddCommand(calibrateCmd)
+
+	calibrateCmd.PersistentFlags().StringP("output", "o", "-", "file to write the calibration gcode to (- for stdout)")
+	die(viper.BindPFlag("calibrate.output", calibrateCmd.PersistentFlags().Lookup("output")))
+
+	pressureAdvanceCmd := newCalibrateSubcommand("pressure-advance", "pressure advance / linear advance line test",
+		func(profile *gcodetools.PrinterProfile, key string) (*gcodetools.GcodeBuilder, error) {
+			return calibrate.PressureAdvance(profile, calibrate.PressureAdvanceOptions{
+				K:           getRange(key, "k"),
+				LineSpacing: viper.GetFloat64(key + "line-spacing"),
+				SlowLength:  viper.GetFloat64(key + "slow-length"),
+				FastLength:  viper.GetFloat64(key + "fast-length"),
+				SlowSpeed:   viper.GetFloat64(key + "slow-speed"),
+				FastSpeed:   viper.GetFloat64(key + "fast-speed"),
+			})
+		})
+	{
+		key, opts := "calibrate.pressure-advance.", calibrate.DefaultPressureAdvanceOptions
+		addRangeFlags(pressureAdvanceCmd, key, "k", "", opts.K)
+		addFloatFlag(pressureAdvanceCmd, key, "line-spacing", opts.LineSpacing, "distance between lines (mm)")
+		addFloatFlag(pressureAdvanceCmd, key, "slow-length", opts.SlowLength, "length of the slow sections (mm)")
+		addFloatFlag(pressureAdvanceCmd, key, "fast-length", opts.FastLength, "length of the fast section (mm)")
+		addFloatFlag(pressureAdvanceCmd, key, "slow-speed", opts.SlowSpeed, "speed of the slow sections (mm/s)")
+		addFloatFlag(pressureAdvanceCmd, key, "fast-speed", opts.FastSpeed, "speed of the fast section (mm/s)")
+	}
+	calibrateCmd.AddCommand(pressureAdvanceCmd)
+
+	temperatureTowerCmd := newCalibrateSubcommand("temperature-tower", "tower with a different hotend temperature for each segment",
+		func(profile *gcodetools.PrinterProfile, key string) (*gcodetools.GcodeBuilder, error) {
+			return calibrate.TemperatureTower(profile, calibrate.TemperatureTowerOptions{
+				Temperature:   getRange(key, "temperature"),
+				SegmentHeight: viper.GetFloat64(key + "segment-height"),
+				Size:          viper.GetFloat64(key + "size"),
+				Perimeters:    viper.GetInt(key + "perimeters"),
+			})
+		})
+	{
+		key, opts := "calibrate.temperature-tower.", calibrate.DefaultTemperatureTowerOptions
+		addRangeFlags(temperatureTowerCmd, key, "temperature", " (°C)", opts.Temperature)
+		addFloatFlag(temperatureTowerCmd, key, "segment-height", opts.SegmentHeight, "height of each temperature segment (mm)")
+		addFloatFlag(temperatureTowerCmd, key, "size", opts.Size, "width of the tower (mm)")
+		addIntFlag(temperatureTowerCmd, key, "perimeters", opts.Perimeters, "number of walls")
+	}
+	calibrateCmd.AddCommand(temperatureTowerCmd)
+
+	retractionTowerCmd := newCalibrateSubcommand("retraction-tower", "pair of towers with a different retraction length for each segment",
+		func(profile *gcodetools.PrinterProfile, key string) (*gcodetools.GcodeBuilder, error) {
+			return calibrate.RetractionTower(profile, calibrate.RetractionTowerOptions{
+				RetractLength: getRange(key, "retract-length"),
+				SegmentHeight: viper.GetFloat64(key + "segment-height"),
+				Size:          viper.GetFloat64(key + "size"),
+				Spacing:       viper.GetFloat64(key + "spacing"),
+			})
+		})
+	{
+		key, opts := "calibrate.retraction-tower.", calibrate.DefaultRetractionTowerOptions
+		addRangeFlags(retractionTowerCmd, key, "retract-length", " (mm)", opts.RetractLength)
+		addFloatFlag(retractionTowerCmd, key, "segment-height", opts.SegmentHeight, "height of each retraction segment (mm)")
+		addFloatFlag(retractionTowerCmd, key, "size", opts.Size, "width of each tower (mm)")
+		addFloatFlag(retractionTowerCmd, key, "spacing", opts.Spacing, "distance between the towers (mm)")
+	}
+	calibrateCmd.AddCommand(retractionTowerCmd)
+
+	flowRateCmd := newCalibrateSubcommand("flow-rate", "patches with a different extrusion multiplier each",
+		func(profile *gcodetools.PrinterProfile, key string) (*gcodetools.GcodeBuilder, error) {
+			return calibrate.FlowRate(profile, calibrate.FlowRateOptions{
+				Multiplier: getRange(key, "multiplier"),
+				PatchSize:  viper.GetFloat64(key + "patch-size"),
+				Spacing:    viper.GetFloat64(key + "spacing"),
+				Layers:     viper.GetInt(key + "layers"),
+			})
+		})
+	{
+		key, opts := "calibrate.flow-rate.", calibrate.DefaultFlowRateOptions
+		addRangeFlags(flowRateCmd, key, "multiplier", "", opts.Multiplier)
+		addFloatFlag(flowRateCmd, key, "patch-size", opts.PatchSize, "width of each patch (mm)")
+		addFloatFlag(flowRateCmd, key, "spacing", opts.Spacing, "distance between patches (mm)")
+		addIntFlag(flowRateCmd, key, "layers", opts.Layers, "number of layers")
+	}
+	calibrateCmd.AddCommand(flowRateCmd)
+
+	firstLayerCmd := newCalibrateSubcommand("first-layer", "single layer patch for checking Z offset",
+		func(profile *gcodetools.PrinterProfile, key string) (*gcodetools.GcodeBuilder, error) {
+			return calibrate.FirstLayer(profile, calibrate.FirstLayerOptions{
+				Size:       viper.GetFloat64(key + "size"),
+				Perimeters: viper.GetInt(key + "perimeters"),
+			})
+		})
+	{
+		key, opts := "calibrate.first-layer.", calibrate.DefaultFirstLayerOptions
+		addFloatFlag(firstLayerCmd, key, "size", opts.Size, "width of the patch (mm)")
+		addIntFlag(firstLayerCmd, key, "perimeters", opts.Perimeters, "number of perimeters around the patch")
+	}
+	calibrateCmd.AddCommand(firstLayerCmd)
+
+	skewCmd := newCalibrateSubcommand("skew", "square frame for measuring skew, for correct-skew",
+		func(profile *gcodetools.PrinterProfile, key string) (*gcodetools.GcodeBuilder, error) {
+			return calibrate.Skew(profile, calibrate.SkewOptions{
+				Size:       viper.GetFloat64(key + "size"),
+				Perimeters: viper.GetInt(key + "perimeters"),
+				Layers:     viper.GetInt(key + "layers"),
+			})
+		})
+	{
+		key, opts := "calibrate.skew.", calibrate.DefaultSkewOptions
+		addFloatFlag(skewCmd, key, "size", opts.Size, "width of the frame (mm)")
+		addIntFlag(skewCmd, key, "perimeters", opts.Perimeters, "number of perimeters in the frame")
+		addIntFlag(skewCmd, key, "layers", opts.Layers, "number of layers")
+	}
+	calibrateCmd.AddCommand(skewCmd)
+
+	maxVolumetricSpeedCmd := newCalibrateSubcommand("max-volumetric-speed", "lines printed at increasing volumetric flow",
+		func(profile *gcodetools.PrinterProfile, key string) (*gcodetools.GcodeBuilder, error) {
+			return calibrate.MaxVolumetricSpeed(profile, calibrate.MaxVolumetricSpeedOptions{
+				VolumetricSpeed: getRange(key, "volumetric-speed"),
+				LineLength:      viper.GetFloat64(key + "line-length"),
+				LineSpacing:     viper.GetFloat64(key + "line-spacing"),
+			})
+		})
+	{
+		key, opts := "calibrate.max-volumetric-speed.", calibrate.DefaultMaxVolumetricSpeedOptions
+		addRangeFlags(maxVolumetricSpeedCmd, key, "volumetric-speed", " (mm³/s)", opts.VolumetricSpeed)
+		addFloatFlag(maxVolumetricSpeedCmd, key, "line-length", opts.LineLength, "length of each line (mm)")
+		addFloatFlag(maxVolumetricSpeedCmd, key, "line-spacing", opts.LineSpacing, "distance between lines (mm)")
+	}
+	calibrateCmd.AddCommand(maxVolumetricSpeedCmd)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// cancelObjectCmd represents the cancel-object command
+var cancelObjectCmd = &cobra.Command{
+	Use:   "cancel-object",
+	Short: "leave some of the objects out of a print, before it's printed",
+	Long: `Leaves objects (--object, which can be repeated) out of a print. They're found the same way that
+label-objects finds them, and run label-objects to see their names.
+
+The moves that print them are left out, but everything else (like temperature and fan changes) is kept, and so
+are retracts and primes, so that the filament is where the rest of the print expects it to be. After each part
+that's left out, the nozzle moves to where the print carries on from, and E is set with G92.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		names := viper.GetStringSlice("cancel-object.object")
+		if len(names) == 0 {
+			die(fmt.Errorf("--object is needed"))
+		}
+		profile := loadProfile()
+		input := openInput(viper.GetString("cancel-object.input"))
+		gcode, err := ioutil.ReadAll(input)
+		die(err)
+		die(input.Close())
+
+		output := createOutput(viper.GetString("cancel-object.output"))
+		defer func() { die(output.Close()) }()
+		_, err = gcodetools.CancelObjects(gcodetools.CancelConfig{
+			Dialect:        profile.FirmwareFlavor().Dialect,
+			TravelFeedrate: 60 * profile.TravelSpeed,
+			ZFeedrate:      60 * profile.Limits.MaxSpeedZ,
+		}, string(gcode), names, output)
+		die(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cancelObjectCmd)
+
+	cancelObjectCmd.Flags().StringP("input", "i", "-", "input file (- for stdin)")
+	die(viper.BindPFlag("cancel-object.input", cancelObjectCmd.Flags().Lookup("input")))
+
+	cancelObjectCmd.Flags().StringP("output", "o", "-", "file to write the gcode to (- for stdout)")
+	die(viper.BindPFlag("cancel-object.output", cancelObjectCmd.Flags().Lookup("output")))
+
+	cancelObjectCmd.Flags().StringSlice("object", nil, "the name of an object to leave out (can be repeated)")
+	die(viper.BindPFlag("cancel-object.object", cancelObjectCmd.Flags().Lookup("object")))
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// convertUnitsCmd represents the convert-units command
+var convertUnitsCmd = &cobra.Command{
+	Use:   "convert-units",
+	Short: "convert a program from inches to mm, or mm to inches",
+	Long: `Rewrites every length in a program (coordinates, feedrates and arc offsets) in the other unit, and changes
+G20/G21 to match. Programs without a G20 are taken to be in mm. The gcode is parsed in the dialect of the
+profile's firmware flavor, so that grbl and LinuxCNC programs keep their (comments).`,
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := loadProfile()
+		conversion := gcodetools.UnitConversion{Dialect: profile.FirmwareFlavor().Dialect}
+		switch to := viper.GetString("convert-units.to"); to {
+		case "mm":
+		case "inch", "in":
+			conversion.ToInches = true
+		default:
+			die(fmt.Errorf("unknown unit %q (expected mm or inch)", to))
+		}
+		conversion.Decimals = viper.GetInt("convert-units.decimals")
+
+		input := openInput(viper.GetString("convert-units.input"))
+		defer input.Close()
+		gcodeBytes, err := ioutil.ReadAll(input)
+		die(err)
+		gcodeStr, err := conversion.ConvertStr(string(gcodeBytes))
+		die(err)
+
+		output := createOutput(viper.GetString("convert-units.output"))
+		defer func() { die(output.Close()) }()
+		_, err = output.Write([]byte(gcodeStr))
+		die(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(convertUnitsCmd)
+
+	convertUnitsCmd.Flags().StringP("input", "i", "-", "input file (- for stdin)")
+	die(viper.BindPFlag("convert-units.input", convertUnitsCmd.Flags().Lookup("input")))
+
+	convertUnitsCmd.Flags().StringP("output", "o", "-", "file to write the converted gcode to (- for stdout)")
+	die(viper.BindPFlag("convert-units.output", convertUnitsCmd.Flags().Lookup("output")))
+
+	convertUnitsCmd.Flags().String("to", "mm", "unit to convert to (mm or inch)")
+	die(viper.BindPFlag("convert-units.to", convertUnitsCmd.Flags().Lookup("to")))
+
+	convertUnitsCmd.Flags().Int("decimals", 0, "decimals to write lengths with (defaults to 4 for mm and 5 for inches)")
+	die(viper.BindPFlag("convert-units.decimals", convertUnitsCmd.Flags().Lookup("decimals")))
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// correctSkewCmd represents the correct-skew command
+var correctSkewCmd = &cobra.Command{
+	Use:   "correct-skew",
+	Short: "correct a print for skewed axes and axes that move too far or not far enough",
+	Long: `Moves every position in a print (including the centers of arcs) to make up for the printer's axes
+being out of square, and for axes that don't move by exactly what they're asked to. This is the same
+correction as Klipper's SET_SKEW, for firmware that doesn't have it.
+
+The skew of each plane comes from a square printed in it (see calibrate skew), as the lengths of its
+diagonals AC and BD and its side AD, like SET_SKEW: --xy 140.4,142.8,99.8. The scale of each axis comes
+from how long something was meant to be and how long it came out: --scale-x 100,100.5.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := loadProfile()
+		correction := gcodetools.AxisCorrection{ScaleX: 1, ScaleY: 1, ScaleZ: 1}
+		for _, skew := range []struct {
+			name   string
+			factor *float64
+		}{{"xy", &correction.Skew.XY}, {"xz", &correction.Skew.XZ}, {"yz", &correction.Skew.YZ}} {
+			lengths := parseLengths(viper.GetString("correct-skew."+skew.name), skew.name, 3)
+			if lengths == nil {
+				continue
+			}
+			factor, err := gcodetools.SkewFactor(lengths[0], lengths[1], lengths[2])
+			die(err)
+			*skew.factor = factor
+		}
+		for _, scale := range []struct {
+			name   string
+			factor *float64
+		}{{"scale-x", &correction.ScaleX}, {"scale-y", &correction.ScaleY}, {"scale-z", &correction.ScaleZ}} {
+			lengths := parseLengths(viper.GetString("correct-skew."+scale.name), scale.name, 2)
+			if lengths == nil {
+				continue
+			}
+			factor, err := gcodetools.AxisScale(lengths[0], lengths[1])
+			die(err)
+			*scale.factor = factor
+		}
+
+		input := openInput(viper.GetString("correct-skew.input"))
+		defer input.Close()
+		output := createOutput(viper.GetString("correct-skew.output"))
+		defer func() { die(output.Close()) }()
+		transform := gcodetools.PositionTransform{Dialect: profile.FirmwareFlavor().Dialect, Matrix: correction.Transform()}
+		die(transform.Rewrite(input, output))
+	},
+}
+
+// parseLengths parses a list of count lengths like 140.4,142.8,99.8, or returns nil if there aren't any
+func parseLengths(s, flag string, count int) []float64 {
+	if s == "" {
+		return nil
+	}
+	fields := strings.Split(s, ",")
+	if len(fields) != count {
+		die(fmt.Errorf("--%s needs %d lengths, not %q", flag, count, s))
+	}
+	lengths := make([]float64, count)
+	for i, field := range fields {
+		length, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			die(fmt.Errorf("--%s: %q isn't a length", flag, field))
+		}
+		lengths[i] = length
+	}
+	return lengths
+}
+
+func init() {
+	rootCmd.AddCommand(correctSkewCmd)
+
+	correctSkewCmd.Flags().StringP("input", "i", "-", "input file (- for stdin)")
+	die(viper.BindPFlag("correct-skew.input", correctSkewCmd.Flags().Lookup("input")))
+
+	correctSkewCmd.Flags().StringP("output", "o", "-", "file to write the corrected gcode to (- for stdout)")
+	die(viper.BindPFlag("correct-skew.output", correctSkewCmd.Flags().Lookup("output")))
+
+	for _, plane := range []string{"xy", "xz", "yz"} {
+		correctSkewCmd.Flags().String(plane, "", "lengths AC,BD,AD of the skew test square printed in the "+strings.ToUpper(plane)+" plane")
+		die(viper.BindPFlag("correct-skew."+plane, correctSkewCmd.Flags().Lookup(plane)))
+	}
+	for _, axis := range []string{"x", "y", "z"} {
+		correctSkewCmd.Flags().String("scale-"+axis, "", "expected,measured length of something printed along "+strings.ToUpper(axis))
+		die(viper.BindPFlag("correct-skew.scale-"+axis, correctSkewCmd.Flags().Lookup("scale-"+axis)))
+	}
+}
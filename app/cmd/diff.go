@@ -0,0 +1,73 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff a.gcode b.gcode",
+	Short: "compare what two gcode files print, layer by layer",
+	Long: `Replays both files through machine state tracking, splits them into layers, and reports the layers where the
+filament extruded, the extrusion paths, the temperatures or the extrusion feedrate differ. Formatting, comments and
+redundant words make no difference. Optionally draws the layers that changed as an SVG.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := loadProfile()
+		cfg := gcodetools.DiffConfig{
+			Dialect:            profile.FirmwareFlavor().Dialect,
+			Resolution:         viper.GetFloat64("diff.resolution"),
+			ExtrusionTolerance: viper.GetFloat64("diff.extrusion-tolerance"),
+			FeedrateTolerance:  viper.GetFloat64("diff.feedrate-tolerance"),
+		}
+
+		a := openInput(args[0])
+		defer a.Close()
+		b := openInput(args[1])
+		defer b.Close()
+		report, err := gcodetools.Diff(cfg, a, b)
+		die(err)
+		die(report.WriteText(os.Stdout, args[0], args[1]))
+
+		if svgFilename := viper.GetString("diff.svg"); svgFilename != "" {
+			svg := createOutput(svgFilename)
+			defer svg.Close()
+			die(report.WriteSVG(svg))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().String("svg", "", "also draw the layers that changed to this SVG file")
+	die(viper.BindPFlag("diff.svg", diffCmd.Flags().Lookup("svg")))
+
+	diffCmd.Flags().Float64("resolution", 0.5, "the size (in mm) of the grid that extrusion paths are compared on")
+	die(viper.BindPFlag("diff.resolution", diffCmd.Flags().Lookup("resolution")))
+
+	diffCmd.Flags().Float64("extrusion-tolerance", 0.01, "how much (in mm) the filament extruded on a layer may differ by")
+	die(viper.BindPFlag("diff.extrusion-tolerance", diffCmd.Flags().Lookup("extrusion-tolerance")))
+
+	diffCmd.Flags().Float64("feedrate-tolerance", 1, "how much (in mm/min) the average extrusion feedrate of a layer may differ by")
+	die(viper.BindPFlag("diff.feedrate-tolerance", diffCmd.Flags().Lookup("feedrate-tolerance")))
+}
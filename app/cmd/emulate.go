@@ -0,0 +1,73 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/madewithlinux/gcodetools/host"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// emulateCmd represents the emulate command
+var emulateCmd = &cobra.Command{
+	Use:   "emulate",
+	Short: "act like a printer running Marlin, on a pseudo-terminal",
+	Long: `Makes a pseudo-terminal that a host (like OctoPrint, or gcodetools send) can connect to as if it was a printer's
+serial port, and answers like Marlin does: ok, temperatures that heat up and cool down over time, positions, line
+numbers and checksums. Moves take as long as they would on the printer in the profile, scaled by --time-scale.
+The pty's name is printed when it's ready, and --link makes a symlink to it with a fixed name.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := loadProfile()
+		pty, name, err := host.OpenPty()
+		die(err)
+		defer pty.Close()
+		// holding the other side open means that hosts can disconnect and reconnect, and it puts the pty in raw mode
+		port, err := host.OpenSerial(name, 115200)
+		die(err)
+		defer port.Close()
+
+		if link := viper.GetString("emulate.link"); link != "" {
+			_ = os.Remove(link)
+			die(os.Symlink(name, link))
+			defer os.Remove(link)
+			name = link
+		}
+		fmt.Println(name)
+
+		emulator := host.NewEmulator(host.EmulatorConfig{
+			Limits:      profile.Limits,
+			TimeScale:   viper.GetFloat64("emulate.time-scale"),
+			ResendEvery: viper.GetInt("emulate.resend-every"),
+		})
+		die(emulator.Run(pty))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(emulateCmd)
+
+	emulateCmd.Flags().String("link", "", "make a symlink to the pty with this name")
+	die(viper.BindPFlag("emulate.link", emulateCmd.Flags().Lookup("link")))
+
+	emulateCmd.Flags().Float64("time-scale", 1, "how long a second takes: 1 is real time, 0.1 is ten times as fast, 0 doesn't wait at all")
+	die(viper.BindPFlag("emulate.time-scale", emulateCmd.Flags().Lookup("time-scale")))
+
+	emulateCmd.Flags().Int("resend-every", 0, "pretend that every so many numbered lines arrive garbled, so that the host has to resend them")
+	die(viper.BindPFlag("emulate.resend-every", emulateCmd.Flags().Lookup("resend-every")))
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// labelObjectsCmd represents the label-objects command
+var labelObjectsCmd = &cobra.Command{
+	Use:   "label-objects",
+	Short: "label the objects in a print, so that the firmware can cancel them one at a time",
+	Long: `Finds the objects in a print and labels them for the profile's firmware flavor, so that one of them can be
+cancelled while it's printing: EXCLUDE_OBJECT_DEFINE/START/END (with each object's outline) for Klipper, M624/M625
+for Bambu printers, and M486 for Marlin and Prusa's firmware.
+
+Objects are found from the comments that slicers write (like PrusaSlicer's "; printing object" and Cura's ;MESH:),
+or from labels that the file already has (which are replaced). Files without any are split into objects by what
+they extrude: pieces that don't touch each other are separate objects, except for ones that are only on the first
+layer, like a skirt or a purge line. The objects are listed on stderr.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := loadProfile()
+		input := openInput(viper.GetString("label-objects.input"))
+		gcode, err := ioutil.ReadAll(input)
+		die(err)
+		die(input.Close())
+
+		output := createOutput(viper.GetString("label-objects.output"))
+		defer func() { die(output.Close()) }()
+		objects, err := gcodetools.LabelObjects(profile.FirmwareFlavor(), string(gcode), output)
+		die(err)
+		printObjects(objects)
+	},
+}
+
+// printObjects lists objects on stderr
+func printObjects(objects *gcodetools.PrintObjects) {
+	for _, object := range objects.Objects {
+		fmt.Fprintf(os.Stderr, "%s: at X%v Y%v\n", object.Name, object.Center.X, object.Center.Y)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(labelObjectsCmd)
+
+	labelObjectsCmd.Flags().StringP("input", "i", "-", "input file (- for stdin)")
+	die(viper.BindPFlag("label-objects.input", labelObjectsCmd.Flags().Lookup("input")))
+
+	labelObjectsCmd.Flags().StringP("output", "o", "-", "file to write the labelled gcode to (- for stdout)")
+	die(viper.BindPFlag("label-objects.output", labelObjectsCmd.Flags().Lookup("output")))
+}
@@ -0,0 +1,120 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "check a gcode file for things that could crash the printer or ruin the print",
+	Long: `Runs a gcode file through machine state tracking against the printer profile, and reports problems.
+
+Each rule can be turned off or have its severity changed, with --rule name=severity
+or under lint.rules in the config file. Rules: ` + lintRuleNames() + `.
+Severities: off, info, warning, error.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		inputFilename := viper.GetString("lint.input")
+		format := viper.GetString("lint.format")
+		failOn, err := gcodetools.ParseLintSeverity(viper.GetString("lint.fail-on"))
+		die(err)
+
+		profile := loadProfile()
+		cfg := gcodetools.LintConfig{
+			Profile:    &profile,
+			Severities: map[gcodetools.LintRule]gcodetools.LintSeverity{},
+		}
+		for rule, severity := range viper.GetStringMapString("lint.rules") {
+			cfg.Severities[gcodetools.LintRule(rule)], err = gcodetools.ParseLintSeverity(severity)
+			die(err)
+		}
+		for _, ruleFlag := range viper.GetStringSlice("lint.rule") {
+			eq := strings.IndexByte(ruleFlag, '=')
+			if eq < 0 {
+				die(fmt.Errorf("--rule should look like name=severity, not %q", ruleFlag))
+			}
+			cfg.Severities[gcodetools.LintRule(ruleFlag[:eq])], err = gcodetools.ParseLintSeverity(ruleFlag[eq+1:])
+			die(err)
+		}
+		for rule := range cfg.Severities {
+			if _, ok := gcodetools.DefaultLintSeverities[rule]; !ok {
+				die(fmt.Errorf("unknown lint rule %q", rule))
+			}
+		}
+
+		input := openInput(inputFilename)
+		defer input.Close()
+		issues, err := gcodetools.Lint(cfg, input)
+		die(err)
+
+		switch format {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if issues == nil {
+				issues = []gcodetools.LintIssue{}
+			}
+			die(encoder.Encode(issues))
+		case "text":
+			for _, issue := range issues {
+				fmt.Printf("%s:%v\n", inputFilename, issue)
+			}
+		default:
+			die(fmt.Errorf("unknown output format %q", format))
+		}
+
+		for _, issue := range issues {
+			if failOn != gcodetools.SeverityOff && issue.Severity >= failOn {
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+func lintRuleNames() string {
+	names := []string{}
+	for rule := range gcodetools.DefaultLintSeverities {
+		names = append(names, string(rule))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func init() {
+	rootCmd.AddCommand(lintCmd)
+
+	lintCmd.Flags().StringP("input", "i", "-", "input file to lint (- for stdin)")
+	die(viper.BindPFlag("lint.input", lintCmd.Flags().Lookup("input")))
+
+	lintCmd.Flags().String("format", "text", "output format: text or json")
+	die(viper.BindPFlag("lint.format", lintCmd.Flags().Lookup("format")))
+
+	lintCmd.Flags().String("fail-on", "error", "exit with an error status if there are issues this severe (off to never fail)")
+	die(viper.BindPFlag("lint.fail-on", lintCmd.Flags().Lookup("fail-on")))
+
+	lintCmd.Flags().StringSlice("rule", nil, "set the severity of a rule, like out-of-bounds=warning (can be repeated)")
+	die(viper.BindPFlag("lint.rule", lintCmd.Flags().Lookup("rule")))
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// mergeCmd represents the merge command
+var mergeCmd = &cobra.Command{
+	Use:   "merge file...",
+	Short: "combine sliced files into one job that prints them one after another",
+	Long: `Combines several sliced files into one job that prints each of them in turn, in its own place on the bed.
+
+Each part is moved to a slot (--slot, where its front left corner goes), or put in rows from the front left of the
+bed, far enough apart that the print head doesn't hit a part that's already printed. The job starts with the first
+file's start gcode and ends with the last one's end gcode. In between parts the nozzle is raised above everything
+that has been printed, E is reset with G92, and the temperatures, fan and so on are set for the next part.
+
+The profile's head_clearance is the space that the print head takes up around the nozzle (left, right, front and
+back) and how far above the nozzle the gantry is (height). Merging fails when the print head would hit an earlier
+part, or when a part that isn't the last is taller than the gantry.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := loadProfile()
+		parts := make([]string, len(args))
+		for i, filename := range args {
+			input := openInput(filename)
+			gcode, err := ioutil.ReadAll(input)
+			die(err)
+			die(input.Close())
+			parts[i] = string(gcode)
+		}
+		var slots []gcodetools.Point
+		for _, slot := range viper.GetStringSlice("merge.slot") {
+			slots = append(slots, parsePoint(slot))
+		}
+
+		output := createOutput(viper.GetString("merge.output"))
+		defer func() { die(output.Close()) }()
+		merged, err := gcodetools.Merge(gcodetools.MergeConfig{
+			Dialect:         profile.FirmwareFlavor().Dialect,
+			HeadClearance:   profile.HeadClearance,
+			BedMin:          gcodetools.Point{X: profile.OriginX, Y: profile.OriginY},
+			BedMax:          gcodetools.Point{X: profile.OriginX + profile.BedSizeX, Y: profile.OriginY + profile.BedSizeY},
+			Slots:           slots,
+			Margin:          viper.GetFloat64("merge.margin"),
+			Lift:            viper.GetFloat64("merge.lift"),
+			TravelFeedrate:  60 * profile.TravelSpeed,
+			ZFeedrate:       60 * profile.Limits.MaxSpeedZ,
+			RetractLength:   profile.RetractLength,
+			RetractFeedrate: 60 * profile.RetractSpeed,
+		}, parts, output)
+		die(err)
+		for i, part := range merged {
+			fmt.Fprintf(os.Stderr, "%s: X%v..%v Y%v..%v, %vmm tall\n", args[i], part.Min.X, part.Max.X, part.Min.Y,
+				part.Max.Y, part.Height)
+		}
+	},
+}
+
+// parsePoint reads a point like 10x20
+func parsePoint(point string) gcodetools.Point {
+	xy := strings.Split(point, "x")
+	if len(xy) != 2 {
+		die(fmt.Errorf("invalid point %q (it should be like 10x20)", point))
+	}
+	x, err := strconv.ParseFloat(xy[0], 64)
+	die(err)
+	y, err := strconv.ParseFloat(xy[1], 64)
+	die(err)
+	return gcodetools.Point{X: x, Y: y}
+}
+
+func init() {
+	rootCmd.AddCommand(mergeCmd)
+
+	mergeCmd.Flags().StringP("output", "o", "-", "file to write the merged job to (- for stdout)")
+	die(viper.BindPFlag("merge.output", mergeCmd.Flags().Lookup("output")))
+
+	mergeCmd.Flags().StringSlice("slot", nil, "where each part's front left corner goes, like 10x20 (one for every file, in order)")
+	die(viper.BindPFlag("merge.slot", mergeCmd.Flags().Lookup("slot")))
+
+	mergeCmd.Flags().Float64("margin", 5, "how far to keep parts from the edge of the bed, in mm")
+	die(viper.BindPFlag("merge.margin", mergeCmd.Flags().Lookup("margin")))
+
+	mergeCmd.Flags().Float64("lift", 5, "how far above the tallest part to travel between parts, in mm")
+	die(viper.BindPFlag("merge.lift", mergeCmd.Flags().Lookup("lift")))
+}
@@ -33,8 +33,6 @@ var minifyCmd = &cobra.Command{
 		var err error
 		inputFilename := viper.GetString("input")
 		outputFilename := viper.GetString("output")
-		removeComments := viper.GetBool("removeComments")
-		allowUnknownGcode := viper.GetBool("allowUnknownGcode")
 
 		var inputGcodeBytes []byte
 		if inputFilename == "-" {
@@ -46,10 +44,18 @@ var minifyCmd = &cobra.Command{
 		}
 		inputGcodeStr := string(inputGcodeBytes)
 
-		cfg := (&gcodetools.GcodeMinifierConfig{
-			RemoveComments:    removeComments,
-			AllowUnknownGcode: allowUnknownGcode,
-		}).Init()
+		profile := loadProfile()
+		// the flags only override the profile's minifier settings when they are given
+		if cmd.Flags().Changed("removeComments") {
+			profile.Minifier.RemoveComments = viper.GetBool("removeComments")
+		}
+		if cmd.Flags().Changed("allowUnknownGcode") {
+			profile.Minifier.AllowUnknownGcode = viper.GetBool("allowUnknownGcode")
+		}
+		if cmd.Flags().Changed("workers") || profile.Minifier.Workers == 0 {
+			profile.Minifier.Workers = viper.GetInt("workers")
+		}
+		cfg := profile.MinifierConfig()
 		state := gcodetools.MachineState{}
 
 		outputGcodeStr, _ := cfg.MinifyGcodeStr(state, inputGcodeStr)
@@ -91,6 +97,9 @@ func init() {
 	minifyCmd.Flags().Bool("allowUnknownGcode", false, "continue on gcode that is not understood by this minifier")
 	die(viper.BindPFlag("allowUnknownGcode", minifyCmd.Flags().Lookup("allowUnknownGcode")))
 
+	minifyCmd.Flags().Int("workers", 1, "how many goroutines to minify on (the output is the same with any number)")
+	die(viper.BindPFlag("workers", minifyCmd.Flags().Lookup("workers")))
+
 }
 
 func die(err error) {
@@ -0,0 +1,103 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// numberCmd represents the number command
+var numberCmd = &cobra.Command{
+	Use:   "number",
+	Short: "add (or strip) line numbers and checksums, for sending a file to a printer",
+	Long: `Numbers every line like a host does (N123 G1 X10*71), so that the file can be streamed to a printer as it is.
+Comments and empty lines are removed, since they aren't sent, and the rest of each line is kept exactly as it was
+written. The file starts with an M110 to set the printer's line number, unless --reset=false. With --strip, line
+numbers and checksums are removed instead.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		input := openInput(viper.GetString("number.input"))
+		defer input.Close()
+		output := createOutput(viper.GetString("number.output"))
+		defer func() { die(output.Close()) }()
+		writer := bufio.NewWriter(output)
+		defer func() { die(writer.Flush()) }()
+
+		strip := viper.GetBool("number.strip")
+		numberer := &gcodetools.LineNumberer{
+			Next:      viper.GetInt("number.start"),
+			Checksums: viper.GetBool("number.checksums"),
+		}
+		if !strip && viper.GetBool("number.reset") {
+			reset := numberer.Reset(numberer.Next)
+			_, err := fmt.Fprintln(writer, gcodetools.NumberedText(fmt.Sprintf("M110 N%d", reset.LineNumber), &reset))
+			die(err)
+		}
+
+		scanner := gcodetools.NewLineScanner(input)
+		for scanner.Scan() {
+			str := scanner.Text()
+			line, err := gcodetools.ParseLine(str)
+			die(err)
+			// the rest of the line is kept exactly as it was written
+			text := gcodetools.LineText(str, &line)
+			if strip {
+				if line.Empty() {
+					continue
+				}
+				if line.Comment != nil {
+					text = strings.TrimSpace(text + " " + *line.Comment)
+				}
+				_, err = fmt.Fprintln(writer, text)
+				die(err)
+				continue
+			}
+			numberer.Number(&line)
+			if line.LineNumberValid {
+				_, err = fmt.Fprintln(writer, gcodetools.NumberedText(text, &line))
+				die(err)
+			}
+		}
+		die(scanner.Err())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(numberCmd)
+
+	numberCmd.Flags().StringP("input", "i", "-", "input file (- for stdin)")
+	die(viper.BindPFlag("number.input", numberCmd.Flags().Lookup("input")))
+
+	numberCmd.Flags().StringP("output", "o", "-", "file to write the numbered gcode to (- for stdout)")
+	die(viper.BindPFlag("number.output", numberCmd.Flags().Lookup("output")))
+
+	numberCmd.Flags().Int("start", 0, "line number to start from")
+	die(viper.BindPFlag("number.start", numberCmd.Flags().Lookup("start")))
+
+	numberCmd.Flags().Bool("checksums", true, "add a checksum to every line")
+	die(viper.BindPFlag("number.checksums", numberCmd.Flags().Lookup("checksums")))
+
+	numberCmd.Flags().Bool("reset", true, "start with an M110 to set the printer's line number")
+	die(viper.BindPFlag("number.reset", numberCmd.Flags().Lookup("reset")))
+
+	numberCmd.Flags().Bool("strip", false, "remove line numbers and checksums instead of adding them")
+	die(viper.BindPFlag("number.strip", numberCmd.Flags().Lookup("strip")))
+}
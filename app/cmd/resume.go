@@ -0,0 +1,106 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// resumeCmd represents the resume command
+var resumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "make a file that carries on with a print that failed part of the way through",
+	Long: `Makes a file that resumes a print from the start of a layer (--at-layer, numbered from 0 like diff shows
+them), from the first layer at or above a height (--at-z), or from a line of the file (--at-line).
+
+The nozzle should still be where the print stopped. Z isn't homed, since that would push the nozzle into the print:
+the nozzle is raised by --clearance, X and Y are homed, and the heaters heat up (the bed first). The commands in
+the profile's start gcode that set the printer up (like M420) are kept, but nothing from it that moves, homes,
+probes or heats. Then the nozzle moves back to where the print carries on from, E, the feedrate, the fan and the
+tool are restored, and the rest of the file follows unchanged.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		given := 0
+		for _, flag := range []string{"at-layer", "at-z", "at-line"} {
+			if cmd.Flags().Changed(flag) {
+				given++
+			}
+		}
+		if given != 1 {
+			die(fmt.Errorf("exactly one of --at-layer, --at-z and --at-line is needed"))
+		}
+
+		profile := loadProfile()
+		flavor := profile.FirmwareFlavor()
+		dialect := flavor.Dialect
+		input := openInput(viper.GetString("resume.input"))
+		original, err := ioutil.ReadAll(input)
+		die(err)
+		die(input.Close())
+
+		line := viper.GetInt("resume.at-line")
+		if !cmd.Flags().Changed("at-line") {
+			layers, err := gcodetools.ReadLayers(dialect, bytes.NewReader(original))
+			die(err)
+			if cmd.Flags().Changed("at-layer") {
+				line, err = gcodetools.ResumeLineAtLayer(layers, viper.GetInt("resume.at-layer"))
+			} else {
+				line, err = gcodetools.ResumeLineAtZ(layers, viper.GetFloat64("resume.at-z"))
+			}
+			die(err)
+		}
+
+		output := createOutput(viper.GetString("resume.output"))
+		defer func() { die(output.Close()) }()
+		state, err := gcodetools.Resume(gcodetools.ResumeConfig{
+			Dialect:        dialect,
+			Flavor:         flavor,
+			StartGcode:     profile.StartGcode,
+			Clearance:      viper.GetFloat64("resume.clearance"),
+			TravelFeedrate: 60 * profile.TravelSpeed,
+			ZFeedrate:      60 * profile.Limits.MaxSpeedZ,
+		}, bytes.NewReader(original), output, line)
+		die(err)
+		fmt.Fprintf(os.Stderr, "resuming from line %d, at X%v Y%v Z%v\n", line, state.X, state.Y, state.Z)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resumeCmd)
+
+	resumeCmd.Flags().StringP("input", "i", "-", "input file (- for stdin)")
+	die(viper.BindPFlag("resume.input", resumeCmd.Flags().Lookup("input")))
+
+	resumeCmd.Flags().StringP("output", "o", "-", "file to write the resumed print to (- for stdout)")
+	die(viper.BindPFlag("resume.output", resumeCmd.Flags().Lookup("output")))
+
+	resumeCmd.Flags().Int("at-layer", 0, "resume from the start of this layer (the first layer is 0, which can't be resumed from)")
+	die(viper.BindPFlag("resume.at-layer", resumeCmd.Flags().Lookup("at-layer")))
+
+	resumeCmd.Flags().Float64("at-z", 0, "resume from the start of the first layer at or above this height")
+	die(viper.BindPFlag("resume.at-z", resumeCmd.Flags().Lookup("at-z")))
+
+	resumeCmd.Flags().Int("at-line", 0, "resume from this line of the file (the first line is 1)")
+	die(viper.BindPFlag("resume.at-line", resumeCmd.Flags().Lookup("at-line")))
+
+	resumeCmd.Flags().Float64("clearance", 5, "how far to raise the nozzle before moving it, in mm")
+	die(viper.BindPFlag("resume.clearance", resumeCmd.Flags().Lookup("clearance")))
+}
@@ -17,7 +17,10 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/madewithlinux/gcodetools"
 	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
 	"os"
 
 	homedir "github.com/mitchellh/go-homedir"
@@ -59,6 +62,9 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.app.yaml)")
 
+	rootCmd.PersistentFlags().StringSlice("profile", nil, "printer profile files to load, in order (yaml/toml/json, or PrusaSlicer .ini exports)")
+	die(viper.BindPFlag("profile", rootCmd.PersistentFlags().Lookup("profile")))
+
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -89,3 +95,39 @@ func initConfig() {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
 }
+
+// loadProfile loads the printer profile files given by --profile (or the profile key in the config file),
+// on top of the default profile
+func loadProfile() gcodetools.PrinterProfile {
+	profile, err := gcodetools.LoadPrinterProfile(viper.GetStringSlice("profile")...)
+	die(err)
+	return profile
+}
+
+// openInput opens a file to read gcode from, where "-" is stdin
+func openInput(filename string) io.ReadCloser {
+	if filename == "-" {
+		return ioutil.NopCloser(os.Stdin)
+	}
+	file, err := os.Open(filename)
+	die(err)
+	return file
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// createOutput creates a file to write gcode to, where "-" is stdout
+func createOutput(filename string) io.WriteCloser {
+	if filename == "-" {
+		return nopWriteCloser{os.Stdout}
+	}
+	file, err := os.Create(filename)
+	die(err)
+	return file
+}
@@ -0,0 +1,133 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/madewithlinux/gcodetools/host"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// sendCmd represents the send command
+var sendCmd = &cobra.Command{
+	Use:   "send",
+	Short: "print a gcode file by streaming it to a printer over a serial port",
+	Long: `Sends a file to a printer the way that a print host does: every line is numbered and checksummed, lines are
+only sent as fast as the printer acknowledges them (up to --buffer-depth ahead), and lines that the printer asks
+for again are resent. Everything that the printer says is written to stderr.
+
+Unless the file is read from stdin, lines typed into stdin control the print: pause, resume and cancel, or any
+other line is sent to the printer straight away (even while paused). Ctrl-C cancels the print.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := loadProfile()
+		port, err := host.OpenSerial(viper.GetString("send.port"), viper.GetInt("send.baud"))
+		die(err)
+		defer port.Close()
+
+		h := host.New(port, host.Config{
+			Dialect:     profile.FirmwareFlavor().Dialect,
+			BufferDepth: viper.GetInt("send.buffer-depth"),
+			Checksums:   viper.GetBool("send.checksums"),
+			Timeout:     viper.GetDuration("send.timeout"),
+			ConnectWait: viper.GetDuration("send.connect-wait"),
+			Messages: func(message string) {
+				fmt.Fprintln(os.Stderr, message)
+			},
+		})
+		ctx := context.Background()
+		die(h.Connect(ctx))
+
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		go func() {
+			<-interrupt
+			fmt.Fprintln(os.Stderr, "cancelling")
+			h.Cancel()
+			// a second Ctrl-C doesn't wait for the printer
+			signal.Stop(interrupt)
+		}()
+
+		inputName := viper.GetString("send.input")
+		if inputName != "-" {
+			go controlFromStdin(ctx, h)
+		}
+		input := openInput(inputName)
+		defer input.Close()
+		if err := h.Send(ctx, input); err == host.ErrCancelled {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		} else {
+			die(err)
+		}
+	},
+}
+
+// controlFromStdin pauses, resumes or cancels the print, or sends any other line as a command
+func controlFromStdin(ctx context.Context, h *host.Host) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		switch command := strings.TrimSpace(scanner.Text()); command {
+		case "":
+		case "pause":
+			h.Pause()
+		case "resume":
+			h.Resume()
+		case "cancel":
+			h.Cancel()
+		default:
+			responses, err := h.Command(ctx, command)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			fmt.Println(strings.Join(responses, "\n"))
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(sendCmd)
+
+	sendCmd.Flags().StringP("input", "i", "-", "input file (- for stdin)")
+	die(viper.BindPFlag("send.input", sendCmd.Flags().Lookup("input")))
+
+	sendCmd.Flags().StringP("port", "p", "", "the printer's serial port, like /dev/ttyUSB0")
+	die(sendCmd.MarkFlagRequired("port"))
+	die(viper.BindPFlag("send.port", sendCmd.Flags().Lookup("port")))
+
+	sendCmd.Flags().Int("baud", 115200, "baud rate")
+	die(viper.BindPFlag("send.baud", sendCmd.Flags().Lookup("baud")))
+
+	sendCmd.Flags().Int("buffer-depth", 1, "how many lines to send ahead of the printer acknowledging them")
+	die(viper.BindPFlag("send.buffer-depth", sendCmd.Flags().Lookup("buffer-depth")))
+
+	sendCmd.Flags().Bool("checksums", true, "add a checksum to every line")
+	die(viper.BindPFlag("send.checksums", sendCmd.Flags().Lookup("checksums")))
+
+	sendCmd.Flags().Duration("timeout", 30*time.Second, "give up when the printer doesn't say anything for this long")
+	die(viper.BindPFlag("send.timeout", sendCmd.Flags().Lookup("timeout")))
+
+	sendCmd.Flags().Duration("connect-wait", 2*time.Second, "how long to wait for the printer to start up after opening the port")
+	die(viper.BindPFlag("send.connect-wait", sendCmd.Flags().Lookup("connect-wait")))
+}
@@ -0,0 +1,122 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/madewithlinux/gcodetools/host"
+	"github.com/madewithlinux/gcodetools/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "serve a printer over HTTP, with the parts of OctoPrint's and Moonraker's APIs that slicers and dashboards use",
+	Long: `Runs a print server that slicers can upload files to and start prints on, as if it was OctoPrint: it has
+/api/version, /api/files/local (for uploads), /api/job and /api/printer. Dashboards can follow prints over
+Moonraker's websocket API on /websocket (printer.objects.subscribe, with toolhead, extruder, heater_bed,
+print_stats and virtual_sdcard). Prints are streamed to the printer on
+--port, or to an emulated printer with --emulate. With --minify, uploads are minified (with the profile's minifier
+settings) before they're stored.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := loadProfile()
+		cfg := host.Config{
+			Dialect:     profile.FirmwareFlavor().Dialect,
+			BufferDepth: viper.GetInt("serve.buffer-depth"),
+			Checksums:   true,
+			ConnectWait: viper.GetDuration("serve.connect-wait"),
+			Messages: func(message string) {
+				fmt.Fprintln(os.Stderr, message)
+			},
+		}
+
+		var h *host.Host
+		if viper.GetBool("serve.emulate") {
+			emulator := host.NewEmulator(host.EmulatorConfig{
+				Limits:    profile.Limits,
+				TimeScale: viper.GetFloat64("serve.time-scale"),
+			})
+			var closer io.Closer
+			h, closer = emulator.Pipe(cfg)
+			defer closer.Close()
+		} else {
+			portName := viper.GetString("serve.port")
+			if portName == "" {
+				die(fmt.Errorf("either --port or --emulate is needed"))
+			}
+			port, err := host.OpenSerial(portName, viper.GetInt("serve.baud"))
+			die(err)
+			defer port.Close()
+			h = host.New(port, cfg)
+		}
+		die(h.Connect(context.Background()))
+
+		serverConfig := server.Config{
+			UploadDir: viper.GetString("serve.upload-dir"),
+			APIKey:    viper.GetString("serve.api-key"),
+			Dialect:   cfg.Dialect,
+			Limits:    profile.Limits,
+		}
+		if viper.GetBool("serve.minify") {
+			serverConfig.Minifier = profile.MinifierConfig()
+		}
+		s, err := server.New(h, serverConfig)
+		die(err)
+		fmt.Fprintln(os.Stderr, "listening on", viper.GetString("serve.listen"))
+		die(http.ListenAndServe(viper.GetString("serve.listen"), s))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().String("listen", ":5000", "the address to listen on")
+	die(viper.BindPFlag("serve.listen", serveCmd.Flags().Lookup("listen")))
+
+	serveCmd.Flags().StringP("port", "p", "", "the printer's serial port, like /dev/ttyUSB0")
+	die(viper.BindPFlag("serve.port", serveCmd.Flags().Lookup("port")))
+
+	serveCmd.Flags().Int("baud", 115200, "baud rate")
+	die(viper.BindPFlag("serve.baud", serveCmd.Flags().Lookup("baud")))
+
+	serveCmd.Flags().Bool("emulate", false, "print to an emulated printer, rather than one on a serial port")
+	die(viper.BindPFlag("serve.emulate", serveCmd.Flags().Lookup("emulate")))
+
+	serveCmd.Flags().Float64("time-scale", 1, "with --emulate, how long a second takes: 1 is real time, 0 doesn't wait at all")
+	die(viper.BindPFlag("serve.time-scale", serveCmd.Flags().Lookup("time-scale")))
+
+	serveCmd.Flags().String("upload-dir", "uploads", "where to keep uploaded files")
+	die(viper.BindPFlag("serve.upload-dir", serveCmd.Flags().Lookup("upload-dir")))
+
+	serveCmd.Flags().String("api-key", "", "the API key that requests have to include (any request is allowed when it's empty)")
+	die(viper.BindPFlag("serve.api-key", serveCmd.Flags().Lookup("api-key")))
+
+	serveCmd.Flags().Bool("minify", false, "minify uploads before storing them")
+	die(viper.BindPFlag("serve.minify", serveCmd.Flags().Lookup("minify")))
+
+	serveCmd.Flags().Int("buffer-depth", 1, "how many lines to send ahead of the printer acknowledging them")
+	die(viper.BindPFlag("serve.buffer-depth", serveCmd.Flags().Lookup("buffer-depth")))
+
+	serveCmd.Flags().Duration("connect-wait", 2*time.Second, "how long to wait for the printer to start up after opening the port")
+	die(viper.BindPFlag("serve.connect-wait", serveCmd.Flags().Lookup("connect-wait")))
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// splitCmd represents the split command
+var splitCmd = &cobra.Command{
+	Use:   "split",
+	Short: "split a long print into files by layer range",
+	Long: `Splits a print into files that are printed one after another, starting at the layers given by --at-layers
+(numbered from 0, like diff shows them), or every --every layers.
+
+The files are named after --output, like part-1.gcode, part-2.gcode and so on. The first has the print's start
+gcode. Each of the others starts like a resumed print (see resume), so the printer can be turned off in between:
+the nozzle is raised, X and Y are homed, the heaters heat up, and the nozzle moves back to where the file before it
+finished. The last has the print's end gcode.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cmd.Flags().Changed("at-layers") == cmd.Flags().Changed("every") {
+			die(fmt.Errorf("exactly one of --at-layers and --every is needed"))
+		}
+		filename := viper.GetString("split.input")
+		prefix := viper.GetString("split.output")
+		if prefix == "" {
+			if filename == "-" {
+				die(fmt.Errorf("--output is needed when reading from stdin"))
+			}
+			prefix = strings.TrimSuffix(filename, filepath.Ext(filename))
+		}
+
+		profile := loadProfile()
+		flavor := profile.FirmwareFlavor()
+		dialect := flavor.Dialect
+		input := openInput(filename)
+		original, err := ioutil.ReadAll(input)
+		die(err)
+		die(input.Close())
+		layers, err := gcodetools.ReadLayers(dialect, bytes.NewReader(original))
+		die(err)
+
+		// this version of viper can't read int slices
+		indexes, err := cmd.Flags().GetIntSlice("at-layers")
+		die(err)
+		if every := viper.GetInt("split.every"); cmd.Flags().Changed("every") {
+			if every < 1 {
+				die(fmt.Errorf("--every has to be at least 1"))
+			}
+			indexes = nil
+			for index := every; index < len(layers); index += every {
+				indexes = append(indexes, index)
+			}
+		}
+		starts, err := gcodetools.SplitLinesAtLayers(layers, indexes)
+		die(err)
+
+		outputs := make([]io.Writer, len(starts)+1)
+		files := make([]io.WriteCloser, len(outputs))
+		for i := range outputs {
+			name := fmt.Sprintf("%s-%d.gcode", prefix, i+1)
+			files[i] = createOutput(name)
+			outputs[i] = files[i]
+			fmt.Fprintf(os.Stderr, "%s\n", name)
+		}
+		_, err = gcodetools.Split(gcodetools.ResumeConfig{
+			Dialect:        dialect,
+			Flavor:         flavor,
+			StartGcode:     profile.StartGcode,
+			Clearance:      viper.GetFloat64("split.clearance"),
+			TravelFeedrate: 60 * profile.TravelSpeed,
+			ZFeedrate:      60 * profile.Limits.MaxSpeedZ,
+		}, bytes.NewReader(original), starts, outputs)
+		die(err)
+		for _, file := range files {
+			die(file.Close())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(splitCmd)
+
+	splitCmd.Flags().StringP("input", "i", "-", "input file (- for stdin)")
+	die(viper.BindPFlag("split.input", splitCmd.Flags().Lookup("input")))
+
+	splitCmd.Flags().StringP("output", "o", "", "what to name the files, before -1.gcode and so on (defaults to the input's name)")
+	die(viper.BindPFlag("split.output", splitCmd.Flags().Lookup("output")))
+
+	splitCmd.Flags().IntSlice("at-layers", nil, "the layers that the second file onwards start at (the first layer is 0)")
+
+	splitCmd.Flags().Int("every", 0, "start a new file every this many layers")
+	die(viper.BindPFlag("split.every", splitCmd.Flags().Lookup("every")))
+
+	splitCmd.Flags().Float64("clearance", 5, "how far to raise the nozzle before moving it, at the start of each file after the first, in mm")
+	die(viper.BindPFlag("split.clearance", splitCmd.Flags().Lookup("clearance")))
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "check that a minified gcode file does the same as the original",
+	Long: `Replays the original and the minified file through machine state tracking side by side, lines up their moves,
+and reports how far the toolpath moved, how much the extrusion changed, any feedrates that changed and any
+commands that were dropped. Exits with an error status if anything is out of tolerance.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := loadProfile()
+		cfg := gcodetools.VerifyConfig{
+			Dialect:            profile.FirmwareFlavor().Dialect,
+			PositionTolerance:  viper.GetFloat64("verify.position-tolerance"),
+			ExtrusionTolerance: viper.GetFloat64("verify.extrusion-tolerance"),
+			FeedrateTolerance:  viper.GetFloat64("verify.feedrate-tolerance"),
+		}
+
+		original := openInput(viper.GetString("verify.original"))
+		defer original.Close()
+		minified := openInput(viper.GetString("verify.minified"))
+		defer minified.Close()
+		report, err := gcodetools.Verify(cfg, original, minified)
+		die(err)
+
+		switch format := viper.GetString("verify.format"); format {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			die(encoder.Encode(report))
+		case "text":
+			fmt.Printf("moves compared: %d\n", report.Moves)
+			fmt.Printf("max deviation: %vmm (line %d)\n", report.MaxDeviation, report.MaxDeviationLine)
+			fmt.Printf("extrusion difference: %vmm (at most %vmm)\n", report.ExtrusionDifference, report.MaxExtrusionDeviation)
+			fmt.Printf("feedrate changes: %d\n", len(report.FeedrateChanges))
+			fmt.Printf("dropped commands: %d, added commands: %d\n", len(report.DroppedCommands), len(report.AddedCommands))
+			for _, problem := range report.Problems {
+				fmt.Println(problem)
+			}
+		default:
+			die(fmt.Errorf("unknown output format %q", format))
+		}
+
+		if !report.OK() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringP("original", "i", "", "the original gcode file")
+	die(verifyCmd.MarkFlagRequired("original"))
+	die(viper.BindPFlag("verify.original", verifyCmd.Flags().Lookup("original")))
+
+	verifyCmd.Flags().StringP("minified", "m", "", "the minified gcode file")
+	die(verifyCmd.MarkFlagRequired("minified"))
+	die(viper.BindPFlag("verify.minified", verifyCmd.Flags().Lookup("minified")))
+
+	verifyCmd.Flags().Float64("position-tolerance", 0.01, "how far (in mm) the toolpath may move")
+	die(viper.BindPFlag("verify.position-tolerance", verifyCmd.Flags().Lookup("position-tolerance")))
+
+	verifyCmd.Flags().Float64("extrusion-tolerance", 0.05, "how much (in mm) the filament extruded may differ by")
+	die(viper.BindPFlag("verify.extrusion-tolerance", verifyCmd.Flags().Lookup("extrusion-tolerance")))
+
+	verifyCmd.Flags().Float64("feedrate-tolerance", 1, "how much (in mm/min) the feedrate of a move may change by")
+	die(viper.BindPFlag("verify.feedrate-tolerance", verifyCmd.Flags().Lookup("feedrate-tolerance")))
+
+	verifyCmd.Flags().String("format", "text", "output format: text or json")
+	die(viper.BindPFlag("verify.format", verifyCmd.Flags().Lookup("format")))
+}
@@ -0,0 +1,89 @@
+package gcodetools
+
+import (
+	"fmt"
+	"math"
+)
+
+// arcCenterTolerance is how far (in mm) the start and end of an arc can be from being the same distance from its
+// center, before it's an error (like Marlin, which allows for some rounding)
+const arcCenterTolerance = 0.05
+
+// ArcCenter is the center of an arc (G2 or G3), given the state before it. Arcs are given by an I/J offset from
+// where they start, or by a radius R (where a negative radius is the long way around).
+func ArcCenter(state *MachineState, line *GcodeLine) (Point, error) {
+	if state.Plane != 0 && state.Plane != 17 {
+		return Point{}, fmt.Errorf("only arcs in the XY plane (G17) are supported")
+	}
+	end := arcEnd(state, line)
+	start := Point{state.X, state.Y}
+	i, iValid := line.NumericParams['I']
+	j, jValid := line.NumericParams['J']
+	if iValid || jValid {
+		center := Point{start.X + i, start.Y + j}
+		if math.Abs(math.Hypot(end.X-center.X, end.Y-center.Y)-math.Hypot(i, j)) > arcCenterTolerance {
+			return Point{}, fmt.Errorf("the arc's end isn't the same distance from its center as its start")
+		}
+		return center, nil
+	}
+	r, ok := line.NumericParams['R']
+	if !ok {
+		return Point{}, fmt.Errorf("the arc needs I and J, or R")
+	}
+	// the center is on the perpendicular bisector of the chord, on the right of it for clockwise arcs (the short way)
+	dx, dy := end.X-start.X, end.Y-start.Y
+	chord := math.Hypot(dx, dy)
+	if chord == 0 {
+		return Point{}, fmt.Errorf("an arc with R can't be a full circle")
+	}
+	if chord > 2*math.Abs(r)+arcCenterTolerance {
+		return Point{}, fmt.Errorf("the arc's radius is too small for it to reach its end")
+	}
+	h := math.Sqrt(math.Max(0, r*r-chord*chord/4))
+	if line.IsG(3) != (r < 0) {
+		h = -h
+	}
+	return Point{start.X + dx/2 + h*dy/chord, start.Y + dy/2 - h*dx/chord}, nil
+}
+
+// arcEnd is where an arc ends in X and Y
+func arcEnd(state *MachineState, line *GcodeLine) Point {
+	end := *state
+	end.applyMove(line)
+	return Point{end.X, end.Y}
+}
+
+// ArcPoints splits an arc (G2 or G3) into pieces that are at most segmentLength long, given the state before it.
+// It returns the end of each piece, evenly spaced along the arc, so the last is where the arc ends. An arc that
+// ends where it starts (with I/J) is a full circle.
+func ArcPoints(state *MachineState, line *GcodeLine, segmentLength float64) ([]Point, error) {
+	center, err := ArcCenter(state, line)
+	if err != nil {
+		return nil, err
+	}
+	end := arcEnd(state, line)
+	radius := math.Hypot(state.X-center.X, state.Y-center.Y)
+	startAngle := math.Atan2(state.Y-center.Y, state.X-center.X)
+	sweep := math.Atan2(end.Y-center.Y, end.X-center.X) - startAngle
+	// G2 is clockwise (a negative sweep), and G3 anticlockwise
+	if line.IsG(2) {
+		if sweep >= 0 {
+			sweep -= 2 * math.Pi
+		}
+	} else if sweep <= 0 {
+		sweep += 2 * math.Pi
+	}
+
+	pieces := int(math.Ceil(math.Abs(sweep) * radius / segmentLength))
+	if pieces < 1 {
+		pieces = 1
+	}
+	points := make([]Point, pieces)
+	for piece := 1; piece < pieces; piece++ {
+		angle := startAngle + sweep*float64(piece)/float64(pieces)
+		points[piece-1] = Point{center.X + radius*math.Cos(angle), center.Y + radius*math.Sin(angle)}
+	}
+	// the end is exactly where the arc says, rather than wherever the rounding puts it
+	points[pieces-1] = end
+	return points, nil
+}
@@ -0,0 +1,77 @@
+package gcodetools
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArcCenter(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		center Point
+	}{
+		{"G3 X0 Y10 I-10 J0", Point{0, 0}},
+		{"G2 X0 Y10 R10", Point{10, 10}},
+		{"G3 X0 Y10 R10", Point{0, 0}},
+		// a negative radius goes the long way around
+		{"G2 X0 Y10 R-10", Point{0, 0}},
+		{"G3 X0 Y10 R-10", Point{10, 10}},
+	} {
+		state := MachineState{X: 10, Y: 0}
+		line, err := ParseLine(test.line)
+		assert.NoError(t, err)
+		center, err := ArcCenter(&state, &line)
+		assert.NoError(t, err, test.line)
+		assert.InDelta(t, test.center.X, center.X, 1e-9, test.line)
+		assert.InDelta(t, test.center.Y, center.Y, 1e-9, test.line)
+	}
+
+	for line, expected := range map[string]string{
+		"G2 X0 Y10 I-5 J0": "the arc's end isn't the same distance from its center as its start",
+		"G2 X0 Y10":        "the arc needs I and J, or R",
+		"G2 X0 Y10 R2":     "the arc's radius is too small for it to reach its end",
+		"G2 X10 Y0 R5":     "an arc with R can't be a full circle",
+	} {
+		state := MachineState{X: 10, Y: 0}
+		parsed, err := ParseLine(line)
+		assert.NoError(t, err)
+		_, err = ArcCenter(&state, &parsed)
+		assert.EqualError(t, err, expected, line)
+	}
+	state := MachineState{X: 10, Y: 0, Plane: 18}
+	line, _ := ParseLine("G2 X0 Z10 I-10")
+	_, err := ArcCenter(&state, &line)
+	assert.EqualError(t, err, "only arcs in the XY plane (G17) are supported")
+}
+
+func TestArcPoints(t *testing.T) {
+	state := MachineState{X: 10, Y: 0}
+	line, _ := ParseLine("G3 X0 Y10 I-10 J0")
+	points, err := ArcPoints(&state, &line, 2)
+	assert.NoError(t, err)
+	// a quarter of a circle is 15.7mm long
+	assert.Len(t, points, 8)
+	for i, p := range points {
+		assert.InDelta(t, 10, math.Hypot(p.X, p.Y), 1e-9)
+		angle := math.Pi / 2 * float64(i+1) / 8
+		assert.InDelta(t, 10*math.Cos(angle), p.X, 1e-9)
+		assert.InDelta(t, 10*math.Sin(angle), p.Y, 1e-9)
+	}
+	assert.Equal(t, Point{0, 10}, points[7])
+
+	// clockwise, it's the other three quarters
+	line, _ = ParseLine("G2 X0 Y10 I-10 J0")
+	points, err = ArcPoints(&state, &line, 2)
+	assert.NoError(t, err)
+	assert.Len(t, points, 24)
+	assert.Less(t, points[0].Y, 0.0)
+
+	// ending where it starts is a full circle
+	line, _ = ParseLine("G2 X10 Y0 I-10 J0")
+	points, err = ArcPoints(&state, &line, 5)
+	assert.NoError(t, err)
+	assert.Len(t, points, 13)
+	assert.Equal(t, Point{10, 0}, points[12])
+}
@@ -0,0 +1,324 @@
+package gcodetools
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BedMesh is a grid of how high the bed is, like the ones that firmware probes for mesh bed leveling
+type BedMesh struct {
+	// Min and Max are the front left and back right points of the grid
+	Min, Max Point
+	// Heights are the rows of the grid from the front of the bed to the back, each from left to right
+	Heights [][]float64
+}
+
+// Validate checks that the mesh is a grid of at least 2 by 2 points, over some of the bed
+func (m *BedMesh) Validate() error {
+	if len(m.Heights) < 2 {
+		return fmt.Errorf("a mesh needs at least 2 rows")
+	}
+	for i, row := range m.Heights {
+		if len(row) != len(m.Heights[0]) {
+			return fmt.Errorf("row %d has %d points, but the first has %d", i+1, len(row), len(m.Heights[0]))
+		}
+	}
+	if len(m.Heights[0]) < 2 {
+		return fmt.Errorf("a mesh needs at least 2 points in each row")
+	}
+	if m.Max.X <= m.Min.X || m.Max.Y <= m.Min.Y {
+		return fmt.Errorf("the mesh doesn't say where it is on the bed")
+	}
+	return nil
+}
+
+// Height is how high the bed is at a point, interpolated between the points of the grid. Outside of the grid, it's
+// the height at the nearest edge (like Klipper does). A mesh without any points is flat, at 0.
+func (m *BedMesh) Height(p Point) float64 {
+	if len(m.Heights) == 0 || len(m.Heights[0]) == 0 {
+		return 0
+	}
+	rows, columns := len(m.Heights), len(m.Heights[0])
+	// where the point is in the grid, as the (fractional) distance from one column or row to the next
+	gridPosition := func(v, min, max float64, count int) (int, int, float64) {
+		f := 0.0
+		if max > min {
+			f = (v - min) / (max - min) * float64(count-1)
+		}
+		f = math.Max(0, math.Min(float64(count-1), f))
+		i := int(math.Floor(f))
+		if i == count-1 && i > 0 {
+			i--
+		}
+		// a grid with a single column or row is the same all the way across
+		next := i + 1
+		if next == count {
+			next = i
+		}
+		return i, next, f - float64(i)
+	}
+	column, nextColumn, tx := gridPosition(p.X, m.Min.X, m.Max.X, columns)
+	row, nextRow, ty := gridPosition(p.Y, m.Min.Y, m.Max.Y, rows)
+	front := m.Heights[row][column]*(1-tx) + m.Heights[row][nextColumn]*tx
+	back := m.Heights[nextRow][column]*(1-tx) + m.Heights[nextRow][nextColumn]*tx
+	return front*(1-ty) + back*ty
+}
+
+var (
+	// a point like (  1,219), which Marlin writes at the corners of its mesh
+	meshCornerRegexp = regexp.MustCompile(`\(\s*(-?[\d.]+)\s*,\s*(-?[\d.]+)\s*\)`)
+	// a setting like min_x = 10.0, in a mesh that Klipper saved
+	meshSettingRegexp = regexp.MustCompile(`^(\w+)\s*[=:]\s*(.*)$`)
+	meshFieldSplitter = regexp.MustCompile(`[\s,|\[\]]+`)
+)
+
+// ReadBedMesh reads a bed mesh, which can be:
+//   - a grid of heights, with one row per line (separated by spaces or commas), from the front of the bed to the back
+//   - what Marlin writes for M420 V or G29 T, where the rows are numbered (from the front)
+//   - the [bed_mesh] section that Klipper saves (points =, min_x = and so on), or what it writes for BED_MESH_OUTPUT
+//
+// Lines starting with # (other than Klipper's #*#) are comments. Marlin's bilinear grid and plain grids don't say
+// where they are on the bed, so min and max (the front left and back right points of the grid) are used for them.
+func ReadBedMesh(r io.Reader, min, max Point) (*BedMesh, error) {
+	var rows [][]float64
+	var indexes []int
+	settings := map[string]float64{}
+	var corners []Point
+	columnHeader := false
+	// only the first grid is read, since Klipper and Marlin can go on to write an interpolated one after it
+	rowsDone := false
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		for _, prefix := range []string{"#*#", "//", "echo:", "Recv:"} {
+			line = strings.TrimSpace(strings.TrimPrefix(line, prefix))
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		numbers, fields := readMeshRow(line)
+		switch {
+		case numbers == nil:
+			if match := meshSettingRegexp.FindStringSubmatch(line); match != nil {
+				if value, err := strconv.ParseFloat(strings.TrimSpace(match[2]), 64); err == nil {
+					settings[strings.ToLower(match[1])] = value
+				}
+			}
+			for _, match := range meshCornerRegexp.FindAllStringSubmatch(line, -1) {
+				x, _ := strconv.ParseFloat(match[1], 64)
+				y, _ := strconv.ParseFloat(match[2], 64)
+				corners = append(corners, Point{x, y})
+			}
+			rowsDone = rowsDone || len(rows) > 0
+		case isColumnHeader(fields):
+			// Marlin numbers its columns (0 1 2...) and then its rows, at the start of each of them
+			columnHeader = true
+		case rowsDone:
+		case columnHeader || strings.Contains(line, "|"):
+			index, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: expected a row number, not %q", lineNumber, fields[0])
+			}
+			indexes = append(indexes, index)
+			rows = append(rows, numbers[1:])
+		default:
+			rows = append(rows, numbers)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if indexes != nil {
+		sort.Sort(meshRowsByIndex{rows, indexes})
+	}
+
+	mesh := &BedMesh{Min: min, Max: max, Heights: rows}
+	if minX, ok := settings["min_x"]; ok {
+		mesh.Min = Point{minX, settings["min_y"]}
+		mesh.Max = Point{settings["max_x"], settings["max_y"]}
+	} else if len(corners) > 0 {
+		mesh.Min, mesh.Max = corners[0], corners[0]
+		for _, corner := range corners {
+			mesh.Min = Point{math.Min(mesh.Min.X, corner.X), math.Min(mesh.Min.Y, corner.Y)}
+			mesh.Max = Point{math.Max(mesh.Max.X, corner.X), math.Max(mesh.Max.Y, corner.Y)}
+		}
+	}
+	if err := mesh.Validate(); err != nil {
+		return nil, err
+	}
+	return mesh, nil
+}
+
+// readMeshRow reads a row of a mesh, or returns nil for lines that aren't one
+func readMeshRow(line string) ([]float64, []string) {
+	fields := meshFieldSplitter.Split(strings.Trim(line, " ,|[]"), -1)
+	numbers := make([]float64, 0, len(fields))
+	for _, field := range fields {
+		number, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, nil
+		}
+		numbers = append(numbers, number)
+	}
+	if len(numbers) < 2 {
+		return nil, nil
+	}
+	return numbers, fields
+}
+
+// isColumnHeader is whether a row is 0 1 2 and so on
+func isColumnHeader(fields []string) bool {
+	for i, field := range fields {
+		if field != strconv.Itoa(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// meshRowsByIndex sorts rows by the numbers that Marlin gave them
+type meshRowsByIndex struct {
+	rows    [][]float64
+	indexes []int
+}
+
+func (m meshRowsByIndex) Len() int           { return len(m.rows) }
+func (m meshRowsByIndex) Less(i, j int) bool { return m.indexes[i] < m.indexes[j] }
+func (m meshRowsByIndex) Swap(i, j int) {
+	m.rows[i], m.rows[j] = m.rows[j], m.rows[i]
+	m.indexes[i], m.indexes[j] = m.indexes[j], m.indexes[i]
+}
+
+// MeshCompensation moves the nozzle up and down to follow a bed that isn't flat, for printers that don't have mesh
+// bed leveling in their firmware
+type MeshCompensation struct {
+	Dialect Dialect
+	Mesh    *BedMesh
+	// FadeHeight is the height that the compensation fades out by: the nozzle follows the mesh exactly at Z0, and
+	// less and less until FadeHeight, above which it isn't compensated at all (like Marlin's M420 Z). 0 never fades.
+	FadeHeight float64
+	// SegmentLength is the longest that moves (and pieces of arcs) can be, so that they follow the mesh.
+	// Defaults to 5
+	SegmentLength float64
+}
+
+// offset is how much the nozzle has to be raised at a point
+func (c *MeshCompensation) offset(x, y, z float64) float64 {
+	fade := 1.0
+	if c.FadeHeight > 0 {
+		fade = math.Max(0, 1-z/c.FadeHeight)
+	}
+	if fade == 0 {
+		return 0
+	}
+	return c.Mesh.Height(Point{x, y}) * fade
+}
+
+// Compensate adds the mesh's height to every move, once the printer is homed. Moves are split into pieces no longer
+// than SegmentLength, and arcs are turned into moves first (since the nozzle has to go up and down along them).
+func (c *MeshCompensation) Compensate(r io.Reader, w io.Writer) error {
+	if err := c.Mesh.Validate(); err != nil {
+		return err
+	}
+	if c.SegmentLength == 0 {
+		c.SegmentLength = 5
+	}
+	out := bufio.NewWriter(w)
+	scanner := NewLineScanner(r)
+	state := MachineState{}
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, err := c.Dialect.ParseLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		if !line.IsMove() || !state.IsHomed || !(line.Xvalid || line.Yvalid || line.Zvalid) {
+			state.Apply(&line)
+			_, _ = out.WriteString(scanner.Text())
+			_ = out.WriteByte('\n')
+			continue
+		}
+		if state.Inches {
+			return fmt.Errorf("line %d: files in inches aren't supported", lineNumber)
+		}
+		if err := c.writeMove(out, &state, &line); err != nil {
+			return fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// writeMove writes a move (or arc) in pieces that follow the mesh, and updates the state for it
+func (c *MeshCompensation) writeMove(w io.Writer, state *MachineState, line *GcodeLine) error {
+	before := *state
+	delta := state.ExtrusionDelta(line)
+	state.Apply(line)
+
+	var points []Point
+	if line.IsG(2) || line.IsG(3) {
+		var err error
+		if points, err = ArcPoints(&before, line, c.SegmentLength); err != nil {
+			return err
+		}
+	} else {
+		length := math.Hypot(state.X-before.X, state.Y-before.Y)
+		pieces := int(math.Max(1, math.Ceil(length/c.SegmentLength)))
+		points = make([]Point, pieces)
+		for piece := 1; piece <= pieces; piece++ {
+			t := float64(piece) / float64(pieces)
+			points[piece-1] = Point{before.X + t*(state.X-before.X), before.Y + t*(state.Y-before.Y)}
+		}
+		points[pieces-1] = Point{state.X, state.Y}
+	}
+
+	from := Point{before.X, before.Y}
+	fromZ := before.Z + c.offset(before.X, before.Y, before.Z)
+	for i, p := range points {
+		t := float64(i+1) / float64(len(points))
+		z := before.Z + t*(state.Z-before.Z)
+		z += c.offset(p.X, p.Y, z)
+		// moves that only go up or down stay that way, in case the printer isn't where it's thought to be after homing
+		moves := line.Xvalid || line.Yvalid || line.IsG(2) || line.IsG(3)
+		piece := GcodeLine{CmdLetter: G, CmdNumber: 1, X: p.X, Y: p.Y, Z: z, Xvalid: moves, Yvalid: moves, Zvalid: true}
+		if line.IsG(0) {
+			piece.CmdNumber = 0
+		}
+		if before.RelativeCoordinates {
+			piece.X, piece.Y, piece.Z = p.X-from.X, p.Y-from.Y, z-fromZ
+		}
+		if line.Evalid {
+			piece.Evalid = true
+			if before.RelativeExtrusion {
+				piece.E = delta / float64(len(points))
+			} else if i == len(points)-1 {
+				piece.E = line.E
+			} else {
+				piece.E = before.E + t*delta
+			}
+		}
+		if i == 0 {
+			piece.Feedrate = line.Feedrate
+		}
+		if i == len(points)-1 {
+			piece.Comment = line.Comment
+		}
+		if _, err := fmt.Fprintln(w, plainLineFormat.FormatGcode(&piece)); err != nil {
+			return err
+		}
+		from, fromZ = p, z
+	}
+	return nil
+}
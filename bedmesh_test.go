@@ -0,0 +1,130 @@
+package gcodetools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBedMesh(t *testing.T) {
+	expected := &BedMesh{
+		Min:     Point{10, 20},
+		Max:     Point{210, 220},
+		Heights: [][]float64{{0.1, 0.2, 0.3}, {0, 0, 0}, {-0.1, -0.2, -0.1}},
+	}
+	for name, mesh := range map[string]string{
+		"grid": `# a plain grid, front row first
+0.1 0.2 0.3
+0,0,0
+-0.1 -0.2 -0.1
+`,
+		"marlin bilinear": `Send: M420 V
+Recv: echo:Bilinear Leveling Grid:
+Recv:       0      1      2
+Recv:  0 +0.100 +0.200 +0.300
+Recv:  1 +0.000 +0.000 +0.000
+Recv:  2 -0.100 -0.200 -0.100
+Recv: ok
+`,
+		"marlin ubl": `Bed Topography Report:
+
+    ( 10,220)                   (210,220)
+        0       1       2
+ 2 | -0.100  -0.200  -0.100
+ 1 | +0.000 [+0.000] +0.000
+ 0 | +0.100  +0.200  +0.300
+        0       1       2
+    ( 10, 20)                   (210, 20)
+`,
+		"klipper saved": `#*# [bed_mesh default]
+#*# version = 1
+#*# points =
+#*# 	0.100000, 0.200000, 0.300000
+#*# 	0.000000, 0.000000, 0.000000
+#*# 	-0.100000, -0.200000, -0.100000
+#*# x_count = 3
+#*# y_count = 3
+#*# min_x = 10.0
+#*# max_x = 210.0
+#*# min_y = 20.0
+#*# max_y = 220.0
+`,
+		"klipper output": `// Mesh Leveling Probed Z positions:
+// 0.100000 0.200000 0.300000
+// 0.000000 0.000000 0.000000
+// -0.100000 -0.200000 -0.100000
+// Measured points:
+// 0.1 0.15 0.2 0.25 0.3
+`,
+	} {
+		mesh, err := ReadBedMesh(strings.NewReader(mesh), Point{10, 20}, Point{210, 220})
+		assert.NoError(t, err, name)
+		assert.Equal(t, expected, mesh, name)
+	}
+
+	_, err := ReadBedMesh(strings.NewReader("0 0\n0 0\n"), Point{}, Point{})
+	assert.EqualError(t, err, "the mesh doesn't say where it is on the bed")
+	_, err = ReadBedMesh(strings.NewReader("0 0\n0 0 0\n"), Point{}, Point{100, 100})
+	assert.EqualError(t, err, "row 2 has 3 points, but the first has 2")
+	_, err = ReadBedMesh(strings.NewReader("0 0\n"), Point{}, Point{100, 100})
+	assert.EqualError(t, err, "a mesh needs at least 2 rows")
+	_, err = ReadBedMesh(strings.NewReader("0 | 0.1\n1 | 0.2\n"), Point{}, Point{100, 100})
+	assert.EqualError(t, err, "a mesh needs at least 2 points in each row")
+}
+
+func TestBedMesh_Height(t *testing.T) {
+	mesh := &BedMesh{Min: Point{0, 0}, Max: Point{100, 100}, Heights: [][]float64{{0, 1, 0}, {1, 2, 3}}}
+	assert.InDelta(t, 0, mesh.Height(Point{0, 0}), 1e-9)
+	assert.InDelta(t, 1, mesh.Height(Point{50, 0}), 1e-9)
+	assert.InDelta(t, 3, mesh.Height(Point{100, 100}), 1e-9)
+	assert.InDelta(t, 1, mesh.Height(Point{25, 50}), 1e-9)
+	assert.InDelta(t, 1.5, mesh.Height(Point{75, 50}), 1e-9)
+	// outside of the mesh it's the height at the edge
+	assert.InDelta(t, 3, mesh.Height(Point{150, 200}), 1e-9)
+	assert.InDelta(t, 1, mesh.Height(Point{-10, 100}), 1e-9)
+
+	// a single column is the same all the way across
+	mesh = &BedMesh{Min: Point{0, 0}, Max: Point{100, 100}, Heights: [][]float64{{0.1}, {0.2}}}
+	assert.InDelta(t, 0.15, mesh.Height(Point{30, 50}), 1e-9)
+	assert.EqualError(t, mesh.Validate(), "a mesh needs at least 2 points in each row")
+	assert.Equal(t, 0.0, (&BedMesh{}).Height(Point{}))
+}
+
+func TestMeshCompensation(t *testing.T) {
+	// the bed goes up by 1mm from front to back
+	mesh := &BedMesh{Min: Point{0, 0}, Max: Point{100, 100}, Heights: [][]float64{{0, 0}, {1, 1}}}
+	compensate := func(c MeshCompensation, gcode string) []string {
+		var out strings.Builder
+		c.Mesh = mesh
+		assert.NoError(t, c.Compensate(strings.NewReader(gcode), &out))
+		return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	}
+
+	lines := compensate(MeshCompensation{SegmentLength: 25}, "G1 X50 Y50\nG28\nG1 Z0.2 F600\nG1 X0 Y0\nG1 Y100 E10 F1200 ; across\nM107\n")
+	assert.Equal(t, []string{
+		// before homing, where the nozzle is isn't known
+		"G1 X50 Y50",
+		"G28",
+		"G1 Z0.2 F600",
+		"G1 X0 Y0 Z0.2",
+		"G1 X0 Y25 Z0.45 E2.5 F1200",
+		"G1 X0 Y50 Z0.7 E5",
+		"G1 X0 Y75 Z0.95 E7.5",
+		"G1 X0 Y100 Z1.2 E10 ; across",
+		"M107",
+	}, lines)
+
+	// it fades out going up, and relative moves stay relative
+	lines = compensate(MeshCompensation{FadeHeight: 10, SegmentLength: 100}, "G28\nG0 X0 Y50 Z5\nG91\nM83\nG1 X4 Y0 E1\nG0 Z10\n")
+	assert.Equal(t, []string{"G28", "G0 X0 Y50 Z5.25", "G91", "M83", "G1 X4 Y0 Z0 E1", "G0 Z9.75"}, lines)
+
+	// arcs become moves that follow the bed
+	lines = compensate(MeshCompensation{SegmentLength: 10}, "G28\nG1 X50 Y0 Z0.2\nG3 X50 Y100 I0 J50 E5\n")
+	// the travel there is split too
+	assert.Len(t, lines, 1+5+16)
+	assert.Equal(t, "G1 X50 Y100 Z1.2 E5", lines[len(lines)-1])
+	for _, lineStr := range lines[6:] {
+		assert.True(t, strings.HasPrefix(lineStr, "G1 X"), lineStr)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"math"
 	"os"
+	"strings"
 )
 
 type GcodeBuilder struct {
@@ -16,6 +17,8 @@ type GcodeBuilder struct {
 	FilamentDiameter    float64
 	PrintFeedrate       float64
 	TravelFeedrate      float64
+	// reorder paths passed to PrintPaths to reduce travel
+	OptimizeTravel bool
 	//
 	buf          []GcodeLine
 	machineState MachineState
@@ -23,31 +26,103 @@ type GcodeBuilder struct {
 }
 
 func (b *GcodeBuilder) extrusionPerLinearMm() float64 {
-	return b.LayerHeight * b.ExtrusionWidth / (math.Pi * math.Pow(b.FilamentDiameter/2, 2))
+	multiplier := b.ExtrusionMultiplier
+	if multiplier == 0 {
+		multiplier = 1
+	}
+	return multiplier * b.LayerHeight * b.ExtrusionWidth / (math.Pi * math.Pow(b.FilamentDiameter/2, 2))
 }
 
-// TODO: gcode commands to heat extruder?
-// TODO: method to add a multi-line string of gcode (such as for start/end gcode)
+// extrusionForLength is the E value for printing a line this long: the length of filament in relative extrusion
+// mode, or where E ends up in absolute mode
+func (b *GcodeBuilder) extrusionForLength(length float64) float64 {
+	return b.extrusionFor(length * b.extrusionPerLinearMm())
+}
 
-func (b *GcodeBuilder) extrusionLengthForPrintMove(x, y, z float64) float64 {
+// extrusionFor is the E value that pushes e more filament (or pulls it back, when e is negative)
+func (b *GcodeBuilder) extrusionFor(e float64) float64 {
 	if !b.machineState.RelativeExtrusion {
-		// TODO: support absolute extrusion
-		panic("relative extrusion is required")
+		return b.machineState.E + e
 	}
-	return math.Sqrt(math.Pow(x-b.machineState.X, 2)+
-		math.Pow(y-b.machineState.Y, 2)+
-		math.Pow(z-b.machineState.Z, 2)) *
-		b.extrusionPerLinearMm()
+	return e
+}
+
+func (b *GcodeBuilder) extrusionLengthForPrintMove(x, y, z float64) float64 {
+	return b.extrusionForLength(math.Sqrt(math.Pow(x-b.machineState.X, 2) +
+		math.Pow(y-b.machineState.Y, 2) +
+		math.Pow(z-b.machineState.Z, 2)))
 }
 
 func (b *GcodeBuilder) RelativeExtrusion() {
 	b.AddGcodeLine(GcodeLine{CmdLetter: M, CmdNumber: 83})
 }
 
+func (b *GcodeBuilder) AbsoluteExtrusion() {
+	b.AddGcodeLine(GcodeLine{CmdLetter: M, CmdNumber: 82})
+}
+
 func (b *GcodeBuilder) Home() {
 	b.AddGcodeLine(GcodeLine{CmdLetter: G, CmdNumber: 28})
 }
 
+// SetHotendTemperature emits M109 (when wait is set) or M104
+func (b *GcodeBuilder) SetHotendTemperature(temperature float64, wait bool) {
+	cmdNumber := uint16(104)
+	if wait {
+		cmdNumber = 109
+	}
+	b.AddGcodeLine(GcodeLine{CmdLetter: M, CmdNumber: cmdNumber, NumericParams: map[uint8]float64{'S': temperature}})
+}
+
+// SetBedTemperature emits M190 (when wait is set) or M140
+func (b *GcodeBuilder) SetBedTemperature(temperature float64, wait bool) {
+	cmdNumber := uint16(140)
+	if wait {
+		cmdNumber = 190
+	}
+	b.AddGcodeLine(GcodeLine{CmdLetter: M, CmdNumber: cmdNumber, NumericParams: map[uint8]float64{'S': temperature}})
+}
+
+// SetFanSpeed sets the part cooling fan, where speed is between 0 and 1
+func (b *GcodeBuilder) SetFanSpeed(speed float64) {
+	if speed <= 0 {
+		b.AddGcodeLine(GcodeLine{CmdLetter: M, CmdNumber: 107})
+		return
+	}
+	b.AddGcodeLine(GcodeLine{CmdLetter: M, CmdNumber: 106, NumericParams: map[uint8]float64{'S': math.Round(math.Min(speed, 1) * 255)}})
+}
+
+// Retract pulls the filament back by length, at the given feedrate
+func (b *GcodeBuilder) Retract(length, feedrate float64) {
+	b.AddGcodeLine(GcodeLine{CmdLetter: G, CmdNumber: 1, Evalid: true, E: b.extrusionFor(-length), Feedrate: feedrate})
+}
+
+// Unretract pushes the filament forward by length, at the given feedrate
+func (b *GcodeBuilder) Unretract(length, feedrate float64) {
+	b.AddGcodeLine(GcodeLine{CmdLetter: G, CmdNumber: 1, Evalid: true, E: b.extrusionFor(length), Feedrate: feedrate})
+}
+
+// MoveToLayer raises (or lowers) the nozzle to z and sets the layer height used for extrusion calculations
+func (b *GcodeBuilder) MoveToLayer(z, layerHeight float64) {
+	b.LayerHeight = layerHeight
+	b.TravelTo(b.machineState.X, b.machineState.Y, z)
+}
+
+// AddGcodeStr parses a multi-line string of gcode (such as start/end gcode) and adds every line of it
+func (b *GcodeBuilder) AddGcodeStr(gcodeStr string) error {
+	for _, lineStr := range strings.Split(gcodeStr, "\n") {
+		line, err := ParseLine(lineStr)
+		if err != nil {
+			return err
+		}
+		if line.Empty() {
+			continue
+		}
+		b.AddGcodeLine(line)
+	}
+	return nil
+}
+
 func (b *GcodeBuilder) AddGcodeLine(line GcodeLine) {
 	if b.minifier == nil {
 		b.minifier = &GcodeMinifierConfig{
@@ -132,7 +207,7 @@ func (b *GcodeBuilder) ToWriter(writer io.Writer) error {
 		minifier.Init()
 	}
 	for _, line := range b.buf {
-		lineStr := minifier.formatGcode(&line)
+		lineStr := minifier.FormatGcode(&line)
 		_, err := fmt.Fprintln(writer, lineStr)
 		if err != nil {
 			return err
@@ -148,13 +223,14 @@ func (b *GcodeBuilder) ToString() string {
 }
 
 func (b *GcodeBuilder) ToFile(filename string) error {
-	file, err := os.Open(filename)
+	file, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	err = b.ToWriter(file)
 	if err != nil {
+		_ = file.Close()
 		return err
 	}
-	return nil
+	return file.Close()
 }
@@ -0,0 +1,259 @@
+package gcodetools
+
+import (
+	"math"
+)
+
+// Point is a position in the XY plane
+type Point struct {
+	X, Y float64
+}
+
+func (p Point) distance(q Point) float64 {
+	return math.Hypot(q.X-p.X, q.Y-p.Y)
+}
+
+// Path is a sequence of points that is printed in one go.
+// A closed path returns to its first point, so Points[0] is also its seam.
+type Path struct {
+	Points []Point
+	Closed bool
+}
+
+func (p Path) start() Point {
+	return p.Points[0]
+}
+
+func (p Path) end() Point {
+	if p.Closed {
+		return p.Points[0]
+	}
+	return p.Points[len(p.Points)-1]
+}
+
+func (p Path) reversed() Path {
+	points := make([]Point, len(p.Points))
+	for i, point := range p.Points {
+		points[len(p.Points)-1-i] = point
+	}
+	return Path{Points: points, Closed: p.Closed}
+}
+
+// RectanglePath returns a closed path around the rectangle with corners (x0, y0) and (x1, y1), starting at (x0, y0)
+func RectanglePath(x0, y0, x1, y1 float64) Path {
+	return Path{
+		Points: []Point{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}},
+		Closed: true,
+	}
+}
+
+// CirclePath returns a closed, counter-clockwise path approximating a circle with the given number of segments.
+// The seam is at the point of the circle with the largest X.
+func CirclePath(cx, cy, r float64, segments int) Path {
+	if segments < 3 {
+		segments = 3
+	}
+	points := make([]Point, segments)
+	for i := range points {
+		angle := 2 * math.Pi * float64(i) / float64(segments)
+		points[i] = Point{cx + r*math.Cos(angle), cy + r*math.Sin(angle)}
+	}
+	return Path{Points: points, Closed: true}
+}
+
+// WithSeam returns a copy of the closed path p that starts (and so ends) at the vertex with the given index
+func (p Path) WithSeam(seam int) Path {
+	n := len(p.Points)
+	if n == 0 {
+		return p
+	}
+	seam = ((seam % n) + n) % n
+	points := make([]Point, 0, n)
+	points = append(points, p.Points[seam:]...)
+	points = append(points, p.Points[:seam]...)
+	return Path{Points: points, Closed: p.Closed}
+}
+
+func signedArea(points []Point) float64 {
+	area := 0.0
+	for i, p := range points {
+		q := points[(i+1)%len(points)]
+		area += p.X*q.Y - q.X*p.Y
+	}
+	return area / 2
+}
+
+// OffsetPolygon offsets every edge of a closed polygon by distance, joining the edges with mitered corners.
+// A positive distance grows the polygon and a negative distance shrinks it, regardless of its winding.
+// Returns nil when the polygon collapses.
+func OffsetPolygon(points []Point, distance float64) []Point {
+	n := len(points)
+	if n < 3 {
+		return nil
+	}
+	area := signedArea(points)
+	if area == 0 {
+		return nil
+	}
+	// for a counter-clockwise polygon, the outward normal of an edge is on its right-hand side
+	if area < 0 {
+		distance = -distance
+	}
+
+	offset := make([]Point, n)
+	for i := range points {
+		prev := points[(i+n-1)%n]
+		cur := points[i]
+		next := points[(i+1)%n]
+
+		n1x, n1y := edgeNormal(prev, cur)
+		n2x, n2y := edgeNormal(cur, next)
+		// the miter direction is the bisector of the two normals, scaled so that both edges move by distance
+		mx, my := n1x+n2x, n1y+n2y
+		dot := 1 + n1x*n2x + n1y*n2y
+		if dot < 1e-9 {
+			// the polygon doubles back on itself here, just push the point out along one normal
+			offset[i] = Point{cur.X + n1x*distance, cur.Y + n1y*distance}
+			continue
+		}
+		offset[i] = Point{cur.X + mx*distance/dot, cur.Y + my*distance/dot}
+	}
+
+	// an inward offset that is larger than the polygon turns its edges around
+	for i := range points {
+		j := (i + 1) % n
+		dot := (points[j].X-points[i].X)*(offset[j].X-offset[i].X) + (points[j].Y-points[i].Y)*(offset[j].Y-offset[i].Y)
+		if dot <= 0 {
+			return nil
+		}
+	}
+	return offset
+}
+
+// edgeNormal is the unit normal pointing to the right of the edge from a to b
+func edgeNormal(a, b Point) (float64, float64) {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	length := math.Hypot(dx, dy)
+	if length == 0 {
+		return 0, 0
+	}
+	return dy / length, -dx / length
+}
+
+// OrderPathsNearestNeighbor greedily orders paths so that each one starts as close as possible to where the previous one ended.
+// Open paths may be reversed to start from whichever end is closer; closed paths always start at their seam.
+func OrderPathsNearestNeighbor(start Point, paths []Path) []Path {
+	remaining := make([]Path, 0, len(paths))
+	for _, path := range paths {
+		if len(path.Points) > 0 {
+			remaining = append(remaining, path)
+		}
+	}
+	ordered := make([]Path, 0, len(remaining))
+	current := start
+	for len(remaining) > 0 {
+		best, bestReversed, bestDistance := 0, false, math.Inf(1)
+		for i, path := range remaining {
+			if d := current.distance(path.start()); d < bestDistance {
+				best, bestReversed, bestDistance = i, false, d
+			}
+			if !path.Closed {
+				if d := current.distance(path.end()); d < bestDistance {
+					best, bestReversed, bestDistance = i, true, d
+				}
+			}
+		}
+		path := remaining[best]
+		if bestReversed {
+			path = path.reversed()
+		}
+		ordered = append(ordered, path)
+		current = path.end()
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return ordered
+}
+
+func (b *GcodeBuilder) position() Point {
+	return Point{b.machineState.X, b.machineState.Y}
+}
+
+// travelToXYIfNeeded only emits a travel move when the nozzle is not already at (x, y)
+func (b *GcodeBuilder) travelToXYIfNeeded(p Point) {
+	if b.position().distance(p) > defaultThreshold {
+		b.TravelToXY(p.X, p.Y)
+	}
+}
+
+// PrintPath travels to the start of the path (if needed) and prints it
+func (b *GcodeBuilder) PrintPath(path Path) {
+	if len(path.Points) == 0 {
+		return
+	}
+	b.travelToXYIfNeeded(path.start())
+	for _, p := range path.Points[1:] {
+		b.PrintToXY(p.X, p.Y)
+	}
+	if path.Closed {
+		b.PrintToXY(path.Points[0].X, path.Points[0].Y)
+	}
+}
+
+// PrintPaths prints all of the paths, with travel moves in between.
+// If OptimizeTravel is set on the builder, the paths are reordered to reduce travel first.
+func (b *GcodeBuilder) PrintPaths(paths []Path) {
+	if b.OptimizeTravel {
+		paths = OrderPathsNearestNeighbor(b.position(), paths)
+	}
+	for _, path := range paths {
+		b.PrintPath(path)
+	}
+}
+
+func (b *GcodeBuilder) PrintPolyline(points ...Point) {
+	b.PrintPath(Path{Points: points})
+}
+
+// PrintPolygon prints the closed polygon, starting and ending at the vertex with index seam
+func (b *GcodeBuilder) PrintPolygon(points []Point, seam int) {
+	b.PrintPath(Path{Points: points, Closed: true}.WithSeam(seam))
+}
+
+func (b *GcodeBuilder) PrintRectangle(x0, y0, x1, y1 float64) {
+	b.PrintPath(RectanglePath(x0, y0, x1, y1))
+}
+
+// PrintCircle prints a circle made out of straight segments
+func (b *GcodeBuilder) PrintCircle(cx, cy, r float64, segments int) {
+	b.PrintPath(CirclePath(cx, cy, r, segments))
+}
+
+// PrintCircleArc prints a full counter-clockwise circle as a single G3 arc, starting from the point with the largest X
+func (b *GcodeBuilder) PrintCircleArc(cx, cy, r float64) {
+	start := Point{cx + r, cy}
+	b.travelToXYIfNeeded(start)
+	b.AddGcodeLine(GcodeLine{
+		CmdLetter: G, CmdNumber: 3,
+		Xvalid: true, X: start.X,
+		Yvalid: true, Y: start.Y,
+		Evalid: true, E: b.extrusionForLength(2 * math.Pi * r),
+		Feedrate:      b.PrintFeedrate,
+		NumericParams: map[uint8]float64{'I': -r, 'J': 0},
+	})
+}
+
+// PrintPerimeters prints count concentric copies of the closed polygon, from the outside in.
+// The outermost perimeter follows the polygon itself and each following one is inset by ExtrusionWidth.
+func (b *GcodeBuilder) PrintPerimeters(points []Point, count int, seam int) {
+	for i := 0; i < count; i++ {
+		perimeter := points
+		if i > 0 {
+			perimeter = OffsetPolygon(points, -float64(i)*b.ExtrusionWidth)
+			if perimeter == nil {
+				// there's no room left for more perimeters
+				return
+			}
+		}
+		b.PrintPolygon(perimeter, seam)
+	}
+}
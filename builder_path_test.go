@@ -0,0 +1,132 @@
+package gcodetools
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTestBuilder() *GcodeBuilder {
+	return &GcodeBuilder{
+		NozzleSize:          0.4,
+		LayerHeight:         0.2,
+		ExtrusionWidth:      0.4,
+		ExtrusionMultiplier: 1,
+		FilamentDiameter:    1.75,
+		TravelFeedrate:      60 * 100,
+		PrintFeedrate:       60 * 40,
+	}
+}
+
+func TestGcodeBuilder_PrintRectangle(t *testing.T) {
+	builder := newTestBuilder()
+	builder.Home()
+	builder.RelativeExtrusion()
+	builder.PrintRectangle(100, 100, 110, 120)
+	builder.PrintRectangle(100, 100, 110, 120)
+
+	expected := `G28
+M83
+G0 X100 Y100 F6000
+G1 X110 E.33260135 F2400
+G1 Y120 E.6652027
+G1 X100 E.33260135
+G1 Y100 E.6652027
+G1 X110 E.33260135
+G1 Y120 E.6652027
+G1 X100 E.33260135
+G1 Y100 E.6652027
+`
+	// the second rectangle starts where the first one ended, so there is no travel in between
+	assert.Equal(t, expected, builder.ToString())
+}
+
+func TestGcodeBuilder_PrintPolygon(t *testing.T) {
+	builder := newTestBuilder()
+	builder.Home()
+	builder.RelativeExtrusion()
+	builder.PrintPolygon([]Point{{0, 0}, {10, 0}, {10, 10}}, 1)
+
+	expected := `G28
+M83
+G0 X10 F6000
+G1 Y10 E.33260135 F2400
+G1 X0 Y0 E.47036934
+G1 X10 E.33260135
+`
+	assert.Equal(t, expected, builder.ToString())
+}
+
+func TestGcodeBuilder_PrintCircleArc(t *testing.T) {
+	builder := newTestBuilder()
+	builder.Home()
+	builder.RelativeExtrusion()
+	builder.PrintCircleArc(50, 50, 10)
+
+	expected := `G28
+M83
+G0 X60 Y50 F6000
+G3 X60 Y50 E2.08979592 F2400 I-10 J0
+`
+	assert.Equal(t, expected, builder.ToString())
+}
+
+func TestGcodeBuilder_PrintCircleArc_AbsoluteExtrusion(t *testing.T) {
+	builder := newTestBuilder()
+	builder.Home()
+	builder.AbsoluteExtrusion()
+	builder.PrintToXY(10, 0)
+	builder.PrintCircleArc(50, 50, 10)
+	builder.PrintCircleArc(50, 50, 10)
+
+	// E carries on from where the move before left it
+	expected := `G28
+M82
+G1 X10 E.33260135 F2400
+G0 X60 Y50 F6000
+G3 X60 Y50 E2.42239727 F2400 I-10 J0
+G3 X60 Y50 E4.51219319 F2400 I-10 J0
+`
+	assert.Equal(t, expected, builder.ToString())
+}
+
+func TestOffsetPolygon(t *testing.T) {
+	square := []Point{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	assert.InDeltaSlice(t, []float64{1, 1, 9, 1, 9, 9, 1, 9}, flattenPoints(OffsetPolygon(square, -1)), 1e-9)
+	assert.InDeltaSlice(t, []float64{-1, -1, 11, -1, 11, 11, -1, 11}, flattenPoints(OffsetPolygon(square, 1)), 1e-9)
+
+	// winding shouldn't matter
+	clockwise := []Point{{0, 10}, {10, 10}, {10, 0}, {0, 0}}
+	assert.InDeltaSlice(t, []float64{1, 9, 9, 9, 9, 1, 1, 1}, flattenPoints(OffsetPolygon(clockwise, -1)), 1e-9)
+
+	// insetting too far collapses the polygon
+	assert.Nil(t, OffsetPolygon(square, -6))
+}
+
+func TestGcodeBuilder_PrintPerimeters(t *testing.T) {
+	builder := newTestBuilder()
+	builder.ExtrusionWidth = 1
+	builder.Home()
+	builder.RelativeExtrusion()
+	builder.PrintPerimeters([]Point{{0, 0}, {4, 0}, {4, 4}, {0, 4}}, 3, 0)
+
+	// the third perimeter doesn't fit, and the first one starts right where the nozzle is after homing
+	assert.Equal(t, 2+4+1+4, len(builder.buf))
+	assert.Equal(t, GcodeLine{CmdLetter: G, CmdNumber: 0, X: 1, Xvalid: true, Y: 1, Yvalid: true, Feedrate: 6000}, builder.buf[2+4])
+}
+
+func TestOrderPathsNearestNeighbor(t *testing.T) {
+	a := Path{Points: []Point{{100, 0}, {110, 0}}}
+	b := Path{Points: []Point{{20, 0}, {10, 0}}}
+	c := RectanglePath(50, 0, 60, 10)
+
+	ordered := OrderPathsNearestNeighbor(Point{0, 0}, []Path{a, b, c})
+	assert.Equal(t, []Path{b.reversed(), c, a}, ordered)
+}
+
+func flattenPoints(points []Point) []float64 {
+	flat := make([]float64, 0, 2*len(points))
+	for _, p := range points {
+		flat = append(flat, p.X, p.Y)
+	}
+	return flat
+}
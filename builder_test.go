@@ -43,3 +43,27 @@ G28
 
 	assert.Equal(t, expected, outputGcodeStr)
 }
+
+func TestGcodeBuilder_Retract(t *testing.T) {
+	builder := newTestBuilder()
+	builder.Home()
+	builder.AbsoluteExtrusion()
+	builder.PrintToXY(10, 0)
+	builder.Retract(1, 2400)
+	builder.TravelToXY(20, 0)
+	builder.Unretract(1, 2400)
+	builder.RelativeExtrusion()
+	builder.Retract(1, 2400)
+
+	// in absolute mode, E goes back from (and then forward to) where it was
+	expected := `G28
+M82
+G1 X10 E.33260135 F2400
+G1 E-0.66739865
+G0 X20 F6000
+G1 E.33260135 F2400
+M83
+G1 E-1
+`
+	assert.Equal(t, expected, builder.ToString())
+}
@@ -0,0 +1,127 @@
+// Package calibrate generates ready-to-print calibration objects with GcodeBuilder.
+// Every generator takes a printer profile and the range of values to test,
+// and labels the value being tested in a comment wherever it changes.
+package calibrate
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/madewithlinux/gcodetools"
+)
+
+// Range is an inclusive range of values, tested in increments of Step
+type Range struct {
+	Start float64
+	End   float64
+	Step  float64
+}
+
+// Values lists every value in the range. A zero step is treated as a single value.
+func (r Range) Values() []float64 {
+	if r.Step == 0 {
+		return []float64{r.Start}
+	}
+	step := math.Abs(r.Step)
+	if r.End < r.Start {
+		step = -step
+	}
+	count := int(math.Floor((r.End-r.Start)/step+1e-9)) + 1
+	values := make([]float64, count)
+	for i := range values {
+		// computed from the start every time, so that errors don't accumulate
+		values[i] = r.Start + float64(i)*step
+	}
+	return values
+}
+
+func formatValue(f float64) string {
+	return gcodetools.FloatToSmallestString(f, 4)
+}
+
+// startPrint heats up and homes the printer using the profile's start gcode, or a sensible default when there is none
+func startPrint(b *gcodetools.GcodeBuilder, p *gcodetools.PrinterProfile, title string, hotendTemperature float64) error {
+	b.Comment("; " + title)
+	b.Comment(fmt.Sprintf("; generated for printer profile %q", p.Name))
+	if p.StartGcode != "" {
+		if err := b.AddGcodeStr(p.StartGcode); err != nil {
+			return err
+		}
+	} else {
+		b.SetBedTemperature(p.BedTemperature, false)
+		b.SetHotendTemperature(hotendTemperature, false)
+		b.SetBedTemperature(p.BedTemperature, true)
+		b.SetHotendTemperature(hotendTemperature, true)
+		b.Home()
+	}
+	b.RelativeExtrusion()
+	b.MoveToLayer(p.FirstLayerHeight, p.FirstLayerHeight)
+	return nil
+}
+
+func endPrint(b *gcodetools.GcodeBuilder, p *gcodetools.PrinterProfile) error {
+	b.Retract(p.RetractLength, 60*p.RetractSpeed)
+	if p.EndGcode != "" {
+		return b.AddGcodeStr(p.EndGcode)
+	}
+	b.SetHotendTemperature(0, false)
+	b.SetBedTemperature(0, false)
+	b.SetFanSpeed(0)
+	b.Home()
+	return nil
+}
+
+// travel moves to (x, y) on the current layer, retracting first if the move is long enough to ooze
+func travel(b *gcodetools.GcodeBuilder, p *gcodetools.PrinterProfile, x, y float64) {
+	travelWithRetraction(b, x, y, p.RetractLength, 60*p.RetractSpeed)
+}
+
+func travelWithRetraction(b *gcodetools.GcodeBuilder, x, y, retractLength, retractFeedrate float64) {
+	if retractLength > 0 {
+		b.Retract(retractLength, retractFeedrate)
+	}
+	b.TravelToXY(x, y)
+	if retractLength > 0 {
+		b.Unretract(retractLength, retractFeedrate)
+	}
+}
+
+// layerZs returns the Z height of every layer of an object that is height tall
+func layerZs(p *gcodetools.PrinterProfile, height float64) []float64 {
+	zs := []float64{p.FirstLayerHeight}
+	for z := p.FirstLayerHeight + p.LayerHeight; z <= height+1e-9; z += p.LayerHeight {
+		zs = append(zs, z)
+	}
+	return zs
+}
+
+func layerHeightAt(p *gcodetools.PrinterProfile, layer int) float64 {
+	if layer == 0 {
+		return p.FirstLayerHeight
+	}
+	return p.LayerHeight
+}
+
+// rectangleFill returns back-and-forth lines along X that cover the rectangle from (x0, y0) to (x1, y1), spaced by the extrusion width
+func rectangleFill(b *gcodetools.GcodeBuilder, x0, y0, x1, y1 float64) []gcodetools.Point {
+	spacing := b.ExtrusionWidth
+	points := []gcodetools.Point{}
+	for i, y := 0, y0+spacing/2; y <= y1-spacing/2+1e-9; i, y = i+1, y+spacing {
+		if i%2 == 0 {
+			points = append(points, gcodetools.Point{X: x0, Y: y}, gcodetools.Point{X: x1, Y: y})
+		} else {
+			points = append(points, gcodetools.Point{X: x1, Y: y}, gcodetools.Point{X: x0, Y: y})
+		}
+	}
+	return points
+}
+
+// placeCentered returns the bottom left corner of a width by depth footprint centered on the bed,
+// or an error if it doesn't fit
+func placeCentered(p *gcodetools.PrinterProfile, width, depth float64) (gcodetools.Point, error) {
+	if width > p.BedSizeX || depth > p.BedSizeY {
+		return gcodetools.Point{}, fmt.Errorf("calibration pattern is %vx%vmm, which doesn't fit on the %vx%vmm bed", width, depth, p.BedSizeX, p.BedSizeY)
+	}
+	center := p.BedCenter()
+	return gcodetools.Point{X: center.X - width/2, Y: center.Y - depth/2}, nil
+}
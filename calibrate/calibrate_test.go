@@ -0,0 +1,169 @@
+package calibrate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRange_Values(t *testing.T) {
+	assert.Equal(t, []float64{0, 0.5, 1}, Range{Start: 0, End: 1, Step: 0.5}.Values())
+	assert.Equal(t, []float64{230, 225, 220}, Range{Start: 230, End: 220, Step: 5}.Values())
+	assert.Equal(t, []float64{230, 225, 220}, Range{Start: 230, End: 220, Step: -5}.Values())
+	assert.Equal(t, []float64{1.5}, Range{Start: 1.5}.Values())
+	assert.Len(t, Range{Start: 0, End: 0.1, Step: 0.005}.Values(), 21)
+}
+
+func countLines(gcode, prefix string) int {
+	count := 0
+	for _, line := range strings.Split(gcode, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestPressureAdvance(t *testing.T) {
+	profile := gcodetools.DefaultPrinterProfile
+	b, err := PressureAdvance(&profile, PressureAdvanceOptions{
+		K:           Range{Start: 0, End: 0.04, Step: 0.02},
+		LineSpacing: 5,
+		SlowLength:  20,
+		FastLength:  40,
+		SlowSpeed:   20,
+		FastSpeed:   100,
+	})
+	assert.NoError(t, err)
+	gcode := b.ToString()
+
+	assert.Contains(t, gcode, "; pressure advance K=0\nM900 K0\n")
+	assert.Contains(t, gcode, "; pressure advance K=.02\nM900 K.02\n")
+	assert.Contains(t, gcode, "; pressure advance K=.04\nM900 K.04\n")
+	assert.Contains(t, gcode, "G1 X90 E.74835304 F1200\nG1 X130 E1.49670608 F6000\nG1 X150 E.74835304 F1200\n")
+}
+
+func TestPressureAdvance_Flavors(t *testing.T) {
+	for flavor, command := range map[string]string{
+		"marlin":         "M900 K.02\n",
+		"prusa":          "M900 K.02\n",
+		"bambu":          "M900 K.02\n",
+		"generic":        "M900 K.02\n",
+		"klipper":        "SET_PRESSURE_ADVANCE ADVANCE=.02\n",
+		"reprapfirmware": "M572 D0 S.02\n",
+	} {
+		profile := gcodetools.DefaultPrinterProfile
+		profile.Flavor = flavor
+		b, err := PressureAdvance(&profile, PressureAdvanceOptions{K: Range{Start: 0.02}, LineSpacing: 5, SlowLength: 20, FastLength: 40, SlowSpeed: 20, FastSpeed: 100})
+		assert.NoError(t, err, flavor)
+		assert.Contains(t, b.ToString(), "; pressure advance K=.02\n"+command, flavor)
+	}
+
+	profile := gcodetools.DefaultPrinterProfile
+	profile.Flavor = "grbl"
+	_, err := PressureAdvance(&profile, DefaultPressureAdvanceOptions)
+	assert.EqualError(t, err, "grbl doesn't have pressure advance")
+}
+
+func TestTemperatureTower(t *testing.T) {
+	profile := gcodetools.DefaultPrinterProfile
+	b, err := TemperatureTower(&profile, TemperatureTowerOptions{
+		Temperature:   Range{Start: 220, End: 200, Step: 10},
+		SegmentHeight: 1,
+		Size:          10,
+		Perimeters:    2,
+	})
+	assert.NoError(t, err)
+	gcode := b.ToString()
+
+	assert.Equal(t, 1, countLines(gcode, "M109 S220"))
+	// heating up, then one per segment, then turning off
+	assert.Equal(t, []string{"M104 S220", "M104 S220", "M104 S210", "M104 S200", "M104 S0"}, grepLines(gcode, "M104"))
+	assert.Contains(t, gcode, "; temperature 210\nM104 S210\n")
+	// the last layer is at Z3
+	assert.Contains(t, gcode, "G0 Z3 ")
+	assert.NotContains(t, gcode, "G0 Z3.2 ")
+}
+
+func TestRetractionTower(t *testing.T) {
+	profile := gcodetools.DefaultPrinterProfile
+	b, err := RetractionTower(&profile, RetractionTowerOptions{
+		RetractLength: Range{Start: 1, End: 2, Step: 1},
+		SegmentHeight: 0.4,
+		Size:          10,
+		Spacing:       50,
+	})
+	assert.NoError(t, err)
+	gcode := b.ToString()
+
+	assert.Equal(t, []string{"; retraction length 1", "; retraction length 2"}, grepLines(gcode, "; retraction length"))
+	// the profile's retraction is used at the end of the print
+	assert.Equal(t, 2+1, countLines(gcode, "G1 E-1 "))
+	assert.Equal(t, 2, countLines(gcode, "G1 E-2 "))
+}
+
+func TestFlowRate(t *testing.T) {
+	profile := gcodetools.DefaultPrinterProfile
+	b, err := FlowRate(&profile, FlowRateOptions{
+		Multiplier: Range{Start: 0.9, End: 1.1, Step: 0.1},
+		PatchSize:  10,
+		Spacing:    5,
+		Layers:     2,
+	})
+	assert.NoError(t, err)
+	gcode := b.ToString()
+
+	assert.Equal(t, 2, countLines(gcode, "; extrusion multiplier .9"))
+	assert.Equal(t, 2, countLines(gcode, "; extrusion multiplier 1.1"))
+
+	_, err = FlowRate(&profile, FlowRateOptions{Multiplier: Range{Start: 0.5, End: 1.5, Step: 0.01}, PatchSize: 20, Spacing: 5, Layers: 1})
+	assert.Error(t, err)
+}
+
+func TestFirstLayer(t *testing.T) {
+	profile := gcodetools.DefaultPrinterProfile
+	b, err := FirstLayer(&profile, DefaultFirstLayerOptions)
+	assert.NoError(t, err)
+	gcode := b.ToString()
+
+	assert.Contains(t, gcode, "; first layer height .2\n")
+	// everything is printed on the first layer
+	assert.Equal(t, 1, countLines(gcode, "G0 Z"))
+}
+
+func TestSkew(t *testing.T) {
+	profile := gcodetools.DefaultPrinterProfile
+	b, err := Skew(&profile, SkewOptions{Size: 50, Perimeters: 2, Layers: 3})
+	assert.NoError(t, err)
+	gcode := b.ToString()
+
+	assert.Contains(t, gcode, "; corners: A X85 Y85, B X85 Y135, C X135 Y135, D X135 Y85\n")
+	assert.Equal(t, 3, countLines(gcode, "G0 Z"))
+}
+
+func TestMaxVolumetricSpeed(t *testing.T) {
+	profile := gcodetools.DefaultPrinterProfile
+	b, err := MaxVolumetricSpeed(&profile, MaxVolumetricSpeedOptions{
+		VolumetricSpeed: Range{Start: 9, End: 18, Step: 9},
+		LineLength:      50,
+		LineSpacing:     3,
+	})
+	assert.NoError(t, err)
+	gcode := b.ToString()
+
+	// 9mm³/s over a 0.2mm by 0.45mm line is 100mm/s
+	assert.Contains(t, gcode, "; volumetric speed 9 mm3/s (F6000)\n")
+	assert.Contains(t, gcode, "; volumetric speed 18 mm3/s (F12000)\n")
+}
+
+func grepLines(gcode, prefix string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(gcode, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,162 @@
+package calibrate
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/madewithlinux/gcodetools"
+)
+
+// FlowRateOptions configures a row of square patches, each printed with a different extrusion multiplier.
+// The best value is the one with the smoothest top surface, without gaps or ridges.
+type FlowRateOptions struct {
+	Multiplier Range
+	PatchSize  float64
+	Spacing    float64
+	Layers     int
+}
+
+var DefaultFlowRateOptions = FlowRateOptions{
+	Multiplier: Range{Start: 0.9, End: 1.1, Step: 0.05},
+	PatchSize:  20,
+	Spacing:    5,
+	Layers:     3,
+}
+
+func FlowRate(p *gcodetools.PrinterProfile, opts FlowRateOptions) (*gcodetools.GcodeBuilder, error) {
+	multipliers := opts.Multiplier.Values()
+	width := float64(len(multipliers))*(opts.PatchSize+opts.Spacing) - opts.Spacing
+	origin, err := placeCentered(p, width, opts.PatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	b := p.NewGcodeBuilder()
+	if err := startPrint(b, p, "flow rate test", p.HotendTemperature); err != nil {
+		return nil, err
+	}
+	z := 0.0
+	for layer := 0; layer < opts.Layers; layer++ {
+		z += layerHeightAt(p, layer)
+		if layer > 0 {
+			b.MoveToLayer(z, layerHeightAt(p, layer))
+		}
+		if layer == 1 {
+			b.SetFanSpeed(p.FanSpeed)
+		}
+		for i, multiplier := range multipliers {
+			x := origin.X + float64(i)*(opts.PatchSize+opts.Spacing)
+			b.Comment(fmt.Sprintf("; extrusion multiplier %s", formatValue(multiplier)))
+			b.ExtrusionMultiplier = multiplier
+			if i > 0 || layer > 0 {
+				travel(b, p, x, origin.Y)
+			}
+			b.PrintRectangle(x, origin.Y, x+opts.PatchSize, origin.Y+opts.PatchSize)
+			// alternate the fill direction on every layer, like a slicer would
+			fill := rectangleFill(b, x+b.ExtrusionWidth, origin.Y+b.ExtrusionWidth, x+opts.PatchSize-b.ExtrusionWidth, origin.Y+opts.PatchSize-b.ExtrusionWidth)
+			if layer%2 == 1 {
+				fill = transposed(fill, x, origin.Y)
+			}
+			b.PrintPolyline(fill...)
+		}
+	}
+	b.ExtrusionMultiplier = 1
+
+	if err := endPrint(b, p); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// transposed mirrors points across the diagonal through origin, to turn lines along X into lines along Y
+func transposed(points []gcodetools.Point, x0, y0 float64) []gcodetools.Point {
+	out := make([]gcodetools.Point, len(points))
+	for i, p := range points {
+		out[i] = gcodetools.Point{X: x0 + (p.Y - y0), Y: y0 + (p.X - x0)}
+	}
+	return out
+}
+
+// FirstLayerOptions configures a single-layer square patch, for checking Z offset and bed adhesion
+type FirstLayerOptions struct {
+	Size       float64
+	Perimeters int
+}
+
+var DefaultFirstLayerOptions = FirstLayerOptions{
+	Size:       100,
+	Perimeters: 2,
+}
+
+func FirstLayer(p *gcodetools.PrinterProfile, opts FirstLayerOptions) (*gcodetools.GcodeBuilder, error) {
+	origin, err := placeCentered(p, opts.Size, opts.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	b := p.NewGcodeBuilder()
+	if err := startPrint(b, p, "first layer test", p.HotendTemperature); err != nil {
+		return nil, err
+	}
+	b.Comment(fmt.Sprintf("; first layer height %s", formatValue(p.FirstLayerHeight)))
+	square := gcodetools.RectanglePath(origin.X, origin.Y, origin.X+opts.Size, origin.Y+opts.Size).Points
+	b.PrintPerimeters(square, opts.Perimeters, 0)
+	inset := float64(opts.Perimeters) * b.ExtrusionWidth
+	b.PrintPolyline(rectangleFill(b, origin.X+inset, origin.Y+inset, origin.X+opts.Size-inset, origin.Y+opts.Size-inset)...)
+
+	if err := endPrint(b, p); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// MaxVolumetricSpeedOptions configures a series of lines, each printed at the feedrate that gives a different volumetric flow.
+// The highest value that still gives a solid line is the most that the hotend can melt.
+type MaxVolumetricSpeedOptions struct {
+	VolumetricSpeed Range // mm³/s
+	LineLength      float64
+	LineSpacing     float64
+}
+
+var DefaultMaxVolumetricSpeedOptions = MaxVolumetricSpeedOptions{
+	VolumetricSpeed: Range{Start: 5, End: 25, Step: 1},
+	LineLength:      80,
+	LineSpacing:     3,
+}
+
+func MaxVolumetricSpeed(p *gcodetools.PrinterProfile, opts MaxVolumetricSpeedOptions) (*gcodetools.GcodeBuilder, error) {
+	speeds := opts.VolumetricSpeed.Values()
+	depth := float64(len(speeds)) * opts.LineSpacing
+	origin, err := placeCentered(p, opts.LineLength, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	b := p.NewGcodeBuilder()
+	if err := startPrint(b, p, "max volumetric speed test", p.HotendTemperature); err != nil {
+		return nil, err
+	}
+	b.SetFanSpeed(p.FanSpeed)
+	crossSection := b.LayerHeight * b.ExtrusionWidth
+	for i, speed := range speeds {
+		feedrate := math.Round(60 * speed / crossSection)
+		y := origin.Y + float64(i)*opts.LineSpacing
+		b.Comment(fmt.Sprintf("; volumetric speed %s mm3/s (F%s)", formatValue(speed), formatValue(feedrate)))
+		// snake back and forth, so that there are no travel moves to hide under-extrusion
+		x0, x1 := origin.X, origin.X+opts.LineLength
+		if i%2 == 1 {
+			x0, x1 = x1, x0
+		}
+		if i == 0 {
+			b.TravelToXY(x0, y)
+		} else {
+			b.PrintToXY(x0, y)
+		}
+		b.PrintToXYF(x1, y, feedrate)
+	}
+
+	if err := endPrint(b, p); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
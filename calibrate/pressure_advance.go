@@ -0,0 +1,82 @@
+package calibrate
+
+import (
+	"fmt"
+
+	"github.com/madewithlinux/gcodetools"
+)
+
+// PressureAdvanceOptions configures a line test, where every line is printed slow-fast-slow with a different pressure advance (aka linear advance) value.
+// The best value is the one where the line has the most even width across the speed changes.
+type PressureAdvanceOptions struct {
+	K           Range
+	LineSpacing float64
+	SlowLength  float64
+	FastLength  float64
+	SlowSpeed   float64 // mm/s
+	FastSpeed   float64 // mm/s
+}
+
+var DefaultPressureAdvanceOptions = PressureAdvanceOptions{
+	K:           Range{Start: 0, End: 0.1, Step: 0.005},
+	LineSpacing: 5,
+	SlowLength:  20,
+	FastLength:  40,
+	SlowSpeed:   20,
+	FastSpeed:   100,
+}
+
+func PressureAdvance(p *gcodetools.PrinterProfile, opts PressureAdvanceOptions) (*gcodetools.GcodeBuilder, error) {
+	if _, err := pressureAdvanceCommand(p.FirmwareFlavor(), 0); err != nil {
+		return nil, err
+	}
+	values := opts.K.Values()
+	width := 2*opts.SlowLength + opts.FastLength
+	depth := float64(len(values)) * opts.LineSpacing
+	origin, err := placeCentered(p, width, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	b := p.NewGcodeBuilder()
+	if err := startPrint(b, p, "pressure advance line test", p.HotendTemperature); err != nil {
+		return nil, err
+	}
+	b.SetFanSpeed(p.FanSpeed)
+
+	for i, k := range values {
+		y := origin.Y + float64(i)*opts.LineSpacing
+		b.Comment(fmt.Sprintf("; pressure advance K=%s", formatValue(k)))
+		command, _ := pressureAdvanceCommand(p.FirmwareFlavor(), k)
+		b.AddGcodeLine(command)
+		if i == 0 {
+			b.TravelToXY(origin.X, y)
+		} else {
+			travel(b, p, origin.X, y)
+		}
+		b.PrintToXYF(origin.X+opts.SlowLength, y, 60*opts.SlowSpeed)
+		b.PrintToXYF(origin.X+opts.SlowLength+opts.FastLength, y, 60*opts.FastSpeed)
+		b.PrintToXYF(origin.X+width, y, 60*opts.SlowSpeed)
+	}
+
+	if err := endPrint(b, p); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// pressureAdvanceCommand is the command that sets pressure advance (or linear advance) to k in a flavor of firmware
+func pressureAdvanceCommand(flavor *gcodetools.Flavor, k float64) (gcodetools.GcodeLine, error) {
+	switch flavor {
+	case gcodetools.FlavorKlipper:
+		return gcodetools.GcodeLine{
+			ExtendedCmd:    "SET_PRESSURE_ADVANCE",
+			ExtendedParams: []gcodetools.ExtendedParam{{Key: "ADVANCE", Value: formatValue(k)}},
+		}, nil
+	case gcodetools.FlavorRepRapFirmware:
+		return gcodetools.GcodeLine{CmdLetter: gcodetools.M, CmdNumber: 572, NumericParams: map[uint8]float64{'D': 0, 'S': k}}, nil
+	case gcodetools.FlavorGrbl, gcodetools.FlavorLinuxCNC:
+		return gcodetools.GcodeLine{}, fmt.Errorf("%s doesn't have pressure advance", flavor.Name)
+	}
+	return gcodetools.GcodeLine{CmdLetter: gcodetools.M, CmdNumber: 900, NumericParams: map[uint8]float64{'K': k}}, nil
+}
@@ -0,0 +1,57 @@
+package calibrate
+
+import (
+	"fmt"
+
+	"github.com/madewithlinux/gcodetools"
+)
+
+// SkewOptions configures a square frame, for measuring how far out of square the X and Y axes are.
+// The corners are A (front left), B (back left), C (back right) and D (front right), so the measurements for
+// gcodetools.SkewFactor are the diagonals AC and BD and the front edge AD. Printing it on its side (or measuring a
+// slicer's version of it printed standing up) gives the XZ and YZ factors in the same way.
+type SkewOptions struct {
+	Size       float64
+	Perimeters int
+	Layers     int
+}
+
+var DefaultSkewOptions = SkewOptions{
+	Size:       100,
+	Perimeters: 4,
+	Layers:     4,
+}
+
+func Skew(p *gcodetools.PrinterProfile, opts SkewOptions) (*gcodetools.GcodeBuilder, error) {
+	origin, err := placeCentered(p, opts.Size, opts.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	b := p.NewGcodeBuilder()
+	if err := startPrint(b, p, "skew test", p.HotendTemperature); err != nil {
+		return nil, err
+	}
+	b.Comment(fmt.Sprintf("; corners: A X%s Y%s, B X%s Y%s, C X%s Y%s, D X%s Y%s",
+		formatValue(origin.X), formatValue(origin.Y),
+		formatValue(origin.X), formatValue(origin.Y+opts.Size),
+		formatValue(origin.X+opts.Size), formatValue(origin.Y+opts.Size),
+		formatValue(origin.X+opts.Size), formatValue(origin.Y)))
+	square := gcodetools.RectanglePath(origin.X, origin.Y, origin.X+opts.Size, origin.Y+opts.Size).Points
+	z := 0.0
+	for layer := 0; layer < opts.Layers; layer++ {
+		z += layerHeightAt(p, layer)
+		if layer > 0 {
+			b.MoveToLayer(z, layerHeightAt(p, layer))
+		}
+		if layer == 1 {
+			b.SetFanSpeed(p.FanSpeed)
+		}
+		b.PrintPerimeters(square, opts.Perimeters, 0)
+	}
+
+	if err := endPrint(b, p); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
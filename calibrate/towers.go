@@ -0,0 +1,147 @@
+package calibrate
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/madewithlinux/gcodetools"
+)
+
+// TemperatureTowerOptions configures a hollow square tower, printed at a different temperature for every segment of SegmentHeight
+type TemperatureTowerOptions struct {
+	Temperature   Range
+	SegmentHeight float64
+	Size          float64
+	Perimeters    int
+}
+
+var DefaultTemperatureTowerOptions = TemperatureTowerOptions{
+	Temperature:   Range{Start: 230, End: 190, Step: 5},
+	SegmentHeight: 5,
+	Size:          20,
+	Perimeters:    2,
+}
+
+func TemperatureTower(p *gcodetools.PrinterProfile, opts TemperatureTowerOptions) (*gcodetools.GcodeBuilder, error) {
+	temperatures := opts.Temperature.Values()
+	origin, err := placeCentered(p, opts.Size, opts.Size)
+	if err != nil {
+		return nil, err
+	}
+	height := float64(len(temperatures)) * opts.SegmentHeight
+	if height > p.MaxZ {
+		return nil, fmt.Errorf("temperature tower is %vmm tall, but the printer can only print %vmm", height, p.MaxZ)
+	}
+
+	b := p.NewGcodeBuilder()
+	if err := startPrint(b, p, "temperature tower", temperatures[0]); err != nil {
+		return nil, err
+	}
+	square := gcodetools.RectanglePath(origin.X, origin.Y, origin.X+opts.Size, origin.Y+opts.Size).Points
+
+	segment := -1
+	for layer, z := range layerZs(p, height) {
+		if layer > 0 {
+			b.MoveToLayer(z, layerHeightAt(p, layer))
+		}
+		if layer == 1 {
+			b.SetFanSpeed(p.FanSpeed)
+		}
+		if s := segmentAt(z, opts.SegmentHeight, len(temperatures)); s != segment {
+			segment = s
+			b.Comment(fmt.Sprintf("; temperature %s", formatValue(temperatures[segment])))
+			b.SetHotendTemperature(temperatures[segment], false)
+		}
+		b.PrintPerimeters(square, opts.Perimeters, 0)
+		if layer == 0 {
+			// fill the bottom so that the tower sticks to the bed
+			inset := float64(opts.Perimeters) * b.ExtrusionWidth
+			b.PrintPolyline(rectangleFill(b, origin.X+inset, origin.Y+inset, origin.X+opts.Size-inset, origin.Y+opts.Size-inset)...)
+		}
+	}
+
+	if err := endPrint(b, p); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// RetractionTowerOptions configures a pair of hollow towers with a travel in between them on every layer.
+// The retraction length for that travel changes every segment of SegmentHeight.
+type RetractionTowerOptions struct {
+	RetractLength Range
+	SegmentHeight float64
+	Size          float64
+	Spacing       float64
+}
+
+var DefaultRetractionTowerOptions = RetractionTowerOptions{
+	RetractLength: Range{Start: 0.5, End: 5, Step: 0.5},
+	SegmentHeight: 3,
+	Size:          10,
+	Spacing:       50,
+}
+
+func RetractionTower(p *gcodetools.PrinterProfile, opts RetractionTowerOptions) (*gcodetools.GcodeBuilder, error) {
+	lengths := opts.RetractLength.Values()
+	width := 2*opts.Size + opts.Spacing
+	origin, err := placeCentered(p, width, opts.Size)
+	if err != nil {
+		return nil, err
+	}
+	height := float64(len(lengths)) * opts.SegmentHeight
+	if height > p.MaxZ {
+		return nil, fmt.Errorf("retraction tower is %vmm tall, but the printer can only print %vmm", height, p.MaxZ)
+	}
+
+	b := p.NewGcodeBuilder()
+	if err := startPrint(b, p, "retraction tower", p.HotendTemperature); err != nil {
+		return nil, err
+	}
+	left := gcodetools.RectanglePath(origin.X, origin.Y, origin.X+opts.Size, origin.Y+opts.Size)
+	right := gcodetools.RectanglePath(origin.X+opts.Size+opts.Spacing, origin.Y, origin.X+width, origin.Y+opts.Size)
+	retractFeedrate := 60 * p.RetractSpeed
+
+	segment := -1
+	for layer, z := range layerZs(p, height) {
+		if layer > 0 {
+			b.MoveToLayer(z, layerHeightAt(p, layer))
+		}
+		if layer == 1 {
+			b.SetFanSpeed(p.FanSpeed)
+		}
+		if s := segmentAt(z, opts.SegmentHeight, len(lengths)); s != segment {
+			segment = s
+			b.Comment(fmt.Sprintf("; retraction length %s", formatValue(lengths[segment])))
+		}
+		length := lengths[segment]
+		// alternate direction so that there is exactly one long travel per layer
+		first, second := left, right
+		if layer%2 == 1 {
+			first, second = right, left
+		}
+		if layer == 0 {
+			b.TravelToXY(first.Points[0].X, first.Points[0].Y)
+		}
+		b.PrintPath(first)
+		travelWithRetraction(b, second.Points[0].X, second.Points[0].Y, length, retractFeedrate)
+		b.PrintPath(second)
+	}
+
+	if err := endPrint(b, p); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// segmentAt is the index of the segment that the layer at z belongs to
+func segmentAt(z, segmentHeight float64, segments int) int {
+	s := int(math.Floor((z - 1e-9) / segmentHeight))
+	if s < 0 {
+		s = 0
+	}
+	if s >= segments {
+		s = segments - 1
+	}
+	return s
+}
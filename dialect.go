@@ -0,0 +1,185 @@
+package gcodetools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect is which kind of gcode a line is parsed as
+type Dialect int
+
+const (
+	// DialectRepRap is 3d printer gcode, with ; comments and one command per line
+	DialectRepRap Dialect = iota
+	// DialectCNC is LinuxCNC/grbl gcode (RS274/NGC), with (comments), several commands per line, %, O and /.
+	// Spaces don't matter, so G0X10Y20 is the same as G0 X10 Y20
+	DialectCNC
+	// DialectRepRapFirmware is 3d printer gcode with RepRapFirmware's quoted strings, {expressions} and meta commands
+	DialectRepRapFirmware
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case DialectRepRap:
+		return "reprap"
+	case DialectCNC:
+		return "cnc"
+	case DialectRepRapFirmware:
+		return "reprapfirmware"
+	}
+	return fmt.Sprintf("Dialect(%d)", int(d))
+}
+
+// ParseLine parses a line in this dialect
+func (d Dialect) ParseLine(str string) (GcodeLine, error) {
+	switch d {
+	case DialectCNC:
+		return parseCNCLine(str)
+	case DialectRepRapFirmware:
+		return parseRepRapLine(str, true)
+	}
+	return ParseLine(str)
+}
+
+// InlineComment is a (comment) in the middle of a line. Since the words of a line aren't formatted in the order
+// they were written, it's kept after the word that it followed: After is the command (like "G17"), or the letter of
+// a parameter (like "X"), or "" for the start of the line
+type InlineComment struct {
+	After string
+	Text  string // including the parentheses
+}
+
+// motionCommands are the CNC commands that the axis words on a line belong to, when there are several commands
+var motionCommands = map[string]bool{"G0": true, "G1": true, "G2": true, "G3": true, "G38": true,
+	"G80": true, "G81": true, "G82": true, "G83": true, "G84": true, "G85": true, "G86": true, "G87": true, "G88": true, "G89": true}
+
+func parseCNCLine(str string) (line GcodeLine, err error) {
+	i := 0
+	for i < len(str) && (isSpace(str[i]) || str[i] == '\r') {
+		i++
+	}
+	if i < len(str) && str[i] == '%' {
+		line.ProgramDelimiter = true
+		if rest := strings.TrimSpace(str[i+1:]); rest != "" {
+			line.Comment = &rest
+		}
+		return
+	}
+	if i < len(str) && str[i] == '/' {
+		line.BlockDelete = true
+		i++
+	}
+
+	// split into words, where every letter starts a new one
+	var words []string
+	var word []byte
+	anchor := ""
+	flush := func() error {
+		if len(word) == 0 {
+			return nil
+		}
+		if len(word) == 1 {
+			return fmt.Errorf("%c without a value in %q", word[0], str)
+		}
+		words = append(words, string(word))
+		anchor = string(word[:1])
+		if isCommandLetter(word[0]) || (len(words) == 1 && word[0] == 'T') {
+			cmd := GcodeLine{}
+			if parseWord(&cmd, 0, string(word)) == nil {
+				anchor = formatCommand(&cmd)
+			}
+		}
+		word = nil
+		return nil
+	}
+	for ; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case c == CommentChar:
+			comment := str[i:]
+			line.Comment = &comment
+			i = len(str)
+		case c == '(':
+			end := strings.IndexByte(str[i:], ')')
+			if end < 0 {
+				return line, fmt.Errorf("unterminated comment in %q", str)
+			}
+			if err = flush(); err != nil {
+				return
+			}
+			line.InlineComments = append(line.InlineComments, InlineComment{After: anchor, Text: str[i : i+end+1]})
+			i += end
+		case isSpace(c) || c == '\r':
+		case ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z'):
+			if err = flush(); err != nil {
+				return
+			}
+			word = []byte{c &^ 0x20} // upper case
+		case c == '#' || c == '[' || c == '<':
+			return line, fmt.Errorf("parameters and expressions aren't supported: %q", str)
+		default:
+			if len(word) == 0 {
+				return line, fmt.Errorf("unexpected %q in %q", c, str)
+			}
+			word = append(word, c)
+		}
+	}
+	if err = flush(); err != nil {
+		return
+	}
+
+	if len(words) > 0 && words[0][0] == 'O' {
+		line.ProgramNumber, err = strconv.Atoi(words[0][1:])
+		if err != nil {
+			return line, fmt.Errorf("LinuxCNC o-words aren't supported: %q", str)
+		}
+		line.ProgramNumberValid = true
+		words = words[1:]
+	}
+	if len(words) > 0 && words[0][0] == 'N' {
+		line.LineNumber, err = strconv.Atoi(words[0][1:])
+		if err != nil {
+			return
+		}
+		line.LineNumberValid = true
+		words = words[1:]
+	}
+
+	// the axis words go with the motion command if there is one, or else the last command.
+	// any other commands end up in ExtraCmds
+	var commands, params []string
+	for index, word := range words {
+		if isCommandLetter(word[0]) || (index == 0 && word[0] == 'T') {
+			commands = append(commands, word)
+		} else {
+			params = append(params, word)
+		}
+	}
+	cmds := make([]GcodeLine, len(commands))
+	main := len(commands) - 1
+	for index, command := range commands {
+		if err = parseWord(&cmds[index], 0, command); err != nil {
+			return
+		}
+		if motionCommands[commandKey(cmds[index].CmdLetter, cmds[index].CmdNumber)] {
+			main = index
+		}
+	}
+	for index, cmd := range cmds {
+		if index == main {
+			line.CmdLetter = cmd.CmdLetter
+			line.CmdNumber = cmd.CmdNumber
+			line.CmdSubcode = cmd.CmdSubcode
+			line.CmdSubcodeValid = cmd.CmdSubcodeValid
+		} else {
+			line.ExtraCmds = append(line.ExtraCmds, cmd)
+		}
+	}
+	for _, param := range params {
+		if err = parseWord(&line, 1, param); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,127 @@
+package gcodetools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseCNC(t *testing.T, str string) GcodeLine {
+	line, err := DialectCNC.ParseLine(str)
+	assert.NoError(t, err)
+	return line
+}
+
+func TestDialectCNC_ParseLine(t *testing.T) {
+	assert.Equal(t, GcodeLine{CmdLetter: G, CmdNumber: 0, X: 10, Xvalid: true, Y: -2.5, Yvalid: true}, parseCNC(t, "g0x10Y-2.5"))
+	assert.Equal(t, GcodeLine{ProgramDelimiter: true}, parseCNC(t, "%"))
+	assert.Equal(t, GcodeLine{ProgramNumber: 1001, ProgramNumberValid: true}, parseCNC(t, "O1001"))
+	assert.Equal(t, GcodeLine{BlockDelete: true, CmdLetter: M, CmdNumber: 0}, parseCNC(t, "/M0"))
+
+	// the axis words go with the motion command, and the rest are extra commands
+	assert.Equal(t, GcodeLine{
+		LineNumber: 20, LineNumberValid: true,
+		ExtraCmds: []GcodeLine{{CmdLetter: G, CmdNumber: 90}, {CmdLetter: G, CmdNumber: 21}},
+		CmdLetter: G, CmdNumber: 1, Z: -1, Zvalid: true, Feedrate: 300,
+	}, parseCNC(t, "N20 G90 G21 G1 Z-1 F300"))
+	assert.Equal(t, GcodeLine{
+		ExtraCmds: []GcodeLine{{CmdLetter: T, CmdNumber: 2}},
+		CmdLetter: M, CmdNumber: 6,
+	}, parseCNC(t, "T2 M6"))
+	assert.Equal(t, GcodeLine{CmdLetter: G, CmdNumber: 38, CmdSubcode: 2, CmdSubcodeValid: true, Z: -10, Zvalid: true, Feedrate: 50}, parseCNC(t, "G38.2 Z-10 F50"))
+
+	comment := "; and a normal comment"
+	assert.Equal(t, GcodeLine{
+		CmdLetter: G, CmdNumber: 1, X: 1, Xvalid: true, Y: 2, Yvalid: true,
+		InlineComments: []InlineComment{{"", "(start)"}, {"X", "(x first)"}},
+		Comment:        &comment,
+	}, parseCNC(t, "(start) G1 X1 (x first) Y2 ; and a normal comment"))
+	commentOnly := parseCNC(t, "(just a comment)")
+	assert.True(t, commentOnly.CommentOnly())
+
+	for _, str := range []string{"G1 X1 (unterminated", "G1 X#1", "G1 X[1+2]", "o100 sub", "1 X2"} {
+		_, err := DialectCNC.ParseLine(str)
+		assert.Error(t, err, str)
+	}
+}
+
+func TestDialectCNC_format(t *testing.T) {
+	for str, expected := range map[string]string{
+		"(start) G1 X1 (x first) Y2 ; comment": "(start) G1 X1 (x first) Y2 ; comment",
+		"N20 G90 G21 G1 Z-1 F300":              "N20 G90 G21 G1 Z-1 F300",
+		"/G0X0Y0":                              "/G0 X0 Y0",
+		"% start":                              "% start",
+		"O1001 (part)":                         "O1001 (part)",
+		"G90 G21 G17 (modes) X1":               "G90 G21 G17 (modes) X1",
+		"G90 (absolute) G21 G17":               "G90 (absolute) G21 G17",
+		"G2 X10 Y0 I5 J0 (arc)":                "G2 X10 Y0 I5 J0 (arc)",
+	} {
+		line := parseCNC(t, str)
+		assert.Equal(t, expected, formatGcode(&line, 4, 4, 4))
+	}
+}
+
+func TestGcodeMinifierConfig_CNC(t *testing.T) {
+	gcodeStr := strings.Join([]string{
+		"%",
+		"O1001 (pocket)",
+		"G90 G21 G17 (absolute, mm, XY plane)",
+		"G0 Z5",
+		"G0 X0 Y0",
+		"M3 S10000",
+		"G1 Z-1 F300",
+		"X10 (implicit G1)",
+		"Y10",
+		"G1 X10 Y10",
+		"G0 Z5",
+		"G1 X10",
+		"X0 Y0",
+		"G18",
+		"G2 X0 Z-1 I1 K0",
+		"X2 Z-1 I1 K0",
+		"/M8",
+		"G1 X2",
+		"G54",
+		"G0 X2",
+		"M5",
+		"M30",
+		"%",
+	}, "\n")
+
+	cfg := (&GcodeMinifierConfig{CNC: true, RemoveComments: true}).Init()
+	output, state := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	assert.Equal(t, strings.Join([]string{
+		"%",
+		"O1001",
+		"G90 G21 G17",
+		"G0 Z5",
+		"X0 Y0",
+		"M3 S10000",
+		"G1 Z-1 F300",
+		"X10",
+		"Y10",
+		"G0 Z5",
+		// doesn't go anywhere, but it's still needed for the next line
+		"G1",
+		"X0 Y0",
+		"G18",
+		"G2 X0 Z-1 I1 K0",
+		"X2 Z-1 I1 K0",
+		"/M8",
+		"G1 X2",
+		"G54",
+		"G0 X2",
+		"M5",
+		"M30",
+		"%",
+		"",
+	}, "\n"), output)
+	assert.Equal(t, 18, state.Plane)
+	assert.Equal(t, "G0", state.MotionMode)
+
+	// the grbl flavor turns on CNC mode, too
+	cfg = (&GcodeMinifierConfig{Flavor: FlavorGrbl, RemoveComments: false}).Init()
+	output, _ = cfg.MinifyGcodeStr(MachineState{}, "G21 G0 X1 (go) Y2\nX1 Y2 (nowhere)\nG20\n")
+	assert.Equal(t, "G21 G0 X1 (go) Y2\nG20\n", output)
+}
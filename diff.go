@@ -0,0 +1,288 @@
+package gcodetools
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// DiffConfig is how Diff compares two prints
+type DiffConfig struct {
+	Dialect Dialect
+	// Resolution is the size (in mm) of the grid that extrusion paths are compared on. Paths that moved by less than
+	// about this much aren't counted as changed. Defaults to 0.5mm
+	Resolution float64
+	// ExtrusionTolerance is how much the filament extruded on a layer may change by before it's reported. Defaults to 0.01mm
+	ExtrusionTolerance float64
+	// FeedrateTolerance is how much the average extrusion feedrate of a layer may change by. Defaults to 1mm/min
+	FeedrateTolerance float64
+}
+
+func (cfg *DiffConfig) init() {
+	if cfg.Resolution == 0 {
+		cfg.Resolution = 0.5
+	}
+	if cfg.ExtrusionTolerance == 0 {
+		cfg.ExtrusionTolerance = 0.01
+	}
+	if cfg.FeedrateTolerance == 0 {
+		cfg.FeedrateTolerance = 1
+	}
+}
+
+// LayerDiff is how a layer differs between two prints, which are called A and B
+type LayerDiff struct {
+	Z float64
+	// A and B are the layer in each print, or nil when it's only in the other one
+	A, B *Layer
+	// ExtrusionDifference is the filament that B extrudes on the layer, less A's
+	ExtrusionDifference float64
+	// FeedrateDifference is B's average extrusion feedrate, less A's
+	FeedrateDifference float64
+	// ChangedArea is the area (in mm²) that only one of the prints extrudes over, and the Changed bounds are where it is
+	ChangedArea                                        float64
+	ChangedMinX, ChangedMinY, ChangedMaxX, ChangedMaxY float64
+	// TemperaturesChanged is whether the hotend or bed temperatures are different
+	TemperaturesChanged bool
+
+	changedCells []gridCell
+	// these are the ones that are worth reporting, by the DiffConfig's tolerances
+	extrusionChanged, feedrateChanged bool
+}
+
+// Changed is whether there's any difference in the layer that's worth reporting
+func (d *LayerDiff) Changed() bool {
+	return d.A == nil || d.B == nil || d.extrusionChanged || d.feedrateChanged || d.ChangedArea > 0 || d.TemperaturesChanged
+}
+
+// DiffReport is the differences between two prints, layer by layer
+type DiffReport struct {
+	LayersA, LayersB []Layer
+	// Layers has every layer of both prints, lined up by Z
+	Layers     []LayerDiff
+	resolution float64
+}
+
+// ChangedLayers are the layers that have any differences
+func (r *DiffReport) ChangedLayers() []LayerDiff {
+	var changed []LayerDiff
+	for _, layer := range r.Layers {
+		if layer.Changed() {
+			changed = append(changed, layer)
+		}
+	}
+	return changed
+}
+
+// Diff compares two prints by what they do, rather than by how they're written: they're split into layers, and each
+// layer's extrusion, toolpath, feedrates and temperatures are compared. Formatting, comments and words that don't
+// change anything make no difference.
+func Diff(cfg DiffConfig, a, b io.Reader) (*DiffReport, error) {
+	cfg.init()
+	layersA, err := ReadLayers(cfg.Dialect, a)
+	if err != nil {
+		return nil, fmt.Errorf("a: %v", err)
+	}
+	layersB, err := ReadLayers(cfg.Dialect, b)
+	if err != nil {
+		return nil, fmt.Errorf("b: %v", err)
+	}
+
+	report := &DiffReport{LayersA: layersA, LayersB: layersB, resolution: cfg.Resolution}
+	i, j := 0, 0
+	for i < len(layersA) || j < len(layersB) {
+		switch {
+		case j == len(layersB) || (i < len(layersA) && layersA[i].Z < layersB[j].Z-layerZTolerance):
+			report.Layers = append(report.Layers, LayerDiff{Z: layersA[i].Z, A: &layersA[i]})
+			i++
+		case i == len(layersA) || (j < len(layersB) && layersB[j].Z < layersA[i].Z-layerZTolerance):
+			report.Layers = append(report.Layers, LayerDiff{Z: layersB[j].Z, B: &layersB[j]})
+			j++
+		default:
+			// the same Z (or both NaN, when neither extrudes anything)
+			report.Layers = append(report.Layers, compareLayers(&cfg, &layersA[i], &layersB[j]))
+			i++
+			j++
+		}
+	}
+	return report, nil
+}
+
+func compareLayers(cfg *DiffConfig, a, b *Layer) LayerDiff {
+	d := LayerDiff{
+		Z:                   a.Z,
+		A:                   a,
+		B:                   b,
+		ExtrusionDifference: b.Extruded - a.Extruded,
+		FeedrateDifference:  b.ExtrusionFeedrate() - a.ExtrusionFeedrate(),
+		TemperaturesChanged: !floatsEqual(a.HotendTemperatures, b.HotendTemperatures) || !floatsEqual(a.BedTemperatures, b.BedTemperatures),
+	}
+	d.extrusionChanged = math.Abs(d.ExtrusionDifference) > cfg.ExtrusionTolerance
+	d.feedrateChanged = math.Abs(d.FeedrateDifference) > cfg.FeedrateTolerance
+
+	cellsA, cellsB := rasterizeLayer(a, cfg.Resolution), rasterizeLayer(b, cfg.Resolution)
+	d.changedCells = append(onlyIn(cellsA, cellsB), onlyIn(cellsB, cellsA)...)
+	sort.Slice(d.changedCells, func(i, j int) bool {
+		return d.changedCells[i].y < d.changedCells[j].y || (d.changedCells[i].y == d.changedCells[j].y && d.changedCells[i].x < d.changedCells[j].x)
+	})
+	d.ChangedArea = float64(len(d.changedCells)) * cfg.Resolution * cfg.Resolution
+	for i, cell := range d.changedCells {
+		minX, minY := float64(cell.x)*cfg.Resolution, float64(cell.y)*cfg.Resolution
+		maxX, maxY := minX+cfg.Resolution, minY+cfg.Resolution
+		if i == 0 {
+			d.ChangedMinX, d.ChangedMinY, d.ChangedMaxX, d.ChangedMaxY = minX, minY, maxX, maxY
+		}
+		d.ChangedMinX, d.ChangedMinY = math.Min(d.ChangedMinX, minX), math.Min(d.ChangedMinY, minY)
+		d.ChangedMaxX, d.ChangedMaxY = math.Max(d.ChangedMaxX, maxX), math.Max(d.ChangedMaxY, maxY)
+	}
+	return d
+}
+
+func floatsEqual(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// gridCell is a square of the grid that extrusion paths are compared on
+type gridCell struct {
+	x, y int
+}
+
+// rasterizeLayer finds every grid cell that the layer extrudes over. Comparing these instead of the moves themselves
+// means that the order of the moves and how they're split up doesn't matter
+func rasterizeLayer(layer *Layer, resolution float64) map[gridCell]bool {
+	cells := map[gridCell]bool{}
+	for _, segment := range layer.Segments {
+		length := math.Hypot(segment.X2-segment.X1, segment.Y2-segment.Y1)
+		steps := int(math.Ceil(2 * length / resolution))
+		for step := 0; step <= steps; step++ {
+			t := 1.0
+			if steps > 0 {
+				t = float64(step) / float64(steps)
+			}
+			x, y := segment.X1+t*(segment.X2-segment.X1), segment.Y1+t*(segment.Y2-segment.Y1)
+			cells[gridCell{int(math.Floor(x / resolution)), int(math.Floor(y / resolution))}] = true
+		}
+	}
+	return cells
+}
+
+// onlyIn is the cells of a that b doesn't have, or any of the cells next to them (so that paths that are only shifted
+// over a cell boundary aren't changes)
+func onlyIn(a, b map[gridCell]bool) []gridCell {
+	var cells []gridCell
+	for cell := range a {
+		found := false
+		for dx := -1; dx <= 1 && !found; dx++ {
+			for dy := -1; dy <= 1 && !found; dy++ {
+				found = b[gridCell{cell.x + dx, cell.y + dy}]
+			}
+		}
+		if !found {
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
+
+func totalExtruded(layers []Layer) float64 {
+	total := 0.0
+	for _, layer := range layers {
+		total += layer.Extruded
+	}
+	return total
+}
+
+// WriteText writes out the differences, one line for each layer that changed. nameA and nameB are what to call the prints
+func (r *DiffReport) WriteText(w io.Writer, nameA, nameB string) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "%s: %d layers, %.2fmm of filament\n", nameA, len(r.LayersA), totalExtruded(r.LayersA))
+	fmt.Fprintf(out, "%s: %d layers, %.2fmm of filament\n", nameB, len(r.LayersB), totalExtruded(r.LayersB))
+	for _, d := range r.ChangedLayers() {
+		switch {
+		case d.A == nil:
+			fmt.Fprintf(out, "Z%v: only in %s (layer %d)\n", d.Z, nameB, d.B.Index)
+			continue
+		case d.B == nil:
+			fmt.Fprintf(out, "Z%v: only in %s (layer %d)\n", d.Z, nameA, d.A.Index)
+			continue
+		}
+		fmt.Fprintf(out, "Z%v (layer %d, %d):", d.Z, d.A.Index, d.B.Index)
+		if d.extrusionChanged {
+			fmt.Fprintf(out, " extrusion %+.3fmm (%.3f to %.3f);", d.ExtrusionDifference, d.A.Extruded, d.B.Extruded)
+		}
+		if d.ChangedArea > 0 {
+			fmt.Fprintf(out, " toolpath changed over %vmm² (X%v to %v, Y%v to %v);",
+				d.ChangedArea, d.ChangedMinX, d.ChangedMaxX, d.ChangedMinY, d.ChangedMaxY)
+		}
+		if d.feedrateChanged {
+			fmt.Fprintf(out, " extrusion feedrate %.0f to %.0f;", d.A.ExtrusionFeedrate(), d.B.ExtrusionFeedrate())
+		}
+		if d.TemperaturesChanged {
+			fmt.Fprintf(out, " temperatures hotend %v bed %v to hotend %v bed %v;",
+				d.A.HotendTemperatures, d.A.BedTemperatures, d.B.HotendTemperatures, d.B.BedTemperatures)
+		}
+		fmt.Fprintln(out)
+	}
+	return out.Flush()
+}
+
+// WriteSVG draws the layers that changed, seen from above: A's extrusion in blue, B's in red, and the areas that
+// changed highlighted. Each layer is a group, with its Z as the title.
+func (r *DiffReport) WriteSVG(w io.Writer) error {
+	changed := r.ChangedLayers()
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, d := range changed {
+		for _, layer := range []*Layer{d.A, d.B} {
+			if layer == nil {
+				continue
+			}
+			for _, s := range layer.Segments {
+				minX, maxX = math.Min(minX, math.Min(s.X1, s.X2)), math.Max(maxX, math.Max(s.X1, s.X2))
+				minY, maxY = math.Min(minY, math.Min(s.Y1, s.Y2)), math.Max(maxY, math.Max(s.Y1, s.Y2))
+			}
+		}
+	}
+	if math.IsInf(minX, 1) {
+		minX, minY, maxX, maxY = 0, 0, 1, 1
+	}
+	const margin = 2
+	minX, minY, maxX, maxY = minX-margin, minY-margin, maxX+margin, maxY+margin
+
+	out := bufio.NewWriter(w)
+	// gcode's Y goes up, and SVG's goes down
+	svgY := func(y float64) float64 { return maxY - (y - minY) }
+	fmt.Fprintf(out, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="%g %g %g %g">`+"\n", minX, minY, maxX-minX, maxY-minY)
+	for _, d := range changed {
+		fmt.Fprintf(out, `<g><title>Z%v</title>`+"\n", d.Z)
+		for _, cell := range d.changedCells {
+			fmt.Fprintf(out, `<rect x="%g" y="%g" width="%g" height="%g" fill="orange" fill-opacity="0.5"/>`+"\n",
+				float64(cell.x)*r.resolution, svgY(float64(cell.y+1)*r.resolution), r.resolution, r.resolution)
+		}
+		for _, path := range []struct {
+			layer *Layer
+			color string
+		}{{d.A, "blue"}, {d.B, "red"}} {
+			if path.layer == nil {
+				continue
+			}
+			fmt.Fprintf(out, `<g stroke="%s" stroke-width="0.2" stroke-opacity="0.6">`+"\n", path.color)
+			for _, s := range path.layer.Segments {
+				fmt.Fprintf(out, `<line x1="%g" y1="%g" x2="%g" y2="%g"/>`+"\n", s.X1, svgY(s.Y1), s.X2, svgY(s.Y2))
+			}
+			fmt.Fprintln(out, `</g>`)
+		}
+		fmt.Fprintln(out, `</g>`)
+	}
+	fmt.Fprintln(out, `</svg>`)
+	return out.Flush()
+}
@@ -0,0 +1,63 @@
+package gcodetools
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func diffStrings(t *testing.T, a, b string) *DiffReport {
+	report, err := Diff(DiffConfig{}, strings.NewReader(a), strings.NewReader(b))
+	assert.NoError(t, err)
+	return report
+}
+
+func TestDiff_minified(t *testing.T) {
+	original := squaresGcode(5, 20, 215)
+	minified, _ := (&GcodeMinifierConfig{RemoveComments: true}).Init().MinifyGcodeStr(MachineState{}, original)
+	report := diffStrings(t, original, minified)
+	assert.Len(t, report.Layers, 5)
+	assert.Empty(t, report.ChangedLayers())
+}
+
+func TestDiff_changes(t *testing.T) {
+	a := squaresGcode(3, 20, 215)
+	// a bigger square, hotter on the second layer, and one more layer
+	b := strings.Replace(squaresGcode(4, 20, 215, 220), "G1 X30 E1 F1800\nG1 Y30 E1\nG1 X10 E1\nG1 Y10 E1\nG1 E-1 ; retract\nM104",
+		"G1 X31 E1.1 F1800\nG1 Y31 E1.1\nG1 X10 E1.1\nG1 Y10 E1.1\nG1 E-1 ; retract\nM104", 1)
+
+	report := diffStrings(t, a, b)
+	changed := report.ChangedLayers()
+	// the temperature stays at 220 for the rest of the print
+	if !assert.Len(t, changed, 4) {
+		return
+	}
+	assert.InDelta(t, 0.2, changed[0].Z, 1e-9)
+	assert.InDelta(t, 0.4, changed[0].ExtrusionDifference, 1e-9)
+	assert.True(t, changed[0].ChangedArea > 0)
+	assert.InDelta(t, 30, changed[0].ChangedMaxX, 1.5)
+	assert.True(t, changed[0].TemperaturesChanged, "the M104 S220 is at the end of the first layer")
+	assert.InDelta(t, 0.4, changed[1].Z, 1e-9)
+	assert.Equal(t, 0.0, changed[1].ChangedArea)
+	assert.True(t, changed[1].TemperaturesChanged)
+	assert.True(t, changed[2].TemperaturesChanged)
+	assert.Nil(t, changed[3].A)
+	assert.InDelta(t, 0.8, changed[3].Z, 1e-9)
+
+	var text bytes.Buffer
+	assert.NoError(t, report.WriteText(&text, "a", "b"))
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	assert.Equal(t, "a: 3 layers, 9.00mm of filament", lines[0])
+	assert.Equal(t, "b: 4 layers, 12.40mm of filament", lines[1])
+	assert.Contains(t, lines[2], "Z0.2 (layer 0, 0): extrusion +0.400mm (3.000 to 3.400); toolpath changed over")
+	assert.Contains(t, lines[3], "Z0.4 (layer 1, 1): temperatures hotend [215] bed [60] to hotend [220] bed [60];")
+	assert.Equal(t, "Z0.8: only in b (layer 3)", lines[5])
+
+	var svg bytes.Buffer
+	assert.NoError(t, report.WriteSVG(&svg))
+	assert.True(t, strings.HasPrefix(svg.String(), `<svg xmlns="http://www.w3.org/2000/svg"`))
+	assert.Contains(t, svg.String(), `<title>Z0.2</title>`)
+	assert.Contains(t, svg.String(), `<rect `)
+	assert.Contains(t, svg.String(), `stroke="red"`)
+}
@@ -0,0 +1,94 @@
+package gcodetools
+
+import (
+	"math"
+	"time"
+)
+
+// TimeEstimator adds up how long a print takes from its moves and dwells.
+// Every move is assumed to accelerate from a standstill and decelerate back to one, which ignores junction speeds.
+// That overestimates prints with lots of short moves, but it makes for a safe upper bound.
+type TimeEstimator struct {
+	Limits KinematicLimits
+
+	seconds float64
+	state   MachineState
+}
+
+// AddLine updates the estimate for one line of gcode and returns how many seconds that line takes
+func (est *TimeEstimator) AddLine(line *GcodeLine) float64 {
+	seconds := est.lineSeconds(line)
+	est.seconds += seconds
+	return seconds
+}
+
+// Seconds is the estimated time of everything added so far
+func (est *TimeEstimator) Seconds() float64 {
+	return est.seconds
+}
+
+func (est *TimeEstimator) Duration() time.Duration {
+	return time.Duration(est.seconds * float64(time.Second))
+}
+
+func (est *TimeEstimator) lineSeconds(line *GcodeLine) float64 {
+	switch {
+	case line.IsG(0) || line.IsG(1):
+		return est.move(line)
+	case line.IsG(4):
+		// G4 P is in milliseconds, G4 S is in seconds
+		if p, ok := line.NumericParams['P']; ok {
+			return p / 1000
+		}
+		return line.NumericParams['S']
+	}
+	est.state.Apply(line)
+	return 0
+}
+
+func (est *TimeEstimator) move(line *GcodeLine) float64 {
+	before := est.state
+	de := est.state.ExtrusionDelta(line)
+	est.state.Apply(line)
+	dx, dy, dz := est.state.X-before.X, est.state.Y-before.Y, est.state.Z-before.Z
+	feedrate := est.state.Feedrate
+
+	distance := math.Sqrt(dx*dx + dy*dy + dz*dz)
+	if distance == 0 {
+		// extrude-only moves (like retractions) are limited by the extruder alone
+		distance = math.Abs(de)
+	}
+	if distance == 0 || feedrate <= 0 {
+		return 0
+	}
+
+	speed := feedrate / 60
+	acceleration := est.Limits.Acceleration
+	// scale the speed and acceleration down so that no single axis goes over its own limits
+	limit := func(delta, maxSpeed, maxAcceleration float64) {
+		fraction := math.Abs(delta) / distance
+		if fraction == 0 {
+			return
+		}
+		if maxSpeed > 0 && speed*fraction > maxSpeed {
+			speed = maxSpeed / fraction
+		}
+		if maxAcceleration > 0 && (acceleration <= 0 || acceleration*fraction > maxAcceleration) {
+			acceleration = maxAcceleration / fraction
+		}
+	}
+	limit(dx, est.Limits.MaxSpeedX, est.Limits.MaxAccelerationX)
+	limit(dy, est.Limits.MaxSpeedY, est.Limits.MaxAccelerationY)
+	limit(dz, est.Limits.MaxSpeedZ, est.Limits.MaxAccelerationZ)
+	limit(de, est.Limits.MaxSpeedE, est.Limits.MaxAccelerationE)
+
+	if acceleration <= 0 {
+		return distance / speed
+	}
+	// trapezoid: accelerate to speed, cruise, decelerate. short moves never reach full speed, and make a triangle instead
+	accelerationDistance := speed * speed / acceleration
+	if distance >= accelerationDistance {
+		return distance/speed + speed/acceleration
+	}
+	return 2 * math.Sqrt(distance/acceleration)
+}
@@ -0,0 +1,31 @@
+package gcodetools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeEstimator(t *testing.T) {
+	est := &TimeEstimator{Limits: KinematicLimits{
+		MaxSpeedX:    100,
+		MaxSpeedZ:    5,
+		Acceleration: 1000,
+	}}
+
+	// 100mm at 50mm/s: 2s of cruising plus the time lost accelerating and decelerating
+	assert.InDelta(t, 2.05, est.AddLine(mustParseLine("G1 X100 F3000")), 1e-9)
+	// back again, but the X axis is limited to 100mm/s
+	assert.InDelta(t, 1.1, est.AddLine(mustParseLine("G1 X0 F60000")), 1e-9)
+	// too short to reach full speed
+	assert.InDelta(t, 0.02, est.AddLine(mustParseLine("G1 X0.1")), 1e-9)
+	// Z is slow
+	assert.InDelta(t, 2.005, est.AddLine(mustParseLine("G1 Z10 F6000")), 1e-9)
+	assert.InDelta(t, 1.5, est.AddLine(mustParseLine("G4 P1500")), 1e-9)
+	assert.InDelta(t, 2, est.AddLine(mustParseLine("G4 S2")), 1e-9)
+
+	// relative moves
+	est.AddLine(mustParseLine("G91"))
+	assert.InDelta(t, 0.02, est.AddLine(mustParseLine("G1 X0.1 F3000")), 1e-9)
+	assert.InDelta(t, 2.05+1.1+0.02+2.005+1.5+2+0.02, est.Seconds(), 1e-9)
+}
@@ -0,0 +1,439 @@
+package gcodetools
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// MaxFastParams is how many parameters (other than X, Y, Z, E and F) a FastLine can hold.
+// Lines with more than that are parsed by ParseLine instead.
+const MaxFastParams = 8
+
+// FastParam is one numeric parameter of a FastLine, like the S in M104 S200
+type FastParam struct {
+	Letter uint8
+	Value  float64
+}
+
+// FastLine is a GcodeLine for parsing huge files: the parameters are in a fixed array instead of maps, and the
+// comment is part of the input instead of a copy of it, so that ParseFast doesn't allocate. A FastLine is meant to be
+// reused for every line of a file.
+//
+// Lines that need more than that (free text, extended commands, or anything malformed)
+// are parsed by ParseLine into Full, and Slow is set. Everything else is the same as it would be from ParseLine.
+type FastLine struct {
+	CmdLetter       uint8
+	CmdNumber       uint16
+	CmdSubcode      uint8
+	CmdSubcodeValid bool
+	X               float64
+	Y               float64
+	Z               float64
+	E               float64
+	Xvalid          bool
+	Yvalid          bool
+	Zvalid          bool
+	Evalid          bool
+	Feedrate        float64
+	Params          [MaxFastParams]FastParam
+	NumParams       int
+	LineNumber      int
+	LineNumberValid bool
+	Checksum        uint8
+	ChecksumValid   bool
+	// Comment is a slice of the input, so it's only valid until the input is reused. nil if there isn't one
+	Comment []byte
+
+	Slow bool
+	Full GcodeLine
+}
+
+func (g *FastLine) IsCmd(cmdLetter uint8, cmdNumber uint16) bool {
+	return g.CmdLetter == cmdLetter && g.CmdNumber == cmdNumber && !g.CmdSubcodeValid
+}
+
+func (g *FastLine) IsG(cmdNumber uint16) bool {
+	return g.IsCmd(G, cmdNumber)
+}
+func (g *FastLine) IsM(cmdNumber uint16) bool {
+	return g.IsCmd(M, cmdNumber)
+}
+
+// Param looks up a numeric parameter (other than X, Y, Z, E and F, which have their own fields)
+func (g *FastLine) Param(letter uint8) (value float64, ok bool) {
+	for i := 0; i < g.NumParams; i++ {
+		if g.Params[i].Letter == letter {
+			return g.Params[i].Value, true
+		}
+	}
+	return 0, false
+}
+
+func (g *FastLine) setParam(letter uint8, value float64) bool {
+	for i := 0; i < g.NumParams; i++ {
+		if g.Params[i].Letter == letter {
+			g.Params[i].Value = value
+			return true
+		}
+	}
+	if g.NumParams == MaxFastParams {
+		return false
+	}
+	g.Params[g.NumParams] = FastParam{Letter: letter, Value: value}
+	g.NumParams++
+	return true
+}
+
+// GcodeLine converts the line to a GcodeLine, which allocates (for the comment and parameters)
+func (g *FastLine) GcodeLine() GcodeLine {
+	if g.Slow {
+		return g.Full
+	}
+	line := GcodeLine{
+		CmdLetter:       g.CmdLetter,
+		CmdNumber:       g.CmdNumber,
+		CmdSubcode:      g.CmdSubcode,
+		CmdSubcodeValid: g.CmdSubcodeValid,
+		X:               g.X,
+		Y:               g.Y,
+		Z:               g.Z,
+		E:               g.E,
+		Xvalid:          g.Xvalid,
+		Yvalid:          g.Yvalid,
+		Zvalid:          g.Zvalid,
+		Evalid:          g.Evalid,
+		Feedrate:        g.Feedrate,
+		LineNumber:      g.LineNumber,
+		LineNumberValid: g.LineNumberValid,
+		Checksum:        g.Checksum,
+		ChecksumValid:   g.ChecksumValid,
+	}
+	if g.NumParams > 0 {
+		line.NumericParams = make(map[uint8]float64, g.NumParams)
+		for _, param := range g.Params[:g.NumParams] {
+			line.NumericParams[param.Letter] = param.Value
+		}
+	}
+	if g.Comment != nil {
+		comment := string(g.Comment)
+		line.Comment = &comment
+	}
+	return line
+}
+
+// ParseFast parses a line into line, overwriting whatever was there. It gives the same result as ParseLine, without
+// allocating for ordinary lines of gcode (only ones that fall back to ParseLine).
+func ParseFast(line *FastLine, buf []byte) error {
+	line.reset()
+	if !parseFastPath(line, buf) {
+		var err error
+		line.reset()
+		line.Slow = true
+		line.Full, err = ParseLine(string(buf))
+		return err
+	}
+	return nil
+}
+
+// reset clears the line for reuse. Full is left alone (it's only looked at when the line is Slow),
+// since clearing all of it for every line is slower than parsing most lines
+func (g *FastLine) reset() {
+	g.CmdLetter, g.CmdNumber, g.CmdSubcode, g.CmdSubcodeValid = 0, 0, 0, false
+	g.X, g.Y, g.Z, g.E = 0, 0, 0, 0
+	g.Xvalid, g.Yvalid, g.Zvalid, g.Evalid = false, false, false, false
+	g.Feedrate = 0
+	g.NumParams = 0
+	g.LineNumber, g.LineNumberValid, g.Checksum, g.ChecksumValid = 0, false, 0, false
+	g.Comment = nil
+	g.Slow = false
+}
+
+// parseFastPath parses a simple line in one pass, returning false if it can't. That's also the case for any errors,
+// so that ParseLine reports them in the same way as always
+func parseFastPath(line *FastLine, buf []byte) bool {
+	pos := 0
+	for pos < len(buf) && isSpace(buf[pos]) {
+		pos++
+	}
+	if pos+1 < len(buf) && (buf[pos] == 'N' || buf[pos] == 'n') && isDigit(buf[pos+1]) {
+		end := pos + 1
+		for end < len(buf) && !isSpace(buf[end]) && buf[end] != CommentChar && buf[end] != '*' {
+			end++
+		}
+		number, ok := parseFastUint(buf[pos+1:end], 1<<31-1)
+		if !ok {
+			return false
+		}
+		line.LineNumber = int(number)
+		line.LineNumberValid = true
+		pos = end
+		for pos < len(buf) && (buf[pos] == ' ' || buf[pos] == '\t') {
+			pos++
+		}
+	}
+	if pos+1 < len(buf) && isExtendedCommandChar(buf[pos]) && isExtendedCommandChar(buf[pos+1]) {
+		// an extended or meta command
+		return false
+	}
+
+	wordIndex := 0
+	for pos < len(buf) {
+		c := buf[pos]
+		switch {
+		case c == CommentChar:
+			line.Comment = buf[pos:]
+			return true
+		case c == '*':
+			return parseFastChecksum(line, buf, pos)
+		case isSpace(c) || c == '\r':
+			pos++
+			continue
+		}
+		// quotes, brackets and anything else that isn't a number end up failing to parse as one
+		end, ok := parseFastWord(line, wordIndex, buf, pos)
+		if !ok || isTextCommand(line.CmdLetter, line.CmdNumber, line.CmdSubcodeValid) {
+			return false
+		}
+		wordIndex++
+		pos = end
+	}
+	return true
+}
+
+// fastWordEnd is the characters that end a word: whitespace, and the start of a comment or checksum
+var fastWordEnd = [256]bool{' ': true, '\t': true, '\n': true, '\r': true, CommentChar: true, '*': true}
+
+// parseFastChecksum parses the checksum that starts at buf[star], and the comment after it
+func parseFastChecksum(line *FastLine, buf []byte, star int) bool {
+	if !line.LineNumberValid {
+		// it's part of the line (or a mistake) for ParseLine to sort out
+		return false
+	}
+	end := star + 1
+	for end < len(buf) && buf[end] != CommentChar {
+		end++
+	}
+	checksum, ok := parseFastUint(trimSpaceBytes(buf[star+1:end]), 255)
+	if !ok {
+		return false
+	}
+	var actual uint8
+	for _, c := range buf[:star] {
+		actual ^= c
+	}
+	if uint8(checksum) != actual {
+		// for ParseLine to report
+		return false
+	}
+	line.Checksum = uint8(checksum)
+	line.ChecksumValid = true
+	if end < len(buf) {
+		line.Comment = buf[end:]
+	}
+	return true
+}
+
+// parseFastWord is parseWord for a FastLine, for the word that starts at buf[start]. It returns where the word ends,
+// so that numbers are only read once
+func parseFastWord(line *FastLine, wordIndex int, buf []byte, start int) (end int, ok bool) {
+	letter := buf[start]
+	switch letter {
+	case '"', '{', '}', '[', ']', '(', ')':
+		return 0, false
+	}
+	if start+1 == len(buf) || fastWordEnd[buf[start+1]] {
+		// a letter without a value
+		return 0, false
+	}
+	switch letter {
+	case 'X', 'x':
+		line.X, end, ok = parseFastFloat(buf, start+1)
+		line.Xvalid = true
+		return
+	case 'Y', 'y':
+		line.Y, end, ok = parseFastFloat(buf, start+1)
+		line.Yvalid = true
+		return
+	case 'Z', 'z':
+		line.Z, end, ok = parseFastFloat(buf, start+1)
+		line.Zvalid = true
+		return
+	case 'E', 'e':
+		line.E, end, ok = parseFastFloat(buf, start+1)
+		line.Evalid = true
+		return
+	case 'F', 'f':
+		line.Feedrate, end, ok = parseFastFloat(buf, start+1)
+		return
+	}
+
+	end = fastWordEndIndex(buf, start+1)
+	number := buf[start+1 : end]
+	if wordIndex == 0 && (letter == 'T' || letter == 't') {
+		if tool, ok := parseFastUint(number, 1<<16-1); ok {
+			line.CmdLetter = T
+			line.CmdNumber = uint16(tool)
+			return end, true
+		}
+	}
+	switch letter {
+	case 'G', 'g', 'M', 'm':
+		if letter == 'G' || letter == 'g' {
+			line.CmdLetter = G
+		} else {
+			line.CmdLetter = M
+		}
+		for dot := range number {
+			if number[dot] == '.' {
+				var subcode uint64
+				if subcode, ok = parseFastUint(number[dot+1:], 255); !ok {
+					return
+				}
+				line.CmdSubcode = uint8(subcode)
+				line.CmdSubcodeValid = true
+				number = number[:dot]
+				break
+			}
+		}
+		var cmdNumber uint64
+		cmdNumber, ok = parseFastUint(number, 1<<16-1)
+		line.CmdNumber = uint16(cmdNumber)
+	default:
+		var value float64
+		if value, _, ok = parseFastFloat(number, 0); ok {
+			ok = line.setParam(letter, value)
+		}
+	}
+	return
+}
+
+// fastWordEndIndex is the index of the end of the word that buf[i] is in
+func fastWordEndIndex(buf []byte, i int) int {
+	for i < len(buf) && !fastWordEnd[buf[i]] {
+		i++
+	}
+	return i
+}
+
+// parseFastUint parses a number of only digits (like strconv.ParseUint in base 10), up to max
+func parseFastUint(b []byte, max uint64) (n uint64, ok bool) {
+	if len(b) == 0 || len(b) > 19 {
+		return 0, false
+	}
+	for _, c := range b {
+		if !isDigit(c) {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
+	}
+	return n, n <= max
+}
+
+// float64pow10 are the powers of 10 that are exactly representable as a float64
+var float64pow10 = [...]float64{1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10,
+	1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18, 1e19, 1e20, 1e21, 1e22}
+
+// parseFastFloat parses the decimal number (like -12.345, which is what every number in gcode looks like) that starts
+// at buf[start] and goes to the end of the word. When the digits fit in a float64's mantissa, dividing by an exact
+// power of 10 is correctly rounded, so the result is exactly the same as strconv.ParseFloat's (this is the same fast
+// path that strconv has, but without needing a string). Anything else (exponents, too many digits...) is left to
+// strconv.ParseFloat.
+func parseFastFloat(buf []byte, start int) (f float64, end int, ok bool) {
+	i := start
+	negative := false
+	if i < len(buf) && (buf[i] == '-' || buf[i] == '+') {
+		negative = buf[i] == '-'
+		i++
+	}
+	var mantissa uint64
+	digitsStart := i
+	for i < len(buf) && isDigit(buf[i]) {
+		mantissa = mantissa*10 + uint64(buf[i]-'0')
+		i++
+	}
+	digits, decimals := i-digitsStart, 0
+	if i < len(buf) && buf[i] == '.' {
+		i++
+		decimalsStart := i
+		for i < len(buf) && isDigit(buf[i]) {
+			mantissa = mantissa*10 + uint64(buf[i]-'0')
+			i++
+		}
+		decimals = i - decimalsStart
+		digits += decimals
+	}
+	if (i < len(buf) && !fastWordEnd[buf[i]]) || digits == 0 || digits > 15 {
+		end = fastWordEndIndex(buf, i)
+		f, ok = parseSlowFloat(buf[start:end])
+		return
+	}
+	f = float64(mantissa)
+	if decimals > 0 {
+		f /= float64pow10[decimals]
+	}
+	if negative {
+		f = -f
+	}
+	return f, i, true
+}
+
+func parseSlowFloat(b []byte) (float64, bool) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	return f, err == nil
+}
+
+func trimSpaceBytes(b []byte) []byte {
+	for len(b) > 0 && (isSpace(b[0]) || b[0] == '\r') {
+		b = b[1:]
+	}
+	for len(b) > 0 && (isSpace(b[len(b)-1]) || b[len(b)-1] == '\r') {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// FastReader parses a file one line at a time, into the same FastLine, so that reading a file doesn't allocate
+// (other than for the lines that aren't simple enough for ParseFast)
+type FastReader struct {
+	scanner    *bufio.Scanner
+	line       FastLine
+	lineNumber int
+	err        error
+}
+
+func NewFastReader(r io.Reader) *FastReader {
+	scanner := NewLineScanner(r)
+	return &FastReader{scanner: scanner}
+}
+
+// Next parses the next line, returning false at the end of the file or on an error
+func (r *FastReader) Next() bool {
+	if r.err != nil || !r.scanner.Scan() {
+		return false
+	}
+	r.lineNumber++
+	if err := ParseFast(&r.line, r.scanner.Bytes()); err != nil {
+		r.err = fmt.Errorf("line %d: %v", r.lineNumber, err)
+		return false
+	}
+	return true
+}
+
+// Line is the line that Next parsed. It's overwritten by the next call to Next
+func (r *FastReader) Line() *FastLine {
+	return &r.line
+}
+
+// LineNumber is the 1-based line number in the file of Line
+func (r *FastReader) LineNumber() int {
+	return r.lineNumber
+}
+
+func (r *FastReader) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.scanner.Err()
+}
@@ -0,0 +1,186 @@
+package gcodetools
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var fastParserTestLines = []string{
+	``,
+	`   `,
+	`; just a comment`,
+	`G0 X1 Y2 Z3 E4`,
+	`G1 X.21 Y-20 Z+3 E-0.5 F1200.5 ; comment`,
+	`g1 x1 y2`,
+	`M104 S200`,
+	`M104 T1 S200`,
+	`M203 X500 Y500 Z12 E120 T0 S1 P2 R3 Q4`,
+	`M906 A1 B2 C3 D4 H5 I6 J7 K8 L9 P10`, // more parameters than fit in a FastLine
+	`G1 X1 X2`,
+	`T0`,
+	`T1 P0`,
+	`T-1`,
+	`G38.2 Z-10 F100`,
+	`N10 G1 X10*96`,
+	`N10 G1 X10*27`, // checksum mismatch
+	`N10 G1 X10`,
+	`G1 X1.5e2`,
+	`G1 X-0 Y+.5 Z1. E-.`,
+	`G1 X12345678901234567890`,
+	`G1 X0.1234567890123456789`,
+	"G1 X10\r",
+	`M117 hello`,
+	`M117 Printing (50%`,
+	`M117 X10 Y20`,
+	`N3 M117 hi*46`,
+	`M118 S"Hello; Duet"`,
+	`G1 X{move.axes[0].max - 10}`,
+	`SET_PRESSURE_ADVANCE ADVANCE=0.05`,
+	`if move.axes[0].homed`,
+	`echo "hi"`,
+	`G1 X`,
+	`G`,
+	`G1.x`,
+	`M70000`,
+}
+
+func TestParseFast(t *testing.T) {
+	var line FastLine
+	for _, str := range fastParserTestLines {
+		expected, expectedErr := ParseLine(str)
+		err := ParseFast(&line, []byte(str))
+		assert.Equal(t, expectedErr, err, str)
+		assert.Equal(t, expected, line.GcodeLine(), str)
+	}
+}
+
+// TestParseFast_random checks that lines made out of bits of gcode parse the same as they do with ParseLine
+func TestParseFast_random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pieces := []string{"G", "M", "T", "N", "X", "y", "E", "F", "S", "1", "23", ".", "-", "+", "e", " ", "\t", "\r",
+		";", "*", "\"", "{", "}", "(", "[", "_"}
+	var line FastLine
+	for i := 0; i < 100000; i++ {
+		var str strings.Builder
+		for n := r.Intn(12); n >= 0; n-- {
+			str.WriteString(pieces[r.Intn(len(pieces))])
+		}
+		expected, expectedErr := ParseLine(str.String())
+		err := ParseFast(&line, []byte(str.String()))
+		if !assert.Equal(t, expectedErr, err, str.String()) || !assert.Equal(t, expected, line.GcodeLine(), str.String()) {
+			return
+		}
+	}
+}
+
+func TestParseFast_fastPath(t *testing.T) {
+	var line FastLine
+	assert.NoError(t, ParseFast(&line, []byte(`G1 X10 Y.5 E-1.25 F1800 ; move`)))
+	assert.False(t, line.Slow)
+	assert.True(t, line.IsG(1))
+	assert.Equal(t, 10.0, line.X)
+	assert.Equal(t, 0.5, line.Y)
+	assert.Equal(t, -1.25, line.E)
+	assert.Equal(t, 1800.0, line.Feedrate)
+	assert.Equal(t, []byte(`; move`), line.Comment)
+
+	// reusing the line clears it
+	assert.NoError(t, ParseFast(&line, []byte(`M104 S210`)))
+	assert.True(t, line.IsM(104))
+	assert.False(t, line.Xvalid)
+	assert.Nil(t, line.Comment)
+	s, ok := line.Param('S')
+	assert.True(t, ok)
+	assert.Equal(t, 210.0, s)
+
+	assert.NoError(t, ParseFast(&line, []byte(`SET_FAN_SPEED FAN=part SPEED=0.5`)))
+	assert.True(t, line.Slow)
+	assert.Equal(t, "SET_FAN_SPEED", line.Full.ExtendedCmd)
+}
+
+func TestParseFast_floats(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var line FastLine
+	for i := 0; i < 10000; i++ {
+		str := fmt.Sprintf("G1 X%.*f", r.Intn(8), (r.Float64()-0.5)*1000)
+		expected := mustParseLine(str)
+		assert.NoError(t, ParseFast(&line, []byte(str)))
+		assert.False(t, line.Slow)
+		if !assert.Equal(t, expected.X, line.X, str) {
+			return
+		}
+	}
+}
+
+func TestParseFast_allocations(t *testing.T) {
+	var line FastLine
+	buf := []byte(`N123 G1 X123.456 Y78.9 E.04567 F1800 S1 ; comment*12`)
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = ParseFast(&line, buf)
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func TestFastReader(t *testing.T) {
+	r := NewFastReader(strings.NewReader("G28\nG1 X10 ; move\nG1 X1..5\n"))
+	assert.True(t, r.Next())
+	assert.True(t, r.Line().IsG(28))
+	assert.True(t, r.Next())
+	assert.Equal(t, 10.0, r.Line().X)
+	assert.Equal(t, 2, r.LineNumber())
+	assert.False(t, r.Next())
+	assert.EqualError(t, r.Err(), `line 3: strconv.ParseFloat: parsing "1..5": invalid syntax`)
+}
+
+// benchmarkGcode is like what a slicer writes, mostly extrusion moves
+func benchmarkGcode() []byte {
+	r := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	buf.WriteString("; generated by a slicer\nM104 S210\nM140 S60\nG28\nG92 E0\n")
+	e := 0.0
+	for i := 0; i < 10000; i++ {
+		switch {
+		case i%100 == 0:
+			fmt.Fprintf(&buf, ";LAYER:%d\nG1 Z%.3f F600\n", i/100, float64(i/100)*0.2+0.2)
+		case i%17 == 0:
+			fmt.Fprintf(&buf, "G0 F7200 X%.3f Y%.3f\n", r.Float64()*200, r.Float64()*200)
+		default:
+			e += r.Float64()
+			fmt.Fprintf(&buf, "G1 X%.3f Y%.3f E%.5f\n", r.Float64()*200, r.Float64()*200, e)
+		}
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkParseLine(b *testing.B) {
+	gcode := benchmarkGcode()
+	b.SetBytes(int64(len(gcode)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, str := range strings.Split(string(gcode), "\n") {
+			if _, err := ParseLine(str); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkParseFast(b *testing.B) {
+	gcode := benchmarkGcode()
+	b.SetBytes(int64(len(gcode)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := NewFastReader(bytes.NewReader(gcode))
+		for r.Next() {
+		}
+		if r.Err() != nil {
+			b.Fatal(r.Err())
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package gcodetools
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Flavor describes what a firmware accepts, so that passes know what is safe to write
+type Flavor struct {
+	Name string
+	// Commands that the firmware understands, like "G1" or "M104"
+	Commands map[string]bool
+	// LeadingDotFloats is whether the firmware reads numbers like ".5" (without the leading zero)
+	LeadingDotFloats bool
+	// Arcs is whether G2/G3 are supported (which may need to be enabled in the firmware config)
+	Arcs bool
+	// ExtendedCommands is whether the firmware has Klipper-style commands like SET_PRESSURE_ADVANCE ADVANCE=0.04
+	ExtendedCommands bool
+	// QuotedStrings is whether string parameters can be quoted, like M291 P"Hello world"
+	QuotedStrings bool
+	// G90ResetsExtrusion is whether G90 makes extrusion absolute as well (undoing M83), like Marlin does. Klipper and
+	// RepRapFirmware leave the extrusion mode alone
+	G90ResetsExtrusion bool
+	// MetaCommands is whether the firmware has RepRapFirmware-style meta commands (if, while, var, echo...) and {expressions}
+	MetaCommands bool
+	// Dialect is how the firmware's gcode is parsed
+	Dialect Dialect
+	// ParamMeanings describes what the parameters of a command mean for this firmware, where that differs between firmwares
+	ParamMeanings map[string]map[uint8]string
+}
+
+// commandKey formats a command the way that Flavor.Commands is keyed
+func commandKey(cmdLetter uint8, cmdNumber uint16) string {
+	return string(rune(cmdLetter)) + strconv.Itoa(int(cmdNumber))
+}
+
+// SupportsCommand is whether the firmware understands the command on line.
+// Lines without a command (like comments) are always supported, and subcodes (like G38.2) go by the command without one.
+func (f *Flavor) SupportsCommand(line *GcodeLine) bool {
+	if line.ExtendedCmd != "" {
+		return f.ExtendedCommands
+	}
+	if line.MetaCmd != "" {
+		return f.MetaCommands
+	}
+	if line.CmdLetter == 0 {
+		return true
+	}
+	for i := range line.ExtraCmds {
+		if !f.SupportsCommand(&line.ExtraCmds[i]) {
+			return false
+		}
+	}
+	if line.CmdLetter == T {
+		return true // every firmware has tool changes
+	}
+	if (line.IsG(2) || line.IsG(3)) && !f.Arcs {
+		return false
+	}
+	return f.Commands[commandKey(line.CmdLetter, line.CmdNumber)]
+}
+
+// ParamMeaning describes a parameter of a command (like 'S' for "M106"), or returns "" if it isn't known
+func (f *Flavor) ParamMeaning(command string, param uint8) string {
+	return f.ParamMeanings[strings.ToUpper(command)][param]
+}
+
+func (f *Flavor) String() string {
+	return f.Name
+}
+
+// commandSet parses a space-separated list of commands, where ranges like M20-M34 include every command in between
+func commandSet(lists ...string) map[string]bool {
+	set := map[string]bool{}
+	for _, list := range lists {
+		for _, cmd := range strings.Fields(list) {
+			dash := strings.IndexByte(cmd, '-')
+			if dash < 0 {
+				set[cmd] = true
+				continue
+			}
+			from, err1 := strconv.Atoi(cmd[1:dash])
+			to, err2 := strconv.Atoi(cmd[dash+2:])
+			if err1 != nil || err2 != nil || cmd[0] != cmd[dash+1] {
+				panic("invalid command range " + cmd)
+			}
+			for i := from; i <= to; i++ {
+				set[commandKey(cmd[0], uint16(i))] = true
+			}
+		}
+	}
+	return set
+}
+
+// the commands that just about every 3d printer firmware understands
+const commonCommands = `G0 G1 G4 G28 G90 G91 G92 M82 M83 M84 M18 M104 M105 M106 M107 M109 M110 M112 M114 M115 M117 M140 M190 M220 M221 M400`
+
+const marlinCommands = `G2 G3 G5 G10 G11 G12 G20 G21 G26 G27 G29 G30 G33 G34 G35 G38 G42 G53-G59 G60 G61 G76 G80 G425
+	M0 M1 M3 M4 M5 M7 M8 M9 M16 M17 M20-M34 M42 M43 M48 M73 M75-M78 M80 M81 M85 M92 M100 M108 M111 M113 M118 M119
+	M120 M121 M122 M125 M126-M129 M141 M143 M145 M149 M150 M154 M155 M163-M166 M191 M200-M209 M211 M217 M218
+	M226 M240 M250 M256 M260 M261 M280 M281 M282 M290 M300-M306 M350 M351 M355 M360-M364 M380 M381 M401 M402
+	M403 M404 M405-M407 M410 M412 M413 M420 M421 M422 M423 M425 M428 M430 M486 M500-M504 M510-M512 M524 M540
+	M569 M575 M600 M603 M605 M665 M666 M672 M701 M702 M710 M851 M852 M860-M869 M871 M876 M900 M906-M919 M928
+	M951 M993 M994 M995 M997 M999`
+
+var (
+	FlavorMarlin = &Flavor{
+		Name:               "marlin",
+		Commands:           commandSet(commonCommands, marlinCommands),
+		LeadingDotFloats:   true, // https://github.com/MarlinFirmware/Marlin/blob/2.0.x/Marlin/src/gcode/parser.h#L248
+		Arcs:               true,
+		G90ResetsExtrusion: true,
+		ParamMeanings: map[string]map[uint8]string{
+			"G4":   {'P': "dwell time (ms)", 'S': "dwell time (s)"},
+			"G10":  {'S': "swap retraction (multi-extruder)"},
+			"M104": {'S': "target temperature (°C)", 'T': "tool"},
+			"M106": {'P': "fan index", 'S': "fan speed (0-255)"},
+			"M109": {'S': "target temperature, waits only when heating (°C)", 'R': "target temperature, waits when heating or cooling (°C)", 'T': "tool"},
+			"M190": {'S': "target temperature, waits only when heating (°C)", 'R': "target temperature, waits when heating or cooling (°C)"},
+			"M900": {'K': "linear advance factor"},
+		},
+	}
+
+	FlavorPrusa = &Flavor{
+		Name:               "prusa",
+		Commands:           commandSet(commonCommands, marlinCommands, `G80 G81 G86 G87 G88 M214 M862`),
+		LeadingDotFloats:   true,
+		Arcs:               true,
+		G90ResetsExtrusion: true,
+		ParamMeanings:      FlavorMarlin.ParamMeanings,
+	}
+
+	FlavorKlipper = &Flavor{
+		Name:     "klipper",
+		Commands: commandSet(commonCommands, `G2 G3 G10 G11 G20 G21 M73 M118 M204 M486 M600`),
+		// numbers are parsed with python's float(), which is fine with ".5"
+		LeadingDotFloats: true,
+		Arcs:             true, // with [gcode_arcs]
+		ExtendedCommands: true,
+		ParamMeanings: map[string]map[uint8]string{
+			"G4":   {'P': "dwell time (ms)"},
+			"M104": {'S': "target temperature (°C)", 'T': "tool"},
+			"M106": {'P': "fan index", 'S': "fan speed (0-255)"},
+			"M109": {'S': "target temperature, waits when heating or cooling (°C)", 'T': "tool"},
+			"M190": {'S': "target temperature, waits when heating or cooling (°C)"},
+			"M204": {'S': "acceleration (mm/s²)", 'P': "print acceleration (mm/s²)", 'T': "travel acceleration (mm/s²)"},
+		},
+	}
+
+	FlavorRepRapFirmware = &Flavor{
+		Name: "reprapfirmware",
+		Commands: commandSet(commonCommands, `G2 G3 G10 G11 G17 G18 G19 G20 G21 G29-G32 G53-G59 G60 G68 G69
+			M0 M1 M3 M4 M5 M17 M20-M39 M80 M81 M98 M99 M108 M111 M116 M118 M119 M120 M121 M122 M141 M143 M150 M191
+			M200-M208 M226 M280 M290 M291 M292 M300-M309 M350 M401 M402 M404 M500-M503 M540 M550-M589 M572 M584 M591
+			M593 M600 M665 M666 M669 M671 M701-M703 M906 M913 M915 M929 M950 M997 M999`),
+		// https://github.com/Duet3D/RRFLibraries/blob/master/src/General/SafeStrtod.cpp
+		LeadingDotFloats: true,
+		Arcs:             true,
+		QuotedStrings:    true,
+		MetaCommands:     true,
+		Dialect:          DialectRepRapFirmware,
+		ParamMeanings: map[string]map[uint8]string{
+			"G4":   {'P': "dwell time (ms)", 'S': "dwell time (s)"},
+			"G10":  {'P': "tool", 'R': "standby temperature (°C)", 'S': "active temperature (°C)", 'X': "tool X offset", 'Y': "tool Y offset", 'Z': "tool Z offset"},
+			"M104": {'S': "target temperature (°C)", 'T': "tool"},
+			"M106": {'P': "fan index", 'S': "fan speed (0-1, or 0-255 when greater than 1)", 'R': "restore speed"},
+			"M109": {'S': "target temperature, waits when heating or cooling (°C)", 'R': "standby temperature (°C)", 'T': "tool"},
+			"M190": {'S': "target temperature, waits only when heating (°C)", 'R': "target temperature, waits when heating or cooling (°C)"},
+			"M572": {'D': "extruder", 'S': "pressure advance (s)"},
+		},
+	}
+
+	FlavorBambu = &Flavor{
+		Name: "bambu",
+		Commands: commandSet(commonCommands, `G2 G3 G29 G380 M201 M203 M204 M205 M400 M412 M620-M625 M630 M710 M900 M960
+			M970 M971 M972 M973 M975 M976 M981 M982 M991 M1002 M1003 M1006`),
+		// nobody outside of Bambu knows how their firmware parses numbers, so don't take any chances
+		LeadingDotFloats:   false,
+		Arcs:               true,
+		G90ResetsExtrusion: true, // it's Marlin underneath
+		ParamMeanings: map[string]map[uint8]string{
+			"G4":   {'P': "dwell time (ms)", 'S': "dwell time (s)"},
+			"M104": {'S': "target temperature (°C)"},
+			"M106": {'P': "fan index (1 part, 2 aux, 3 chamber)", 'S': "fan speed (0-255)"},
+			"M109": {'S': "target temperature (°C)"},
+			"M900": {'K': "pressure advance factor"},
+		},
+	}
+
+	FlavorGrbl = &Flavor{
+		Name: "grbl",
+		Commands: commandSet(`G0 G1 G2 G3 G4 G10 G17 G18 G19 G20 G21 G28 G30 G38 G40 G43 G49 G53 G54-G59 G61 G80 G90 G91
+			G92 G93 G94 M0 M1 M2 M3 M4 M5 M7 M8 M9 M30 M56`),
+		LeadingDotFloats: true,
+		Arcs:             true,
+		Dialect:          DialectCNC,
+		ParamMeanings: map[string]map[uint8]string{
+			"G4":  {'P': "dwell time (s)"},
+			"G10": {'L': "what to set (2: work offset, 20: work offset to make the current position)", 'P': "coordinate system (1-6 for G54-G59)"},
+			"M3":  {'S': "spindle speed (rpm), or laser power"},
+			"M4":  {'S': "spindle speed (rpm), or laser power (dynamic in laser mode)"},
+		},
+	}
+
+	FlavorLinuxCNC = &Flavor{
+		Name: "linuxcnc",
+		Commands: commandSet(`G0 G1 G2 G3 G4 G5 G7 G8 G10 G17 G18 G19 G20 G21 G28 G30 G33 G38 G40 G41 G42 G43 G49 G53 G54-G59
+			G61 G64 G73 G76 G80-G99 M0 M1 M2 M3 M4 M5 M6 M7 M8 M9 M30 M48-M53 M60-M68 M70-M73 M100-M199`),
+		LeadingDotFloats: true,
+		Arcs:             true,
+		Dialect:          DialectCNC,
+		ParamMeanings: map[string]map[uint8]string{
+			"G4":  {'P': "dwell time (s)"},
+			"G10": {'L': "what to set (1: tool table, 2: work offset, 20: work offset to make the current position)", 'P': "tool or coordinate system"},
+			"M3":  {'S': "spindle speed (rpm)"},
+			"M6":  {'T': "tool"},
+		},
+	}
+
+	// FlavorGeneric is for when the firmware isn't known, and only allows what every firmware understands
+	FlavorGeneric = &Flavor{
+		Name:          "generic",
+		Commands:      commandSet(commonCommands),
+		ParamMeanings: map[string]map[uint8]string{"G4": {'P': "dwell time (ms)"}},
+	}
+)
+
+var flavors = map[string]*Flavor{}
+
+func init() {
+	for _, flavor := range []*Flavor{FlavorMarlin, FlavorPrusa, FlavorKlipper, FlavorRepRapFirmware, FlavorBambu, FlavorGrbl, FlavorLinuxCNC, FlavorGeneric} {
+		flavors[flavor.Name] = flavor
+	}
+	// other names that people (and slicers) use
+	flavors["rrf"] = FlavorRepRapFirmware
+	flavors["duet"] = FlavorRepRapFirmware
+	flavors["marlin2"] = FlavorMarlin
+	flavors["prusa-firmware"] = FlavorPrusa
+	flavors["bambulab"] = FlavorBambu
+	flavors["fluidnc"] = FlavorGrbl
+	flavors["grblhal"] = FlavorGrbl
+}
+
+// LookupFlavor finds a flavor by name (case insensitive)
+func LookupFlavor(name string) (*Flavor, error) {
+	if flavor, ok := flavors[strings.ToLower(name)]; ok {
+		return flavor, nil
+	}
+	return nil, fmt.Errorf("unknown firmware flavor %q (expected one of %s)", name, strings.Join(FlavorNames(), ", "))
+}
+
+// FlavorNames lists the canonical name of every flavor
+func FlavorNames() []string {
+	names := []string{}
+	for name, flavor := range flavors {
+		if flavor.Name == name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,119 @@
+package gcodetools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupFlavor(t *testing.T) {
+	flavor, err := LookupFlavor("Klipper")
+	assert.NoError(t, err)
+	assert.Equal(t, FlavorKlipper, flavor)
+	flavor, err = LookupFlavor("rrf")
+	assert.NoError(t, err)
+	assert.Equal(t, FlavorRepRapFirmware, flavor)
+	_, err = LookupFlavor("sailfish")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"bambu", "generic", "grbl", "klipper", "linuxcnc", "marlin", "prusa", "reprapfirmware"}, FlavorNames())
+}
+
+func TestFlavor_SupportsCommand(t *testing.T) {
+	assert.True(t, FlavorMarlin.SupportsCommand(mustParseLine("M900 K0.05")))
+	assert.True(t, FlavorMarlin.SupportsCommand(mustParseLine("M25")))
+	assert.True(t, FlavorMarlin.SupportsCommand(mustParseLine("; just a comment")))
+	assert.False(t, FlavorKlipper.SupportsCommand(mustParseLine("M900 K0.05")))
+	assert.True(t, FlavorRepRapFirmware.SupportsCommand(mustParseLine("M572 D0 S0.05")))
+	assert.False(t, FlavorGeneric.SupportsCommand(mustParseLine("G2 X10 Y10 I5 J5")))
+	assert.True(t, FlavorGeneric.SupportsCommand(mustParseLine("G1 X10 Y10")))
+}
+
+func TestFlavor_ParamMeaning(t *testing.T) {
+	assert.Equal(t, "fan speed (0-255)", FlavorMarlin.ParamMeaning("M106", 'S'))
+	assert.Equal(t, "fan speed (0-1, or 0-255 when greater than 1)", FlavorRepRapFirmware.ParamMeaning("m106", 'S'))
+	assert.Equal(t, "tool", FlavorRepRapFirmware.ParamMeaning("G10", 'P'))
+	assert.Equal(t, "", FlavorMarlin.ParamMeaning("G10", 'P'))
+}
+
+func TestGcodeMinifierConfig_Flavor(t *testing.T) {
+	gcodeStr := "G28\nM83\nG1 X0.5 E0.25 F1200\nM900 K0.04\n"
+
+	// Bambu's firmware might not read ".5"
+	cfg := (&GcodeMinifierConfig{Flavor: FlavorBambu}).Init()
+	output, _ := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	assert.Equal(t, "G28\nM83\nG1 X0.5 E0.25 F1200\nM900 K0.04\n", output)
+
+	cfg = (&GcodeMinifierConfig{Flavor: FlavorMarlin}).Init()
+	output, _ = cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	assert.Equal(t, "G28\nM83\nG1 X.5 E.25 F1200\nM900 K.04\n", output)
+
+	// Klipper doesn't have M900, and unknown gcode isn't allowed
+	cfg = (&GcodeMinifierConfig{Flavor: FlavorKlipper}).Init()
+	assert.Panics(t, func() { cfg.MinifyGcodeStr(MachineState{}, gcodeStr) })
+}
+
+func TestGcodeMinifierConfig_extendedCommands(t *testing.T) {
+	gcodeStr := "G28\nSET_PRESSURE_ADVANCE ADVANCE=0.040 ; pa\nEXCLUDE_OBJECT_DEFINE NAME=part_1 POLYGON=[[100.00, 100.00], [120.00, 100.00]]\n"
+
+	cfg := (&GcodeMinifierConfig{Flavor: FlavorKlipper, RemoveComments: true}).Init()
+	output, _ := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	assert.Equal(t, "G28\nSET_PRESSURE_ADVANCE ADVANCE=0.040\nEXCLUDE_OBJECT_DEFINE NAME=part_1 POLYGON=[[100.00, 100.00], [120.00, 100.00]]\n", output)
+
+	cfg = (&GcodeMinifierConfig{Flavor: FlavorMarlin}).Init()
+	assert.Panics(t, func() { cfg.MinifyGcodeStr(MachineState{}, gcodeStr) })
+}
+
+func TestGcodeMinifierConfig_metaCommands(t *testing.T) {
+	gcodeStr := `G28
+G1 X10 Y10 F3000
+var offset = 5 ; how far to move
+if move.axes[0].homed
+  G1 X10 Y10 ; this could be anywhere
+
+  while iterations < 2
+    G1 X{10 + var.offset}
+else
+	M291 P"not homed; oops" S1
+G1 X10 Y10
+G1 X{var.offset} Y10
+G1 X20 Y10
+`
+	cfg := (&GcodeMinifierConfig{Flavor: FlavorRepRapFirmware, RemoveComments: true}).Init()
+	output, state := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	assert.Equal(t, `G28
+G1 X10 Y10 F3000
+var offset = 5 ; how far to move
+if move.axes[0].homed
+  G1 X10 Y10 ; this could be anywhere
+  while iterations < 2
+    G1 X{10 + var.offset}
+else
+	M291 P"not homed; oops" S1
+G1 X10 Y10
+G1 Y10 X{var.offset}
+G1 X20
+`, output)
+	assert.Equal(t, 20.0, state.X)
+
+	cfg = (&GcodeMinifierConfig{Flavor: FlavorMarlin}).Init()
+	assert.Panics(t, func() { cfg.MinifyGcodeStr(MachineState{}, gcodeStr) })
+}
+
+func TestGcodeMinifierConfig_arcsUpdateState(t *testing.T) {
+	cfg := (&GcodeMinifierConfig{Flavor: FlavorMarlin}).Init()
+	gcodeStr := "G28\nG1 X10 Y0\nG2 X20 Y0 I5 J0\nG1 X10 Y0\n"
+	output, state := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	// the last move goes back to where the arc started, so it mustn't be dropped
+	assert.Equal(t, "G28\nG1 X10\nG2 X20 Y0 I5 J0\nG1 X10\n", output)
+	assert.Equal(t, 10.0, state.X)
+}
+
+func TestLint_flavor(t *testing.T) {
+	profile := DefaultPrinterProfile
+	profile.Flavor = "klipper"
+	issues, err := Lint(LintConfig{Profile: &profile}, strings.NewReader("G28\nM900 K0.04\nM204 S1000\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"unknown-command@2"}, lintRules(issues))
+	assert.Equal(t, "klipper doesn't support M900 K0.04", issues[0].Message)
+}
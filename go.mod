@@ -4,10 +4,12 @@ go 1.15
 
 require (
 	github.com/go-gl/mathgl v1.0.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/lithammer/dedent v1.1.0
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/spf13/viper v1.4.0
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a
 )
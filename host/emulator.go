@@ -0,0 +1,310 @@
+package host
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/madewithlinux/gcodetools"
+)
+
+// keepaliveSeconds is how often Marlin says busy: while it's in the middle of a command (DEFAULT_KEEPALIVE_INTERVAL)
+const keepaliveSeconds = 2
+
+// EmulatorConfig is how an Emulator behaves
+type EmulatorConfig struct {
+	Limits gcodetools.KinematicLimits
+	// TimeScale is how long a second of the printer's time takes: 1 is real time, 0.1 is ten times as fast, and 0
+	// doesn't wait at all
+	TimeScale float64
+	// PlannerDepth is how many moves can be planned ahead of the one that's running, like Marlin's BLOCK_BUFFER_SIZE.
+	// Defaults to 16
+	PlannerDepth int
+	// ResendEvery pretends that every so many numbered lines arrive garbled, so that the host has to send them again.
+	// 0 never does
+	ResendEvery int
+}
+
+func (cfg *EmulatorConfig) init() {
+	if cfg.PlannerDepth <= 0 {
+		cfg.PlannerDepth = 16
+	}
+}
+
+// Emulator acts like a printer running Marlin, on the other side of a serial port (usually a pty), so that hosts can
+// be tested without a printer. It's driven by a GcodeVirtualMachine: moves take as long as the time estimator says,
+// and heaters heat up and cool down over time.
+type Emulator struct {
+	cfg    EmulatorConfig
+	marlin *gcodetools.Flavor
+	out    io.Writer
+
+	mu sync.Mutex
+	vm *gcodetools.GcodeVirtualMachine
+	// start is when the emulator started, and startTime is the machine's time then
+	start     time.Time
+	startTime float64
+	// planned are the times at which each of the planned moves finish
+	planned  []float64
+	lastLine int
+	// numbered is how many numbered lines have been received
+	numbered int
+}
+
+// NewEmulator makes an emulated printer, with every heater at the ambient temperature
+func NewEmulator(cfg EmulatorConfig) *Emulator {
+	cfg.init()
+	vm := gcodetools.NewGcodeVirtualMachine(cfg.Limits)
+	vm.State.G90ResetsExtrusion = gcodetools.FlavorMarlin.G90ResetsExtrusion
+	return &Emulator{
+		cfg:    cfg,
+		marlin: gcodetools.FlavorMarlin,
+		vm:     vm,
+	}
+}
+
+// State is the emulated printer's state
+func (e *Emulator) State() gcodetools.MachineState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.vm.State
+}
+
+// Run talks to a host over port, until reading from it fails
+func (e *Emulator) Run(port io.ReadWriter) error {
+	e.out = port
+	e.start = time.Now()
+	e.startTime = e.vm.Time
+	e.reply("start")
+	scanner := bufio.NewScanner(port)
+	for scanner.Scan() {
+		if text := strings.TrimSpace(scanner.Text()); text != "" {
+			e.handle(text)
+		}
+	}
+	return scanner.Err()
+}
+
+func (e *Emulator) reply(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(e.out, format+"\n", args...)
+}
+
+// requestResend rejects a line, and asks for the one after the last one that was accepted
+func (e *Emulator) requestResend(reason string) {
+	e.reply("Error:%s, Last Line: %d", reason, e.lastLine)
+	e.reply("Resend: %d", e.lastLine+1)
+	e.reply("ok")
+}
+
+func (e *Emulator) handle(text string) {
+	e.catchUp()
+	line, err := gcodetools.ParseLine(text)
+	if _, ok := err.(*gcodetools.ChecksumError); ok {
+		e.requestResend("checksum mismatch")
+		return
+	} else if err != nil {
+		e.reply("echo:Unknown command: %q", text)
+		e.reply("ok")
+		return
+	}
+
+	if line.LineNumberValid {
+		if line.IsM(110) {
+			e.lastLine = line.LineNumber
+			if n, ok := line.NumericParams['N']; ok {
+				e.lastLine = int(n)
+			}
+			e.reply("ok")
+			return
+		}
+		if line.LineNumber != e.lastLine+1 {
+			e.requestResend("Line Number is not Last Line Number+1")
+			return
+		}
+		if !line.ChecksumValid {
+			e.requestResend("No Checksum with line number")
+			return
+		}
+		e.numbered++
+		if e.cfg.ResendEvery > 0 && e.numbered%e.cfg.ResendEvery == 0 {
+			e.requestResend("checksum mismatch")
+			return
+		}
+		e.lastLine = line.LineNumber
+	} else if line.IsM(110) {
+		e.lastLine = int(line.NumericParams['N'])
+	}
+
+	command := gcodetools.LineText(text, &line)
+	gcodetools.StripLineNumber(&line)
+	if e.run(&line, command) {
+		e.reply("ok")
+	}
+}
+
+// run runs a command (which is text, without its line number and checksum), and returns whether it still needs an ok
+// (M105 puts the temperatures after its ok)
+func (e *Emulator) run(line *gcodetools.GcodeLine, text string) bool {
+	switch {
+	case line.CommentOnly() || line.Empty():
+	case line.IsMove():
+		e.plan(line)
+	case line.IsG(4) || line.IsG(28):
+		e.synchronize()
+		e.mu.Lock()
+		seconds := e.vm.Run(line)
+		e.mu.Unlock()
+		e.waitUntil(e.now()+seconds, nil)
+	case line.IsM(109) || line.IsM(190):
+		e.synchronize()
+		e.mu.Lock()
+		e.vm.Run(line)
+		e.mu.Unlock()
+		e.waitUntil(math.Inf(1), func() {
+			e.reply(" %s W:?", e.temperatures())
+		})
+	case line.IsM(400):
+		e.synchronize()
+	case line.IsM(105):
+		e.reply("ok %s", e.temperatures())
+		return false
+	case line.IsM(114):
+		state := e.State()
+		e.reply("X:%.2f Y:%.2f Z:%.2f E:%.2f", state.X, state.Y, state.Z, state.EAbsolute)
+	case line.IsM(115):
+		e.reply("FIRMWARE_NAME:Marlin (gcodetools emulator) PROTOCOL_VERSION:1.0 MACHINE_TYPE:gcodetools EXTRUDER_COUNT:1")
+	default:
+		if !e.marlin.SupportsCommand(line) {
+			e.reply("echo:Unknown command: %q", text)
+		}
+		e.mu.Lock()
+		e.vm.Run(line)
+		e.mu.Unlock()
+	}
+	return true
+}
+
+// temperatures is how Marlin reports temperatures, like T:200.00 /200.00 B:60.00 /60.00 @:0 B@:0
+func (e *Emulator) temperatures() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	tool := e.vm.State.Tool
+	return fmt.Sprintf("T:%.2f /%.2f B:%.2f /%.2f @:0 B@:0", e.vm.HotendTemperatures[tool], e.vm.HotendTarget(tool),
+		e.vm.BedTemperature, e.vm.State.BedTemperature)
+}
+
+// now is the machine's time
+func (e *Emulator) now() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.vm.Time
+}
+
+// plan adds a move to the planner, once there is room for it
+func (e *Emulator) plan(line *gcodetools.GcodeLine) {
+	now := e.now()
+	for len(e.planned) > 0 && e.planned[0] <= now {
+		e.planned = e.planned[1:]
+	}
+	if len(e.planned) >= e.cfg.PlannerDepth {
+		e.waitUntil(e.planned[0], nil)
+		e.planned = e.planned[1:]
+		now = e.now()
+	}
+	e.mu.Lock()
+	seconds := e.vm.Run(line)
+	e.mu.Unlock()
+	if seconds > 0 {
+		start := now
+		if len(e.planned) > 0 {
+			start = e.planned[len(e.planned)-1]
+		}
+		e.planned = append(e.planned, start+seconds)
+	}
+}
+
+// synchronize waits for every planned move to finish, like Marlin's planner.synchronize()
+func (e *Emulator) synchronize() {
+	if len(e.planned) > 0 {
+		e.waitUntil(e.planned[len(e.planned)-1], nil)
+		e.planned = nil
+	}
+}
+
+// catchUp lets the machine's time pass for as long as the emulator was waiting for the host
+func (e *Emulator) catchUp() {
+	if e.cfg.TimeScale <= 0 {
+		return
+	}
+	elapsed := time.Since(e.start).Seconds() / e.cfg.TimeScale
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if behind := e.startTime + elapsed - e.vm.Time; behind > 0 {
+		e.vm.Advance(behind)
+	}
+}
+
+// waitUntil lets time pass until the machine's time is until, or until it isn't waiting for a heater any more when
+// until is infinite. report is called every second (for temperature reports), and otherwise the printer says
+// busy: every keepaliveSeconds.
+func (e *Emulator) waitUntil(until float64, report func()) {
+	interval := float64(keepaliveSeconds)
+	if report != nil {
+		interval = 1
+	} else {
+		report = func() {
+			e.reply("echo:busy: processing")
+		}
+	}
+	lastReport := e.now()
+	for {
+		e.mu.Lock()
+		now, waiting := e.vm.Time, e.vm.Waiting()
+		e.mu.Unlock()
+		if (math.IsInf(until, 1) && !waiting) || (!math.IsInf(until, 1) && now >= until) {
+			return
+		}
+		step := math.Min(until-now, lastReport+interval-now)
+		if e.cfg.TimeScale > 0 {
+			time.Sleep(time.Duration(step * e.cfg.TimeScale * float64(time.Second)))
+		}
+		e.mu.Lock()
+		e.vm.Advance(step)
+		now = e.vm.Time
+		e.mu.Unlock()
+		if now-lastReport >= interval-1e-9 {
+			report()
+			lastReport = now
+		}
+	}
+}
+
+// pipePort is one end of an in-memory connection
+type pipePort struct {
+	io.Reader
+	io.Writer
+}
+
+type pipeCloser []*io.PipeWriter
+
+func (p pipeCloser) Close() error {
+	for _, writer := range p {
+		_ = writer.Close()
+	}
+	return nil
+}
+
+// Pipe connects a Host to the emulator in memory, rather than over a pty. The host still has to Connect.
+// Closing the returned io.Closer disconnects them, and stops the emulator.
+func (e *Emulator) Pipe(cfg Config) (*Host, io.Closer) {
+	hostReader, emulatorWriter := io.Pipe()
+	emulatorReader, hostWriter := io.Pipe()
+	go func() {
+		_ = e.Run(pipePort{emulatorReader, emulatorWriter})
+	}()
+	return New(pipePort{hostReader, hostWriter}, cfg), pipeCloser{hostWriter, emulatorWriter}
+}
@@ -0,0 +1,117 @@
+package host
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func newEmulatedHost(t *testing.T, emulator *Emulator, cfg Config) *Host {
+	pty, name, err := OpenPty()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	port, err := OpenSerial(name, 250000)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		_ = port.Close()
+		_ = pty.Close()
+	})
+	go func() {
+		_ = emulator.Run(pty)
+	}()
+
+	cfg.Checksums = true
+	cfg.ConnectWait = time.Second
+	h := New(port, cfg)
+	assert.NoError(t, h.Connect(context.Background()))
+	return h
+}
+
+func TestEmulator_send(t *testing.T) {
+	emulator := NewEmulator(EmulatorConfig{Limits: gcodetools.DefaultPrinterProfile.Limits, ResendEvery: 7, PlannerDepth: 4})
+	var messages []string
+	h := newEmulatedHost(t, emulator, Config{
+		BufferDepth: 4,
+		Messages: func(message string) {
+			messages = append(messages, message)
+		},
+	})
+	file, _ := testFile(200)
+	assert.NoError(t, h.Send(context.Background(), strings.NewReader("G28\n"+file)))
+
+	// every line ran exactly once
+	state := emulator.State()
+	assert.InDelta(t, 20, state.Extruded, 1e-9)
+	assert.Equal(t, 99.0, state.X)
+	assert.Equal(t, 14.0, state.Y)
+	assert.True(t, state.IsHomed)
+	assert.Empty(t, messages)
+}
+
+func TestEmulator_commands(t *testing.T) {
+	emulator := NewEmulator(EmulatorConfig{})
+	h := newEmulatedHost(t, emulator, Config{})
+	command := func(str string) []string {
+		responses, err := h.Command(context.Background(), str)
+		assert.NoError(t, err)
+		return responses
+	}
+
+	assert.Equal(t, []string{"ok T:25.00 /0.00 B:25.00 /0.00 @:0 B@:0"}, command("M105"))
+	command("G1 X10 Y20 Z0.3 E5")
+	assert.Equal(t, []string{"X:10.00 Y:20.00 Z:0.30 E:5.00", "ok"}, command("M114"))
+	assert.Equal(t, []string{`echo:Unknown command: "M9999"`, "ok"}, command("M9999"))
+	assert.Equal(t, []string{`echo:Unknown command: "M9999 S1.50 Hello"`, "ok"}, command("M9999 S1.50 Hello ; comment"))
+	assert.Equal(t, []string{"ok"}, command("M117 Printing (50%"))
+	assert.Equal(t, []string{"ok"}, command("M118 [done"))
+	assert.Equal(t, []string{"ok"}, command(`M117 6" part`))
+	assert.True(t, strings.HasPrefix(command("M115")[0], "FIRMWARE_NAME:Marlin"))
+
+	// heating reports the temperature every second until it gets there
+	command("M140 S60")
+	responses := command("M109 S200")
+	assert.True(t, len(responses) > 60, "%d responses", len(responses))
+	assert.True(t, strings.HasPrefix(responses[0], "T:29.00 /200.00 B:25.5"), responses[0])
+	assert.Equal(t, "ok", responses[len(responses)-1])
+	assert.True(t, strings.HasPrefix(command("M105")[0], "ok T:199."))
+}
+
+func TestEmulator_timing(t *testing.T) {
+	emulator := NewEmulator(EmulatorConfig{TimeScale: 0.05})
+	h := newEmulatedHost(t, emulator, Config{Timeout: time.Second})
+	start := time.Now()
+	// 2 seconds of dwelling take 100ms
+	assert.NoError(t, h.Send(context.Background(), strings.NewReader("G4 S1\nG4 P1000\n")))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "took %v", time.Since(start))
+	assert.True(t, time.Since(start) < time.Second, "took %v", time.Since(start))
+}
+
+func TestEmulator_Pipe(t *testing.T) {
+	emulator := NewEmulator(EmulatorConfig{})
+	h, closer := emulator.Pipe(Config{Checksums: true, ConnectWait: time.Second})
+	defer closer.Close()
+	assert.NoError(t, h.Connect(context.Background()))
+	assert.NoError(t, h.Send(context.Background(), strings.NewReader("M104 S200\nG1 X5\n")))
+	assert.Equal(t, 5.0, emulator.State().X)
+	assert.Equal(t, int64(len("M104 S200\nG1 X5\n")), h.FilePosition())
+
+	_, err := h.Command(context.Background(), "M105")
+	assert.NoError(t, err)
+	assert.Equal(t, Temperatures{Tools: []Temperature{{25, 200}}, Bed: Temperature{25, 0}}, h.Temperatures())
+}
+
+func TestEmulator_noChecksums(t *testing.T) {
+	// Marlin won't take numbered lines without checksums
+	h, closer := NewEmulator(EmulatorConfig{}).Pipe(Config{})
+	defer closer.Close()
+	assert.NoError(t, h.Connect(context.Background()))
+	err := h.Send(context.Background(), strings.NewReader("G1 X5\n"))
+	assert.EqualError(t, err, "the printer asked for line 1 11 times in a row")
+}
@@ -0,0 +1,591 @@
+// Package host streams gcode to a printer over a serial port, the way that a print host (like OctoPrint or Pronterface)
+// does. Every line is numbered and checksummed, only as many lines as the printer's command buffer can hold are sent
+// ahead of it acknowledging them, and lines that the printer asks for again are resent.
+package host
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/madewithlinux/gcodetools"
+)
+
+// ErrCancelled is returned by Send when the print was cancelled
+var ErrCancelled = errors.New("print cancelled")
+
+// resendHistory is how many of the lines that were sent last are kept, in case the printer asks for them again
+const resendHistory = 128
+
+// maxResends is how many times in a row a line is resent before giving up on it
+const maxResends = 10
+
+// Config is how a Host talks to the printer
+type Config struct {
+	Dialect gcodetools.Dialect
+	// BufferDepth is how many lines can be sent before the printer has acknowledged them. Marlin's command buffer
+	// holds 4 by default, but 1 (waiting for every ok) is the safe choice, and the default.
+	BufferDepth int
+	// Checksums is whether to add a checksum to every line, as well as a line number
+	Checksums bool
+	// Timeout is how long the printer can go without saying anything while it has lines to acknowledge. Printers
+	// send busy: messages during long commands (like homing or heating) to show that they are still there.
+	// Defaults to 30 seconds
+	Timeout time.Duration
+	// ConnectWait is how long Connect waits for the printer to start up (or say "start") before talking to it.
+	// Opening a serial port resets most printer boards.
+	ConnectWait time.Duration
+	// Messages is called with everything that the printer says, other than acknowledgements, resend requests and
+	// busy: messages. It's called from the goroutine that is sending.
+	Messages func(message string)
+}
+
+func (cfg *Config) init() {
+	if cfg.BufferDepth <= 0 {
+		cfg.BufferDepth = 1
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+}
+
+// sentLine is a line that was sent to the printer, and hasn't been acknowledged yet
+type sentLine struct {
+	lineNumber int
+	historyLine
+	// rejected is a line that the printer will acknowledge without running, because it asked for an earlier line
+	// to be resent
+	rejected bool
+}
+
+// historyLine is a line that was sent, as it was sent
+type historyLine struct {
+	text    string
+	line    gcodetools.GcodeLine
+	command *pendingCommand // nil for lines of a file
+}
+
+// pendingCommand is a line sent by Command, which is waiting for the printer to run it
+type pendingCommand struct {
+	line      gcodetools.GcodeLine
+	text      string
+	responses []string
+	err       error
+	done      chan struct{}
+	// finished is whether done has been closed. A command can still be sent again after that, if the printer asks for
+	// it again after the host gave up on it
+	finished bool
+}
+
+// respond adds a response from the printer, unless the command has already finished
+func (c *pendingCommand) respond(response string) {
+	if !c.finished {
+		c.responses = append(c.responses, response)
+	}
+}
+
+// finish closes done, the first time that it's called
+func (c *pendingCommand) finish(err error) {
+	if c.finished {
+		return
+	}
+	c.finished = true
+	c.err = err
+	close(c.done)
+}
+
+// Host sends gcode to a printer. A file can be sent with Send (and paused, resumed or cancelled from other
+// goroutines), and single commands can be sent with Command at any time, even in the middle of a file.
+type Host struct {
+	cfg  Config
+	port io.Writer
+
+	responses chan string
+	readErr   chan error
+	// runner is held by whichever goroutine is talking to the printer
+	runner chan struct{}
+	wake   chan struct{}
+
+	mu           sync.Mutex
+	paused       bool
+	cancelled    bool
+	queue        []*pendingCommand
+	temperatures Temperatures
+	filePosition int64
+	// state is the machine's state after every line that the printer has acknowledged
+	state gcodetools.MachineState
+
+	// everything below is only used by the goroutine that holds runner
+	numberer gcodetools.LineNumberer
+	history  map[int]historyLine
+	// next is the line number of the next line to send. It's behind numberer.Next while lines are being resent
+	next     int
+	inFlight []sentLine
+	// acknowledged is whether the printer has said ok since Connect
+	acknowledged bool
+	// resends is how many times in a row the printer has asked for lastResend
+	lastResend int
+	resends    int
+}
+
+// New makes a Host that talks to a printer over port (which is usually from OpenSerial). It starts reading from port
+// straight away. Connect should be called before anything is sent.
+func New(port io.ReadWriter, cfg Config) *Host {
+	cfg.init()
+	h := &Host{
+		cfg:       cfg,
+		port:      port,
+		responses: make(chan string, 64),
+		readErr:   make(chan error, 1),
+		runner:    make(chan struct{}, 1),
+		wake:      make(chan struct{}, 1),
+		numberer:  gcodetools.LineNumberer{Checksums: cfg.Checksums},
+		history:   map[int]historyLine{},
+	}
+	go h.read(port)
+	return h
+}
+
+func (h *Host) read(port io.Reader) {
+	reader := bufio.NewReader(port)
+	for {
+		response, err := reader.ReadString('\n')
+		if response = strings.TrimSpace(response); response != "" {
+			h.responses <- response
+		}
+		if err != nil {
+			h.readErr <- err
+			return
+		}
+	}
+}
+
+// Connect waits for the printer to start up, then resets its line number, so that numbering starts from 0
+func (h *Host) Connect(ctx context.Context) error {
+	h.runner <- struct{}{}
+	if h.cfg.ConnectWait > 0 {
+		timer := time.NewTimer(h.cfg.ConnectWait)
+	wait:
+		for {
+			select {
+			case response := <-h.responses:
+				if response == "start" {
+					timer.Stop()
+					break wait
+				}
+				h.message(response)
+			case <-timer.C:
+				break wait
+			case <-ctx.Done():
+				h.release()
+				return ctx.Err()
+			}
+		}
+	}
+	h.numberer.Next = 0
+	h.next = 0
+	h.history = map[int]historyLine{}
+	h.inFlight = nil
+	h.acknowledged = false
+	h.release()
+
+	_, err := h.Command(ctx, "M110 N0")
+	return err
+}
+
+func (h *Host) release() {
+	h.mu.Lock()
+	<-h.runner
+	h.mu.Unlock()
+}
+
+// Pause stops sending the file. Lines that were already sent still run, and commands can still be sent.
+func (h *Host) Pause() {
+	h.mu.Lock()
+	h.paused = true
+	h.mu.Unlock()
+	h.wakeUp()
+}
+
+// Resume carries on sending the file after Pause
+func (h *Host) Resume() {
+	h.mu.Lock()
+	h.paused = false
+	h.mu.Unlock()
+	h.wakeUp()
+}
+
+// Paused is whether the file is paused
+func (h *Host) Paused() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.paused
+}
+
+// Cancel stops sending the file. Send returns ErrCancelled once the printer has acknowledged the lines that it
+// already has.
+func (h *Host) Cancel() {
+	h.mu.Lock()
+	h.cancelled = true
+	h.mu.Unlock()
+	h.wakeUp()
+}
+
+func (h *Host) wakeUp() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Temperatures are the temperatures that the printer reported last
+func (h *Host) Temperatures() Temperatures {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	temperatures := h.temperatures
+	temperatures.Tools = append([]Temperature(nil), temperatures.Tools...)
+	return temperatures
+}
+
+// FilePosition is how many bytes of the file that's being sent (or that was sent last) have been sent so far
+func (h *Host) FilePosition() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.filePosition
+}
+
+// State is the machine's state after every line that the printer has acknowledged so far
+func (h *Host) State() gcodetools.MachineState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// Send streams a file to the printer, and returns once the printer has acknowledged all of it. Comments and empty
+// lines aren't sent, and any line numbers and checksums in the file are replaced.
+func (h *Host) Send(ctx context.Context, r io.Reader) error {
+	h.runner <- struct{}{}
+	h.mu.Lock()
+	h.paused = false
+	h.cancelled = false
+	h.filePosition = 0
+	h.mu.Unlock()
+
+	scanner := gcodetools.NewLineScanner(r)
+	lineNumber := 0
+	return h.run(ctx, func() (line gcodetools.GcodeLine, text string, ok bool, err error) {
+		for scanner.Scan() {
+			lineNumber++
+			h.mu.Lock()
+			h.filePosition += int64(len(scanner.Bytes())) + 1
+			h.mu.Unlock()
+			line, err = h.cfg.Dialect.ParseLine(scanner.Text())
+			if err != nil {
+				return line, "", false, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			text = gcodetools.LineText(scanner.Text(), &line)
+			gcodetools.StripLineNumber(&line)
+			line.Comment = nil
+			line.InlineComments = nil
+			if !line.Empty() {
+				return line, text, true, nil
+			}
+		}
+		return line, "", false, scanner.Err()
+	})
+}
+
+// Command sends a single line to the printer, and returns everything that the printer said while running it,
+// including the ok at the end (which can have more in it, like the temperatures after an M105).
+// If a file is being sent, the command goes ahead of the rest of it, even if it's paused.
+func (h *Host) Command(ctx context.Context, str string) ([]string, error) {
+	line, err := h.cfg.Dialect.ParseLine(str)
+	if err != nil {
+		return nil, err
+	}
+	text := gcodetools.LineText(str, &line)
+	gcodetools.StripLineNumber(&line)
+	command := &pendingCommand{line: line, text: text, done: make(chan struct{})}
+
+	h.mu.Lock()
+	h.queue = append(h.queue, command)
+	runner := false
+	select {
+	case h.runner <- struct{}{}:
+		runner = true
+	default:
+		// whoever is talking to the printer sends it
+	}
+	h.mu.Unlock()
+	h.wakeUp()
+
+	if runner {
+		if err := h.run(ctx, nil); err != nil {
+			return nil, err
+		}
+	}
+	select {
+	case <-command.done:
+		return command.responses, command.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run talks to the printer until the file (if there is one) and all of the queued commands have been sent and
+// acknowledged. It has to be called holding runner, and releases it.
+func (h *Host) run(ctx context.Context, file func() (gcodetools.GcodeLine, string, bool, error)) (err error) {
+	finished := false
+	defer func() {
+		if !finished {
+			h.failCommands(err)
+		}
+	}()
+	timer := time.NewTimer(h.cfg.Timeout)
+	defer timer.Stop()
+	cancelled := false
+
+	for {
+		h.mu.Lock()
+		paused := h.paused
+		if h.cancelled && file != nil {
+			file = nil
+			cancelled = true
+		}
+		h.mu.Unlock()
+
+		for len(h.inFlight) < h.cfg.BufferDepth {
+			if h.next < h.numberer.Next {
+				if err := h.resendNext(); err != nil {
+					return err
+				}
+				continue
+			}
+			if command := h.nextCommand(); command != nil {
+				if err := h.sendLine(command.line, command.text, command); err != nil {
+					return err
+				}
+				continue
+			}
+			if file == nil || paused {
+				break
+			}
+			line, text, ok, err := file()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				file = nil
+				break
+			}
+			if err := h.sendLine(line, text, nil); err != nil {
+				return err
+			}
+		}
+
+		if len(h.inFlight) == 0 && file == nil {
+			h.mu.Lock()
+			if len(h.queue) == 0 {
+				// released while holding mu, so that a command can't be queued without anyone to send it
+				<-h.runner
+				h.mu.Unlock()
+				finished = true
+				if cancelled {
+					return ErrCancelled
+				}
+				return nil
+			}
+			h.mu.Unlock()
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(h.cfg.Timeout)
+		select {
+		case response := <-h.responses:
+			if err := h.handleResponse(response); err != nil {
+				return err
+			}
+		case err := <-h.readErr:
+			h.readErr <- err // so that anything sent after this fails too
+			return fmt.Errorf("reading from the printer: %v", err)
+		case <-h.wake:
+		case <-timer.C:
+			if len(h.inFlight) > 0 {
+				return fmt.Errorf("the printer hasn't said anything for %v", h.cfg.Timeout)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (h *Host) nextCommand() *pendingCommand {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.queue) == 0 {
+		return nil
+	}
+	command := h.queue[0]
+	h.queue = h.queue[1:]
+	return command
+}
+
+// failCommands gives up on every command that hasn't been acknowledged, and releases runner
+func (h *Host) failCommands(err error) {
+	for _, sent := range h.inFlight {
+		if sent.command != nil && !sent.rejected {
+			sent.command.finish(err)
+		}
+	}
+	h.inFlight = nil
+	for h.next < h.numberer.Next {
+		// lines waiting to be resent are lost too
+		if command := h.history[h.next].command; command != nil {
+			command.finish(err)
+		}
+		h.next++
+	}
+	h.mu.Lock()
+	queue := h.queue
+	h.queue = nil
+	<-h.runner
+	h.mu.Unlock()
+	for _, command := range queue {
+		command.finish(err)
+	}
+}
+
+// sendLine numbers a line and sends it. text is the line as it was written (from LineText), which is what's sent.
+func (h *Host) sendLine(line gcodetools.GcodeLine, text string, command *pendingCommand) error {
+	h.numberer.Number(&line)
+	sent := historyLine{text: gcodetools.NumberedText(text, &line), line: line, command: command}
+	h.history[line.LineNumber] = sent
+	delete(h.history, line.LineNumber-resendHistory)
+	h.next = h.numberer.Next
+	return h.write(line.LineNumber, sent)
+}
+
+// resendNext sends the next of the lines that the printer asked for again
+func (h *Host) resendNext() error {
+	sent, ok := h.history[h.next]
+	if !ok {
+		return fmt.Errorf("the printer asked for line %d again, which is too long ago", h.next)
+	}
+	h.next++
+	return h.write(h.next-1, sent)
+}
+
+func (h *Host) write(lineNumber int, sent historyLine) error {
+	h.inFlight = append(h.inFlight, sentLine{lineNumber: lineNumber, historyLine: sent})
+	if _, err := io.WriteString(h.port, sent.text+"\n"); err != nil {
+		return fmt.Errorf("writing to the printer: %v", err)
+	}
+	return nil
+}
+
+// handleResponse deals with a line from the printer. Everything that the printer says is about the oldest line
+// that it hasn't acknowledged yet.
+func (h *Host) handleResponse(response string) error {
+	if temperatures, ok := parseTemperatures(response); ok {
+		h.mu.Lock()
+		h.temperatures = temperatures
+		h.mu.Unlock()
+	}
+
+	var sent *sentLine
+	if len(h.inFlight) > 0 {
+		sent = &h.inFlight[0]
+	}
+
+	if strings.HasPrefix(response, "ok") {
+		if sent == nil {
+			// an ok that turned up late, after a timeout
+			return nil
+		}
+		h.acknowledged = true
+		if !sent.rejected {
+			h.resends = 0
+			h.mu.Lock()
+			h.state.Apply(&sent.line)
+			h.mu.Unlock()
+			if sent.command != nil {
+				sent.command.respond(response)
+				sent.command.finish(nil)
+			}
+		}
+		h.inFlight = h.inFlight[1:]
+		return nil
+	}
+	if lineNumber, ok := parseResend(response); ok {
+		// the printer rejects every line after the one that it wants, and asks for it again each time
+		if sent != nil && !sent.rejected {
+			if lineNumber == h.lastResend && h.resends > 0 {
+				h.resends++
+			} else {
+				h.lastResend = lineNumber
+				h.resends = 1
+			}
+			if h.resends > maxResends {
+				return fmt.Errorf("the printer asked for line %d %d times in a row", lineNumber, h.resends)
+			}
+			for i := range h.inFlight {
+				h.inFlight[i].rejected = true
+			}
+			h.next = lineNumber
+		}
+		return nil
+	}
+	if strings.Contains(response, "busy:") {
+		return nil
+	}
+	if strings.HasPrefix(response, "Error:") && strings.Contains(response, "Last Line") {
+		// about a line number or checksum, and there's a resend request after it
+		return nil
+	}
+
+	if sent != nil && sent.command != nil && !sent.rejected {
+		sent.command.respond(response)
+	}
+	h.message(response)
+	switch {
+	case response == "start" && h.acknowledged:
+		return errors.New("the printer restarted")
+	case strings.HasPrefix(response, "Error:") && (strings.Contains(response, "halted") || strings.Contains(response, "kill")):
+		return fmt.Errorf("the printer stopped: %s", response)
+	}
+	return nil
+}
+
+func (h *Host) message(message string) {
+	if h.cfg.Messages != nil {
+		h.cfg.Messages(message)
+	}
+}
+
+// parseResend parses a request to resend a line, which is Resend: 123 (Marlin and RepRapFirmware) or rs N123
+// (Teacup and Repetier)
+func parseResend(response string) (lineNumber int, ok bool) {
+	var rest string
+	switch {
+	case strings.HasPrefix(response, "Resend:"):
+		rest = response[len("Resend:"):]
+	case strings.HasPrefix(response, "rs "):
+		rest = response[len("rs "):]
+	default:
+		return 0, false
+	}
+	rest = strings.TrimPrefix(strings.TrimSpace(rest), "N")
+	lineNumber, err := strconv.Atoi(rest)
+	return lineNumber, err == nil
+}
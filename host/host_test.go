@@ -0,0 +1,294 @@
+package host
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePrinter answers like Marlin does, on the other side of a pty
+type fakePrinter struct {
+	// corrupt are line numbers that arrive garbled the first time they are sent
+	corrupt map[int]bool
+	// garbled are commands that always arrive garbled
+	garbled map[string]bool
+	// busy are commands that take a while, and say busy: while they run
+	busy map[string]time.Duration
+	// echo are commands that the printer says something back to, before the ok
+	echo map[string]string
+	// silent is a printer that never answers
+	silent bool
+	delay  time.Duration
+
+	mu          sync.Mutex
+	commands    []string
+	lastLine    int
+	received    int
+	acked       int
+	maxBuffered int
+}
+
+func (p *fakePrinter) run(pty io.ReadWriter) {
+	lines := make(chan string, 100)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(pty)
+		for scanner.Scan() {
+			p.mu.Lock()
+			p.received++
+			if buffered := p.received - p.acked; buffered > p.maxBuffered {
+				p.maxBuffered = buffered
+			}
+			p.mu.Unlock()
+			lines <- scanner.Text()
+		}
+	}()
+
+	if !p.silent {
+		fmt.Fprintln(pty, "start")
+	}
+	for text := range lines {
+		if p.silent {
+			continue
+		}
+		time.Sleep(p.delay)
+		for _, response := range p.handle(text, pty) {
+			fmt.Fprintln(pty, response)
+		}
+		p.mu.Lock()
+		p.acked++
+		p.mu.Unlock()
+		fmt.Fprintln(pty, "ok")
+	}
+}
+
+func (p *fakePrinter) handle(text string, pty io.Writer) (responses []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	line, err := gcodetools.ParseLine(text)
+	if line.LineNumberValid && p.corrupt[line.LineNumber] {
+		delete(p.corrupt, line.LineNumber)
+		err = &gcodetools.ChecksumError{}
+	}
+	if p.garbled[gcodetools.LineText(text, &line)] {
+		err = &gcodetools.ChecksumError{}
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("Error:checksum mismatch, Last Line: %d", p.lastLine), fmt.Sprintf("Resend: %d", p.lastLine+1)}
+	}
+	if line.IsM(110) {
+		p.lastLine = int(line.NumericParams['N'])
+		return nil
+	}
+	if line.LineNumberValid {
+		if line.LineNumber != p.lastLine+1 {
+			return []string{fmt.Sprintf("Error:Line Number is not Last Line Number+1, Last Line: %d", p.lastLine), fmt.Sprintf("Resend: %d", p.lastLine+1)}
+		}
+		p.lastLine = line.LineNumber
+	}
+
+	command := gcodetools.LineText(text, &line)
+	p.commands = append(p.commands, command)
+	if duration, ok := p.busy[command]; ok {
+		for start := time.Now(); time.Since(start) < duration; time.Sleep(duration / 10) {
+			fmt.Fprintln(pty, "echo:busy: processing")
+		}
+	}
+	if echo, ok := p.echo[command]; ok {
+		responses = append(responses, echo)
+	}
+	return responses
+}
+
+func (p *fakePrinter) Commands() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.commands...)
+}
+
+func newTestHost(t *testing.T, printer *fakePrinter, cfg Config) *Host {
+	pty, name, err := OpenPty()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	port, err := OpenSerial(name, 250000)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		_ = port.Close()
+		_ = pty.Close()
+	})
+	go printer.run(pty)
+
+	if cfg.ConnectWait == 0 {
+		cfg.ConnectWait = time.Second
+	}
+	cfg.Checksums = true
+	h := New(port, cfg)
+	if !printer.silent {
+		assert.NoError(t, h.Connect(context.Background()))
+	}
+	return h
+}
+
+// testFile is a file to send, and the commands that the printer should get from it
+func testFile(lines int) (file string, commands []string) {
+	var buf strings.Builder
+	buf.WriteString("; a comment\nM83\n\n")
+	commands = append(commands, "M83")
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&buf, "G1 X%d Y%d E0.1 ; move %d\n", i%100, i%37, i)
+		commands = append(commands, fmt.Sprintf("G1 X%d Y%d E0.1", i%100, i%37))
+	}
+	return buf.String(), commands
+}
+
+func TestHost_Send(t *testing.T) {
+	for _, depth := range []int{1, 4} {
+		printer := &fakePrinter{delay: time.Millisecond}
+		h := newTestHost(t, printer, Config{BufferDepth: depth})
+		file, commands := testFile(100)
+		assert.NoError(t, h.Send(context.Background(), strings.NewReader(file)))
+		assert.Equal(t, commands, printer.Commands())
+		assert.True(t, printer.maxBuffered <= depth, "%d lines were buffered", printer.maxBuffered)
+		if depth > 1 {
+			assert.True(t, printer.maxBuffered > 1)
+		}
+	}
+}
+
+func TestHost_Send_resend(t *testing.T) {
+	printer := &fakePrinter{corrupt: map[int]bool{5: true, 17: true, 18: true, 40: true}}
+	h := newTestHost(t, printer, Config{BufferDepth: 4})
+	file, commands := testFile(100)
+	assert.NoError(t, h.Send(context.Background(), strings.NewReader(file)))
+	assert.Equal(t, commands, printer.Commands())
+	assert.Empty(t, printer.corrupt)
+
+	// lines that were rejected and sent again only count once
+	state := h.State()
+	assert.InDelta(t, 10, state.Extruded, 1e-9)
+	assert.Equal(t, 99.0, state.X)
+	assert.Equal(t, 25.0, state.Y)
+}
+
+func TestHost_Send_givesUp(t *testing.T) {
+	printer := &fakePrinter{garbled: map[string]bool{"G1 X10": true}}
+	h := newTestHost(t, printer, Config{BufferDepth: 4})
+	err := h.Send(context.Background(), strings.NewReader("G28\nG1 X10\nG1 X20\n"))
+	assert.EqualError(t, err, "the printer asked for line 2 11 times in a row")
+
+	// the printer still asks for the line that was given up on, and a command can only finish once
+	assert.NotPanics(t, func() {
+		for i := 0; i < 5; i++ {
+			_, _ = h.Command(context.Background(), "M105")
+		}
+	})
+}
+
+func TestHost_Send_busy(t *testing.T) {
+	printer := &fakePrinter{busy: map[string]time.Duration{"G28": 500 * time.Millisecond}}
+	h := newTestHost(t, printer, Config{Timeout: 200 * time.Millisecond})
+	assert.NoError(t, h.Send(context.Background(), strings.NewReader("G28\nG1 X10\n")))
+	assert.Equal(t, []string{"G28", "G1 X10"}, printer.Commands())
+}
+
+func TestHost_Send_timeout(t *testing.T) {
+	h := newTestHost(t, &fakePrinter{silent: true}, Config{Timeout: 100 * time.Millisecond})
+	err := h.Send(context.Background(), strings.NewReader("G28\nG1 X10\n"))
+	assert.EqualError(t, err, "the printer hasn't said anything for 100ms")
+}
+
+func TestHost_pauseAndResume(t *testing.T) {
+	printer := &fakePrinter{echo: map[string]string{"M118 E1 pause": "echo:pause"}}
+	var h *Host
+	paused := make(chan struct{})
+	h = newTestHost(t, printer, Config{
+		BufferDepth: 4,
+		Messages: func(message string) {
+			if message == "echo:pause" {
+				h.Pause()
+				close(paused)
+			}
+		},
+	})
+	file, commands := testFile(50)
+	file = "M118 E1 pause\n" + file
+	commands = append([]string{"M118 E1 pause"}, commands...)
+
+	sent := make(chan error)
+	go func() {
+		sent <- h.Send(context.Background(), strings.NewReader(file))
+	}()
+	<-paused
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, h.Paused())
+	// the lines that were already sent still run
+	before := len(printer.Commands())
+	assert.True(t, before <= 4, "%d commands ran while paused", before)
+
+	// commands still go through while paused
+	responses, err := h.Command(context.Background(), "M105")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ok"}, responses)
+	assert.Equal(t, "M105", printer.Commands()[before])
+
+	h.Resume()
+	assert.NoError(t, <-sent)
+	assert.Equal(t, append(append(commands[:before:before], "M105"), commands[before:]...), printer.Commands())
+}
+
+func TestHost_cancel(t *testing.T) {
+	printer := &fakePrinter{echo: map[string]string{"M118 E1 cancel": "echo:cancel"}}
+	var h *Host
+	h = newTestHost(t, printer, Config{
+		BufferDepth: 2,
+		Messages: func(message string) {
+			if message == "echo:cancel" {
+				h.Cancel()
+			}
+		},
+	})
+	file, _ := testFile(50)
+	err := h.Send(context.Background(), strings.NewReader("G28\nM118 E1 cancel\n"+file))
+	assert.Equal(t, ErrCancelled, err)
+	assert.Equal(t, []string{"G28", "M118 E1 cancel", "M83"}, printer.Commands())
+
+	// the host can carry on after a cancelled print
+	assert.NoError(t, h.Send(context.Background(), strings.NewReader("G1 X1\n")))
+	assert.Equal(t, "G1 X1", printer.Commands()[3])
+}
+
+func TestHost_Command(t *testing.T) {
+	printer := &fakePrinter{echo: map[string]string{"M115": "FIRMWARE_NAME:Marlin"}}
+	h := newTestHost(t, printer, Config{})
+	responses, err := h.Command(context.Background(), "M115")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"FIRMWARE_NAME:Marlin", "ok"}, responses)
+
+	// lines are sent as they were written, without their comments
+	for _, command := range []string{"M117 Printing (50% ; progress", "M118 [done", `M117 6" part`, "M117 Layer 1*", "G1 X10.000"} {
+		_, err := h.Command(context.Background(), command)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"M115", "M117 Printing (50%", "M118 [done", `M117 6" part`, "M117 Layer 1*", "G1 X10.000"}, printer.Commands())
+}
+
+func TestParseResend(t *testing.T) {
+	for response, expected := range map[string]int{"Resend: 12": 12, "Resend:3": 3, "rs N7": 7, "rs 8": 8} {
+		lineNumber, ok := parseResend(response)
+		assert.True(t, ok, response)
+		assert.Equal(t, expected, lineNumber, response)
+	}
+	_, ok := parseResend("ok")
+	assert.False(t, ok)
+}
@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package host
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenSerial opens a serial port in raw mode (8 data bits, no parity, 1 stop bit) at any baud rate, including
+// the non-standard ones that a lot of printers use, like 250000
+func OpenSerial(name string, baud int) (io.ReadWriteCloser, error) {
+	// non-blocking, so that closing the port interrupts a read
+	fd, err := unix.Open(name, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", name, err)
+	}
+	if err := makeRaw(fd, baud); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("setting up %s: %v", name, err)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// makeRaw does what cfmakeraw does, and sets the baud rate with termios2, which takes any number
+func makeRaw(fd int, baud int) error {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS2)
+	if err != nil {
+		return err
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL |
+		unix.IXON | unix.IXOFF | unix.IXANY
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+	termios.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | unix.BOTHER
+	termios.Ispeed = uint32(baud)
+	termios.Ospeed = uint32(baud)
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS2, termios)
+}
+
+// OpenPty makes a pseudo-terminal. Whatever is written to the returned file can be read from the terminal called
+// name (like /dev/pts/3), and the other way around, so a program can open name as if a printer was plugged into it.
+func OpenPty() (pty *os.File, name string, err error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		_ = unix.Close(fd)
+		return nil, "", fmt.Errorf("unlocking the pty: %v", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, "", fmt.Errorf("getting the pty's number: %v", err)
+	}
+	return os.NewFile(uintptr(fd), "/dev/ptmx"), fmt.Sprintf("/dev/pts/%d", n), nil
+}
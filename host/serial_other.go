@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package host
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var errNotLinux = errors.New("serial ports are only supported on linux")
+
+// OpenSerial opens a serial port. It's only supported on linux.
+func OpenSerial(name string, baud int) (io.ReadWriteCloser, error) {
+	return nil, errNotLinux
+}
+
+// OpenPty makes a pseudo-terminal. It's only supported on linux.
+func OpenPty() (pty *os.File, name string, err error) {
+	return nil, "", errNotLinux
+}
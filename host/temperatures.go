@@ -0,0 +1,65 @@
+package host
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Temperature is a heater's actual and target temperature. A target of 0 means that the heater is off.
+type Temperature struct {
+	Actual float64
+	Target float64
+}
+
+// Temperatures are every heater's temperature, as the printer reported them
+type Temperatures struct {
+	// Tools are the hotends, by tool number
+	Tools []Temperature
+	Bed   Temperature
+}
+
+// parseTemperatures parses a temperature report, which Marlin and RepRapFirmware write like
+// ok T:200.0 /200.0 B:60.0 /60.0 @:0 B@:0 (or with T0:, T1: and so on for more than one hotend)
+func parseTemperatures(response string) (temperatures Temperatures, ok bool) {
+	fields := strings.Fields(strings.TrimPrefix(response, "ok"))
+	for i, field := range fields {
+		colon := strings.IndexByte(field, ':')
+		if colon < 1 {
+			continue
+		}
+		name := field[:colon]
+		var heater *Temperature
+		switch {
+		case name == "B":
+			heater = &temperatures.Bed
+		case name == "T":
+			if len(temperatures.Tools) > 0 {
+				// T: before T0: is the current tool, which is repeated
+				continue
+			}
+			temperatures.Tools = []Temperature{{}}
+			heater = &temperatures.Tools[0]
+		case name[0] == 'T':
+			tool, err := strconv.Atoi(name[1:])
+			if err != nil || tool < 0 || tool > 64 {
+				continue
+			}
+			if tool >= len(temperatures.Tools) {
+				temperatures.Tools = append(temperatures.Tools, make([]Temperature, tool+1-len(temperatures.Tools))...)
+			}
+			heater = &temperatures.Tools[tool]
+		default:
+			continue
+		}
+		actual, err := strconv.ParseFloat(field[colon+1:], 64)
+		if err != nil {
+			continue
+		}
+		heater.Actual = actual
+		if i+1 < len(fields) && strings.HasPrefix(fields[i+1], "/") {
+			heater.Target, _ = strconv.ParseFloat(fields[i+1][1:], 64)
+		}
+		ok = true
+	}
+	return temperatures, ok
+}
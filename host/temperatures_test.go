@@ -0,0 +1,22 @@
+package host
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTemperatures(t *testing.T) {
+	temperatures, ok := parseTemperatures("ok T:201.5 /200.0 B:59.9 /60.0 @:127 B@:0")
+	assert.True(t, ok)
+	assert.Equal(t, Temperatures{Tools: []Temperature{{201.5, 200}}, Bed: Temperature{59.9, 60}}, temperatures)
+
+	temperatures, ok = parseTemperatures(" T:150.00 /200.00 B:25.00 /0.00 T0:150.00 /200.00 T1:24.00 /0.00 @:0 B@:0 W:?")
+	assert.True(t, ok)
+	assert.Equal(t, Temperatures{Tools: []Temperature{{150, 200}, {24, 0}}, Bed: Temperature{25, 0}}, temperatures)
+
+	_, ok = parseTemperatures("X:10.00 Y:20.00 Z:0.30 E:5.00")
+	assert.False(t, ok)
+	_, ok = parseTemperatures("ok")
+	assert.False(t, ok)
+}
@@ -0,0 +1,119 @@
+package gcodetools
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// layerZTolerance is how close extrusion has to be to a layer's Z to be part of it
+const layerZTolerance = 1e-4
+
+// LayerSegment is an extruding move, from X1/Y1 to X2/Y2
+type LayerSegment struct {
+	X1, Y1, X2, Y2 float64
+	Feedrate       float64
+}
+
+// Layer is a summary of one layer of a print: everything from its first extrusion until the first extrusion at a
+// different Z. Anything before the first extrusion of the print is part of the first layer.
+type Layer struct {
+	Index     int
+	Z         float64
+	StartLine int // 1-based
+	EndLine   int
+	// Extruded is the filament extruded on the layer (less retractions)
+	Extruded float64
+	// ExtrusionDistance is how far the nozzle moved while extruding, and TravelDistance is how far it moved otherwise
+	ExtrusionDistance float64
+	TravelDistance    float64
+	// Segments are the extruding moves
+	Segments []LayerSegment
+	// HotendTemperatures and BedTemperatures are the temperatures that were set while the layer printed, starting
+	// with the ones that were already set
+	HotendTemperatures []float64
+	BedTemperatures    []float64
+}
+
+// ExtrusionFeedrate is the average feedrate while extruding, by distance
+func (l *Layer) ExtrusionFeedrate() float64 {
+	if l.ExtrusionDistance == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, segment := range l.Segments {
+		total += math.Hypot(segment.X2-segment.X1, segment.Y2-segment.Y1) * segment.Feedrate
+	}
+	return total / l.ExtrusionDistance
+}
+
+// ReadLayers splits a print into its layers, by replaying it through machine state tracking
+func ReadLayers(dialect Dialect, r io.Reader) ([]Layer, error) {
+	state := MachineState{}
+	layers := []Layer{{Z: math.NaN(), StartLine: 1}}
+	layer := &layers[0]
+	extruding := false // whether the current layer has extruded yet
+
+	setTemperature := func(temperatures *[]float64, temperature float64) {
+		if n := len(*temperatures); n == 0 || (*temperatures)[n-1] != temperature {
+			*temperatures = append(*temperatures, temperature)
+		}
+	}
+
+	scanner := NewLineScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, err := dialect.ParseLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		if line.CommentOnly() || line.Empty() {
+			continue
+		}
+
+		before := state
+		extrusion := 0.0
+		isMove := line.IsMove()
+		if isMove {
+			extrusion = state.ExtrusionDelta(&line)
+		}
+		state.Apply(&line)
+		if !isMove {
+			if state.HotendTemperature != before.HotendTemperature || state.Tool != before.Tool {
+				setTemperature(&layer.HotendTemperatures, state.HotendTemperature)
+			}
+			if state.BedTemperature != before.BedTemperature {
+				setTemperature(&layer.BedTemperatures, state.BedTemperature)
+			}
+			continue
+		}
+
+		distance := math.Hypot(state.X-before.X, state.Y-before.Y)
+		if math.IsNaN(distance) {
+			distance = 0
+		}
+		if extrusion > 0 && distance > 0 {
+			if extruding && math.Abs(state.Z-layer.Z) > layerZTolerance {
+				layer.EndLine = lineNumber - 1
+				layers = append(layers, Layer{Index: len(layers), StartLine: lineNumber})
+				layer = &layers[len(layers)-1]
+				if before.HotendTemperature != 0 {
+					layer.HotendTemperatures = []float64{before.HotendTemperature}
+				}
+				if before.BedTemperature != 0 {
+					layer.BedTemperatures = []float64{before.BedTemperature}
+				}
+			}
+			layer.Z = state.Z
+			extruding = true
+			layer.ExtrusionDistance += distance
+			layer.Segments = append(layer.Segments, LayerSegment{before.X, before.Y, state.X, state.Y, state.Feedrate})
+		} else {
+			layer.TravelDistance += distance
+		}
+		layer.Extruded += extrusion
+	}
+	layer.EndLine = lineNumber
+	return layers, scanner.Err()
+}
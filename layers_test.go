@@ -0,0 +1,54 @@
+package gcodetools
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// squaresGcode prints a square on each layer, size mm across, with a Z hop between layers
+func squaresGcode(layers int, size float64, temperatures ...float64) string {
+	lines := []string{"; start", "M140 S60", "M104 S210", "G28", "M83"}
+	for layer := 0; layer < layers; layer++ {
+		z := 0.2 * float64(layer+1)
+		if layer < len(temperatures) && temperatures[layer] != 0 {
+			lines = append(lines, fmt.Sprintf("M104 S%v", temperatures[layer]))
+		}
+		lines = append(lines,
+			fmt.Sprintf("G0 Z%.1f F600 ; hop", z+0.4),
+			"G0 X10 Y10 F6000",
+			fmt.Sprintf("G0 Z%.1f", z),
+			fmt.Sprintf("G1 X%v E1 F1800", 10+size),
+			fmt.Sprintf("G1 Y%v E1", 10+size),
+			"G1 X10 E1",
+			"G1 Y10 E1",
+			"G1 E-1 ; retract",
+		)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestReadLayers(t *testing.T) {
+	layers, err := ReadLayers(DialectRepRap, strings.NewReader(squaresGcode(3, 20, 215, 0, 220)))
+	assert.NoError(t, err)
+	assert.Len(t, layers, 3)
+
+	assert.Equal(t, 0, layers[0].Index)
+	assert.InDelta(t, 0.2, layers[0].Z, 1e-9)
+	assert.Equal(t, 1, layers[0].StartLine)
+	assert.InDelta(t, 3, layers[0].Extruded, 1e-9)
+	assert.InDelta(t, 80, layers[0].ExtrusionDistance, 1e-9)
+	assert.Len(t, layers[0].Segments, 4)
+	assert.Equal(t, 1800.0, layers[0].ExtrusionFeedrate())
+	assert.Equal(t, []float64{210, 215}, layers[0].HotendTemperatures)
+	assert.Equal(t, []float64{60}, layers[0].BedTemperatures)
+
+	assert.InDelta(t, 0.4, layers[1].Z, 1e-9)
+	// the second layer starts with its first extrusion, after the hop and travel
+	assert.Equal(t, 18, layers[1].StartLine)
+	assert.Equal(t, 17, layers[0].EndLine)
+	// the M104 for the third layer comes before its first extrusion, so it's part of the second layer
+	assert.Equal(t, []float64{215, 220}, layers[1].HotendTemperatures)
+	assert.Equal(t, []float64{220}, layers[2].HotendTemperatures)
+}
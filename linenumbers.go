@@ -0,0 +1,128 @@
+package gcodetools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ChecksumError is returned by ParseLine when a line's checksum doesn't match the rest of the line.
+// The line is still parsed, so that a host can ask for it to be resent by its line number.
+type ChecksumError struct {
+	LineNumber int
+	Expected   uint8 // the checksum that was on the line
+	Actual     uint8 // the checksum of what was actually received
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch on line %d: expected %d, got %d", e.LineNumber, e.Expected, e.Actual)
+}
+
+// Checksum is the XOR of every byte, which is what goes after the * at the end of a line
+func Checksum(str string) uint8 {
+	var checksum uint8
+	for i := 0; i < len(str); i++ {
+		checksum ^= str[i]
+	}
+	return checksum
+}
+
+// checksumStart finds the * that starts a checksum, or returns -1 if there isn't one. Only lines with a line number
+// have a checksum, and it's nothing but digits after the last * (any other * is part of the line, like in
+// M117 Layer 1*).
+func checksumStart(str string) int {
+	if len(str) < 2 || (str[0] != 'N' && str[0] != 'n') || !isDigit(str[1]) {
+		return -1
+	}
+	star := strings.LastIndexByte(str, '*')
+	if star < 0 {
+		return -1
+	}
+	digits := strings.TrimSpace(str[star+1:])
+	if digits == "" {
+		return -1
+	}
+	for i := 0; i < len(digits); i++ {
+		if !isDigit(digits[i]) {
+			return -1
+		}
+	}
+	return star
+}
+
+// LineNumberer numbers lines for sending to a printer, the way that a host does, so that the printer can tell when a
+// line goes missing and ask for it again.
+type LineNumberer struct {
+	// Next is the line number that the next line gets
+	Next int
+	// Checksums is whether to add a checksum to every line, as well as a line number
+	Checksums bool
+}
+
+// Number adds a line number (and maybe a checksum) to line. Comments are removed, since they're never sent to the
+// printer. Empty lines aren't numbered, because they don't need to be sent at all.
+// M110 N sets the printer's line number, so the lines after it continue from there.
+func (n *LineNumberer) Number(line *GcodeLine) {
+	line.Comment = nil
+	if line.Empty() {
+		line.LineNumberValid = false
+		line.ChecksumValid = false
+		return
+	}
+	line.LineNumber = n.Next
+	if lineNumber, ok := line.NumericParams['N']; ok && line.IsM(110) {
+		line.LineNumber = int(lineNumber)
+	}
+	line.LineNumberValid = true
+	line.ChecksumValid = n.Checksums
+	n.Next = line.LineNumber + 1
+}
+
+// Reset makes a numbered M110 line that sets the printer's line number to lineNumber, and continues numbering from there.
+// Hosts send this when they connect, or after they have had to give up on resending a line.
+func (n *LineNumberer) Reset(lineNumber int) GcodeLine {
+	line := GcodeLine{CmdLetter: M, CmdNumber: 110, NumericParams: map[uint8]float64{'N': float64(lineNumber)}}
+	n.Number(&line)
+	return line
+}
+
+// StripLineNumber removes the line number and checksum from a line
+func StripLineNumber(line *GcodeLine) {
+	line.LineNumber = 0
+	line.LineNumberValid = false
+	line.Checksum = 0
+	line.ChecksumValid = false
+}
+
+// LineText is str (which was parsed into line) without its line number, checksum or comment, and otherwise exactly as
+// it was written. It's what a host sends, so that nothing changes on the way to the printer (like the text of an M117).
+// It goes by the line number and checksum that line was parsed with, so it has to be called before Number.
+func LineText(str string, line *GcodeLine) string {
+	if line.Comment != nil {
+		str = strings.TrimSuffix(str, *line.Comment)
+	}
+	str = strings.TrimSpace(str)
+	if star := strings.LastIndexByte(str, '*'); line.ChecksumValid && star >= 0 {
+		str = strings.TrimSpace(str[:star])
+	}
+	if line.LineNumberValid && (strings.HasPrefix(str, "N") || strings.HasPrefix(str, "n")) {
+		end := 1
+		for end < len(str) && isDigit(str[end]) {
+			end++
+		}
+		str = strings.TrimLeft(str[end:], " \t")
+	}
+	return str
+}
+
+// NumberedText is text (from LineText) with line's line number and checksum, from Number
+func NumberedText(text string, line *GcodeLine) string {
+	if !line.LineNumberValid {
+		return text
+	}
+	text = "N" + strconv.Itoa(line.LineNumber) + " " + text
+	if line.ChecksumValid {
+		text += "*" + strconv.Itoa(int(Checksum(text)))
+	}
+	return text
+}
@@ -0,0 +1,103 @@
+package gcodetools
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksum(t *testing.T) {
+	// from https://reprap.org/wiki/G-code#.2A:_Checksum
+	assert.Equal(t, uint8(57), Checksum("N3 T0"))
+	assert.Equal(t, uint8(125), Checksum("N0 M110 N0"))
+}
+
+func TestParseLine_lineNumbers(t *testing.T) {
+	line, err := ParseLine("N123 G1 X10*81")
+	assert.NoError(t, err)
+	assert.Equal(t, GcodeLine{CmdLetter: G, CmdNumber: 1, X: 10, Xvalid: true, LineNumber: 123, LineNumberValid: true, Checksum: 81, ChecksumValid: true}, line)
+
+	line, err = ParseLine("N0 M110 N0*125")
+	assert.NoError(t, err)
+	assert.Equal(t, GcodeLine{CmdLetter: M, CmdNumber: 110, NumericParams: map[uint8]float64{'N': 0}, LineNumber: 0, LineNumberValid: true, Checksum: 125, ChecksumValid: true}, line)
+
+	// a * in a quoted string isn't a checksum
+	line, err = ParseLine(`N10 M291 P"a*b" S1*3`)
+	assert.NoError(t, err)
+	assert.Equal(t, `"a*b"`, line.StringParams['P'])
+	assert.Equal(t, uint8(3), line.Checksum)
+
+	line, err = ParseLine("N124 G1 X10*81")
+	assert.Equal(t, &ChecksumError{LineNumber: 124, Expected: 81, Actual: Checksum("N124 G1 X10")}, err)
+	assert.Equal(t, 124, line.LineNumber)
+
+	_, err = ParseLine("N125 G1 X10*abc")
+	assert.Error(t, err)
+
+	// a * is only a checksum after a line number, and when there's nothing but digits after it
+	line, err = ParseLine("M117 Layer 1*")
+	assert.NoError(t, err)
+	assert.Equal(t, GcodeLine{CmdLetter: M, CmdNumber: 117, Text: "Layer 1*"}, line)
+	line, err = ParseLine("M117 2*3")
+	assert.NoError(t, err)
+	assert.Equal(t, GcodeLine{CmdLetter: M, CmdNumber: 117, Text: "2*3"}, line)
+	line, err = ParseLine("N5 M117 Layer 1*")
+	assert.NoError(t, err)
+	assert.Equal(t, GcodeLine{CmdLetter: M, CmdNumber: 117, Text: "Layer 1*", LineNumber: 5, LineNumberValid: true}, line)
+	line, err = ParseLine("N6 M117 Layer 1**" + fmt.Sprint(Checksum("N6 M117 Layer 1*")))
+	assert.NoError(t, err)
+	assert.Equal(t, "Layer 1*", line.Text)
+	assert.True(t, line.ChecksumValid)
+}
+
+func TestLineNumberer(t *testing.T) {
+	numberer := &LineNumberer{Checksums: true}
+	reset := numberer.Reset(0)
+	lines := []string{formatGcode(&reset, 3, 3, 5)}
+	for _, str := range []string{"G28 ; home", "", "; just a comment", "G1 X10", "M110 N100", "G1 X20"} {
+		line := mustParseLine(str)
+		numberer.Number(line)
+		if !line.Empty() {
+			lines = append(lines, formatGcode(line, 3, 3, 5))
+		}
+	}
+	assert.Equal(t, []string{"N0 M110 N0*125", "N1 G28*18", "N2 G1 X10*83", "N100 M110 N100*125", "N101 G1 X20*82"}, lines)
+	for _, str := range lines {
+		_, err := ParseLine(str)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 102, numberer.Next)
+
+	numberer = &LineNumberer{Next: 5}
+	line := mustParseLine("G1 X10")
+	numberer.Number(line)
+	assert.Equal(t, "N5 G1 X10", formatGcode(line, 3, 3, 5))
+
+	line = mustParseLine("N7 G1 X10*86")
+	StripLineNumber(line)
+	assert.Equal(t, "G1 X10", formatGcode(line, 3, 3, 5))
+}
+
+func TestLineText(t *testing.T) {
+	for str, expected := range map[string]string{
+		"G1 X10.000 ; move":             "G1 X10.000",
+		"N7 G1 X10*86":                  "G1 X10",
+		"  N8   M117 Printing (50%*21 ": "M117 Printing (50%",
+		"M117 Layer 1*":                 "M117 Layer 1*",
+		`M117 6" part`:                  `M117 6" part`,
+	} {
+		line := mustParseLine(str)
+		assert.Equal(t, expected, LineText(str, line), str)
+	}
+
+	numberer := &LineNumberer{Next: 3, Checksums: true}
+	line := mustParseLine("M117 Printing (50% ; progress")
+	text := LineText("M117 Printing (50% ; progress", line)
+	numberer.Number(line)
+	text = NumberedText(text, line)
+	assert.Equal(t, "N3 M117 Printing (50%*"+fmt.Sprint(Checksum("N3 M117 Printing (50%")), text)
+	parsed, err := ParseLine(text)
+	assert.NoError(t, err)
+	assert.Equal(t, "Printing (50%", parsed.Text)
+}
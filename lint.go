@@ -0,0 +1,224 @@
+package gcodetools
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+type LintSeverity int
+
+const (
+	SeverityOff LintSeverity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityError
+)
+
+var lintSeverityNames = []string{"off", "info", "warning", "error"}
+
+func (s LintSeverity) String() string {
+	if s < 0 || int(s) >= len(lintSeverityNames) {
+		return fmt.Sprintf("LintSeverity(%d)", int(s))
+	}
+	return lintSeverityNames[s]
+}
+
+func (s LintSeverity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *LintSeverity) UnmarshalText(text []byte) error {
+	severity, err := ParseLintSeverity(string(text))
+	if err != nil {
+		return err
+	}
+	*s = severity
+	return nil
+}
+
+func ParseLintSeverity(str string) (LintSeverity, error) {
+	for i, name := range lintSeverityNames {
+		if strings.EqualFold(str, name) {
+			return LintSeverity(i), nil
+		}
+	}
+	return SeverityOff, fmt.Errorf("unknown lint severity %q (expected one of %s)", str, strings.Join(lintSeverityNames, ", "))
+}
+
+type LintRule string
+
+const (
+	RuleParseError        LintRule = "parse-error"
+	RuleOutOfBounds       LintRule = "out-of-bounds"
+	RuleMoveBeforeHome    LintRule = "move-before-home"
+	RuleExtrudeBeforeHeat LintRule = "extrude-before-heat"
+	RuleColdExtrusion     LintRule = "cold-extrusion"
+	RuleTemperatureLimit  LintRule = "temperature-limit"
+	RuleUnknownCommand    LintRule = "unknown-command"
+	RuleEDiscontinuity    LintRule = "e-discontinuity"
+)
+
+// DefaultLintSeverities lists every rule, with how bad it is when it isn't configured otherwise
+var DefaultLintSeverities = map[LintRule]LintSeverity{
+	RuleParseError:        SeverityError,
+	RuleOutOfBounds:       SeverityError,
+	RuleMoveBeforeHome:    SeverityError,
+	RuleExtrudeBeforeHeat: SeverityWarning,
+	RuleColdExtrusion:     SeverityError,
+	RuleTemperatureLimit:  SeverityError,
+	RuleUnknownCommand:    SeverityWarning,
+	RuleEDiscontinuity:    SeverityWarning,
+}
+
+type LintIssue struct {
+	Line     int          `json:"line"` // 1-based
+	Rule     LintRule     `json:"rule"`
+	Severity LintSeverity `json:"severity"`
+	Message  string       `json:"message"`
+	Source   string       `json:"source"`
+}
+
+func (issue LintIssue) String() string {
+	return fmt.Sprintf("%d: %s: %s [%s]", issue.Line, issue.Severity, issue.Message, issue.Rule)
+}
+
+type LintConfig struct {
+	Profile *PrinterProfile
+	// Severities overrides DefaultLintSeverities, use SeverityOff to disable a rule
+	Severities map[LintRule]LintSeverity
+	// MaxEJump is the most that absolute E may jump by on a move without any XYZ motion (or go backwards by on any move) before it's reported.
+	// Defaults to 10mm, or more if the profile's retraction is longer than that.
+	MaxEJump float64
+}
+
+func (cfg *LintConfig) severity(rule LintRule) LintSeverity {
+	if severity, ok := cfg.Severities[rule]; ok {
+		return severity
+	}
+	return DefaultLintSeverities[rule]
+}
+
+// linter runs the rules over one line at a time, keeping track of the machine state in between
+type linter struct {
+	cfg     *LintConfig
+	profile *PrinterProfile
+	flavor  *Flavor
+	state   MachineState
+	issues  []LintIssue
+}
+
+func (l *linter) report(lineNumber int, source string, rule LintRule, format string, args ...interface{}) {
+	severity := l.cfg.severity(rule)
+	if severity == SeverityOff {
+		return
+	}
+	l.issues = append(l.issues, LintIssue{
+		Line:     lineNumber,
+		Rule:     rule,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+		Source:   source,
+	})
+}
+
+// Lint checks a gcode file for things that could damage the printer or ruin the print, as configured by cfg
+func Lint(cfg LintConfig, r io.Reader) ([]LintIssue, error) {
+	l := &linter{cfg: &cfg, profile: cfg.Profile}
+	if l.profile == nil {
+		l.profile = &DefaultPrinterProfile
+	}
+	l.flavor = l.profile.FirmwareFlavor()
+	l.state.G90ResetsExtrusion = l.flavor.G90ResetsExtrusion
+	if cfg.MaxEJump == 0 {
+		cfg.MaxEJump = math.Max(10, 2*l.profile.RetractLength)
+	}
+
+	scanner := NewLineScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		source := scanner.Text()
+		line, err := l.flavor.Dialect.ParseLine(source)
+		if err != nil {
+			l.report(lineNumber, source, RuleParseError, "%v", err)
+			continue
+		}
+		l.lintLine(lineNumber, source, &line)
+	}
+	return l.issues, scanner.Err()
+}
+
+func (l *linter) lintLine(lineNumber int, source string, line *GcodeLine) {
+	if line.CommentOnly() || line.Empty() {
+		return
+	}
+	state := &l.state
+	p := l.profile
+
+	if !l.flavor.SupportsCommand(line) {
+		l.report(lineNumber, source, RuleUnknownCommand, "%s doesn't support %s", l.flavor.Name, strings.TrimSpace(source))
+	}
+
+	if line.IsMove() {
+		moves := line.Xvalid || line.Yvalid || line.Zvalid
+		if moves && !state.IsHomed {
+			l.report(lineNumber, source, RuleMoveBeforeHome, "move before the printer has been homed")
+		}
+
+		extrusion := state.ExtrusionDelta(line)
+		if extrusion > 0 {
+			if state.HotendTemperature == 0 || !state.HotendWaited {
+				l.report(lineNumber, source, RuleExtrudeBeforeHeat, "extrusion before waiting for the hotend to heat up (M109)")
+			} else if state.HotendTemperature < p.MinExtrudeTemperature {
+				l.report(lineNumber, source, RuleColdExtrusion, "extrusion with the hotend set to %v°C, below the minimum of %v°C",
+					state.HotendTemperature, p.MinExtrudeTemperature)
+			}
+		}
+		if !state.RelativeExtrusion && line.Evalid {
+			if extrusion < -l.cfg.MaxEJump || (!moves && extrusion > l.cfg.MaxEJump) {
+				l.report(lineNumber, source, RuleEDiscontinuity, "E jumps from %v to %v (missing G92 E?)", state.E, line.E)
+			}
+		}
+
+		state.Apply(line)
+		if moves && state.IsHomed {
+			l.checkBounds(lineNumber, source)
+		}
+		return
+	}
+
+	if state.Apply(line) {
+		if line.IsM(104) || line.IsM(109) {
+			if state.HotendTemperature > p.MaxHotendTemperature {
+				l.report(lineNumber, source, RuleTemperatureLimit, "hotend set to %v°C, above the maximum of %v°C", state.HotendTemperature, p.MaxHotendTemperature)
+			}
+		}
+		if line.IsM(140) || line.IsM(190) {
+			if state.BedTemperature > p.MaxBedTemperature {
+				l.report(lineNumber, source, RuleTemperatureLimit, "bed set to %v°C, above the maximum of %v°C", state.BedTemperature, p.MaxBedTemperature)
+			}
+		}
+	}
+}
+
+func (l *linter) checkBounds(lineNumber int, source string) {
+	state := l.state
+	p := l.profile
+	if state.Inches {
+		// the profile is in mm
+		state.scaleLengths(MmPerInch)
+	}
+	// allow for floating point error in the gcode
+	const tolerance = 1e-6
+	if state.X < p.OriginX-tolerance || state.X > p.OriginX+p.BedSizeX+tolerance {
+		l.report(lineNumber, source, RuleOutOfBounds, "X%v is outside of the bed (%v to %v)", state.X, p.OriginX, p.OriginX+p.BedSizeX)
+	}
+	if state.Y < p.OriginY-tolerance || state.Y > p.OriginY+p.BedSizeY+tolerance {
+		l.report(lineNumber, source, RuleOutOfBounds, "Y%v is outside of the bed (%v to %v)", state.Y, p.OriginY, p.OriginY+p.BedSizeY)
+	}
+	if state.Z < -tolerance || state.Z > p.MaxZ+tolerance {
+		l.report(lineNumber, source, RuleOutOfBounds, "Z%v is outside of the build volume (0 to %v)", state.Z, p.MaxZ)
+	}
+}
@@ -0,0 +1,96 @@
+package gcodetools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lintRules(issues []LintIssue) []string {
+	rules := []string{}
+	for _, issue := range issues {
+		rules = append(rules, string(issue.Rule)+"@"+FloatToSmallestString(float64(issue.Line), 0))
+	}
+	return rules
+}
+
+func TestLint(t *testing.T) {
+	gcode := strings.Join([]string{
+		"G1 X10 Y10",       // 1: not homed yet
+		"G28",              // 2
+		"M104 S300",        // 3: too hot
+		"M104 S150",        // 4
+		"M109 S150",        // 5
+		"G1 X20 E1",        // 6: too cold
+		"M109 S210",        // 7
+		"M82",              // 8
+		"G1 X30 E2",        // 9
+		"G1 X300 E3",       // 10: off the bed
+		"G1 X30 E-50",      // 11: missing G92
+		"G92 E0",           // 12
+		"G1 X40 E1",        // 13
+		"M140 S60",         // 14
+		"M190 S120",        // 15: too hot
+		"M12345",           // 16: unknown
+		"G1 Z-1",           // 17: below the bed
+		"G1 X1b",           // 18: not gcode
+		"M117 Hello World", // 19
+	}, "\n")
+
+	profile := DefaultPrinterProfile
+	issues, err := Lint(LintConfig{Profile: &profile}, strings.NewReader(gcode))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"move-before-home@1",
+		"temperature-limit@3",
+		"cold-extrusion@6",
+		"out-of-bounds@10",
+		"e-discontinuity@11",
+		"temperature-limit@15",
+		"unknown-command@16",
+		"out-of-bounds@17",
+		"parse-error@18",
+	}, lintRules(issues))
+	assert.Equal(t, LintIssue{
+		Line:     10,
+		Rule:     RuleOutOfBounds,
+		Severity: SeverityError,
+		Message:  "X300 is outside of the bed (0 to 220)",
+		Source:   "G1 X300 E3",
+	}, issues[3])
+	assert.Equal(t, SeverityWarning, issues[4].Severity)
+
+	// rules can be turned off, or made more or less severe
+	issues, err = Lint(LintConfig{
+		Profile: &profile,
+		Severities: map[LintRule]LintSeverity{
+			RuleOutOfBounds:    SeverityOff,
+			RuleUnknownCommand: SeverityError,
+		},
+	}, strings.NewReader(gcode))
+	assert.NoError(t, err)
+	assert.NotContains(t, lintRules(issues), "out-of-bounds@10")
+	assert.Equal(t, SeverityError, issues[5].Severity)
+}
+
+func TestLint_extrudeBeforeHeat(t *testing.T) {
+	issues, err := Lint(LintConfig{}, strings.NewReader("G28\nM83\nM104 S210\nG1 X10 E1\nM109 S210\nG1 X20 E1\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"extrude-before-heat@4"}, lintRules(issues))
+}
+
+func TestLint_toolChanges(t *testing.T) {
+	// the second tool is heated, but it's never waited for
+	issues, err := Lint(LintConfig{}, strings.NewReader("G28\nM104 T1 S210\nM109 T0 S200\nG1 X10 E1\nT1\nG1 X20 E1\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"extrude-before-heat@6"}, lintRules(issues))
+}
+
+func TestParseLintSeverity(t *testing.T) {
+	severity, err := ParseLintSeverity("Warning")
+	assert.NoError(t, err)
+	assert.Equal(t, SeverityWarning, severity)
+	_, err = ParseLintSeverity("fatal")
+	assert.Error(t, err)
+}
@@ -0,0 +1,352 @@
+package gcodetools
+
+import "math"
+
+// MaxTools is how many tools (extruders) MachineState keeps track of. Bambu printers use up to T15 for AMS slots
+const MaxTools = 16
+
+// ToolState is the state of one tool (extruder and hotend).
+// EAbsolute is the firmware's own E position, which keeps counting while in relative extrusion mode (where E stays 0).
+type ToolState struct {
+	E         float64
+	EAbsolute float64
+	// Extruded is the total filament pushed through so far (less what was retracted), which isn't reset by G92
+	Extruded float64
+	// Retracted is set after a retraction (G10, or a move that only takes filament back), until the next extrusion
+	Retracted bool
+	// target temperature, 0 means off
+	HotendTemperature float64
+	// HotendWaited is set once M109 has waited for the hotend to come up to temperature
+	HotendWaited bool
+	// offsets from G10 P or M218
+	OffsetX float64
+	OffsetY float64
+	OffsetZ float64
+}
+
+// MachineState is what the printer's state is after some gcode.
+// The state of the current tool is embedded (so that E is the current tool's E), and the other tools are kept in Tools
+// until they're selected again. Relative extrusion (M82/M83) is for every tool, like it is in the firmware.
+type MachineState struct {
+	X float64
+	Y float64
+	Z float64
+	ToolState
+	Feedrate            float64
+	RelativeExtrusion   bool
+	RelativeCoordinates bool
+	IsHomed             bool
+	// G90ResetsExtrusion is whether G90 makes extrusion absolute too, which depends on the firmware (see Flavor)
+	G90ResetsExtrusion bool
+	// Plane is for arcs: 17 (XY, the default), 18 (ZX) or 19 (YZ), like G17/G18/G19
+	Plane int
+	// Inches is set by G20, and cleared by G21
+	Inches bool
+	// MotionMode is the last motion command (like "G1" or "G38.2"), which CNC gcode uses for lines that only have axis words
+	MotionMode string
+	// target temperature, 0 means off
+	BedTemperature float64
+	FanSpeed       float64 // 0 to 255, like M106 S
+	// Tool is the selected tool (T0, T1...)
+	Tool int
+	// Tools has the state of every tool other than the current one (which is in ToolState)
+	Tools [MaxTools]ToolState
+}
+
+// ToolStateOf is the state of a tool, whether or not it's the current one
+func (s *MachineState) ToolStateOf(tool int) ToolState {
+	return *s.tool(tool)
+}
+
+// tool is where the state of a tool is kept, or nil for tools that aren't tracked
+func (s *MachineState) tool(tool int) *ToolState {
+	if tool == s.Tool {
+		return &s.ToolState
+	}
+	if tool < 0 || tool >= MaxTools {
+		return nil
+	}
+	return &s.Tools[tool]
+}
+
+// paramTool is the tool given by a parameter like the T in M104 T1, or the current tool
+func (s *MachineState) paramTool(line *GcodeLine, param uint8) *ToolState {
+	if tool, ok := line.NumericParams[param]; ok {
+		return s.tool(int(tool))
+	}
+	return &s.ToolState
+}
+
+func (s *MachineState) selectTool(tool int) bool {
+	if tool < 0 || tool >= MaxTools {
+		return false
+	}
+	if tool == s.Tool {
+		return true
+	}
+	s.Tools[s.Tool] = s.ToolState
+	s.Tool = tool
+	s.ToolState = s.Tools[tool]
+	s.Tools[tool] = ToolState{}
+	if s.RelativeExtrusion {
+		s.E = 0
+	} else {
+		s.E = s.EAbsolute
+	}
+	return true
+}
+
+// Apply updates the state for a line of gcode, and reports whether the line was understood.
+// Unlike the minifier, moves are tracked exactly (there's no threshold).
+func (s *MachineState) Apply(line *GcodeLine) bool {
+	// in CNC gcode, the other commands on the line run first
+	understood := true
+	for i := range line.ExtraCmds {
+		understood = s.Apply(&line.ExtraCmds[i]) && understood
+	}
+	return s.applyCommand(line) && understood
+}
+
+func (s *MachineState) applyCommand(line *GcodeLine) bool {
+	switch {
+	case line.CommentOnly() || line.Empty():
+		return true
+	case line.IsG(0) || line.IsG(1):
+		s.applyMove(line)
+		s.MotionMode = motionMode(line)
+	case line.IsG(2) || line.IsG(3):
+		// arcs end up at their X/Y/Z like any other move, it's only the path there that's different
+		s.applyMove(line)
+		s.MotionMode = motionMode(line)
+	case line.CmdLetter == G && line.CmdNumber == 38 && line.CmdSubcodeValid:
+		// probing stops wherever the probe triggers, so the axes that it moves end up somewhere that isn't known
+		s.applyMove(line)
+		s.MotionMode = motionMode(line)
+		if line.Xvalid {
+			s.X = math.NaN()
+		}
+		if line.Yvalid {
+			s.Y = math.NaN()
+		}
+		if line.Zvalid {
+			s.Z = math.NaN()
+		}
+	case line.IsG(80): // cancel canned cycle
+		s.MotionMode = ""
+	case line.IsG(17), line.IsG(18), line.IsG(19):
+		s.Plane = int(line.CmdNumber)
+	case line.IsG(20):
+		if !s.Inches {
+			s.scaleLengths(1 / MmPerInch)
+		}
+		s.Inches = true
+	case line.IsG(21):
+		if s.Inches {
+			s.scaleLengths(MmPerInch)
+		}
+		s.Inches = false
+	case line.IsG(4): // dwell
+	case line.CmdLetter == T && !line.CmdSubcodeValid:
+		return s.selectTool(int(line.CmdNumber))
+	case line.IsG(10):
+		if _, ok := line.NumericParams['L']; ok {
+			return false // CNC work offsets
+		}
+		if _, ok := line.NumericParams['P']; !ok {
+			s.Retracted = true // firmware retraction
+			return true
+		}
+		// RepRapFirmware tool settings
+		tool := s.paramTool(line, 'P')
+		if tool == nil {
+			return false
+		}
+		s.applyToolOffsets(tool, line)
+		if temperature, ok := line.NumericParams['S']; ok {
+			tool.HotendTemperature = temperature
+		}
+	case line.IsG(11):
+		s.Retracted = false
+	case line.IsG(28):
+		s.X = 0
+		s.Y = 0
+		s.Z = 0
+		s.IsHomed = true
+	case line.IsG(90): // G90 - Absolute Positioning
+		s.RelativeCoordinates = false
+		if s.G90ResetsExtrusion {
+			s.RelativeExtrusion = false
+			s.E = s.EAbsolute
+		}
+	case line.IsG(91): // G91 - Relative Positioning
+		s.RelativeCoordinates = true
+	case line.IsG(92): // G92 - Set Position
+		if line.Xvalid {
+			s.X = line.X
+		}
+		if line.Yvalid {
+			s.Y = line.Y
+		}
+		if line.Zvalid {
+			s.Z = line.Z
+		}
+		if line.Evalid {
+			s.EAbsolute = line.E
+			if !s.RelativeExtrusion {
+				s.E = line.E
+			}
+		}
+	case line.IsM(82):
+		s.RelativeExtrusion = false
+		s.E = s.EAbsolute
+	case line.IsM(83):
+		s.RelativeExtrusion = true
+		s.E = 0
+	case line.IsM(104), line.IsM(109):
+		tool := s.paramTool(line, 'T')
+		if tool == nil {
+			return false
+		}
+		// M109 R waits for the temperature in either direction, S only waits to heat up
+		if temperature, ok := line.NumericParams['S']; ok {
+			tool.HotendTemperature = temperature
+		} else if temperature, ok := line.NumericParams['R']; ok {
+			tool.HotendTemperature = temperature
+		}
+		if line.IsM(109) {
+			tool.HotendWaited = tool.HotendTemperature > 0
+		} else if tool.HotendTemperature == 0 {
+			tool.HotendWaited = false
+		}
+	case line.IsM(140), line.IsM(190):
+		if temperature, ok := line.NumericParams['S']; ok {
+			s.BedTemperature = temperature
+		} else if temperature, ok := line.NumericParams['R']; ok {
+			s.BedTemperature = temperature
+		}
+	case line.IsM(106):
+		s.FanSpeed = 255
+		if speed, ok := line.NumericParams['S']; ok {
+			s.FanSpeed = speed
+		}
+	case line.IsM(107):
+		s.FanSpeed = 0
+	case line.IsM(218): // Marlin hotend offsets
+		tool := s.paramTool(line, 'T')
+		if tool == nil {
+			return false
+		}
+		s.applyToolOffsets(tool, line)
+	default:
+		return false
+	}
+	return true
+}
+
+var simpleMotionModes = []string{"G0", "G1", "G2", "G3"}
+
+// motionMode is how MachineState.MotionMode is written, without formatting the common ones every time
+func motionMode(line *GcodeLine) string {
+	if line.CmdLetter == G && line.CmdNumber < 4 && !line.CmdSubcodeValid {
+		return simpleMotionModes[line.CmdNumber]
+	}
+	return formatCommand(line)
+}
+
+func (s *MachineState) applyToolOffsets(tool *ToolState, line *GcodeLine) {
+	if line.Xvalid {
+		tool.OffsetX = line.X
+	}
+	if line.Yvalid {
+		tool.OffsetY = line.Y
+	}
+	if line.Zvalid {
+		tool.OffsetZ = line.Z
+	}
+}
+
+func (s *MachineState) applyMove(line *GcodeLine) {
+	if s.RelativeCoordinates {
+		if line.Xvalid {
+			s.X += line.X
+		}
+		if line.Yvalid {
+			s.Y += line.Y
+		}
+		if line.Zvalid {
+			s.Z += line.Z
+		}
+	} else {
+		if line.Xvalid {
+			s.X = line.X
+		}
+		if line.Yvalid {
+			s.Y = line.Y
+		}
+		if line.Zvalid {
+			s.Z = line.Z
+		}
+	}
+	if line.Evalid {
+		s.trackExtrusion(s.ExtrusionDelta(line))
+		if s.RelativeExtrusion {
+			s.EAbsolute += line.E
+		} else {
+			s.E = line.E
+			s.EAbsolute = line.E
+		}
+	}
+	if line.Feedrate != 0 {
+		s.Feedrate = line.Feedrate
+	}
+}
+
+// trackExtrusion keeps count of the filament used, and whether the current tool is retracted
+func (s *ToolState) trackExtrusion(delta float64) {
+	s.Extruded += delta
+	if delta < 0 {
+		s.Retracted = true
+	} else if delta > 0 {
+		s.Retracted = false
+	}
+}
+
+// scaleLengths converts everything that's in the current units, for when they change
+func (s *MachineState) scaleLengths(factor float64) {
+	s.X *= factor
+	s.Y *= factor
+	s.Z *= factor
+	s.Feedrate *= factor
+	s.ToolState.scaleLengths(factor)
+	for i := range s.Tools {
+		s.Tools[i].scaleLengths(factor)
+	}
+}
+
+func (s *ToolState) scaleLengths(factor float64) {
+	s.E *= factor
+	s.EAbsolute *= factor
+	s.Extruded *= factor
+}
+
+// forgetPosition is for when the position can't be known, like after gcode that's only run conditionally.
+// NaN never compares as equal to anything, so the next move to each axis is always kept.
+func (s *MachineState) forgetPosition() {
+	s.X = math.NaN()
+	s.Y = math.NaN()
+	s.Z = math.NaN()
+	s.E = math.NaN()
+	s.EAbsolute = math.NaN()
+	s.Feedrate = math.NaN()
+}
+
+// ExtrusionDelta is how much filament the move in line pushes through the nozzle, given the state before the move
+func (s *MachineState) ExtrusionDelta(line *GcodeLine) float64 {
+	if !line.Evalid {
+		return 0
+	}
+	if s.RelativeExtrusion {
+		return line.E
+	}
+	return line.E - s.E
+}
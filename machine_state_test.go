@@ -0,0 +1,85 @@
+package gcodetools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func applyAll(state *MachineState, gcode string) {
+	for _, str := range strings.Split(gcode, "\n") {
+		state.Apply(mustParseLine(str))
+	}
+}
+
+func TestMachineState_toolChanges(t *testing.T) {
+	state := MachineState{}
+	applyAll(&state, `G28
+M104 T1 S210
+M109 S200
+M218 T1 X25 Y0.5
+G1 X10 E5
+G1 X20 E4
+T1
+M109 S210
+G1 X30 E2
+G10
+T0
+G1 X40 E6`)
+
+	assert.Equal(t, 0, state.Tool)
+	assert.Equal(t, 6.0, state.E)
+	assert.Equal(t, 6.0, state.Extruded)
+	assert.False(t, state.Retracted)
+	assert.Equal(t, 200.0, state.HotendTemperature)
+
+	tool1 := state.ToolStateOf(1)
+	assert.Equal(t, ToolState{E: 2, EAbsolute: 2, Extruded: 2, Retracted: true, HotendTemperature: 210, HotendWaited: true, OffsetX: 25, OffsetY: 0.5}, tool1)
+	assert.Equal(t, state.ToolState, state.ToolStateOf(0))
+}
+
+func TestMachineState_toolChangesRelativeExtrusion(t *testing.T) {
+	state := MachineState{}
+	applyAll(&state, `M83
+G1 X10 E5
+T1
+G1 X20 E1
+G1 E-0.5
+T0
+G1 E1`)
+	assert.Equal(t, 0.0, state.E)
+	assert.Equal(t, 6.0, state.EAbsolute)
+	assert.Equal(t, 0.5, state.ToolStateOf(1).Extruded)
+	assert.True(t, state.ToolStateOf(1).Retracted)
+
+	// RepRapFirmware sets tool offsets and temperatures with G10 P
+	assert.True(t, state.Apply(mustParseLine("G10 P1 X-10 S215 R150")))
+	assert.Equal(t, -10.0, state.ToolStateOf(1).OffsetX)
+	assert.Equal(t, 215.0, state.ToolStateOf(1).HotendTemperature)
+	assert.False(t, state.Apply(mustParseLine("T99")))
+	assert.Equal(t, 0, state.Tool)
+}
+
+func TestMachineState_G90ResetsRelativeExtrusion(t *testing.T) {
+	state := MachineState{}
+	applyAll(&state, "M83\nG90")
+	// without G90ResetsExtrusion, like Klipper
+	assert.True(t, state.RelativeExtrusion)
+
+	state = MachineState{G90ResetsExtrusion: true}
+	applyAll(&state, `M83
+G1 X10 E5
+G91
+G1 Z1 E-1
+G90`)
+	assert.False(t, state.RelativeCoordinates)
+	// like Marlin, G90 makes extrusion absolute again
+	assert.False(t, state.RelativeExtrusion)
+	assert.Equal(t, 4.0, state.E)
+
+	applyAll(&state, `M83
+G1 X20 E1`)
+	assert.True(t, state.RelativeExtrusion)
+	assert.Equal(t, 5.0, state.EAbsolute)
+}
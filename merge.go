@@ -0,0 +1,348 @@
+package gcodetools
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// plainLineFormat writes out lines that have been changed, without minifying them (and with leading zeros, which
+// every firmware can read)
+var plainLineFormat = GcodeMinifierConfig{XYDecimals: 5, ZDecimals: 5, EDecimals: 5, Flavor: FlavorGeneric}
+
+// MergeConfig is how Merge lays out and joins up the parts of a job
+type MergeConfig struct {
+	Dialect Dialect
+	// HeadClearance is the space that the print head takes up, which mustn't reach any part that was printed before
+	HeadClearance ClearanceBox
+	// BedMin and BedMax are the front left and back right corners of the bed
+	BedMin, BedMax Point
+	// Slots are where each part's front left corner (of everything that it extrudes) goes. When there aren't any,
+	// parts are put in rows from the front left of the bed, far enough apart for the print head.
+	Slots []Point
+	// Margin is how far the parts are kept from the edge of the bed, when they're laid out. Defaults to 5
+	Margin float64
+	// Lift is how far above the tallest part the nozzle travels between parts. Defaults to 5
+	Lift float64
+	// TravelFeedrate and ZFeedrate are how fast to move between parts, in mm/min. They default to 6000 and 600
+	TravelFeedrate float64
+	ZFeedrate      float64
+	// RetractLength is how far (in mm) the filament is pulled back while moving between parts, so that it doesn't ooze
+	// (0 doesn't retract), and RetractFeedrate is how fast, in mm/min. RetractFeedrate defaults to 2100
+	RetractLength   float64
+	RetractFeedrate float64
+}
+
+func (cfg *MergeConfig) init() {
+	if cfg.Margin == 0 {
+		cfg.Margin = 5
+	}
+	if cfg.Lift == 0 {
+		cfg.Lift = 5
+	}
+	if cfg.TravelFeedrate == 0 {
+		cfg.TravelFeedrate = 6000
+	}
+	if cfg.ZFeedrate == 0 {
+		cfg.ZFeedrate = 600
+	}
+	if cfg.RetractFeedrate == 0 {
+		cfg.RetractFeedrate = 2100
+	}
+}
+
+// MergedPart is where a part of a merged job ended up
+type MergedPart struct {
+	// Offset is how far the part was moved
+	Offset Point
+	// Min and Max are the corners of everything that it extrudes (after it was moved), and Height is how tall it is
+	Min, Max Point
+	Height   float64
+}
+
+// layerChangeRegexp matches the comments that slicers write at the start of every layer: ;LAYER_CHANGE from
+// PrusaSlicer (and the slicers based on it), and ;LAYER:0 from Cura
+var layerChangeRegexp = regexp.MustCompile(`^;\s*(LAYER_CHANGE|LAYER:-?\d+)\s*$`)
+
+// mergePart is a part of a job, split into its start gcode, the part that prints it, and its end gcode
+type mergePart struct {
+	lines []string
+	// first and last are the indexes of its first and last extruding moves
+	first, last int
+	min, max    Point
+	height      float64
+	// start is the state before the first extruding move, and end is the state after the last one
+	start, end MachineState
+}
+
+func readMergePart(dialect Dialect, gcode string) (*mergePart, error) {
+	part := &mergePart{
+		lines: strings.Split(strings.TrimSuffix(gcode, "\n"), "\n"),
+		first: -1,
+		min:   Point{math.Inf(1), math.Inf(1)},
+		max:   Point{math.Inf(-1), math.Inf(-1)},
+	}
+	from := partStartLine(dialect, gcode, part.lines)
+	state := MachineState{}
+	for i, lineStr := range part.lines {
+		line, err := dialect.ParseLine(lineStr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if i < from {
+			// the start gcode, which can extrude too (like a purge line)
+			state.Apply(&line)
+			continue
+		}
+		before := state
+		isMove := line.IsMove()
+		extrusion := 0.0
+		if isMove {
+			extrusion = state.ExtrusionDelta(&line)
+		}
+		state.Apply(&line)
+		if state.Inches {
+			return nil, fmt.Errorf("line %d: parts in inches can't be merged", i+1)
+		}
+		if !isMove || extrusion <= 0 || (state.X == before.X && state.Y == before.Y) {
+			continue
+		}
+		if part.first < 0 {
+			part.first = i
+			part.start = before
+		}
+		part.last = i
+		part.end = state
+		for _, p := range []Point{{before.X, before.Y}, {state.X, state.Y}} {
+			part.min = Point{math.Min(part.min.X, p.X), math.Min(part.min.Y, p.Y)}
+			part.max = Point{math.Max(part.max.X, p.X), math.Max(part.max.Y, p.Y)}
+		}
+		part.height = math.Max(part.height, state.Z)
+	}
+	if part.first < 0 {
+		return nil, fmt.Errorf("it doesn't print anything")
+	}
+	return part, nil
+}
+
+// partStartLine is the index of the line that a part starts from, after its start gcode: the first layer change
+// that the slicer marked, or when there aren't any marks, the start of the first object (see FindObjects), so that
+// anything that's only extruded on the first layer before it (like a purge line) is left with the start gcode
+func partStartLine(dialect Dialect, gcode string, lines []string) int {
+	for i, lineStr := range lines {
+		if layerChangeRegexp.MatchString(strings.TrimSpace(lineStr)) {
+			return i
+		}
+	}
+	objects, err := FindObjects(dialect, gcode)
+	if err != nil {
+		// reading the part will find out what's wrong with it
+		return 0
+	}
+	from := len(lines)
+	for _, section := range objects.Sections {
+		if section.StartLine-1 < from {
+			from = section.StartLine - 1
+		}
+	}
+	return from
+}
+
+// Merge joins several prints into one job that prints them one after another, each in its own slot on the bed.
+// The job starts with the first part's start gcode and ends with the last part's end gcode: the start and end gcode
+// of the others is left out. A part starts at its first layer (see partStartLine), so a purge line in its start gcode
+// is neither moved nor counted as part of it. In between parts the filament is retracted, the nozzle is raised above
+// everything that has been printed and moves to the next part, and the temperatures, E (with G92), the fan and so on
+// are set for it.
+//
+// It fails when the print head or gantry would hit a part that has already been printed: the print head
+// (HeadClearance) can't reach any earlier part while printing a later one, and every part but the last has to be
+// lower than the gantry.
+func Merge(cfg MergeConfig, parts []string, w io.Writer) ([]MergedPart, error) {
+	cfg.init()
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("there's nothing to merge")
+	}
+	if len(cfg.Slots) != 0 && len(cfg.Slots) != len(parts) {
+		return nil, fmt.Errorf("there are %d slots for %d parts", len(cfg.Slots), len(parts))
+	}
+	read := make([]*mergePart, len(parts))
+	for i, gcode := range parts {
+		part, err := readMergePart(cfg.Dialect, gcode)
+		if err != nil {
+			return nil, fmt.Errorf("part %d: %v", i+1, err)
+		}
+		read[i] = part
+	}
+
+	merged, err := layOutParts(&cfg, read)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkClearance(&cfg, merged); err != nil {
+		return nil, err
+	}
+	return merged, writeMerged(&cfg, read, merged, w)
+}
+
+// layOutParts puts the parts in their slots, or in rows when there aren't any slots
+func layOutParts(cfg *MergeConfig, parts []*mergePart) ([]MergedPart, error) {
+	merged := make([]MergedPart, len(parts))
+	x, y := cfg.BedMin.X+cfg.Margin, cfg.BedMin.Y+cfg.Margin
+	rowBack := y
+	for i, part := range parts {
+		size := Point{part.max.X - part.min.X, part.max.Y - part.min.Y}
+		corner := Point{x, y}
+		if len(cfg.Slots) != 0 {
+			corner = cfg.Slots[i]
+		} else {
+			if x+size.X > cfg.BedMax.X-cfg.Margin && x > cfg.BedMin.X+cfg.Margin {
+				// the next row starts behind this one, far enough back that the head doesn't reach it
+				x, y = cfg.BedMin.X+cfg.Margin, rowBack+cfg.HeadClearance.Front
+				corner = Point{x, y}
+			}
+			// later parts are to the right, so the head mustn't reach back to the left
+			x += size.X + cfg.HeadClearance.Left
+			rowBack = math.Max(rowBack, corner.Y+size.Y)
+		}
+		offset := Point{corner.X - part.min.X, corner.Y - part.min.Y}
+		merged[i] = MergedPart{
+			Offset: offset,
+			Min:    corner,
+			Max:    Point{corner.X + size.X, corner.Y + size.Y},
+			Height: part.height,
+		}
+		if merged[i].Min.X < cfg.BedMin.X || merged[i].Min.Y < cfg.BedMin.Y ||
+			merged[i].Max.X > cfg.BedMax.X || merged[i].Max.Y > cfg.BedMax.Y {
+			return nil, fmt.Errorf("part %d (%.1fx%.1fmm) doesn't fit on the bed at X%.1f Y%.1f", i+1, size.X, size.Y,
+				corner.X, corner.Y)
+		}
+	}
+	return merged, nil
+}
+
+// checkClearance checks that printing each part doesn't hit any of the parts that were printed before it
+func checkClearance(cfg *MergeConfig, merged []MergedPart) error {
+	head := cfg.HeadClearance
+	for j, later := range merged {
+		// everywhere that the print head goes while printing the later part
+		reachMin := Point{later.Min.X - head.Left, later.Min.Y - head.Front}
+		reachMax := Point{later.Max.X + head.Right, later.Max.Y + head.Back}
+		for i, earlier := range merged[:j] {
+			if reachMin.X < earlier.Max.X && earlier.Min.X < reachMax.X && reachMin.Y < earlier.Max.Y && earlier.Min.Y < reachMax.Y {
+				return fmt.Errorf("the print head would hit part %d while printing part %d", i+1, j+1)
+			}
+		}
+	}
+	for i, part := range merged[:len(merged)-1] {
+		if part.Height > head.Height {
+			return fmt.Errorf("part %d is %.2fmm tall, so the gantry would hit it while printing the parts after it "+
+				"(only parts up to %.2fmm tall can be printed before others)", i+1, part.Height, head.Height)
+		}
+	}
+	return nil
+}
+
+// writeMerged writes out every part, moved to its slot, with the moves between them
+func writeMerged(cfg *MergeConfig, parts []*mergePart, merged []MergedPart, w io.Writer) error {
+	out := bufio.NewWriter(w)
+
+	fmt.Fprintf(out, "; %d parts, printed one after another\n", len(parts))
+	var current MachineState
+	tallest := 0.0
+	for i, part := range parts {
+		offset := merged[i].Offset
+		if i == 0 {
+			for _, lineStr := range part.lines[:part.first] {
+				fmt.Fprintln(out, lineStr)
+			}
+			current = part.start
+		}
+
+		start := part.start
+		fmt.Fprintf(out, "; part %d, moved by X%s Y%s\n", i+1, formatNumber(offset.X), formatNumber(offset.Y))
+		fmt.Fprintln(out, "G90")
+		// the part before this one ended with its last extrusion, so the nozzle would ooze on the way
+		retracted := i > 0 && cfg.RetractLength > 0 && !current.Retracted
+		if retracted {
+			fmt.Fprintln(out, "M83")
+			fmt.Fprintf(out, "G1 E%s F%s\n", formatNumber(-cfg.RetractLength), formatNumber(cfg.RetractFeedrate))
+		}
+		fmt.Fprintf(out, "G0 Z%s F%s\n", formatNumber(tallest+cfg.Lift), formatNumber(cfg.ZFeedrate))
+		if start.BedTemperature != current.BedTemperature {
+			fmt.Fprintf(out, "M190 S%s\n", formatNumber(start.BedTemperature))
+		}
+		if start.Tool != current.Tool {
+			fmt.Fprintf(out, "T%d\n", start.Tool)
+		}
+		if start.HotendTemperature != current.ToolStateOf(start.Tool).HotendTemperature {
+			fmt.Fprintf(out, "M109 S%s\n", formatNumber(start.HotendTemperature))
+		}
+		fmt.Fprintf(out, "G0 X%s Y%s F%s\n", formatNumber(start.X+offset.X), formatNumber(start.Y+offset.Y), formatNumber(cfg.TravelFeedrate))
+		fmt.Fprintf(out, "G0 Z%s F%s\n", formatNumber(start.Z), formatNumber(cfg.ZFeedrate))
+		if retracted && !start.Retracted && start.Tool == current.Tool {
+			fmt.Fprintf(out, "G1 E%s F%s\n", formatNumber(cfg.RetractLength), formatNumber(cfg.RetractFeedrate))
+		}
+		if start.RelativeExtrusion {
+			fmt.Fprintln(out, "M83")
+		} else {
+			fmt.Fprintln(out, "M82")
+		}
+		fmt.Fprintf(out, "G92 E%s\n", formatNumber(start.E))
+		if start.Feedrate != 0 {
+			fmt.Fprintf(out, "G1 F%s\n", formatNumber(start.Feedrate))
+		}
+		if start.FanSpeed > 0 {
+			fmt.Fprintf(out, "M106 S%s\n", formatNumber(math.Round(start.FanSpeed)))
+		} else {
+			fmt.Fprintln(out, "M107")
+		}
+		if start.RelativeCoordinates {
+			fmt.Fprintln(out, "G91")
+		}
+
+		if err := writeTranslated(out, cfg.Dialect, part.lines[part.first:part.last+1], start, offset); err != nil {
+			return fmt.Errorf("part %d: %v", i+1, err)
+		}
+		current = part.end
+		tallest = math.Max(tallest, part.height)
+	}
+
+	last := parts[len(parts)-1]
+	fmt.Fprintln(out, "; the end of the last part")
+	for _, lineStr := range last.lines[last.last+1:] {
+		fmt.Fprintln(out, lineStr)
+	}
+	return out.Flush()
+}
+
+// writeTranslated writes lines moved by offset, starting from state. Lines that don't need to move are kept exactly
+// as they are.
+func writeTranslated(w io.Writer, dialect Dialect, lines []string, state MachineState, offset Point) error {
+	for _, lineStr := range lines {
+		line, err := dialect.ParseLine(lineStr)
+		if err != nil {
+			return err
+		}
+		absolute := !state.RelativeCoordinates
+		state.Apply(&line)
+		isMove := line.IsMove()
+		// G92 sets where the nozzle is, which moves too
+		if (line.IsG(92) || (isMove && absolute)) && (line.Xvalid || line.Yvalid) {
+			if line.Xvalid {
+				line.X += offset.X
+			}
+			if line.Yvalid {
+				line.Y += offset.Y
+			}
+			lineStr = plainLineFormat.FormatGcode(&line)
+		}
+		if _, err := fmt.Fprintln(w, lineStr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
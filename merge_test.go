@@ -0,0 +1,124 @@
+package gcodetools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mergeConfig() MergeConfig {
+	return MergeConfig{
+		Dialect:       DialectRepRap,
+		HeadClearance: ClearanceBox{Left: 30, Right: 20, Front: 15, Back: 40, Height: 10},
+		BedMax:        Point{200, 200},
+		RetractLength: 0.8,
+	}
+}
+
+func TestMerge(t *testing.T) {
+	part := squaresGcode(2, 20) + "\n; end\nM104 S0\nM140 S0"
+	var out strings.Builder
+	merged, err := Merge(mergeConfig(), []string{part, part}, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []MergedPart{
+		{Offset: Point{-5, -5}, Min: Point{5, 5}, Max: Point{25, 25}, Height: 0.4},
+		{Offset: Point{45, -5}, Min: Point{55, 5}, Max: Point{75, 25}, Height: 0.4},
+	}, merged)
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Equal(t, []string{
+		"; 2 parts, printed one after another",
+		"; start", "M140 S60", "M104 S210", "G28", "M83",
+		"G0 Z0.6 F600 ; hop",
+		"G0 X10 Y10 F6000",
+		"G0 Z0.2",
+		"; part 1, moved by X-5 Y-5",
+		"G90",
+		"G0 Z5 F600",
+		"G0 X5 Y5 F6000",
+		"G0 Z0.2 F600",
+		"M83",
+		"G92 E0",
+		"G1 F6000",
+		"M107",
+		"G1 X25 E1 F1800",
+	}, lines[:19])
+	// the filament is pulled back on the way to the next part, and pushed forward again once it's there
+	assert.Contains(t, out.String(), "G1 Y5 E1\n; part 2, moved by X45 Y-5\nG90\nM83\nG1 E-0.8 F2100\nG0 Z5.4 F600\n"+
+		"G0 X55 Y5 F6000\nG0 Z0.2 F600\nG1 E0.8 F2100\nM83\nG92 E0\n")
+	assert.Contains(t, lines, "G1 X75 E1 F1800")
+	// only the last part's end gcode is kept
+	assert.Equal(t, 1, strings.Count(out.String(), "; end\n"))
+	assert.Equal(t, 1, strings.Count(out.String(), "; start\n"))
+	assert.Equal(t, []string{"; the end of the last part", "G1 E-1 ; retract", "; end", "M104 S0", "M140 S0"}, lines[len(lines)-5:])
+}
+
+// introGcode is a part with a PrusaSlicer-style purge line along the front of the bed in its start gcode, and with
+// layer change marks when marked is set
+func introGcode(marked bool) string {
+	gcode := strings.Replace(squaresGcode(2, 20), "M83\n", "M83\nG0 X0 Y0 Z0.2 F6000\nG1 X60 E9 F1000\nG1 X100 E12.5\nG1 E-0.8\n", 1)
+	if marked {
+		gcode = strings.Replace(gcode, "G0 Z0.6 F600 ; hop", ";LAYER_CHANGE\n;Z:0.2\nG0 Z0.6 F600 ; hop", 1)
+	}
+	return gcode
+}
+
+func TestMerge_purgeLine(t *testing.T) {
+	for _, marked := range []bool{false, true} {
+		part := introGcode(marked)
+		var out strings.Builder
+		merged, err := Merge(mergeConfig(), []string{part, part}, &out)
+		assert.NoError(t, err)
+		// the purge line isn't part of the part
+		assert.Equal(t, Point{5, 5}, merged[0].Min)
+		assert.Equal(t, Point{25, 25}, merged[0].Max)
+		assert.Equal(t, Point{55, 5}, merged[1].Min)
+		// it's only printed once, where it was
+		assert.Equal(t, 1, strings.Count(out.String(), "G1 X100 E12.5\n"))
+		assert.Equal(t, 1, strings.Count(out.String(), "G1 X60 E9 F1000\n"))
+	}
+}
+
+func TestMerge_rows(t *testing.T) {
+	part := squaresGcode(1, 60)
+	cfg := mergeConfig()
+	merged, err := Merge(cfg, []string{part, part, part}, &strings.Builder{})
+	assert.NoError(t, err)
+	assert.Equal(t, Point{5, 5}, merged[0].Min)
+	assert.Equal(t, Point{95, 5}, merged[1].Min)
+	// the third doesn't fit next to them, so it goes behind
+	assert.Equal(t, Point{5, 80}, merged[2].Min)
+
+	_, err = Merge(cfg, []string{part, part, part, part, part}, &strings.Builder{})
+	assert.EqualError(t, err, "part 5 (60.0x60.0mm) doesn't fit on the bed at X5.0 Y155.0")
+}
+
+func TestMerge_clearance(t *testing.T) {
+	part := squaresGcode(1, 20)
+	cfg := mergeConfig()
+	cfg.Slots = []Point{{100, 100}, {145, 100}}
+	_, err := Merge(cfg, []string{part, part}, &strings.Builder{})
+	assert.EqualError(t, err, "the print head would hit part 1 while printing part 2")
+
+	// the same gap is fine the other way around, since the head sticks out less to the right
+	cfg.Slots = []Point{{100, 100}, {55, 100}}
+	_, err = Merge(cfg, []string{part, part}, &strings.Builder{})
+	assert.NoError(t, err)
+
+	cfg.Slots = []Point{{100, 100}}
+	_, err = Merge(cfg, []string{part, part}, &strings.Builder{})
+	assert.EqualError(t, err, "there are 1 slots for 2 parts")
+
+	cfg.Slots = nil
+	tall := squaresGcode(60, 20)
+	_, err = Merge(cfg, []string{tall, part}, &strings.Builder{})
+	assert.EqualError(t, err, "part 1 is 12.00mm tall, so the gantry would hit it while printing the parts after it "+
+		"(only parts up to 10.00mm tall can be printed before others)")
+	// the last part can be as tall as it likes
+	_, err = Merge(cfg, []string{part, tall}, &strings.Builder{})
+	assert.NoError(t, err)
+
+	_, err = Merge(cfg, []string{part, "G28\nG1 X10"}, &strings.Builder{})
+	assert.EqualError(t, err, "part 2: it doesn't print anything")
+}
@@ -3,6 +3,7 @@ package gcodetools
 import (
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -10,11 +11,23 @@ import (
 var defaultThreshold = 0.001
 
 type GcodeMinifierConfig struct {
-	RemoveComments                   bool
-	Threshold                        float64
-	thresholdSqr                     float64
-	XYDecimals, ZDecimals, EDecimals int
-	AllowUnknownGcode                bool
+	RemoveComments    bool    `mapstructure:"remove_comments"`
+	Threshold         float64 `mapstructure:"threshold"`
+	thresholdSqr      float64
+	XYDecimals        int  `mapstructure:"xy_decimals"`
+	ZDecimals         int  `mapstructure:"z_decimals"`
+	EDecimals         int  `mapstructure:"e_decimals"`
+	AllowUnknownGcode bool `mapstructure:"allow_unknown_gcode"`
+	// Flavor is the firmware that the output is for. Commands that it supports are passed through even without AllowUnknownGcode,
+	// and numbers are only written without a leading zero if it can read them
+	Flavor *Flavor `mapstructure:"-"`
+	// CNC is for LinuxCNC/grbl gcode (DialectCNC). Moves leave out the G0/G1 when it's the same as the last move's,
+	// and the machine doesn't have to be homed first. It's also on when the Flavor's dialect is DialectCNC
+	CNC bool `mapstructure:"cnc"`
+	// Workers is how many goroutines MinifyGcodeStr minifies on. 0 or 1 is sequential
+	Workers int `mapstructure:"workers"`
+	// feedrates are written as whole numbers in mm/min, but need decimals in inches
+	feedrateDecimals int
 	////
 }
 
@@ -46,41 +59,205 @@ func (cfg *GcodeMinifierConfig) Init() *GcodeMinifierConfig {
 	return cfg
 }
 
+func (cfg *GcodeMinifierConfig) cnc() bool {
+	return cfg.CNC || (cfg.Flavor != nil && cfg.Flavor.Dialect == DialectCNC)
+}
+
+func (cfg *GcodeMinifierConfig) dialect() Dialect {
+	if cfg.cnc() {
+		return DialectCNC
+	}
+	if cfg.Flavor != nil {
+		return cfg.Flavor.Dialect
+	}
+	return DialectRepRap
+}
+
+// supports is whether a line that MachineState doesn't understand can be passed through anyway
+func (cfg *GcodeMinifierConfig) supports(line *GcodeLine) bool {
+	if cfg.AllowUnknownGcode {
+		return true
+	}
+	flavor := cfg.Flavor
+	if flavor == nil && cfg.cnc() {
+		flavor = FlavorGrbl
+	}
+	return flavor != nil && flavor.SupportsCommand(line)
+}
+
+// inchExtraDecimals is how many more decimals numbers get in inches, to be at least as precise as they are in mm
+const inchExtraDecimals = 2
+
+// forUnits is the config for the units that the machine is in. Threshold and the decimals are for mm, so in
+// inches (after G20) the threshold is scaled down, and there are more decimals
+func (cfg *GcodeMinifierConfig) forUnits(state *MachineState) *GcodeMinifierConfig {
+	if !state.Inches {
+		return cfg
+	}
+	inches := *cfg
+	inches.Threshold /= MmPerInch
+	inches.thresholdSqr = inches.Threshold * inches.Threshold
+	inches.XYDecimals += inchExtraDecimals
+	inches.ZDecimals += inchExtraDecimals
+	inches.EDecimals += inchExtraDecimals
+	inches.feedrateDecimals = inchExtraDecimals
+	return &inches
+}
+
 func (cfg *GcodeMinifierConfig) float64ApproxEq(a, b float64) bool {
 	return math.Abs(a-b) < cfg.Threshold
 }
 
-func (cfg *GcodeMinifierConfig) formatGcode(g *GcodeLine) string {
-	return formatGcode(g, cfg.XYDecimals, cfg.ZDecimals, cfg.EDecimals)
+func (cfg *GcodeMinifierConfig) gcodeFormat() gcodeFormat {
+	return gcodeFormat{
+		xyDecimals:       cfg.XYDecimals,
+		zDecimals:        cfg.ZDecimals,
+		eDecimals:        cfg.EDecimals,
+		feedrateDecimals: cfg.feedrateDecimals,
+		leadingZero:      cfg.Flavor != nil && !cfg.Flavor.LeadingDotFloats,
+	}
+}
+
+// FormatGcode writes out a line with the config's decimals (and the flavor's number format), without minifying it
+func (cfg *GcodeMinifierConfig) FormatGcode(g *GcodeLine) string {
+	return cfg.gcodeFormat().format(g)
 }
 
 func (cfg *GcodeMinifierConfig) MinifyGcodeStr(initialState MachineState, gcodeStr string) (output string, state MachineState) {
-	state = initialState
+	if cfg.Workers > 1 {
+		return cfg.minifyGcodeStrParallel(initialState, gcodeStr)
+	}
+	m := cfg.newLineMinifier(initialState)
 	strLines := strings.Split(gcodeStr, "\n")
-	gcodeLines := make([]GcodeLine, 0, len(strLines))
-	for _, line := range strLines {
-		g, err := ParseLine(line)
+	outputLines := make([]string, 0, len(strLines)+1)
+	for _, strLine := range strLines {
+		strLine = strings.TrimRight(strLine, "\r")
+		g, err := m.dialect.ParseLine(strLine)
 		if err != nil {
 			panic(err) // TODO: better error handling
 		}
-		cfg.MinifyGcodeLineInPlace(&state, &g)
-		if !g.Empty() {
-			gcodeLines = append(gcodeLines, g)
-		}
+		outputLines = m.appendLine(outputLines, strLine, &g)
 	}
+	state = m.finish()
 
-	// len+1 so that there's a trailing newline
-	outputLines := make([]string, len(gcodeLines)+1)
-	for i, gcodeLine := range gcodeLines {
-		outputLines[i] = cfg.formatGcode(&gcodeLine)
-	}
+	// an empty line at the end, so that there's a trailing newline
+	outputLines = append(outputLines, "")
 	output = strings.Join(outputLines, "\n")
 	return
 }
 
+// lineMinifier minifies a file one line at a time
+type lineMinifier struct {
+	cfg     *GcodeMinifierConfig
+	dialect Dialect
+	state   MachineState
+	// blockIndent is the indentation of the meta command (if, while...) that started the block we're in, or -1 when
+	// we aren't in one. Blocks are kept exactly as they are, since there's no knowing which parts of them run
+	blockIndent int
+}
+
+func (cfg *GcodeMinifierConfig) newLineMinifier(initialState MachineState) lineMinifier {
+	m := lineMinifier{cfg: cfg, dialect: cfg.dialect(), state: initialState, blockIndent: -1}
+	if cfg.Flavor != nil {
+		m.state.G90ResetsExtrusion = cfg.Flavor.G90ResetsExtrusion
+	}
+	if cfg.cnc() && !m.state.IsHomed {
+		// CNC machines work from wherever they're zeroed, so there's no knowing where they start
+		m.state.forgetPosition()
+	}
+	return m
+}
+
+// step minifies the next line (which is strLine, parsed into g). It returns whether anything is left of it, and whether
+// it's kept exactly as strLine instead of formatting g
+func (m *lineMinifier) step(strLine string, g *GcodeLine) (keep, verbatim bool) {
+	cfg := m.cfg
+	if g.BlockDelete {
+		// the machine might skip this line, so it's kept as it is, and where it leaves the machine isn't known
+		m.state.forgetPosition()
+		return true, true
+	}
+
+	indent := indentation(strLine)
+	if m.blockIndent >= 0 {
+		if g.Empty() || (g.CommentOnly() && cfg.RemoveComments) {
+			return false, false
+		}
+		if indent > m.blockIndent || g.CommentOnly() {
+			return true, true
+		}
+		m.blockIndent = -1
+		m.state.forgetPosition()
+	}
+	if g.MetaCmd != "" {
+		cfg.MinifyGcodeLineInPlace(&m.state, g)
+		if metaBlockCommands[g.MetaCmd] {
+			m.blockIndent = indent
+		}
+		return true, true
+	}
+
+	cfg.MinifyGcodeLineInPlace(&m.state, g)
+	return !g.Empty(), false
+}
+
+// track is step without minifying the line: it only keeps track of the state, the same as step would
+func (m *lineMinifier) track(strLine string, g *GcodeLine) {
+	if g.BlockDelete {
+		m.state.forgetPosition()
+		return
+	}
+	indent := indentation(strLine)
+	if m.blockIndent >= 0 {
+		if g.Empty() || g.CommentOnly() || indent > m.blockIndent {
+			return
+		}
+		m.blockIndent = -1
+		m.state.forgetPosition()
+	}
+	if g.MetaCmd != "" {
+		if metaBlockCommands[g.MetaCmd] {
+			m.blockIndent = indent
+		}
+		return
+	}
+	m.cfg.forUnits(&m.state).trackGcodeLine(&m.state, g)
+}
+
+// appendLine is step, adding whatever is left of the line to outputLines
+func (m *lineMinifier) appendLine(outputLines []string, strLine string, g *GcodeLine) []string {
+	keep, verbatim := m.step(strLine, g)
+	switch {
+	case !keep:
+		return outputLines
+	case verbatim:
+		return append(outputLines, strLine)
+	}
+	return append(outputLines, m.cfg.forUnits(&m.state).FormatGcode(g))
+}
+
+// finish is the state at the end of the file
+func (m *lineMinifier) finish() MachineState {
+	if m.blockIndent >= 0 {
+		m.state.forgetPosition()
+	}
+	return m.state
+}
+
+func indentation(str string) int {
+	i := 0
+	for i < len(str) && (str[i] == ' ' || str[i] == '\t') {
+		i++
+	}
+	return i
+}
+
 func (cfg *GcodeMinifierConfig) MinifyGcodeLineInPlace(state *MachineState, line *GcodeLine) {
+	// the units are as they were before the line, a G20 or G21 on the line itself doesn't change how it's minified
+	cfg = cfg.forUnits(state)
 	if cfg.RemoveComments {
 		line.Comment = nil
+		line.InlineComments = nil
 	}
 	if line.NumericParams != nil && len(line.NumericParams) == 0 {
 		line.NumericParams = nil
@@ -93,151 +270,449 @@ func (cfg *GcodeMinifierConfig) MinifyGcodeLineInPlace(state *MachineState, line
 		return
 	}
 
-	if line.IsG(28) {
-		state.X = 0
-		state.Y = 0
-		state.Z = 0
-		state.IsHomed = true
+	if cfg.cnc() {
+		cfg.minifyCNCLine(state, line)
 		return
 	}
-	if line.IsG(0) || line.IsG(1) {
-		cfg.minifyAbsoluteG0G1Move(state, line)
+
+	if line.MetaCmd != "" {
+		if !cfg.supports(line) {
+			panic("unimplemented: " + line.String())
+		}
+		// meta commands can't be minified, but whatever they do won't move anything
 		return
 	}
 
-	if line.IsM(83) {
-		state.RelativeExtrusion = true
-		state.E = 0
+	if (line.IsG(0) || line.IsG(1)) && hasExpressionParams(line) {
+		// the move is kept as it is
+		applyExpressionMove(state, line)
 		return
 	}
-	if line.IsM(82) {
-		state.RelativeExtrusion = false
-		state.E = state.EAbsolute
+	if line.IsG(0) || line.IsG(1) {
+		if state.RelativeCoordinates {
+			cfg.minifyRelativeG0G1Move(state, line)
+		} else {
+			cfg.minifyAbsoluteG0G1Move(state, line)
+		}
 		return
 	}
+	if state.Apply(line) {
+		return
+	}
+
+	if !cfg.supports(line) {
+		panic("unimplemented: " + line.String())
+	}
+}
+
+// trackGcodeLine is what MinifyGcodeLineInPlace does to the state, without changing the line (other than to fill in a
+// CNC line's motion mode) or checking that it's supported
+func (cfg *GcodeMinifierConfig) trackGcodeLine(state *MachineState, line *GcodeLine) {
+	switch {
+	case line.CommentOnly() || line.Empty() || line.MetaCmd != "":
+	case cfg.cnc():
+		for i := range line.ExtraCmds {
+			state.Apply(&line.ExtraCmds[i])
+			if cncForgetsPosition(&line.ExtraCmds[i]) {
+				state.forgetPosition()
+			}
+		}
+		if line.CmdLetter == 0 && state.MotionMode != "" && hasMotionWords(line) {
+			_ = parseWord(line, 0, state.MotionMode)
+		}
+		if line.IsG(0) || line.IsG(1) {
+			cfg.trackMove(state, line)
+			state.MotionMode = motionMode(line)
+			return
+		}
+		line.ExtraCmds = nil // already done
+		state.Apply(line)
+		if cncForgetsPosition(line) {
+			state.forgetPosition()
+		}
+	case (line.IsG(0) || line.IsG(1)) && hasExpressionParams(line):
+		applyExpressionMove(state, line)
+	case line.IsG(0) || line.IsG(1):
+		cfg.trackMove(state, line)
+	default:
+		state.Apply(line)
+	}
+}
 
-	if line.IsG(90) { // G90 - Absolute Positioning
-		// TODO
+// trackMove applies a G0 or G1 to state, the same as minifying it would
+func (cfg *GcodeMinifierConfig) trackMove(state *MachineState, line *GcodeLine) {
+	if state.RelativeCoordinates {
+		cfg.minifyRelativeG0G1Move(state, line)
+	} else {
+		cfg.applyAbsoluteMove(state, line)
 	}
-	if line.IsG(91) { // G91 - Relative Positioning
-		// TODO
+}
+
+func (cfg *GcodeMinifierConfig) minifyCNCLine(state *MachineState, line *GcodeLine) {
+	for i := range line.ExtraCmds {
+		cmd := &line.ExtraCmds[i]
+		if !state.Apply(cmd) && !cfg.supports(cmd) {
+			panic("unimplemented: " + line.String())
+		}
+		if cncForgetsPosition(cmd) {
+			state.forgetPosition()
+		}
 	}
 
-	if !cfg.AllowUnknownGcode {
-		panic("unimplemented: " + line.String())
+	// a line with only axis words (like X10 Y20) is another move like the last one
+	previousMode := state.MotionMode
+	if line.CmdLetter == 0 && previousMode != "" && hasMotionWords(line) {
+		_ = parseWord(line, 0, previousMode)
+	}
+	isMotion := motionCommands[commandKey(line.CmdLetter, line.CmdNumber)]
+	mode := motionMode(line)
+
+	if line.IsG(0) || line.IsG(1) {
+		if state.RelativeCoordinates {
+			cfg.minifyRelativeG0G1Move(state, line)
+		} else {
+			cfg.minifyAbsoluteG0G1Move(state, line)
+		}
+		state.MotionMode = mode
+		if line.CmdLetter == 0 && mode != previousMode {
+			// even when the move doesn't go anywhere, the next moves need its motion mode
+			_ = parseWord(line, 0, mode)
+		}
+	} else {
+		extraCmds := line.ExtraCmds
+		line.ExtraCmds = nil // already done
+		if !state.Apply(line) && !cfg.supports(line) {
+			panic("unimplemented: " + line.String())
+		}
+		line.ExtraCmds = extraCmds
+		if cncForgetsPosition(line) {
+			state.forgetPosition()
+		}
+	}
+
+	if isMotion && line.CmdLetter != 0 && mode == previousMode {
+		line.CmdLetter = 0
+		line.CmdNumber = 0
+		line.CmdSubcode = 0
+		line.CmdSubcodeValid = false
 	}
 }
 
+// hasMotionWords is whether a line has any axis (or arc center) words
+func hasMotionWords(line *GcodeLine) bool {
+	if line.Xvalid || line.Yvalid || line.Zvalid {
+		return true
+	}
+	for _, param := range []uint8{'A', 'B', 'C', 'I', 'J', 'K', 'R'} {
+		if _, ok := line.NumericParams[param]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cncForgetsPosition is whether a command moves the machine somewhere that isn't known, or changes its coordinates
+func cncForgetsPosition(line *GcodeLine) bool {
+	if line.CmdLetter != G {
+		return false
+	}
+	switch {
+	case line.CmdNumber == 28, line.CmdNumber == 30: // go to a stored position
+		return true
+	case line.CmdNumber == 38: // probing stops wherever the probe is triggered
+		return true
+	case line.CmdNumber == 53: // machine coordinates
+		return true
+	case line.CmdNumber >= 54 && line.CmdNumber <= 59: // work coordinate systems
+		return true
+	case line.CmdNumber >= 81 && line.CmdNumber <= 89: // canned cycles
+		return true
+	case line.CmdNumber == 92 && line.CmdSubcodeValid: // G92.1 and G92.2 reset the offsets
+		return true
+	case line.CmdNumber == 10:
+		_, ok := line.NumericParams['L']
+		return ok
+	}
+	return false
+}
+
+// move must be G0 or G1. Relative moves are kept as they are, except for a repeated feedrate
+func (cfg *GcodeMinifierConfig) minifyRelativeG0G1Move(state *MachineState, line *GcodeLine) {
+	if line.Feedrate != 0 && cfg.float64ApproxEq(line.Feedrate, state.Feedrate) {
+		line.Feedrate = 0
+	}
+	state.applyMove(line)
+}
+
 // move must be G0 or G1
 func (cfg *GcodeMinifierConfig) minifyAbsoluteG0G1Move(state *MachineState, line *GcodeLine) {
-	if !state.IsHomed || state.RelativeCoordinates {
+	if (!state.IsHomed && !cfg.cnc()) || state.RelativeCoordinates {
 		panic("error: relative moves are unimplemented")
 	}
 
-	if line.NumericParams != nil || line.StringParams != nil {
+	// CNC moves often have other parameters, like S for laser power, which are kept as they are
+	if !cfg.cnc() && (line.NumericParams != nil || line.StringParams != nil) {
 		panic("error: extra G0/G1 parameters are unimplemented") // TODO handle extra parameters on G0/G1 (or maybe just pass them through unchanged?)
 	}
-	if line.Xvalid && !cfg.float64ApproxEq(line.X, state.X) {
-		state.X = line.X
-	} else {
+	x, y, z, e, f := cfg.applyAbsoluteMove(state, line)
+	if !x {
 		line.Xvalid = false
 		line.X = 0
 	}
-	if line.Yvalid && !cfg.float64ApproxEq(line.Y, state.Y) {
-		state.Y = line.Y
-	} else {
+	if !y {
 		line.Yvalid = false
 		line.Y = 0
 	}
-	if line.Zvalid && !cfg.float64ApproxEq(line.Z, state.Z) {
-		state.Z = line.Z
-	} else {
+	if !z {
 		line.Zvalid = false
 		line.Z = 0
 	}
+	if !e {
+		line.Evalid = false
+		if !state.RelativeExtrusion {
+			line.E = 0
+		}
+	}
+	if !f {
+		line.Feedrate = 0
+	}
+
+	// if we're left with a do-nothing move, just empty it
+	if !(line.Xvalid || line.Yvalid || line.Zvalid || line.Evalid || line.Feedrate != 0 ||
+		line.NumericParams != nil || line.StringParams != nil) {
+		// (but keep anything else that's on the line)
+		*line = GcodeLine{
+			ExtraCmds:          line.ExtraCmds,
+			LineNumber:         line.LineNumber,
+			LineNumberValid:    line.LineNumberValid,
+			ProgramNumber:      line.ProgramNumber,
+			ProgramNumberValid: line.ProgramNumberValid,
+		}
+	}
+}
+
+// applyAbsoluteMove applies an absolute G0 or G1 to state, leaving out any change that's within the threshold (so that
+// those never add up). It returns which of the move's words change anything.
+func (cfg *GcodeMinifierConfig) applyAbsoluteMove(state *MachineState, line *GcodeLine) (x, y, z, e, f bool) {
+	if x = line.Xvalid && !cfg.float64ApproxEq(line.X, state.X); x {
+		state.X = line.X
+	}
+	if y = line.Yvalid && !cfg.float64ApproxEq(line.Y, state.Y); y {
+		state.Y = line.Y
+	}
+	if z = line.Zvalid && !cfg.float64ApproxEq(line.Z, state.Z); z {
+		state.Z = line.Z
+	}
 	if !state.RelativeExtrusion {
-		if line.Evalid && !cfg.float64ApproxEq(line.E, state.E) {
+		if e = line.Evalid && !cfg.float64ApproxEq(line.E, state.E); e {
+			state.trackExtrusion(line.E - state.E)
 			state.E = line.E
 			state.EAbsolute = line.E
-		} else {
-			line.Evalid = false
-			line.E = 0
 		}
 	} else if line.Evalid {
-		if cfg.float64ApproxEq(line.E, 0) {
-			line.Evalid = false
-		}
+		e = !cfg.float64ApproxEq(line.E, 0)
 		// keep track of E in relative extrusion, anyway
+		state.trackExtrusion(line.E)
 		state.EAbsolute += line.E
 	}
-	if line.Feedrate != 0 && !cfg.float64ApproxEq(line.Feedrate, state.Feedrate) {
+	if f = line.Feedrate != 0 && !cfg.float64ApproxEq(line.Feedrate, state.Feedrate); f {
 		state.Feedrate = line.Feedrate
-	} else if line.Feedrate != 0 && cfg.float64ApproxEq(line.Feedrate, state.Feedrate) {
-		line.Feedrate = 0
 	}
+	return
+}
 
-	// if we're left with a do-nothing move, just empty it
-	if !(line.Xvalid || line.Yvalid || line.Zvalid || line.Evalid || line.Feedrate != 0 ||
-		line.NumericParams != nil || line.StringParams != nil) {
-		*line = GcodeLine{}
+// applyExpressionMove applies a G0 or G1 with {expressions} in it, whatever they come out as is unknown
+func applyExpressionMove(state *MachineState, line *GcodeLine) {
+	state.applyMove(line)
+	if _, ok := line.StringParams['X']; ok {
+		state.X = math.NaN()
+	}
+	if _, ok := line.StringParams['Y']; ok {
+		state.Y = math.NaN()
+	}
+	if _, ok := line.StringParams['Z']; ok {
+		state.Z = math.NaN()
+	}
+	if _, ok := line.StringParams['E']; ok {
+		state.E = math.NaN()
+		state.EAbsolute = math.NaN()
+	}
+	if _, ok := line.StringParams['F']; ok {
+		state.Feedrate = math.NaN()
 	}
 }
 
-type MachineState struct {
-	X                   float64
-	Y                   float64
-	Z                   float64
-	E                   float64
-	EAbsolute           float64
-	Feedrate            float64
-	RelativeExtrusion   bool
-	RelativeCoordinates bool
-	IsHomed             bool
-	// TODO: temperature
+// hasExpressionParams is whether any of the parameters are {expressions}
+func hasExpressionParams(line *GcodeLine) bool {
+	for _, value := range line.StringParams {
+		if strings.HasPrefix(value, "{") {
+			return true
+		}
+	}
+	return false
+}
+
+// gcodeFormat is how the numbers in a line of gcode are written out
+type gcodeFormat struct {
+	xyDecimals, zDecimals, eDecimals, feedrateDecimals int
+	// leadingZero writes numbers like "0.5" instead of ".5", for firmware that can't read the short form
+	leadingZero bool
 }
 
 func formatGcode(g *GcodeLine, xyDecimals, zDecimals, eDecimals int) string {
-	if g.Empty() {
+	return gcodeFormat{xyDecimals: xyDecimals, zDecimals: zDecimals, eDecimals: eDecimals}.format(g)
+}
+
+func (f gcodeFormat) float(value float64, decimals int) string {
+	return floatToString(value, decimals, f.leadingZero)
+}
+
+func (f gcodeFormat) format(g *GcodeLine) string {
+	if g.Empty() && !g.LineNumberValid {
 		return ""
 	}
 	parts := []string{}
 	//var buf bytes.Buffer
+	if g.ProgramDelimiter {
+		parts = append(parts, "%")
+	}
+	if g.ProgramNumberValid {
+		parts = append(parts, "O"+strconv.Itoa(g.ProgramNumber))
+	}
+	if g.LineNumberValid {
+		parts = append(parts, "N"+strconv.Itoa(g.LineNumber))
+	}
+	for _, cmd := range g.ExtraCmds {
+		parts = append(parts, formatCommand(&cmd))
+	}
 	if g.CmdLetter != 0 {
-		parts = append(parts, fmt.Sprintf("%c%d", g.CmdLetter, g.CmdNumber))
+		parts = append(parts, formatCommand(g))
+	}
+	if g.MetaCmd != "" {
+		parts = append(parts, g.MetaCmd)
+		if g.MetaArgs != "" {
+			parts = append(parts, g.MetaArgs)
+		}
+	}
+	if g.Text != "" {
+		parts = append(parts, g.Text)
+	}
+	if g.ExtendedCmd != "" {
+		// extended commands are written back exactly as they were, their values could be anything
+		parts = append(parts, g.ExtendedCmd)
+		for _, param := range g.ExtendedParams {
+			parts = append(parts, param.Key+"="+param.Value)
+		}
 	}
 	if g.Xvalid {
-		parts = append(parts, "X"+FloatToSmallestString(g.X, xyDecimals))
+		parts = append(parts, "X"+f.float(g.X, f.xyDecimals))
 	}
 	if g.Yvalid {
-		parts = append(parts, "Y"+FloatToSmallestString(g.Y, xyDecimals))
+		parts = append(parts, "Y"+f.float(g.Y, f.xyDecimals))
 	}
 	if g.Zvalid {
-		parts = append(parts, "Z"+FloatToSmallestString(g.Z, zDecimals))
+		parts = append(parts, "Z"+f.float(g.Z, f.zDecimals))
 	}
 	if g.Evalid {
-		parts = append(parts, "E"+FloatToSmallestString(g.E, eDecimals))
+		parts = append(parts, "E"+f.float(g.E, f.eDecimals))
 	}
 	if g.Feedrate != 0 {
-		parts = append(parts, "F"+FloatToSmallestString(g.Feedrate, 0))
+		parts = append(parts, "F"+f.float(g.Feedrate, f.feedrateDecimals))
 	}
 	if g.NumericParams != nil {
-		for u, f := range g.NumericParams {
-			parts = append(parts, fmt.Sprintf("%c%v", u, FloatToSmallestString(f, xyDecimals)))
+		for _, u := range sortedParamKeys(g.NumericParams) {
+			parts = append(parts, fmt.Sprintf("%c%v", u, f.float(g.NumericParams[u], f.xyDecimals)))
 		}
 	}
 	if g.StringParams != nil {
-		for u, s := range g.StringParams {
-			parts = append(parts, fmt.Sprintf("%c%s", u, s))
+		for _, u := range sortedStringParamKeys(g.StringParams) {
+			parts = append(parts, fmt.Sprintf("%c%s", u, g.StringParams[u]))
 		}
 	}
+	if len(g.InlineComments) > 0 {
+		parts = insertInlineComments(parts, g.InlineComments)
+	}
+	if g.ChecksumValid {
+		// the checksum is of everything before the *, so it has to be worked out from what's actually written
+		line := strings.Join(parts, " ")
+		parts = []string{fmt.Sprintf("%s*%d", line, Checksum(line))}
+	}
 	if g.Comment != nil {
 		parts = append(parts, *g.Comment)
 	}
 
+	if g.BlockDelete {
+		return "/" + strings.Join(parts, " ")
+	}
 	return strings.Join(parts, " ")
 }
 
+func formatCommand(g *GcodeLine) string {
+	if g.CmdSubcodeValid {
+		return fmt.Sprintf("%c%d.%d", g.CmdLetter, g.CmdNumber, g.CmdSubcode)
+	}
+	return fmt.Sprintf("%c%d", g.CmdLetter, g.CmdNumber)
+}
+
+// insertInlineComments puts each comment after the part that it was after when it was parsed.
+// Comments that were after a word that isn't there anymore go at the end.
+func insertInlineComments(parts []string, comments []InlineComment) []string {
+	placed := make([]bool, len(comments))
+	result := make([]string, 0, len(parts)+len(comments))
+	place := func(part string) {
+		for i, comment := range comments {
+			isAfter := comment.After == part || (len(comment.After) == 1 && part != "" && part[0] == comment.After[0])
+			if !placed[i] && isAfter {
+				result = append(result, comment.Text)
+				placed[i] = true
+			}
+		}
+	}
+	place("")
+	for _, part := range parts {
+		result = append(result, part)
+		place(part)
+	}
+	for i, comment := range comments {
+		if !placed[i] {
+			result = append(result, comment.Text)
+		}
+	}
+	return result
+}
+
+// map iteration order is random, so params are sorted to make the output stable
+func sortedParamKeys(params map[uint8]float64) []uint8 {
+	keys := make([]uint8, 0, len(params))
+	for u := range params {
+		keys = append(keys, u)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func sortedStringParamKeys(params map[uint8]string) []uint8 {
+	keys := make([]uint8, 0, len(params))
+	for u := range params {
+		keys = append(keys, u)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
 func FloatToSmallestString(f float64, decimals int) string {
+	return floatToString(f, decimals, false)
+}
+
+// formatNumber is how numbers are written in lines that are made up rather than minified: with up to 5 decimals, and
+// the leading zero
+func formatNumber(f float64) string {
+	return floatToString(f, 5, true)
+}
+
+// floatToString formats f with at most decimals digits after the point, and without trailing zeros.
+// Without leadingZero, numbers between -1 and 1 are written without the 0 before the point.
+func floatToString(f float64, decimals int, leadingZero bool) string {
 	s := strconv.FormatFloat(f, 'f', decimals, 64)
 	if !strings.Contains(s, ".") {
 		return s
@@ -247,7 +722,8 @@ func FloatToSmallestString(f float64, decimals int) string {
 	// 3d printers should be able to interpret less-than-1 numbers without leading zeros (like ".01" instead of "0.01")
 	// RepRapFirmware should be fine (ref. https://github.com/Duet3D/RRFLibraries/blob/master/src/General/SafeStrtod.cpp)
 	// Marlin should be fine, too: https://github.com/MarlinFirmware/Marlin/blob/2.0.x/Marlin/src/gcode/parser.h#L248
-	if s[0] == '0' {
+	// for firmware that isn't, the Flavor says so and leadingZero is set
+	if s[0] == '0' && !leadingZero {
 		s = s[1:]
 	}
 	for s[len(s)-1] == '0' {
@@ -46,7 +46,23 @@ func TestGcodeMinifierConfig_MinifyGcodeStr(t *testing.T) {
 		"", // make sure there's a trailing newline
 	}, "\n")
 	assert.Equal(t, expected, outputGcodeStr)
-	assert.Equal(t, MachineState{X: 0, Y: 0, Z: 10, E: 0, EAbsolute: -18, Feedrate: 1000, RelativeExtrusion: true, IsHomed: true}, finalState)
+	assert.Equal(t, MachineState{X: 0, Y: 0, Z: 10, ToolState: ToolState{E: 0, EAbsolute: -18, Extruded: -18, Retracted: true}, Feedrate: 1000, RelativeExtrusion: true, IsHomed: true}, finalState)
+}
+
+// after probing, the probed axis could be anywhere, so the next move to it is kept
+func TestGcodeMinifierConfig_MinifyGcodeStr_probing(t *testing.T) {
+	cfg := (&GcodeMinifierConfig{Flavor: FlavorMarlin}).Init()
+	outputGcodeStr, finalState := cfg.MinifyGcodeStr(MachineState{}, "G28\nG38.2 Z-10 F100\nG1 Z-10\n")
+	assert.Equal(t, "G28\nG38.2 Z-10 F100\nG1 Z-10\n", outputGcodeStr)
+	assert.Equal(t, -10.0, finalState.Z)
+}
+
+// messages and file names are kept exactly as they are, whatever is in them
+func TestGcodeMinifierConfig_MinifyGcodeStr_text(t *testing.T) {
+	cfg := (&GcodeMinifierConfig{RemoveComments: true, Flavor: FlavorMarlin}).Init()
+	gcodeStr := "M117 Printing (50%\nM118 [done\nM117 6\" part ; size\nM117 Layer 2 of 10\nM117 Layer 1*\n"
+	outputGcodeStr, _ := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	assert.Equal(t, "M117 Printing (50%\nM118 [done\nM117 6\" part\nM117 Layer 2 of 10\nM117 Layer 1*\n", outputGcodeStr)
 }
 
 func TestGcodeMinifierConfig_MinifyGcodeLineInPlace(t *testing.T) {
@@ -81,6 +97,7 @@ func TestFormatGcode(t *testing.T) {
 		{GcodeLine{CmdLetter: 'G', CmdNumber: 1, X: 1, Xvalid: true, Y: 2, Yvalid: true, Z: 0.31, Zvalid: true}, `G1 X1 Y2 Z.31`, 4, 4, 8},
 		{GcodeLine{CmdLetter: 'G', CmdNumber: 0, X: 100, Xvalid: true, Feedrate: 1234}, `G0 X100 F1234`, 4, 4, 8},
 		{GcodeLine{CmdLetter: 'M', CmdNumber: 83}, `M83`, 4, 4, 8},
+		{GcodeLine{CmdLetter: 'G', CmdNumber: 38, CmdSubcode: 2, CmdSubcodeValid: true, Z: -10, Zvalid: true, Feedrate: 100}, `G38.2 Z-10 F100`, 4, 4, 8},
 		{GcodeLine{NumericParams: map[uint8]float64{'T': 0}}, `T0`, 4, 4, 8},
 		{GcodeLine{CmdLetter: 'M', CmdNumber: 118, StringParams: map[uint8]string{'S': `"Hello_Duet"`}}, `M118 S"Hello_Duet"`, 4, 4, 8},
 		{GcodeLine{CmdLetter: 'M', CmdNumber: 118, StringParams: map[uint8]string{'S': `Hello_Duet`}}, `M118 SHello_Duet`, 4, 4, 8},
@@ -123,3 +140,81 @@ func TestFloatToSmallestString(t *testing.T) {
 	assert.Equal(t, FloatToSmallestString(0.00005, 4), ".0001")
 	assert.Equal(t, FloatToSmallestString(0.00001, 5), ".00001")
 }
+
+func TestGcodeMinifierConfig_MinifyGcodeStr_relativeMoves(t *testing.T) {
+	cfg := (&GcodeMinifierConfig{}).Init()
+
+	gcodeStr := strings.Join([]string{
+		"G28",
+		"G91",
+		"G1 Z5 F300",
+		"G1 Z5 F300",
+		"G90",
+		"G1 X10 Z10 F300",
+	}, "\n")
+	outputGcodeStr, finalState := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+
+	expected := strings.Join([]string{
+		"G28",
+		"G91",
+		"G1 Z5 F300",
+		"G1 Z5",
+		"G90",
+		// Z is already at 10 after the two relative moves
+		"G1 X10",
+		"",
+	}, "\n")
+	assert.Equal(t, expected, outputGcodeStr)
+	assert.Equal(t, 10.0, finalState.Z)
+}
+
+func TestGcodeMinifierConfig_MinifyGcodeStr_G90KeepsRelativeExtrusion(t *testing.T) {
+	gcodeStr := "G28\nM83\nG90\nG1 X10 E0.5\nG1 X20 E0.5"
+	for _, flavor := range []*Flavor{FlavorKlipper, FlavorRepRapFirmware} {
+		cfg := (&GcodeMinifierConfig{Flavor: flavor}).Init()
+		outputGcodeStr, finalState := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+		// G90 leaves extrusion relative, so both moves extrude
+		assert.Equal(t, "G28\nM83\nG90\nG1 X10 E.5\nG1 X20 E.5\n", outputGcodeStr, flavor.Name)
+		assert.True(t, finalState.RelativeExtrusion, flavor.Name)
+	}
+
+	cfg := (&GcodeMinifierConfig{Flavor: FlavorMarlin}).Init()
+	outputGcodeStr, _ := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	// on Marlin, G90 makes extrusion absolute, so E is already at 0.5
+	assert.Equal(t, "G28\nM83\nG90\nG1 X10 E.5\nG1 X20\n", outputGcodeStr)
+}
+
+func TestGcodeMinifierConfig_MinifyGcodeStr_toolChanges(t *testing.T) {
+	cfg := (&GcodeMinifierConfig{}).Init()
+
+	gcodeStr := strings.Join([]string{
+		"G28",
+		"M82",
+		"G1 X10 E5",
+		"T1",
+		// T1 hasn't extruded anything yet, so this isn't a retraction
+		"G1 X20 E5",
+		"G1 X30 E5",
+		"T0",
+		// T0 is already at E5
+		"G1 X40 E5",
+		"G1 X50 E6",
+	}, "\n")
+	outputGcodeStr, finalState := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+
+	expected := strings.Join([]string{
+		"G28",
+		"M82",
+		"G1 X10 E5",
+		"T1",
+		"G1 X20 E5",
+		"G1 X30",
+		"T0",
+		"G1 X40",
+		"G1 X50 E6",
+		"",
+	}, "\n")
+	assert.Equal(t, expected, outputGcodeStr)
+	assert.Equal(t, 6.0, finalState.Extruded)
+	assert.Equal(t, 5.0, finalState.ToolStateOf(1).Extruded)
+}
@@ -0,0 +1,696 @@
+package gcodetools
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// objectCellSize is the size (in mm) of the grid that extrusions are clustered on, when a file doesn't say where its
+// objects are. Objects further apart than this are kept apart.
+const objectCellSize = 1.0
+
+// PrintObject is one of the objects on the bed, which can be cancelled on its own
+type PrintObject struct {
+	Name string
+	// Outline is the convex hull of everything that the object extrudes (anticlockwise), and Center is the middle of
+	// its bounding box
+	Outline []Point
+	Center  Point
+}
+
+// ObjectSection is a run of lines that prints (part of) one object
+type ObjectSection struct {
+	// Object is the index of the object in PrintObjects.Objects
+	Object int
+	// StartLine and EndLine are the first and last of its lines (1-based)
+	StartLine, EndLine int
+}
+
+// PrintObjects are the objects that a print is made of, and where each of them is printed
+type PrintObjects struct {
+	Objects  []PrintObject
+	Sections []ObjectSection
+}
+
+// Index finds an object by name (case insensitive, like Klipper)
+func (p *PrintObjects) Index(name string) (int, error) {
+	names := make([]string, len(p.Objects))
+	for i, object := range p.Objects {
+		if strings.EqualFold(object.Name, name) {
+			return i, nil
+		}
+		names[i] = object.Name
+	}
+	return 0, fmt.Errorf("there is no object %q (the objects are %s)", name, strings.Join(names, ", "))
+}
+
+// objectLine is what a line of a print does, as far as finding objects goes
+type objectLine struct {
+	line GcodeLine
+	// extrudes is whether it extrudes while moving X or Y, from one point to another
+	extrudes bool
+	from, to Point
+	z        float64
+	// travels is whether it moves X or Y without extruding, and retracts is whether it only moves E (which is how
+	// retracts and primes are done)
+	travels, retracts bool
+}
+
+func readObjectLines(dialect Dialect, gcode string) ([]objectLine, error) {
+	lineStrs := strings.Split(strings.TrimSuffix(gcode, "\n"), "\n")
+	lines := make([]objectLine, len(lineStrs))
+	state := MachineState{}
+	for i, lineStr := range lineStrs {
+		line, err := dialect.ParseLine(lineStr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		before := state
+		isMove := line.IsMove()
+		extrusion := 0.0
+		if isMove {
+			extrusion = state.ExtrusionDelta(&line)
+		}
+		state.Apply(&line)
+		if state.Inches {
+			return nil, fmt.Errorf("line %d: files in inches aren't supported", i+1)
+		}
+		moved := state.X != before.X || state.Y != before.Y
+		// arcs are taken to be straight lines, which is close enough to tell objects apart
+		lines[i] = objectLine{
+			line:     line,
+			extrudes: isMove && extrusion > 0 && moved,
+			from:     Point{before.X, before.Y},
+			to:       Point{state.X, state.Y},
+			z:        state.Z,
+			travels:  isMove && extrusion <= 0 && moved,
+			retracts: isMove && extrusion != 0 && !moved && state.Z == before.Z,
+		}
+	}
+	return lines, nil
+}
+
+// objectMarker is a line that says that an object starts or ends
+type objectMarker struct {
+	// kind is what wrote the marker, since a file can be labelled in more than one way
+	kind       int
+	name       string
+	start, end bool
+}
+
+// kinds of object markers, from the most to the least preferred
+const (
+	markerKlipper = iota
+	markerM486
+	markerComment
+	markerMesh
+	markerKinds
+)
+
+var (
+	// PrusaSlicer, SuperSlicer and OrcaSlicer
+	printingObjectRegexp = regexp.MustCompile(`^;\s*(stop )?printing object (.+)$`)
+	labelIDRegexp        = regexp.MustCompile(`^;\s*(start|stop) printing object, unique label id:\s*(\d+)$`)
+	// Cura
+	meshRegexp = regexp.MustCompile(`^;MESH:(.+)$`)
+)
+
+// readObjectMarker reads what a line says about objects, if anything
+func readObjectMarker(line *GcodeLine) (objectMarker, bool) {
+	switch {
+	case line.IsExtended("EXCLUDE_OBJECT_START"):
+		name, _ := line.ExtendedParam("NAME")
+		return objectMarker{kind: markerKlipper, name: name, start: true}, true
+	case line.IsExtended("EXCLUDE_OBJECT_END"):
+		return objectMarker{kind: markerKlipper, end: true}, true
+	case line.IsM(486):
+		id, ok := line.NumericParams['S']
+		if !ok {
+			return objectMarker{}, false
+		}
+		if id < 0 {
+			return objectMarker{kind: markerM486, end: true}, true
+		}
+		return objectMarker{kind: markerM486, name: fmt.Sprintf("object_%d", int(id)), start: true}, true
+	case line.Comment == nil || line.CmdLetter != 0 || line.ExtendedCmd != "":
+		return objectMarker{}, false
+	}
+
+	comment := strings.TrimSpace(*line.Comment)
+	if match := labelIDRegexp.FindStringSubmatch(comment); match != nil {
+		return objectMarker{kind: markerComment, name: "id_" + match[2], start: match[1] == "start", end: match[1] == "stop"}, true
+	}
+	if match := printingObjectRegexp.FindStringSubmatch(comment); match != nil {
+		return objectMarker{kind: markerComment, name: match[2], start: match[1] == "", end: match[1] != ""}, true
+	}
+	if match := meshRegexp.FindStringSubmatch(comment); match != nil {
+		if match[1] == "NONMESH" {
+			return objectMarker{kind: markerMesh, end: true}, true
+		}
+		return objectMarker{kind: markerMesh, name: match[1], start: true}, true
+	}
+	if strings.HasPrefix(comment, ";LAYER:") {
+		// Cura doesn't say when an object ends, except by starting something else
+		return objectMarker{kind: markerMesh, end: true}, true
+	}
+	return objectMarker{}, false
+}
+
+// FindObjects finds the objects in a print, and the lines that print each of them. Objects are found from the
+// labels that slicers write (like PrusaSlicer's "; printing object" comments, Cura's ;MESH: comments, Klipper's
+// EXCLUDE_OBJECT_START and Marlin's M486), or when there aren't any, by clustering everything that's extruded into
+// pieces that don't touch. Pieces that are only on the first layer (like a skirt or a purge line) aren't objects.
+func FindObjects(dialect Dialect, gcode string) (*PrintObjects, error) {
+	lines, err := readObjectLines(dialect, gcode)
+	if err != nil {
+		return nil, err
+	}
+	objects := findMarkedObjects(lines)
+	if objects == nil {
+		objects = clusterObjects(lines)
+	}
+	if len(objects.Objects) == 0 {
+		return nil, fmt.Errorf("there aren't any objects")
+	}
+
+	// every object's outline is the convex hull of everything that it extrudes
+	points := make([][]Point, len(objects.Objects))
+	for _, section := range objects.Sections {
+		for _, line := range lines[section.StartLine-1 : section.EndLine] {
+			if line.extrudes {
+				points[section.Object] = append(points[section.Object], line.from, line.to)
+			}
+		}
+	}
+	for i := range objects.Objects {
+		object := &objects.Objects[i]
+		object.Outline = convexHull(points[i])
+		min := Point{math.Inf(1), math.Inf(1)}
+		max := Point{math.Inf(-1), math.Inf(-1)}
+		for _, p := range object.Outline {
+			min = Point{math.Min(min.X, p.X), math.Min(min.Y, p.Y)}
+			max = Point{math.Max(max.X, p.X), math.Max(max.Y, p.Y)}
+		}
+		object.Center = Point{(min.X + max.X) / 2, (min.Y + max.Y) / 2}
+	}
+	return objects, nil
+}
+
+// findMarkedObjects finds objects by the labels in a file, or returns nil if it doesn't have any
+func findMarkedObjects(lines []objectLine) *PrintObjects {
+	lastExtrusion := 0
+	for i, line := range lines {
+		if line.extrudes {
+			lastExtrusion = i + 1
+		}
+	}
+
+	var found [markerKinds]*PrintObjects
+	var open [markerKinds]int
+	for kind := range found {
+		found[kind] = &PrintObjects{}
+		open[kind] = -1
+	}
+	closeSection := func(kind, endLine int) {
+		if open[kind] < 0 {
+			return
+		}
+		section := &found[kind].Sections[open[kind]]
+		section.EndLine = endLine
+		open[kind] = -1
+	}
+	for i := range lines {
+		marker, ok := readObjectMarker(&lines[i].line)
+		if !ok {
+			continue
+		}
+		if marker.end {
+			closeSection(marker.kind, i+1)
+		}
+		if !marker.start {
+			continue
+		}
+		closeSection(marker.kind, i)
+		objects := found[marker.kind]
+		index := -1
+		for j, object := range objects.Objects {
+			if object.Name == marker.name {
+				index = j
+			}
+		}
+		if index < 0 {
+			index = len(objects.Objects)
+			objects.Objects = append(objects.Objects, PrintObject{Name: marker.name})
+		}
+		objects.Sections = append(objects.Sections, ObjectSection{Object: index, StartLine: i + 1})
+		open[marker.kind] = len(objects.Sections) - 1
+	}
+
+	for kind, objects := range found {
+		// a section that nothing said the end of doesn't go on past the end of the print, into the end gcode
+		unfinished := open[kind]
+		closeSection(kind, len(lines))
+		sections := objects.Sections[:0]
+		for i, section := range objects.Sections {
+			if i == unfinished && section.StartLine <= lastExtrusion {
+				section.EndLine = lastExtrusion
+			}
+			if sectionExtrudes(lines, section) {
+				sections = append(sections, section)
+			}
+		}
+		objects.Sections = sections
+		if len(sections) > 0 {
+			return removeEmptyObjects(objects)
+		}
+	}
+	return nil
+}
+
+func sectionExtrudes(lines []objectLine, section ObjectSection) bool {
+	for _, line := range lines[section.StartLine-1 : section.EndLine] {
+		if line.extrudes {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEmptyObjects leaves out objects that don't have any sections
+func removeEmptyObjects(objects *PrintObjects) *PrintObjects {
+	indexes := map[int]int{}
+	result := &PrintObjects{}
+	for _, section := range objects.Sections {
+		index, ok := indexes[section.Object]
+		if !ok {
+			index = len(result.Objects)
+			indexes[section.Object] = index
+			result.Objects = append(result.Objects, objects.Objects[section.Object])
+		}
+		section.Object = index
+		result.Sections = append(result.Sections, section)
+	}
+	return result
+}
+
+// objectCell is a square of the grid that extrusions are clustered on
+type objectCell struct {
+	x, y int
+}
+
+func cellOf(p Point) objectCell {
+	return objectCell{int(math.Floor(p.X / objectCellSize)), int(math.Floor(p.Y / objectCellSize))}
+}
+
+// clusterObjects finds objects by joining up everything that's extruded into pieces that don't touch
+func clusterObjects(lines []objectLine) *PrintObjects {
+	parent := map[objectCell]objectCell{}
+	var find func(c objectCell) objectCell
+	find = func(c objectCell) objectCell {
+		p, ok := parent[c]
+		if !ok {
+			parent[c] = c
+			return c
+		}
+		if p == c {
+			return c
+		}
+		root := find(p)
+		parent[c] = root
+		return root
+	}
+	union := func(a, b objectCell) {
+		a, b = find(a), find(b)
+		if a != b {
+			parent[b] = a
+		}
+	}
+	for _, line := range lines {
+		if !line.extrudes {
+			continue
+		}
+		length := math.Hypot(line.to.X-line.from.X, line.to.Y-line.from.Y)
+		steps := int(math.Ceil(2 * length / objectCellSize))
+		previous := cellOf(line.from)
+		find(previous)
+		for step := 1; step <= steps; step++ {
+			t := float64(step) / float64(steps)
+			c := cellOf(Point{line.from.X + t*(line.to.X-line.from.X), line.from.Y + t*(line.to.Y-line.from.Y)})
+			union(previous, c)
+			previous = c
+		}
+	}
+
+	// every piece is an object, except the ones that are only on the first layer
+	clusters := map[objectCell]int{}
+	var maxZ []float64
+	firstZ := math.Inf(1)
+	lineCluster := make([]int, len(lines))
+	for i, line := range lines {
+		if !line.extrudes {
+			continue
+		}
+		root := find(cellOf(line.to))
+		cluster, ok := clusters[root]
+		if !ok {
+			cluster = len(maxZ)
+			clusters[root] = cluster
+			maxZ = append(maxZ, line.z)
+		}
+		maxZ[cluster] = math.Max(maxZ[cluster], line.z)
+		firstZ = math.Min(firstZ, line.z)
+		lineCluster[i] = cluster
+	}
+	isObject := make([]bool, len(maxZ))
+	anyTaller := false
+	for cluster, z := range maxZ {
+		isObject[cluster] = z > firstZ+layerZTolerance
+		anyTaller = anyTaller || isObject[cluster]
+	}
+	if !anyTaller {
+		for cluster := range isObject {
+			isObject[cluster] = true
+		}
+	}
+
+	// a section starts where the one before it ended, and ends with the last extrusion (and any retract after it)
+	objects := &PrintObjects{}
+	current := -1
+	next := 0
+	traveled := false
+	for i, line := range lines {
+		switch {
+		case line.extrudes && !isObject[lineCluster[i]]:
+			current = -1
+			next = i + 1
+		case line.extrudes && current >= 0 && objects.Sections[current].Object == lineCluster[i]:
+			objects.Sections[current].EndLine = i + 1
+			next = i + 1
+		case line.extrudes:
+			objects.Sections = append(objects.Sections, ObjectSection{Object: lineCluster[i], StartLine: next + 1, EndLine: i + 1})
+			current = len(objects.Sections) - 1
+			next = i + 1
+		case line.retracts && current >= 0 && !traveled:
+			objects.Sections[current].EndLine = i + 1
+			next = i + 1
+		}
+		traveled = (traveled || line.travels) && !line.extrudes
+	}
+	objects.Objects = make([]PrintObject, len(maxZ))
+	objects = removeEmptyObjects(objects)
+	for i := range objects.Objects {
+		objects.Objects[i].Name = fmt.Sprintf("object_%d", i+1)
+	}
+	return objects
+}
+
+// convexHull is the convex hull of some points, anticlockwise (Andrew's monotone chain)
+func convexHull(points []Point) []Point {
+	sorted := append([]Point(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].X != sorted[j].X {
+			return sorted[i].X < sorted[j].X
+		}
+		return sorted[i].Y < sorted[j].Y
+	})
+	if len(sorted) < 3 {
+		return sorted
+	}
+	cross := func(o, a, b Point) float64 {
+		return (a.X-o.X)*(b.Y-o.Y) - (a.Y-o.Y)*(b.X-o.X)
+	}
+	hull := make([]Point, 0, 2*len(sorted))
+	for _, p := range sorted {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	lower := len(hull) + 1
+	for i := len(sorted) - 2; i >= 0; i-- {
+		p := sorted[i]
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	return hull[:len(hull)-1]
+}
+
+// objectLabels writes the commands that tell a firmware where objects are
+type objectLabels struct {
+	// define is written at the start of the file, and start and end around each section of an object
+	define     func(objects []PrintObject) []string
+	start, end func(index int, object *PrintObject) string
+	// maxObjects is how many objects the firmware can keep track of, if there's a limit
+	maxObjects int
+}
+
+// klipperName makes a name safe to use as a parameter of an extended command
+func klipperName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func labelsFor(flavor *Flavor) (*objectLabels, error) {
+	number := func(f float64) string {
+		return floatToString(f, 3, true)
+	}
+	switch {
+	case flavor.ExtendedCommands:
+		return &objectLabels{
+			define: func(objects []PrintObject) []string {
+				lines := []string{}
+				for _, object := range objects {
+					points := make([]string, len(object.Outline))
+					for i, p := range object.Outline {
+						points[i] = fmt.Sprintf("[%s,%s]", number(p.X), number(p.Y))
+					}
+					lines = append(lines, fmt.Sprintf("EXCLUDE_OBJECT_DEFINE NAME=%s CENTER=%s,%s POLYGON=[%s]",
+						klipperName(object.Name), number(object.Center.X), number(object.Center.Y), strings.Join(points, ",")))
+				}
+				return lines
+			},
+			start: func(index int, object *PrintObject) string {
+				return "EXCLUDE_OBJECT_START NAME=" + klipperName(object.Name)
+			},
+			end: func(index int, object *PrintObject) string {
+				return "EXCLUDE_OBJECT_END NAME=" + klipperName(object.Name)
+			},
+		}, nil
+	case flavor.Commands["M624"]:
+		// Bambu's firmware takes a bit mask of objects, as 8 bytes of base64
+		return &objectLabels{
+			define: func(objects []PrintObject) []string {
+				return nil
+			},
+			start: func(index int, object *PrintObject) string {
+				mask := make([]byte, 8)
+				binary.LittleEndian.PutUint64(mask, 1<<uint(index))
+				return "M624 " + base64.StdEncoding.EncodeToString(mask)
+			},
+			end: func(index int, object *PrintObject) string {
+				return "M625"
+			},
+			maxObjects: 64,
+		}, nil
+	case flavor.Commands["M486"]:
+		return &objectLabels{
+			define: func(objects []PrintObject) []string {
+				lines := []string{fmt.Sprintf("M486 T%d", len(objects))}
+				for i, object := range objects {
+					lines = append(lines, fmt.Sprintf("; object %d is %s", i, object.Name))
+				}
+				return lines
+			},
+			start: func(index int, object *PrintObject) string {
+				return fmt.Sprintf("M486 S%d", index)
+			},
+			end: func(index int, object *PrintObject) string {
+				return "M486 S-1"
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("%s firmware can't cancel objects", flavor.Name)
+}
+
+// isObjectLabel is whether a line is a command that labels objects (for any firmware)
+func isObjectLabel(line *GcodeLine) bool {
+	return line.IsExtended("EXCLUDE_OBJECT_DEFINE") || line.IsExtended("EXCLUDE_OBJECT_START") ||
+		line.IsExtended("EXCLUDE_OBJECT_END") || line.IsM(486) || line.IsM(624) || line.IsM(625)
+}
+
+// LabelObjects labels the objects in a print (see FindObjects) so that the firmware can cancel them while it's
+// printing: EXCLUDE_OBJECT_DEFINE/START/END for Klipper, M624/M625 for Bambu printers, and M486 for Marlin and
+// Prusa's firmware. Any labels that the file already had are replaced.
+func LabelObjects(flavor *Flavor, gcode string, w io.Writer) (*PrintObjects, error) {
+	labels, err := labelsFor(flavor)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := FindObjects(flavor.Dialect, gcode)
+	if err != nil {
+		return nil, err
+	}
+	if labels.maxObjects != 0 && len(objects.Objects) > labels.maxObjects {
+		return nil, fmt.Errorf("there are %d objects, but %s firmware can only cancel up to %d", len(objects.Objects),
+			flavor.Name, labels.maxObjects)
+	}
+
+	out := bufio.NewWriter(w)
+	for _, line := range labels.define(objects.Objects) {
+		fmt.Fprintln(out, line)
+	}
+	sections := objects.Sections
+	for i, lineStr := range strings.Split(strings.TrimSuffix(gcode, "\n"), "\n") {
+		lineNumber := i + 1
+		if len(sections) > 0 && lineNumber == sections[0].StartLine {
+			fmt.Fprintln(out, labels.start(sections[0].Object, &objects.Objects[sections[0].Object]))
+		}
+		// the file has already been parsed, so this can't fail
+		line, _ := flavor.Dialect.ParseLine(lineStr)
+		if !isObjectLabel(&line) {
+			fmt.Fprintln(out, lineStr)
+		}
+		if len(sections) > 0 && lineNumber == sections[0].EndLine {
+			fmt.Fprintln(out, labels.end(sections[0].Object, &objects.Objects[sections[0].Object]))
+			sections = sections[1:]
+		}
+	}
+	return objects, out.Flush()
+}
+
+// CancelConfig is how CancelObjects leaves objects out of a print
+type CancelConfig struct {
+	Dialect Dialect
+	// TravelFeedrate and ZFeedrate are how fast to move to where the print carries on, after an object that was left
+	// out, in mm/min. They default to 6000 and 600
+	TravelFeedrate float64
+	ZFeedrate      float64
+}
+
+func (cfg *CancelConfig) init() {
+	if cfg.TravelFeedrate == 0 {
+		cfg.TravelFeedrate = 6000
+	}
+	if cfg.ZFeedrate == 0 {
+		cfg.ZFeedrate = 600
+	}
+}
+
+// CancelObjects leaves some objects (by name) out of a print, before it's printed. Their moves are left out, but
+// everything else (like temperature and fan changes) is kept, and so are retracts and primes, so that the filament
+// ends up where the rest of the print expects it to be. After each section that's left out, the nozzle moves to
+// where the print carries on from and E is set with G92.
+func CancelObjects(cfg CancelConfig, gcode string, names []string, w io.Writer) (*PrintObjects, error) {
+	cfg.init()
+	objects, err := FindObjects(cfg.Dialect, gcode)
+	if err != nil {
+		return nil, err
+	}
+	cancelled := map[int]bool{}
+	for _, name := range names {
+		index, err := objects.Index(name)
+		if err != nil {
+			return nil, err
+		}
+		cancelled[index] = true
+	}
+	lineStrs := strings.Split(strings.TrimSuffix(gcode, "\n"), "\n")
+	skip := make([]bool, len(lineStrs))
+	for _, section := range objects.Sections {
+		if cancelled[section.Object] {
+			for i := section.StartLine - 1; i < section.EndLine; i++ {
+				skip[i] = true
+			}
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	// state is where the print thinks that the printer is, and firmware is where it actually is
+	var state, firmware MachineState
+	write := func(lineStr string) {
+		fmt.Fprintln(out, lineStr)
+		// lines that are written are either from the file (which has already been parsed) or made here
+		line, _ := cfg.Dialect.ParseLine(lineStr)
+		firmware.Apply(&line)
+	}
+	for i, lineStr := range lineStrs {
+		line, _ := cfg.Dialect.ParseLine(lineStr)
+		if !skip[i] {
+			if i > 0 && skip[i-1] {
+				catchUp(&state, &firmware, &cfg, write)
+			}
+			state.Apply(&line)
+			write(lineStr)
+			continue
+		}
+
+		if !line.IsMove() {
+			state.Apply(&line)
+			write(lineStr)
+			continue
+		}
+		delta := state.ExtrusionDelta(&line)
+		state.Apply(&line)
+		if line.Xvalid || line.Yvalid || line.Zvalid || line.IsG(2) || line.IsG(3) || delta == 0 {
+			continue
+		}
+		// a retract or prime
+		feedrate := ""
+		if line.Feedrate != 0 {
+			feedrate = " F" + formatNumber(line.Feedrate)
+		}
+		if state.RelativeExtrusion {
+			write(fmt.Sprintf("G1 E%s%s", formatNumber(delta), feedrate))
+		} else {
+			write(fmt.Sprintf("G1 E%s%s", formatNumber(firmware.E+delta), feedrate))
+		}
+	}
+	return objects, out.Flush()
+}
+
+// catchUp gets the printer to where the print expects it to be, after moves were left out
+func catchUp(state, firmware *MachineState, cfg *CancelConfig, write func(string)) {
+	if state.X != firmware.X || state.Y != firmware.Y || state.Z != firmware.Z {
+		if state.RelativeCoordinates {
+			write("G90")
+		}
+		xy := fmt.Sprintf("G0 X%s Y%s F%s", formatNumber(state.X), formatNumber(state.Y), formatNumber(cfg.TravelFeedrate))
+		z := fmt.Sprintf("G0 Z%s F%s", formatNumber(state.Z), formatNumber(cfg.ZFeedrate))
+		// go up before moving across, and across before going down, so as not to hit the print
+		if state.Z > firmware.Z {
+			write(z)
+			write(xy)
+		} else {
+			write(xy)
+			if state.Z != firmware.Z {
+				write(z)
+			}
+		}
+		if state.RelativeCoordinates {
+			write("G91")
+			// G90 made extrusion absolute as well, on firmware like Marlin
+			if state.RelativeExtrusion {
+				write("M83")
+			}
+		}
+		if state.Feedrate != 0 {
+			write("G1 F" + formatNumber(state.Feedrate))
+		}
+	}
+	if !state.RelativeExtrusion && state.E != firmware.E {
+		write("G92 E" + formatNumber(state.E))
+	}
+}
@@ -0,0 +1,185 @@
+package gcodetools
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// twoSquaresGcode prints two 20mm squares, 30mm apart, with a skirt around them on the first layer. mark writes
+// whatever a slicer writes before and after each of them.
+func twoSquaresGcode(layers int, mark func(object int, start bool) string) string {
+	lines := []string{"; start", "G28", "M82", "G92 E0", "G1 X0 Y0 Z0.2 F3000", "G1 X100 E5 ; purge"}
+	e := 5.0
+	extrude := func(x, y float64) string {
+		e++
+		return fmt.Sprintf("G1 X%v Y%v E%v", x, y, e)
+	}
+	for layer := 0; layer < layers; layer++ {
+		lines = append(lines, fmt.Sprintf("G1 Z%.1f F600 ; layer %d", 0.2*float64(layer+1), layer))
+		if layer == 0 {
+			lines = append(lines, "G0 X5 Y5 F6000", extrude(85, 5), extrude(85, 35), extrude(5, 35), extrude(5, 5))
+		}
+		for object, x := range []float64{10, 60} {
+			if mark != nil {
+				lines = append(lines, mark(object, true))
+			}
+			lines = append(lines,
+				fmt.Sprintf("G0 X%v Y10 F6000", x),
+				fmt.Sprintf("G1 E%v F2400 ; prime", e),
+				extrude(x+20, 10), extrude(x+20, 30), extrude(x, 30), extrude(x, 10),
+				fmt.Sprintf("G1 E%v F2400 ; retract", e-1),
+			)
+			if mark != nil {
+				lines = append(lines, mark(object, false))
+			}
+		}
+	}
+	lines = append(lines, "; end", "G1 Z10", "M104 S0")
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestFindObjects(t *testing.T) {
+	objects, err := FindObjects(DialectRepRap, twoSquaresGcode(2, nil))
+	assert.NoError(t, err)
+	if !assert.Len(t, objects.Objects, 2) {
+		return
+	}
+	assert.Equal(t, PrintObject{
+		Name:    "object_1",
+		Outline: []Point{{10, 10}, {30, 10}, {30, 30}, {10, 30}},
+		Center:  Point{20, 20},
+	}, objects.Objects[0])
+	assert.Equal(t, "object_2", objects.Objects[1].Name)
+	assert.Equal(t, Point{70, 20}, objects.Objects[1].Center)
+	// each section starts after the one before it (or the skirt), and ends with the retract
+	assert.Equal(t, []ObjectSection{
+		{Object: 0, StartLine: 13, EndLine: 19},
+		{Object: 1, StartLine: 20, EndLine: 26},
+		{Object: 0, StartLine: 27, EndLine: 34},
+		{Object: 1, StartLine: 35, EndLine: 41},
+	}, objects.Sections)
+
+	_, err = FindObjects(DialectRepRap, "G28\nG1 X10\n")
+	assert.EqualError(t, err, "there aren't any objects")
+}
+
+func TestFindObjects_labelled(t *testing.T) {
+	for name, mark := range map[string]func(object int, start bool) string{
+		"prusaslicer": func(object int, start bool) string {
+			if start {
+				return fmt.Sprintf("; printing object square.stl id:%d copy 0", object)
+			}
+			return fmt.Sprintf("; stop printing object square.stl id:%d copy 0", object)
+		},
+		"klipper": func(object int, start bool) string {
+			if start {
+				return fmt.Sprintf("EXCLUDE_OBJECT_START NAME=square.stl_id_%d_copy_0", object)
+			}
+			return fmt.Sprintf("EXCLUDE_OBJECT_END NAME=square.stl_id_%d_copy_0", object)
+		},
+		"cura": func(object int, start bool) string {
+			if start {
+				return fmt.Sprintf(";MESH:square.stl(%d)", object)
+			}
+			return ";TYPE:SUPPORT"
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			objects, err := FindObjects(DialectRepRap, twoSquaresGcode(2, mark))
+			assert.NoError(t, err)
+			if !assert.Len(t, objects.Objects, 2) || !assert.Len(t, objects.Sections, 4) {
+				return
+			}
+			assert.Contains(t, objects.Objects[1].Name, "1")
+			assert.Equal(t, Point{70, 20}, objects.Objects[1].Center)
+			assert.Equal(t, 13, objects.Sections[0].StartLine)
+			if name == "cura" {
+				// Cura doesn't say where the last object ends, so it goes up to the last extrusion
+				assert.Equal(t, 47, objects.Sections[3].EndLine)
+			} else {
+				assert.Equal(t, 21, objects.Sections[0].EndLine)
+			}
+		})
+	}
+}
+
+func TestLabelObjects(t *testing.T) {
+	var out strings.Builder
+	_, err := LabelObjects(FlavorKlipper, twoSquaresGcode(2, nil), &out)
+	assert.NoError(t, err)
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal(t, "EXCLUDE_OBJECT_DEFINE NAME=object_1 CENTER=20,20 POLYGON=[[10,10],[30,10],[30,30],[10,30]]", lines[0])
+	assert.Equal(t, "EXCLUDE_OBJECT_DEFINE NAME=object_2 CENTER=70,20 POLYGON=[[60,10],[80,10],[80,30],[60,30]]", lines[1])
+	assert.Equal(t, []string{"EXCLUDE_OBJECT_START NAME=object_1", "G0 X10 Y10 F6000"}, lines[14:16])
+	assert.Equal(t, []string{"G1 E12 F2400 ; retract", "EXCLUDE_OBJECT_END NAME=object_1", "EXCLUDE_OBJECT_START NAME=object_2"}, lines[21:24])
+
+	// labelling it again gives the same thing
+	var again strings.Builder
+	_, err = LabelObjects(FlavorKlipper, out.String(), &again)
+	assert.NoError(t, err)
+	assert.Equal(t, out.String(), again.String())
+
+	out.Reset()
+	_, err = LabelObjects(FlavorMarlin, twoSquaresGcode(2, nil), &out)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.String(), "M486 T2\n; object 0 is object_1\n; object 1 is object_2\n"))
+	assert.Contains(t, out.String(), "\nG1 E12 F2400 ; retract\nM486 S-1\nM486 S1\n")
+
+	out.Reset()
+	_, err = LabelObjects(FlavorBambu, twoSquaresGcode(2, nil), &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "\nM625\nM624 AgAAAAAAAAA=\n")
+
+	_, err = LabelObjects(FlavorGeneric, twoSquaresGcode(2, nil), &out)
+	assert.EqualError(t, err, "generic firmware can't cancel objects")
+}
+
+func TestCancelObjects(t *testing.T) {
+	original := twoSquaresGcode(2, nil)
+	var out strings.Builder
+	_, err := CancelObjects(CancelConfig{Dialect: DialectRepRap}, original, []string{"OBJECT_1"}, &out)
+	assert.NoError(t, err)
+
+	// nothing goes near the first square, and the second is printed exactly as it was
+	var state MachineState
+	extruded := 0.0
+	for _, lineStr := range strings.Split(out.String(), "\n") {
+		line, err := ParseLine(lineStr)
+		assert.NoError(t, err)
+		delta := 0.0
+		if line.IsG(0) || line.IsG(1) {
+			delta = state.ExtrusionDelta(&line)
+		}
+		state.Apply(&line)
+		if delta > 0 && state.Z > 0 && state.X < 50 && state.X > 5 {
+			t.Errorf("it still prints the first square: %s", lineStr)
+		}
+		extruded += delta
+	}
+	// everything but the 8mm that the first square took
+	assert.InDelta(t, 24-8, extruded, 1e-9)
+	assert.InDelta(t, 10, state.Z, 1e-9)
+
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal(t, []string{
+		"G1 Z0.2 F600 ; layer 0",
+		"G0 X5 Y5 F6000",
+		"G1 X85 Y5 E6",
+		"G1 X85 Y35 E7",
+		"G1 X5 Y35 E8",
+		"G1 X5 Y5 E9",
+		// the retract is kept
+		"G1 E8 F2400",
+		"G0 X10 Y10 F6000",
+		"G1 F2400",
+		"G92 E12",
+		"G0 X60 Y10 F6000",
+		"G1 E13 F2400 ; prime",
+	}, lines[6:18])
+
+	_, err = CancelObjects(CancelConfig{Dialect: DialectRepRap}, original, []string{"nope"}, &out)
+	assert.EqualError(t, err, `there is no object "nope" (the objects are object_1, object_2)`)
+}
@@ -0,0 +1,115 @@
+package gcodetools
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// minChunkLines is the fewest lines that are worth handing to another goroutine
+const minChunkLines = 4096
+
+// minifyChunk is a part of a file, with the minifier's state at the start of it
+type minifyChunk struct {
+	start, end int // line indexes
+	minifier   lineMinifier
+	output     []string
+	// panicked is what minifying the chunk panicked with, if it did
+	panicked interface{}
+}
+
+// minifyGcodeStrParallel is MinifyGcodeStr on cfg.Workers goroutines. The state at the start of every chunk comes from
+// a first pass that only keeps track of the state (with the fast parser), without minifying or formatting anything,
+// which is the part that can't be split up. The chunks are then minified from those states at the same time, so the
+// output is exactly the same as it is sequentially.
+func (cfg *GcodeMinifierConfig) minifyGcodeStrParallel(initialState MachineState, gcodeStr string) (output string, state MachineState) {
+	strLines := strings.Split(gcodeStr, "\n")
+	chunkLines := len(strLines) / (4 * cfg.Workers)
+	if chunkLines < minChunkLines {
+		chunkLines = minChunkLines
+	}
+
+	// the first pass, to find the state at the start of each chunk
+	var chunks []*minifyChunk
+	m := cfg.newLineMinifier(initialState)
+	var fastLine FastLine
+	gcodeBytes := []byte(gcodeStr)
+	for i, strLine := range strLines {
+		if i%chunkLines == 0 {
+			chunks = append(chunks, &minifyChunk{start: i, minifier: m})
+		}
+		lineBytes := gcodeBytes
+		if newline := bytes.IndexByte(gcodeBytes, '\n'); newline >= 0 {
+			lineBytes, gcodeBytes = gcodeBytes[:newline], gcodeBytes[newline+1:]
+		}
+		lineBytes = bytes.TrimRight(lineBytes, "\r")
+		strLine = strings.TrimRight(strLine, "\r")
+
+		var g GcodeLine
+		var err error
+		if m.dialect == DialectRepRap {
+			err = ParseFast(&fastLine, lineBytes)
+			g = fastLine.GcodeLine()
+		} else {
+			g, err = m.dialect.ParseLine(strLine)
+		}
+		if err != nil {
+			panic(err) // TODO: better error handling
+		}
+		m.track(strLine, &g)
+	}
+	state = m.finish()
+	for i, chunk := range chunks {
+		if i+1 < len(chunks) {
+			chunk.end = chunks[i+1].start
+		} else {
+			chunk.end = len(strLines)
+		}
+	}
+
+	// the second pass, the same as MinifyGcodeStr for each chunk
+	work := make(chan *minifyChunk)
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range work {
+				chunk.minify(strLines)
+			}
+		}()
+	}
+	for _, chunk := range chunks {
+		work <- chunk
+	}
+	close(work)
+	wg.Wait()
+
+	outputLines := make([]string, 0, len(strLines)+1)
+	for _, chunk := range chunks {
+		if chunk.panicked != nil {
+			// the same as it would have sequentially, from the first line that the minifier can't handle
+			panic(chunk.panicked)
+		}
+		outputLines = append(outputLines, chunk.output...)
+	}
+	// an empty line at the end, so that there's a trailing newline
+	outputLines = append(outputLines, "")
+	output = strings.Join(outputLines, "\n")
+	return
+}
+
+// minify minifies the chunk's lines into its output. A panic is kept for minifyGcodeStrParallel, since it would
+// otherwise take the whole program down from this goroutine.
+func (chunk *minifyChunk) minify(strLines []string) {
+	defer func() {
+		chunk.panicked = recover()
+	}()
+	chunk.output = make([]string, 0, chunk.end-chunk.start)
+	for _, strLine := range strLines[chunk.start:chunk.end] {
+		strLine = strings.TrimRight(strLine, "\r")
+		// this can't fail, since the first pass already parsed everything
+		g, _ := chunk.minifier.dialect.ParseLine(strLine)
+		chunk.output = chunk.minifier.appendLine(chunk.output, strLine, &g)
+	}
+}
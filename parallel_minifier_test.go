@@ -0,0 +1,133 @@
+package gcodetools
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+// parallelTestGcode is a long file with everything that changes the minifier's state in it, so that the chunks start
+// in all sorts of states
+func parallelTestGcode(lines int, metaBlocks bool) string {
+	r := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	buf.WriteString("; generated\nM104 S210\nG28\nM82\nG92 E0\n")
+	e := 0.0
+	for i := 0; i < lines; i++ {
+		x, y := float64(r.Intn(2000))/10, float64(r.Intn(2000))/10
+		switch r.Intn(40) {
+		case 0:
+			fmt.Fprintf(&buf, ";LAYER:%d\nG1 Z%.2f F600\n", i, float64(i)/1000)
+		case 1:
+			buf.WriteString("G92 E0\n")
+			e = 0
+		case 2:
+			fmt.Fprintf(&buf, "T%d\n", r.Intn(2))
+		case 3:
+			buf.WriteString("M83\nG1 E-1 F2400\nG1 E1\nM82\n")
+		case 4:
+			buf.WriteString("G91\nG1 Z.2\nG1 Z-.2\nG90\n")
+		case 5:
+			fmt.Fprintf(&buf, "M106 S%d\n", r.Intn(256))
+		case 6:
+			// the same place again, or nearly
+			buf.WriteString("G1 X10 Y10\nG1 X10.0001 Y10 F1200\n")
+		case 7:
+			if metaBlocks {
+				buf.WriteString("if move.axes[0].homed\n  G1 X5 Y5\n  G1 X6\nG1 X7 Y7\n")
+			}
+		default:
+			e += r.Float64()
+			fmt.Fprintf(&buf, "G1 X%.3f Y%.3f E%.5f ; move\n", x, y, e)
+		}
+	}
+	return buf.String()
+}
+
+func TestGcodeMinifierConfig_MinifyGcodeStr_parallel(t *testing.T) {
+	gcodeStr := parallelTestGcode(50000, false)
+	for _, removeComments := range []bool{true, false} {
+		sequentialCfg := (&GcodeMinifierConfig{RemoveComments: removeComments}).Init()
+		expected, expectedState := sequentialCfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+
+		for _, workers := range []int{2, 3, 8} {
+			cfg := (&GcodeMinifierConfig{RemoveComments: removeComments, Workers: workers}).Init()
+			output, state := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+			assert.True(t, expected == output, "output with %d workers isn't the same", workers)
+			assert.Equal(t, expectedState, state)
+		}
+	}
+}
+
+func TestGcodeMinifierConfig_MinifyGcodeStr_parallelMetaBlocks(t *testing.T) {
+	gcodeStr := parallelTestGcode(50000, true)
+	sequentialCfg := (&GcodeMinifierConfig{Flavor: FlavorRepRapFirmware}).Init()
+	expected, _ := sequentialCfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+
+	cfg := (&GcodeMinifierConfig{Flavor: FlavorRepRapFirmware, Workers: 4}).Init()
+	output, _ := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	assert.True(t, expected == output)
+}
+
+func TestGcodeMinifierConfig_MinifyGcodeStr_parallelCNC(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("%\nG21 G90 G17\n")
+	for i := 0; i < 20000; i++ {
+		switch i % 50 {
+		case 0:
+			buf.WriteString("G20\n")
+		case 25:
+			buf.WriteString("G21\n")
+		case 10:
+			buf.WriteString("G54 (work offset)\n")
+		case 30:
+			buf.WriteString("/G0 Z5\n")
+		}
+		fmt.Fprintf(&buf, "G1 X%d Y%d F100\nX%d\n", i%7, i%11, i%13)
+	}
+	buf.WriteString("M2\n%")
+	gcodeStr := buf.String()
+
+	sequentialCfg := (&GcodeMinifierConfig{CNC: true}).Init()
+	expected, expectedState := sequentialCfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	cfg := (&GcodeMinifierConfig{CNC: true, Workers: 4}).Init()
+	output, state := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	assert.True(t, expected == output)
+	assert.Equal(t, fmt.Sprint(expectedState), fmt.Sprint(state)) // NaN != NaN
+}
+
+func TestGcodeMinifierConfig_MinifyGcodeStr_parallelPanics(t *testing.T) {
+	// the panic comes from the goroutine that calls MinifyGcodeStr, so that it can be recovered like it is sequentially
+	gcodeStr := parallelTestGcode(50000, false) + "M9999\n"
+	cfg := (&GcodeMinifierConfig{Workers: 4}).Init()
+	assert.PanicsWithValue(t, "unimplemented: GcodeLine{CmdLetter: 'M', CmdNumber: 9999,}", func() {
+		cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	})
+}
+
+func benchmarkMinifyGcodeStr(b *testing.B, workers int) {
+	gcodeStr := parallelTestGcode(100000, false)
+	cfg := (&GcodeMinifierConfig{Workers: workers}).Init()
+	b.SetBytes(int64(len(gcodeStr)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	}
+}
+
+func BenchmarkGcodeMinifierConfig_MinifyGcodeStr(b *testing.B) {
+	benchmarkMinifyGcodeStr(b, 0)
+}
+
+// the part that isn't split up between the workers (splitting the lines, the first pass and joining the output) is
+// about a sixth of the work, so with n cores this should take about 1/6 + 5/6n of the time that the sequential
+// benchmark does
+func BenchmarkGcodeMinifierConfig_MinifyGcodeStr_parallel(b *testing.B) {
+	for _, workers := range []int{2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkMinifyGcodeStr(b, workers)
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package gcodetools
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -10,33 +12,110 @@ import (
 const CommentChar = ';'
 const G = byte('G')
 const M = byte('M')
+const T = byte('T')
 
 type GcodeLine struct {
-	CmdLetter     uint8 // e.g. G0/G1 or M83 or whatever
-	CmdNumber     uint16
-	X             float64
-	Y             float64
-	Z             float64
-	E             float64
-	Xvalid        bool
-	Yvalid        bool
-	Zvalid        bool
-	Evalid        bool
-	Feedrate      float64 // Feedrate == 0 is obviously invalid
-	NumericParams map[uint8]float64
-	StringParams  map[uint8]string
-	Comment       *string
+	CmdLetter uint8 // e.g. G0/G1 or M83 or whatever
+	CmdNumber uint16
+	// CmdSubcode is the 2 in G38.2. Commands with a subcode aren't the same as the command without one
+	CmdSubcode      uint8
+	CmdSubcodeValid bool
+	X               float64
+	Y               float64
+	Z               float64
+	E               float64
+	Xvalid          bool
+	Yvalid          bool
+	Zvalid          bool
+	Evalid          bool
+	Feedrate        float64 // Feedrate == 0 is obviously invalid
+	NumericParams   map[uint8]float64
+	StringParams    map[uint8]string
+	// ExtendedCmd is a Klipper-style extended command, like SET_PRESSURE_ADVANCE. When it's set, CmdLetter is 0 and
+	// the parameters are in ExtendedParams instead (in the order that they were written)
+	ExtendedCmd    string
+	ExtendedParams []ExtendedParam
+	// MetaCmd is a RepRapFirmware meta command keyword (like "if" or "echo"), and MetaArgs is the rest of the line
+	// after it (without the comment). Meta commands aren't understood, just kept.
+	MetaCmd  string
+	MetaArgs string
+	// Text is what comes after a command that takes free text instead of parameters, like the message in M117 or the
+	// file name in M23. It's kept exactly as it was written.
+	Text string
+	// LineNumber is the N123 that a host puts at the start of a line, and Checksum is the *71 that it puts at the end.
+	// When a line is formatted, the checksum is recalculated (since the rest of the line could have changed)
+	LineNumber      int
+	LineNumberValid bool
+	Checksum        uint8
+	ChecksumValid   bool
+	Comment         *string
+
+	// these are only used by DialectCNC
+
+	// InlineComments are (parenthesised comments) in the middle of the line
+	InlineComments []InlineComment
+	// ExtraCmds are the other commands on the same line, like the G90 and G21 in G90 G21 G0 X10, which run first
+	ExtraCmds []GcodeLine
+	// BlockDelete is a line that starts with /, which the machine can be told to skip
+	BlockDelete bool
+	// ProgramDelimiter is a % line, at the start and end of a program
+	ProgramDelimiter bool
+	// ProgramNumber is O1234 at the start of the program
+	ProgramNumber      int
+	ProgramNumberValid bool
+}
+
+// ExtendedParam is one KEY=VALUE parameter of an extended command. Value is kept exactly as it was written
+// (including any quotes or brackets), so that it can be written back out unchanged.
+type ExtendedParam struct {
+	Key   string
+	Value string
 }
 
 func (g *GcodeLine) IsCmd(cmdLetter uint8, cmdNumber uint16) bool {
-	return g.CmdLetter == cmdLetter && g.CmdNumber == cmdNumber
+	return g.CmdLetter == cmdLetter && g.CmdNumber == cmdNumber && !g.CmdSubcodeValid
 }
 
 func (g *GcodeLine) IsG(cmdNumber uint16) bool {
-	return g.CmdLetter == G && g.CmdNumber == cmdNumber
+	return g.IsCmd(G, cmdNumber)
 }
 func (g *GcodeLine) IsM(cmdNumber uint16) bool {
-	return g.CmdLetter == M && g.CmdNumber == cmdNumber
+	return g.IsCmd(M, cmdNumber)
+}
+func (g *GcodeLine) IsT(cmdNumber uint16) bool {
+	return g.IsCmd(T, cmdNumber)
+}
+
+// IsMove is whether the line is a straight (G0, G1) or arc (G2, G3) move
+func (g *GcodeLine) IsMove() bool {
+	return g.IsG(0) || g.IsG(1) || g.IsG(2) || g.IsG(3)
+}
+
+// IsCmdSub is like IsCmd, for commands with a subcode (like G38.2)
+func (g *GcodeLine) IsCmdSub(cmdLetter uint8, cmdNumber uint16, subcode uint8) bool {
+	return g.CmdLetter == cmdLetter && g.CmdNumber == cmdNumber && g.CmdSubcodeValid && g.CmdSubcode == subcode
+}
+
+func (g *GcodeLine) IsGSub(cmdNumber uint16, subcode uint8) bool {
+	return g.IsCmdSub(G, cmdNumber, subcode)
+}
+func (g *GcodeLine) IsMSub(cmdNumber uint16, subcode uint8) bool {
+	return g.IsCmdSub(M, cmdNumber, subcode)
+}
+
+// IsExtended is whether the line is the extended command name (case insensitive, like Klipper)
+func (g *GcodeLine) IsExtended(name string) bool {
+	return g.ExtendedCmd != "" && strings.EqualFold(g.ExtendedCmd, name)
+}
+
+// ExtendedParam looks up a parameter of an extended command by key (case insensitive, like Klipper)
+func (g *GcodeLine) ExtendedParam(key string) (value string, ok bool) {
+	for _, param := range g.ExtendedParams {
+		if strings.EqualFold(param.Key, key) {
+			return param.Value, true
+		}
+	}
+	return "", false
 }
 
 func (g GcodeLine) String() string {
@@ -48,6 +127,25 @@ func (g GcodeLine) String() string {
 	if g.CmdLetter != 0 { // if g.CmdLetter == 0, this line is probably a comment (or some other thing we don't know how to parse...)
 		_, _ = fmt.Fprintf(&buf, "CmdLetter: '%c', CmdNumber: %v,", g.CmdLetter, g.CmdNumber)
 	}
+	if g.CmdSubcodeValid {
+		_, _ = fmt.Fprintf(&buf, "CmdSubcode: %v, CmdSubcodeValid: true,", g.CmdSubcode)
+	}
+	if g.ExtendedCmd != "" {
+		_, _ = fmt.Fprintf(&buf, "ExtendedCmd: %#q,", g.ExtendedCmd)
+	}
+	if g.MetaCmd != "" {
+		_, _ = fmt.Fprintf(&buf, "MetaCmd: %#q, MetaArgs: %#q,", g.MetaCmd, g.MetaArgs)
+	}
+	if g.Text != "" {
+		_, _ = fmt.Fprintf(&buf, "Text: %#q,", g.Text)
+	}
+	if g.ExtendedParams != nil {
+		_, _ = fmt.Fprint(&buf, "ExtendedParams: []ExtendedParam{")
+		for _, param := range g.ExtendedParams {
+			_, _ = fmt.Fprintf(&buf, "{%#q, %#q},", param.Key, param.Value)
+		}
+		_, _ = fmt.Fprint(&buf, "},")
+	}
 	if g.Xvalid {
 		_, _ = fmt.Fprintf(&buf, "X: %v, Xvalid: true,", g.X)
 	}
@@ -77,6 +175,12 @@ func (g GcodeLine) String() string {
 		}
 		_, _ = fmt.Fprint(&buf, "},")
 	}
+	if g.LineNumberValid {
+		_, _ = fmt.Fprintf(&buf, "LineNumber: %v, LineNumberValid: true,", g.LineNumber)
+	}
+	if g.ChecksumValid {
+		_, _ = fmt.Fprintf(&buf, "Checksum: %v, ChecksumValid: true,", g.Checksum)
+	}
 	if g.Comment != nil {
 		_, _ = fmt.Fprintf(&buf, "Comment: &comment%d,", g.Comment)
 	}
@@ -85,34 +189,46 @@ func (g GcodeLine) String() string {
 }
 
 func (g *GcodeLine) CommentOnly() bool {
-	return g.CmdLetter == 0 &&
-		g.CmdNumber == 0 &&
-		!g.Xvalid &&
-		!g.Yvalid &&
-		!g.Zvalid &&
-		!g.Evalid &&
-		g.Feedrate == 0 &&
-		(g.NumericParams == nil || len(g.NumericParams) == 0) &&
-		(g.StringParams == nil || len(g.StringParams) == 0) &&
-		(g.Comment != nil && len(*g.Comment) > 0)
+	return !g.hasContent() && g.hasComment()
 }
 
 func (g *GcodeLine) Empty() bool {
-	return g.CmdLetter == 0 &&
-		g.CmdNumber == 0 &&
-		!g.Xvalid &&
-		!g.Yvalid &&
-		!g.Zvalid &&
-		!g.Evalid &&
-		g.Feedrate == 0 &&
-		(g.NumericParams == nil || len(g.NumericParams) == 0) &&
-		(g.StringParams == nil || len(g.StringParams) == 0) &&
-		(g.Comment == nil || len(*g.Comment) == 0)
+	return !g.hasContent() && !g.hasComment()
+}
+
+// hasContent is whether the line has anything other than comments
+func (g *GcodeLine) hasContent() bool {
+	return g.CmdLetter != 0 ||
+		g.ExtendedCmd != "" ||
+		g.MetaCmd != "" ||
+		g.Text != "" ||
+		g.CmdNumber != 0 ||
+		g.Xvalid ||
+		g.Yvalid ||
+		g.Zvalid ||
+		g.Evalid ||
+		g.Feedrate != 0 ||
+		len(g.NumericParams) > 0 ||
+		len(g.StringParams) > 0 ||
+		len(g.ExtraCmds) > 0 ||
+		g.ProgramDelimiter ||
+		g.ProgramNumberValid
+}
+
+func (g *GcodeLine) hasComment() bool {
+	return (g.Comment != nil && len(*g.Comment) > 0) || len(g.InlineComments) > 0
 }
 
 //var gcodeLineRegexp = regexp.MustCompile(`([GgMm]\d+)(?:\s+([A-Za-z]\S*))*(;.*)?`)
 
+// ParseLine parses a line of 3d printer gcode (DialectRepRap)
 func ParseLine(str string) (line GcodeLine, err error) {
+	return parseRepRapLine(str, false)
+}
+
+// parseRepRapLine parses a line of 3d printer gcode. RepRapFirmware (rrf) also has quoted strings, {expressions} and
+// meta commands, which can have spaces and semicolons in them.
+func parseRepRapLine(str string, rrf bool) (line GcodeLine, err error) {
 	i := 0
 	for i < len(str) && isSpace(str[i]) {
 		i++
@@ -127,9 +243,13 @@ func ParseLine(str string) (line GcodeLine, err error) {
 		return
 	}
 
+	// a ; inside of a quoted string isn't a comment
 	commentStartChar := i
+	inQuote := false
 	for ; commentStartChar < len(str); commentStartChar++ {
-		if str[commentStartChar] == CommentChar {
+		if str[commentStartChar] == '"' && rrf {
+			inQuote = !inQuote
+		} else if str[commentStartChar] == CommentChar && !inQuote {
 			break
 		}
 	}
@@ -138,59 +258,259 @@ func ParseLine(str string) (line GcodeLine, err error) {
 		line.Comment = &comment
 	}
 
-	// TODO: support tabs in gcode
-	// TODO: support gcodes with quoted string parameters that have spaces in them https://duet3d.dozuki.com/Wiki/Gcode#Section_Quoted_strings
-	splits := strings.Split(str[i:commentStartChar], " ")
-	for _, split := range splits {
-		match := []byte(split)
-		if len(match) == 0 {
-			continue
-		}
-		switch match[0] {
-		case 'G', 'g', 'M', 'm':
-			if match[0] == 'G' || match[0] == 'g' {
-				line.CmdLetter = G
-			} else {
-				line.CmdLetter = M
-			}
-			var u64 uint64
-			u64, err = strconv.ParseUint(string(match[1:]), 10, 16)
-			line.CmdNumber = uint16(u64)
-		case 'X', 'x':
-			line.X, err = strconv.ParseFloat(string(match[1:]), 64)
-			line.Xvalid = true
-		case 'Y', 'y':
-			line.Y, err = strconv.ParseFloat(string(match[1:]), 64)
-			line.Yvalid = true
-		case 'Z', 'z':
-			line.Z, err = strconv.ParseFloat(string(match[1:]), 64)
-			line.Zvalid = true
-		case 'E', 'e':
-			line.E, err = strconv.ParseFloat(string(match[1:]), 64)
-			line.Evalid = true
-		case 'F', 'f':
-			line.Feedrate, err = strconv.ParseFloat(string(match[1:]), 64)
-		default:
-			f, parseFloatErr := strconv.ParseFloat(string(match[1:]), 64)
-			if parseFloatErr != nil {
-				if line.StringParams == nil {
-					line.StringParams = map[uint8]string{}
-				}
-				line.StringParams[match[0]] = string(match[1:])
-			} else {
-				if line.NumericParams == nil {
-					line.NumericParams = map[uint8]float64{}
-				}
-				line.NumericParams[match[0]] = f
-			}
+	body := str[i:commentStartChar]
+	var actualChecksum uint8
+	if star := checksumStart(body); star >= 0 {
+		var checksum uint64
+		checksum, err = strconv.ParseUint(strings.TrimSpace(body[star+1:]), 10, 8)
+		if err != nil {
+			return
 		}
+		line.Checksum = uint8(checksum)
+		line.ChecksumValid = true
+		actualChecksum = Checksum(str[:i+star])
+		body = body[:star]
+	}
+	if len(body) > 1 && (body[0] == 'N' || body[0] == 'n') && isDigit(body[1]) {
+		end := 1
+		for end < len(body) && !isSpace(body[end]) {
+			end++
+		}
+		line.LineNumber, err = strconv.Atoi(body[1:end])
 		if err != nil {
 			return
 		}
+		line.LineNumberValid = true
+		body = strings.TrimLeft(body[end:], " \t")
+	}
+
+	err = parseCommand(&line, body, rrf)
+	if err == nil && line.ChecksumValid && actualChecksum != line.Checksum {
+		err = &ChecksumError{LineNumber: line.LineNumber, Expected: line.Checksum, Actual: actualChecksum}
 	}
 	return
 }
 
+// parseCommand parses the part of a line after the line number, and before the checksum and comment
+func parseCommand(line *GcodeLine, body string, rrf bool) (err error) {
+	if keyword := metaCommandKeyword(body); keyword != "" && rrf {
+		line.MetaCmd = keyword
+		line.MetaArgs = strings.TrimSpace(body[len(keyword):])
+		return
+	}
+	if isExtendedCommand(body) {
+		line.ExtendedCmd, line.ExtendedParams, err = parseExtendedCommand(body)
+		return
+	}
+
+	var words []string
+	if rrf {
+		// quoted strings (https://duet3d.dozuki.com/Wiki/Gcode#Section_Quoted_strings) and {expressions} can have spaces in them
+		if words, err = splitWords(body, `"`, true); err != nil {
+			return
+		}
+	} else {
+		words, _ = splitWords(body, "", false)
+		var cmd GcodeLine
+		if len(words) > 0 && parseWord(&cmd, 0, words[0]) == nil && isTextCommand(cmd.CmdLetter, cmd.CmdNumber, cmd.CmdSubcodeValid) {
+			line.CmdLetter, line.CmdNumber = cmd.CmdLetter, cmd.CmdNumber
+			line.Text = strings.TrimSpace(body[len(words[0]):])
+			return
+		}
+	}
+	for wordIndex, word := range words {
+		if err = parseWord(line, wordIndex, word); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// parseWord parses one word of a line, like X10 or G1. wordIndex is where it is in the line, since T is only a
+// command when it's first
+func parseWord(line *GcodeLine, wordIndex int, word string) (err error) {
+	match := []byte(word)
+	if len(match) > 1 && match[1] == '{' && !isCommandLetter(match[0]) {
+		// an expression, like X{move.axes[0].max - 10}, is only known once the firmware evaluates it
+		if line.StringParams == nil {
+			line.StringParams = map[uint8]string{}
+		}
+		line.StringParams[match[0]] = string(match[1:])
+		return
+	}
+	if wordIndex == 0 && (match[0] == 'T' || match[0] == 't') {
+		// a tool change. T is only a parameter when it isn't first, like in M104 T1 S200
+		// (tool numbers that aren't, like RepRapFirmware's T-1 to deselect, are left as a parameter)
+		if tool, parseErr := strconv.ParseUint(string(match[1:]), 10, 16); parseErr == nil {
+			line.CmdLetter = T
+			line.CmdNumber = uint16(tool)
+			return
+		}
+	}
+	switch match[0] {
+	case 'G', 'g', 'M', 'm':
+		if match[0] == 'G' || match[0] == 'g' {
+			line.CmdLetter = G
+		} else {
+			line.CmdLetter = M
+		}
+		number := string(match[1:])
+		if dot := strings.IndexByte(number, '.'); dot >= 0 {
+			var subcode uint64
+			subcode, err = strconv.ParseUint(number[dot+1:], 10, 8)
+			if err != nil {
+				return
+			}
+			line.CmdSubcode = uint8(subcode)
+			line.CmdSubcodeValid = true
+			number = number[:dot]
+		}
+		var u64 uint64
+		u64, err = strconv.ParseUint(number, 10, 16)
+		line.CmdNumber = uint16(u64)
+	case 'X', 'x':
+		line.X, err = strconv.ParseFloat(string(match[1:]), 64)
+		line.Xvalid = true
+	case 'Y', 'y':
+		line.Y, err = strconv.ParseFloat(string(match[1:]), 64)
+		line.Yvalid = true
+	case 'Z', 'z':
+		line.Z, err = strconv.ParseFloat(string(match[1:]), 64)
+		line.Zvalid = true
+	case 'E', 'e':
+		line.E, err = strconv.ParseFloat(string(match[1:]), 64)
+		line.Evalid = true
+	case 'F', 'f':
+		line.Feedrate, err = strconv.ParseFloat(string(match[1:]), 64)
+	default:
+		f, parseFloatErr := strconv.ParseFloat(string(match[1:]), 64)
+		if parseFloatErr != nil {
+			if line.StringParams == nil {
+				line.StringParams = map[uint8]string{}
+			}
+			line.StringParams[match[0]] = string(match[1:])
+		} else {
+			if line.NumericParams == nil {
+				line.NumericParams = map[uint8]float64{}
+			}
+			line.NumericParams[match[0]] = f
+		}
+	}
+	return
+}
+
+// isExtendedCommand is whether a line (without its comment) starts with a Klipper-style extended command.
+// Traditional commands and parameters are a single letter followed by a number, so a word that starts with
+// two letters (or an underscore) can't be one of those.
+func isExtendedCommand(str string) bool {
+	return len(str) >= 2 && isExtendedCommandChar(str[0]) && isExtendedCommandChar(str[1])
+}
+
+func isExtendedCommandChar(c uint8) bool {
+	return ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || c == '_'
+}
+
+// parseExtendedCommand splits a line like `EXCLUDE_OBJECT_DEFINE NAME=part_1 POLYGON=[[1,2],[3,4]]` into its
+// command and KEY=VALUE parameters. Values may be quoted or bracketed, in which case they can contain spaces.
+func parseExtendedCommand(str string) (cmd string, params []ExtendedParam, err error) {
+	words, err := splitWords(str, `"'`, true)
+	if err != nil {
+		return "", nil, err
+	}
+	cmd = words[0]
+	for _, word := range words[1:] {
+		eq := strings.IndexByte(word, '=')
+		if eq <= 0 {
+			return "", nil, fmt.Errorf("malformed parameter %q for %s (expected KEY=VALUE)", word, cmd)
+		}
+		params = append(params, ExtendedParam{Key: word[:eq], Value: word[eq+1:]})
+	}
+	return
+}
+
+// splitWords splits on whitespace, except inside of quotes (any of quoteChars) and brackets (when brackets is set).
+// A doubled quote inside of a string (like "say ""hi""") just closes and reopens it, so it stays in one word.
+func splitWords(str string, quoteChars string, brackets bool) (words []string, err error) {
+	var quote uint8
+	depth := 0
+	start := -1
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if start < 0 {
+			if isSpace(c) || c == '\r' {
+				continue
+			}
+			start = i
+		}
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case strings.IndexByte(quoteChars, c) >= 0:
+			quote = c
+		case brackets && (c == '[' || c == '{' || c == '('):
+			depth++
+		case brackets && (c == ']' || c == '}' || c == ')'):
+			depth--
+		case (isSpace(c) || c == '\r') && depth <= 0:
+			words = append(words, str[start:i])
+			start = -1
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated string in %q", str)
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("unbalanced brackets in %q", str)
+	}
+	if start >= 0 {
+		words = append(words, str[start:])
+	}
+	return
+}
+
+// textCommands are the M commands that take free text (a message or a file name) instead of parameters, in Marlin
+// and most other firmware
+var textCommands = map[uint16]bool{23: true, 28: true, 30: true, 32: true, 117: true, 118: true, 928: true}
+
+func isTextCommand(cmdLetter uint8, cmdNumber uint16, subcodeValid bool) bool {
+	return cmdLetter == M && !subcodeValid && textCommands[cmdNumber]
+}
+
+// metaCommands are the RepRapFirmware 3 meta command keywords https://duet3d.dozuki.com/Wiki/GCode_Meta_Commands
+var metaCommands = []string{"if", "elif", "else", "while", "break", "continue", "abort", "var", "global", "set", "echo"}
+
+// metaBlockCommands are the meta commands that start an indented block
+var metaBlockCommands = map[string]bool{"if": true, "elif": true, "else": true, "while": true}
+
+// metaCommandKeyword returns the meta command that a line (without its comment) starts with, or ""
+func metaCommandKeyword(str string) string {
+	for _, keyword := range metaCommands {
+		if strings.HasPrefix(str, keyword) && (len(str) == len(keyword) || !isIdentifierChar(str[len(keyword)])) {
+			return keyword
+		}
+	}
+	return ""
+}
+
+func isIdentifierChar(c uint8) bool {
+	return isExtendedCommandChar(c) || ('0' <= c && c <= '9') || c == '.'
+}
+
+func isCommandLetter(c uint8) bool {
+	return c == 'G' || c == 'g' || c == 'M' || c == 'm'
+}
+
+// UnquoteString removes the quotes from a quoted string parameter (like P"say ""hi"""), and un-doubles the quotes
+// inside of it. Values that aren't quoted are returned unchanged.
+func UnquoteString(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	return strings.ReplaceAll(value[1:len(value)-1], `""`, `"`)
+}
+
 func mustParseLine(str string) *GcodeLine {
 	line, err := ParseLine(str)
 	if err != nil {
@@ -199,6 +519,17 @@ func mustParseLine(str string) *GcodeLine {
 	return &line
 }
 
+func isDigit(c uint8) bool {
+	return '0' <= c && c <= '9'
+}
+
 func isSpace(c uint8) bool {
 	return (c == ' ') || (c == '\t') || (c == '\n')
 }
+
+// NewLineScanner reads gcode a line at a time, with room for lines much longer than a slicer writes
+func NewLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return scanner
+}
@@ -58,22 +58,126 @@ func TestParseLine(t *testing.T) {
 	comment824634126176 := `; move Z axis up`
 	testParsesAs(t, `G1 Z20 F200 ; move Z axis up`, GcodeLine{CmdLetter: 'G', CmdNumber: 1, Z: 20, Zvalid: true, Feedrate: 200, Comment: &comment824634126176})
 
-	testParsesAs(t, `T0`, GcodeLine{NumericParams: map[uint8]float64{'T': 0}})
+	testParsesAs(t, `T0`, GcodeLine{CmdLetter: 'T', CmdNumber: 0})
+	testParsesAs(t, `T1 P0`, GcodeLine{CmdLetter: 'T', CmdNumber: 1, NumericParams: map[uint8]float64{'P': 0}})
+	testParsesAs(t, `T-1`, GcodeLine{NumericParams: map[uint8]float64{'T': -1}})
+	testParsesAs(t, `M104 T1 S200`, GcodeLine{CmdLetter: 'M', CmdNumber: 104, NumericParams: map[uint8]float64{'T': 1, 'S': 200}})
 
 	testParsesAs(t, `M587 S"Network_SSID" P"Network_Password"`, GcodeLine{CmdLetter: 'M', CmdNumber: 587, StringParams: map[uint8]string{'S': `"Network_SSID"`, 'P': `"Network_Password"`}})
-	// TODO: support gcodes with quoted string parameters that have spaces in them https://duet3d.dozuki.com/Wiki/Gcode#Section_Quoted_strings
-	//testParsesAs(t, `M587 S"Network SSID" P"Network Password"`, GcodeLine{CmdLetter: 'M', CmdNumber: 587, StringParams: map[uint8]string{'S': `"Network_SSID"`, 'P': `"Network_Password"`}})
+	testParsesAsIn(t, DialectRepRapFirmware, `M587 S"Network SSID" P"Network Password"`, GcodeLine{CmdLetter: 'M', CmdNumber: 587, StringParams: map[uint8]string{'S': `"Network SSID"`, 'P': `"Network Password"`}})
 
 	// https://duet3d.dozuki.com/Wiki/Gcode#Section_M117_Display_Message
-	//testParsesAs(t, `M117 Hello World`, GcodeLine{})
-	testParsesAs(t, `M118 S"Hello_Duet"`, GcodeLine{CmdLetter: 'M', CmdNumber: 118, StringParams: map[uint8]string{'S': `"Hello_Duet"`}})
-	testParsesAs(t, `M118 SHello_Duet`, GcodeLine{CmdLetter: 'M', CmdNumber: 118, StringParams: map[uint8]string{'S': `Hello_Duet`}})
+	testParsesAs(t, `M117 Hello World`, GcodeLine{CmdLetter: 'M', CmdNumber: 117, Text: `Hello World`})
+	testParsesAsIn(t, DialectRepRapFirmware, `M118 S"Hello_Duet"`, GcodeLine{CmdLetter: 'M', CmdNumber: 118, StringParams: map[uint8]string{'S': `"Hello_Duet"`}})
+	testParsesAsIn(t, DialectRepRapFirmware, `M118 SHello_Duet`, GcodeLine{CmdLetter: 'M', CmdNumber: 118, StringParams: map[uint8]string{'S': `Hello_Duet`}})
 
 	// TODO: test parse failures
 }
 
+func TestParseLine_subcodes(t *testing.T) {
+	testParsesAs(t, `G38.2 Z-10 F100`, GcodeLine{CmdLetter: 'G', CmdNumber: 38, CmdSubcode: 2, CmdSubcodeValid: true, Z: -10, Zvalid: true, Feedrate: 100})
+	testParsesAs(t, `m600.1`, GcodeLine{CmdLetter: 'M', CmdNumber: 600, CmdSubcode: 1, CmdSubcodeValid: true})
+
+	line, err := ParseLine(`G92.1`)
+	assert.NoError(t, err)
+	assert.False(t, line.IsG(92))
+	assert.True(t, line.IsGSub(92, 1))
+	assert.False(t, line.IsGSub(92, 2))
+	assert.False(t, line.IsMSub(92, 1))
+	assert.Equal(t, "GcodeLine{CmdLetter: 'G', CmdNumber: 92,CmdSubcode: 1, CmdSubcodeValid: true,}", line.String())
+
+	line, err = ParseLine(`G92 E0`)
+	assert.NoError(t, err)
+	assert.True(t, line.IsG(92))
+	assert.False(t, line.IsGSub(92, 0))
+
+	_, err = ParseLine(`G29.x`)
+	assert.Error(t, err)
+}
+
+// free text is kept as it is, even when it looks like it has quotes, brackets or parameters in it
+func TestParseLine_text(t *testing.T) {
+	testParsesAs(t, `M117 Printing (50%`, GcodeLine{CmdLetter: 'M', CmdNumber: 117, Text: `Printing (50%`})
+	testParsesAs(t, `M118 [done`, GcodeLine{CmdLetter: 'M', CmdNumber: 118, Text: `[done`})
+	testParsesAs(t, `M117 6" part`, GcodeLine{CmdLetter: 'M', CmdNumber: 117, Text: `6" part`})
+	comment := `; message`
+	testParsesAs(t, `m117   Layer 2 of 10 ; message`, GcodeLine{CmdLetter: 'M', CmdNumber: 117, Text: `Layer 2 of 10`, Comment: &comment})
+	testParsesAs(t, `M23 file name.gco`, GcodeLine{CmdLetter: 'M', CmdNumber: 23, Text: `file name.gco`})
+	testParsesAs(t, `M117`, GcodeLine{CmdLetter: 'M', CmdNumber: 117})
+	// and quotes and brackets are only special for RepRapFirmware
+	testParsesAs(t, `M104 S"x`, GcodeLine{CmdLetter: 'M', CmdNumber: 104, StringParams: map[uint8]string{'S': `"x`}})
+}
+
+func TestParseLine_quotedStrings(t *testing.T) {
+	testParsesAsIn(t, DialectRepRapFirmware, `M291 P"Hello world" S1`, GcodeLine{CmdLetter: 'M', CmdNumber: 291, NumericParams: map[uint8]float64{'S': 1}, StringParams: map[uint8]string{'P': `"Hello world"`}})
+	testParsesAsIn(t, DialectRepRapFirmware, `M98	P"homeall.g"`, GcodeLine{CmdLetter: 'M', CmdNumber: 98, StringParams: map[uint8]string{'P': `"homeall.g"`}})
+	comment := `; a real comment`
+	testParsesAsIn(t, DialectRepRapFirmware, `M291 P"say ""hi""; not a comment" S2 ; a real comment`, GcodeLine{CmdLetter: 'M', CmdNumber: 291, NumericParams: map[uint8]float64{'S': 2}, StringParams: map[uint8]string{'P': `"say ""hi""; not a comment"`}, Comment: &comment})
+	assert.Equal(t, `say "hi"; not a comment`, UnquoteString(`"say ""hi""; not a comment"`))
+	assert.Equal(t, `Hello_Duet`, UnquoteString(`Hello_Duet`))
+
+	_, err := DialectRepRapFirmware.ParseLine(`M291 P"unterminated`)
+	assert.Error(t, err)
+}
+
+func TestParseLine_expressions(t *testing.T) {
+	testParsesAsIn(t, DialectRepRapFirmware, `G1 X{move.axes[0].max - 10} Y20 F{global.speed * 60}`, GcodeLine{CmdLetter: 'G', CmdNumber: 1, Y: 20, Yvalid: true, StringParams: map[uint8]string{'X': `{move.axes[0].max - 10}`, 'F': `{global.speed * 60}`}})
+	testParsesAsIn(t, DialectRepRapFirmware, `M104 S{var.temp + 5}`, GcodeLine{CmdLetter: 'M', CmdNumber: 104, StringParams: map[uint8]string{'S': `{var.temp + 5}`}})
+}
+
+func TestParseLine_metaCommands(t *testing.T) {
+	testParsesAsIn(t, DialectRepRapFirmware, `if move.axes[0].homed && !move.axes[1].homed`, GcodeLine{MetaCmd: "if", MetaArgs: `move.axes[0].homed && !move.axes[1].homed`})
+	testParsesAsIn(t, DialectRepRapFirmware, `  else`, GcodeLine{MetaCmd: "else"})
+	comment := `; count up`
+	testParsesAsIn(t, DialectRepRapFirmware, `	set var.count = var.count + 1 ; count up`, GcodeLine{MetaCmd: "set", MetaArgs: `var.count = var.count + 1`, Comment: &comment})
+	testParsesAsIn(t, DialectRepRapFirmware, `echo "x is ", {move.axes[0].userPosition}`, GcodeLine{MetaCmd: "echo", MetaArgs: `"x is ", {move.axes[0].userPosition}`})
+	// a word that only starts with a keyword is something else
+	testParsesAsIn(t, DialectRepRapFirmware, `iffy_macro`, GcodeLine{ExtendedCmd: "iffy_macro"})
+	// and other firmware doesn't have them
+	testParsesAs(t, `else`, GcodeLine{ExtendedCmd: "else"})
+}
+
+func TestParseLine_extended(t *testing.T) {
+	testParsesAs(t, `SET_PRESSURE_ADVANCE EXTRUDER=extruder ADVANCE=0.04`, GcodeLine{
+		ExtendedCmd:    "SET_PRESSURE_ADVANCE",
+		ExtendedParams: []ExtendedParam{{"EXTRUDER", "extruder"}, {"ADVANCE", "0.04"}},
+	})
+	comment := `; define the object`
+	testParsesAs(t, `EXCLUDE_OBJECT_DEFINE NAME=part_1 CENTER=110,110 POLYGON=[[100, 100], [120, 100], [120,120]] ; define the object`, GcodeLine{
+		ExtendedCmd:    "EXCLUDE_OBJECT_DEFINE",
+		ExtendedParams: []ExtendedParam{{"NAME", "part_1"}, {"CENTER", "110,110"}, {"POLYGON", "[[100, 100], [120, 100], [120,120]]"}},
+		Comment:        &comment,
+	})
+	testParsesAs(t, `RESPOND TYPE=echo MSG="hello world"`, GcodeLine{
+		ExtendedCmd:    "RESPOND",
+		ExtendedParams: []ExtendedParam{{"TYPE", "echo"}, {"MSG", `"hello world"`}},
+	})
+	testParsesAs(t, `  TURN_OFF_HEATERS`, GcodeLine{ExtendedCmd: "TURN_OFF_HEATERS"})
+	testParsesAs(t, `print_start bed_temp=60`, GcodeLine{ExtendedCmd: "print_start", ExtendedParams: []ExtendedParam{{"bed_temp", "60"}}})
+
+	line, err := ParseLine(`SET_FAN_SPEED FAN=part SPEED=0.5`)
+	assert.NoError(t, err)
+	assert.True(t, line.IsExtended("set_fan_speed"))
+	value, ok := line.ExtendedParam("speed")
+	assert.True(t, ok)
+	assert.Equal(t, "0.5", value)
+	_, ok = line.ExtendedParam("INDEX")
+	assert.False(t, ok)
+
+	_, err = ParseLine(`SET_FAN_SPEED FAN`)
+	assert.Error(t, err)
+	_, err = ParseLine(`RESPOND MSG="unterminated`)
+	assert.Error(t, err)
+	_, err = ParseLine(`EXCLUDE_OBJECT_DEFINE POLYGON=[[1,2]`)
+	assert.Error(t, err)
+}
+
 func testParsesAs(t *testing.T, str string, expected GcodeLine) {
-	actual, err := ParseLine(str)
+	testParsesAsIn(t, DialectRepRap, str, expected)
+}
+
+func testParsesAsIn(t *testing.T, dialect Dialect, str string, expected GcodeLine) {
+	actual, err := dialect.ParseLine(str)
 	if err != nil {
 		t.Fatal(err)
 	}
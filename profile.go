@@ -0,0 +1,459 @@
+package gcodetools
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// PrinterProfile describes a printer and the filament and settings that it prints with.
+// Speeds are in mm/s (like in slicers), but the builder and minifier work with feedrates in mm/min.
+//
+// Profiles are usually loaded from YAML/TOML/JSON files (see LoadPrinterProfile), using the snake_case keys in the struct tags.
+type PrinterProfile struct {
+	Name string `mapstructure:"name"`
+	// Inherits is the filename of a profile that this one is based on, relative to this profile's file
+	Inherits string `mapstructure:"inherits"`
+	// Flavor is the firmware that the printer runs, e.g. marlin or klipper
+	Flavor string `mapstructure:"flavor"`
+
+	BedSizeX float64 `mapstructure:"bed_size_x"`
+	BedSizeY float64 `mapstructure:"bed_size_y"`
+	MaxZ     float64 `mapstructure:"max_z"`
+	// the coordinates of the front left corner of the bed (negative for printers that can park off the bed, or that put 0,0 in the middle)
+	OriginX float64 `mapstructure:"origin_x"`
+	OriginY float64 `mapstructure:"origin_y"`
+
+	NozzleDiameter   float64 `mapstructure:"nozzle_diameter"`
+	FilamentDiameter float64 `mapstructure:"filament_diameter"`
+
+	HotendTemperature float64 `mapstructure:"hotend_temperature"`
+	BedTemperature    float64 `mapstructure:"bed_temperature"`
+	FanSpeed          float64 `mapstructure:"fan_speed"` // 0 to 1
+	// the safe temperature range of the hotend and the material, used by lint
+	MinExtrudeTemperature float64 `mapstructure:"min_extrude_temperature"`
+	MaxHotendTemperature  float64 `mapstructure:"max_hotend_temperature"`
+	MaxBedTemperature     float64 `mapstructure:"max_bed_temperature"`
+
+	LayerHeight      float64 `mapstructure:"layer_height"`
+	FirstLayerHeight float64 `mapstructure:"first_layer_height"`
+	ExtrusionWidth   float64 `mapstructure:"extrusion_width"`
+
+	PrintSpeed  float64 `mapstructure:"print_speed"`
+	TravelSpeed float64 `mapstructure:"travel_speed"`
+
+	RetractLength float64 `mapstructure:"retract_length"`
+	RetractSpeed  float64 `mapstructure:"retract_speed"`
+
+	Limits KinematicLimits `mapstructure:"limits"`
+	// HeadClearance is the space that the print head takes up around the nozzle, for printing objects one after another
+	HeadClearance ClearanceBox `mapstructure:"head_clearance"`
+
+	StartGcode string `mapstructure:"start_gcode"`
+	EndGcode   string `mapstructure:"end_gcode"`
+
+	Minifier GcodeMinifierConfig `mapstructure:"minifier"`
+}
+
+// ClearanceBox is how far the print head (and the gantry above it) reaches from the nozzle, in mm. Front is towards
+// Y=0 and Left is towards X=0.
+type ClearanceBox struct {
+	Left  float64 `mapstructure:"left"`
+	Right float64 `mapstructure:"right"`
+	Front float64 `mapstructure:"front"`
+	Back  float64 `mapstructure:"back"`
+	// Height is how far above the nozzle tip the gantry is, so anything taller that has already been printed is in
+	// its way
+	Height float64 `mapstructure:"height"`
+}
+
+// KinematicLimits are the firmware's motion limits, in mm/s and mm/s²
+type KinematicLimits struct {
+	MaxSpeedX        float64 `mapstructure:"max_speed_x"`
+	MaxSpeedY        float64 `mapstructure:"max_speed_y"`
+	MaxSpeedZ        float64 `mapstructure:"max_speed_z"`
+	MaxSpeedE        float64 `mapstructure:"max_speed_e"`
+	MaxAccelerationX float64 `mapstructure:"max_acceleration_x"`
+	MaxAccelerationY float64 `mapstructure:"max_acceleration_y"`
+	MaxAccelerationZ float64 `mapstructure:"max_acceleration_z"`
+	MaxAccelerationE float64 `mapstructure:"max_acceleration_e"`
+	// Acceleration is the default acceleration for moves, before it is limited per axis
+	Acceleration float64 `mapstructure:"acceleration"`
+}
+
+var DefaultPrinterProfile = PrinterProfile{
+	Name:                  "default",
+	Flavor:                "marlin",
+	BedSizeX:              220,
+	BedSizeY:              220,
+	MaxZ:                  250,
+	NozzleDiameter:        0.4,
+	FilamentDiameter:      1.75,
+	HotendTemperature:     210,
+	BedTemperature:        60,
+	FanSpeed:              1,
+	MinExtrudeTemperature: 170,
+	MaxHotendTemperature:  260,
+	MaxBedTemperature:     110,
+	LayerHeight:           0.2,
+	FirstLayerHeight:      0.2,
+	ExtrusionWidth:        0.45,
+	PrintSpeed:            40,
+	TravelSpeed:           150,
+	RetractLength:         1,
+	RetractSpeed:          35,
+	Limits: KinematicLimits{
+		MaxSpeedX:        500,
+		MaxSpeedY:        500,
+		MaxSpeedZ:        12,
+		MaxSpeedE:        120,
+		MaxAccelerationX: 1000,
+		MaxAccelerationY: 1000,
+		MaxAccelerationZ: 100,
+		MaxAccelerationE: 5000,
+		Acceleration:     1000,
+	},
+	// PrusaSlicer's defaults
+	HeadClearance: ClearanceBox{Left: 20, Right: 20, Front: 20, Back: 20, Height: 20},
+}
+
+// NewGcodeBuilder returns a builder configured to print with this profile.
+// The builder is set to the first layer height.
+func (p *PrinterProfile) NewGcodeBuilder() *GcodeBuilder {
+	return &GcodeBuilder{
+		NozzleSize:          p.NozzleDiameter,
+		LayerHeight:         p.FirstLayerHeight,
+		ExtrusionWidth:      p.ExtrusionWidth,
+		ExtrusionMultiplier: 1,
+		FilamentDiameter:    p.FilamentDiameter,
+		PrintFeedrate:       60 * p.PrintSpeed,
+		TravelFeedrate:      60 * p.TravelSpeed,
+	}
+}
+
+// MinifierConfig returns a copy of the profile's minifier settings, ready to use
+func (p *PrinterProfile) MinifierConfig() *GcodeMinifierConfig {
+	cfg := p.Minifier
+	if cfg.Flavor == nil && p.Flavor != "" {
+		cfg.Flavor, _ = LookupFlavor(p.Flavor)
+	}
+	return cfg.Init()
+}
+
+// FirmwareFlavor looks up the profile's Flavor, falling back to FlavorGeneric when it isn't set or isn't known
+func (p *PrinterProfile) FirmwareFlavor() *Flavor {
+	flavor, err := LookupFlavor(p.Flavor)
+	if err != nil {
+		return FlavorGeneric
+	}
+	return flavor
+}
+
+// NewTimeEstimator returns an estimator that uses the profile's kinematic limits
+func (p *PrinterProfile) NewTimeEstimator() *TimeEstimator {
+	return &TimeEstimator{Limits: p.Limits}
+}
+
+// BedCenter is the middle of the bed, which is where calibration objects are usually placed
+func (p *PrinterProfile) BedCenter() Point {
+	return Point{p.OriginX + p.BedSizeX/2, p.OriginY + p.BedSizeY/2}
+}
+
+// LoadPrinterProfile starts with DefaultPrinterProfile and applies each of the files in order.
+// PrusaSlicer .ini exports (printer, filament or print settings) are imported with ImportPrusaSlicerIni;
+// any other file is read by viper, after first loading the profile that it inherits from (if any).
+func LoadPrinterProfile(filenames ...string) (PrinterProfile, error) {
+	profile := DefaultPrinterProfile
+	for _, filename := range filenames {
+		if strings.EqualFold(filepath.Ext(filename), ".ini") {
+			file, err := os.Open(filename)
+			if err != nil {
+				return profile, err
+			}
+			err = ImportPrusaSlicerIni(file, &profile)
+			_ = file.Close()
+			if err != nil {
+				return profile, fmt.Errorf("%s: %w", filename, err)
+			}
+			continue
+		}
+
+		settings, err := loadProfileSettings(filename, map[string]bool{})
+		if err != nil {
+			return profile, err
+		}
+		v := viper.New()
+		for key, value := range settings {
+			v.Set(key, value)
+		}
+		if err := v.Unmarshal(&profile); err != nil {
+			return profile, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	// a child profile's inherits shouldn't leak out, it's only meaningful relative to its own file
+	profile.Inherits = ""
+	if profile.Flavor != "" {
+		if _, err := LookupFlavor(profile.Flavor); err != nil {
+			return profile, err
+		}
+	}
+	return profile, nil
+}
+
+// loadProfileSettings reads a profile file into a map, with the settings of the profile it inherits from merged underneath
+func loadProfileSettings(filename string, seen map[string]bool) (map[string]interface{}, error) {
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	if seen[absFilename] {
+		return nil, fmt.Errorf("%s: profile inherits from itself", filename)
+	}
+	seen[absFilename] = true
+
+	v := viper.New()
+	v.SetConfigFile(filename)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	inherits := v.GetString("inherits")
+	if inherits == "" {
+		return v.AllSettings(), nil
+	}
+	if !filepath.IsAbs(inherits) {
+		inherits = filepath.Join(filepath.Dir(filename), inherits)
+	}
+	parentSettings, err := loadProfileSettings(inherits, seen)
+	if err != nil {
+		return nil, err
+	}
+	mergeSettings(parentSettings, v.AllSettings())
+	return parentSettings, nil
+}
+
+// mergeSettings recursively copies src over dst.
+// (viper's own merging refuses to merge values of different types, like an int over a float)
+func mergeSettings(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeSettings(dstMap, srcMap)
+		} else {
+			dst[key] = value
+		}
+	}
+}
+
+// ImportPrusaSlicerIni applies the settings that gcodetools understands from a PrusaSlicer config export to profile.
+// Per-extruder values (like "0.4,0.4") use the first extruder, and unknown keys are ignored.
+func ImportPrusaSlicerIni(r io.Reader, profile *PrinterProfile) error {
+	settings := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	// start/end gcode can make for very long lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '[' {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			continue
+		}
+		settings[strings.TrimSpace(line[:eq])] = strings.TrimSpace(line[eq+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var err error
+	// percentOf sets *dst from the setting, if it's there, where a percentage is of base
+	percentOf := func(key string, dst *float64, base float64) {
+		value, ok := settings[key]
+		if !ok || err != nil {
+			return
+		}
+		value = firstExtruderValue(value)
+		var f float64
+		if strings.HasSuffix(value, "%") {
+			f, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			f = f / 100 * base
+		} else {
+			f, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", key, err)
+			return
+		}
+		*dst = f
+	}
+	// number is for most settings, where percentages are relative to the nozzle diameter
+	number := func(key string, dst *float64) {
+		percentOf(key, dst, profile.NozzleDiameter)
+	}
+	// automatic is for widths and speeds, where zero means "automatic", so our own value is kept
+	automatic := func(key string, dst *float64) {
+		value := *dst
+		number(key, &value)
+		if value != 0 {
+			*dst = value
+		}
+	}
+
+	if name, ok := settings["printer_model"]; ok && name != "" {
+		profile.Name = name
+	}
+	if flavor, ok := settings["gcode_flavor"]; ok {
+		profile.Flavor = prusaSlicerFlavors[flavor]
+		if profile.Flavor == "" {
+			profile.Flavor = FlavorGeneric.Name
+		}
+	}
+	if bedShape, ok := settings["bed_shape"]; ok {
+		if err := importBedShape(bedShape, profile); err != nil {
+			return err
+		}
+	}
+	number("max_print_height", &profile.MaxZ)
+	number("nozzle_diameter", &profile.NozzleDiameter)
+	number("filament_diameter", &profile.FilamentDiameter)
+	number("temperature", &profile.HotendTemperature)
+	number("bed_temperature", &profile.BedTemperature)
+	if fanSpeed, ok := settings["max_fan_speed"]; ok {
+		percent, err := strconv.ParseFloat(firstExtruderValue(fanSpeed), 64)
+		if err != nil {
+			return fmt.Errorf("max_fan_speed: %w", err)
+		}
+		profile.FanSpeed = percent / 100
+	}
+	number("layer_height", &profile.LayerHeight)
+	// but the first layer is a percentage of the other layers
+	percentOf("first_layer_height", &profile.FirstLayerHeight, profile.LayerHeight)
+	automatic("extrusion_width", &profile.ExtrusionWidth)
+	automatic("perimeter_speed", &profile.PrintSpeed)
+	automatic("travel_speed", &profile.TravelSpeed)
+	number("retract_length", &profile.RetractLength)
+	automatic("retract_speed", &profile.RetractSpeed)
+	number("machine_max_feedrate_x", &profile.Limits.MaxSpeedX)
+	number("machine_max_feedrate_y", &profile.Limits.MaxSpeedY)
+	number("machine_max_feedrate_z", &profile.Limits.MaxSpeedZ)
+	number("machine_max_feedrate_e", &profile.Limits.MaxSpeedE)
+	number("machine_max_acceleration_x", &profile.Limits.MaxAccelerationX)
+	number("machine_max_acceleration_y", &profile.Limits.MaxAccelerationY)
+	number("machine_max_acceleration_z", &profile.Limits.MaxAccelerationZ)
+	number("machine_max_acceleration_e", &profile.Limits.MaxAccelerationE)
+	number("machine_max_acceleration_extruding", &profile.Limits.Acceleration)
+	// PrusaSlicer only has a radius around the nozzle
+	if _, ok := settings["extruder_clearance_radius"]; ok {
+		var radius float64
+		number("extruder_clearance_radius", &radius)
+		profile.HeadClearance.Left, profile.HeadClearance.Right = radius, radius
+		profile.HeadClearance.Front, profile.HeadClearance.Back = radius, radius
+	}
+	number("extruder_clearance_height", &profile.HeadClearance.Height)
+	if err != nil {
+		return err
+	}
+
+	if startGcode, ok := settings["start_gcode"]; ok {
+		profile.StartGcode = expandPrusaSlicerPlaceholders(unescapePrusaSlicerString(startGcode), settings)
+	}
+	if endGcode, ok := settings["end_gcode"]; ok {
+		profile.EndGcode = expandPrusaSlicerPlaceholders(unescapePrusaSlicerString(endGcode), settings)
+	}
+	return nil
+}
+
+// prusaSlicerFlavors are PrusaSlicer's gcode_flavor values for the firmware that has its own flavor. The rest
+// (RepRap/Sprinter, Repetier, Smoothie, Teacup, MakerWare, Sailfish, Mach3, Machinekit and no extrusion) are generic.
+var prusaSlicerFlavors = map[string]string{
+	"marlin":         "marlin",
+	"marlin2":        "marlin",
+	"klipper":        "klipper",
+	"reprapfirmware": "reprapfirmware",
+}
+
+func firstExtruderValue(value string) string {
+	if comma := strings.IndexByte(value, ','); comma >= 0 {
+		return value[:comma]
+	}
+	return value
+}
+
+// importBedShape reads a bed_shape polygon like "0x0,250x0,250x210,0x210"
+func importBedShape(bedShape string, profile *PrinterProfile) error {
+	minX, minY, maxX, maxY := 0.0, 0.0, 0.0, 0.0
+	for i, corner := range strings.Split(bedShape, ",") {
+		xy := strings.Split(corner, "x")
+		if len(xy) != 2 {
+			return fmt.Errorf("bed_shape: invalid point %q", corner)
+		}
+		x, err := strconv.ParseFloat(xy[0], 64)
+		if err != nil {
+			return fmt.Errorf("bed_shape: %w", err)
+		}
+		y, err := strconv.ParseFloat(xy[1], 64)
+		if err != nil {
+			return fmt.Errorf("bed_shape: %w", err)
+		}
+		if i == 0 || x < minX {
+			minX = x
+		}
+		if i == 0 || y < minY {
+			minY = y
+		}
+		if i == 0 || x > maxX {
+			maxX = x
+		}
+		if i == 0 || y > maxY {
+			maxY = y
+		}
+	}
+	profile.OriginX, profile.OriginY = minX, minY
+	profile.BedSizeX, profile.BedSizeY = maxX-minX, maxY-minY
+	return nil
+}
+
+// PrusaSlicer writes multi-line values on a single line, with C-style escapes
+func unescapePrusaSlicerString(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	replacer := strings.NewReplacer(`\n`, "\n", `\r`, "\r", `\t`, "\t", `\"`, `"`, `\\`, `\`)
+	return replacer.Replace(value)
+}
+
+// expandPrusaSlicerPlaceholders substitutes simple [key] and {key} placeholders with values from the same config.
+// Anything more complicated (like conditionals or expressions) is left as it is.
+func expandPrusaSlicerPlaceholders(gcode string, settings map[string]string) string {
+	var out strings.Builder
+	for i := 0; i < len(gcode); i++ {
+		c := gcode[i]
+		if c == '[' || c == '{' {
+			closing := byte(']')
+			if c == '{' {
+				closing = '}'
+			}
+			if end := strings.IndexByte(gcode[i+1:], closing); end >= 0 {
+				key := gcode[i+1 : i+1+end]
+				// {key[0]} refers to the first extruder
+				key = strings.TrimSuffix(key, "[0]")
+				if value, ok := settings[key]; ok {
+					out.WriteString(firstExtruderValue(value))
+					i += end + 1
+					continue
+				}
+			}
+		}
+		out.WriteByte(c)
+	}
+	return out.String()
+}
@@ -0,0 +1,146 @@
+package gcodetools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFile(t *testing.T, dir, name, contents string) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadPrinterProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcodetools-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, dir, "base.yaml", `
+name: base
+bed_size_x: 250
+bed_size_y: 210
+nozzle_diameter: 0.6
+limits:
+  max_speed_x: 200
+  max_speed_y: 200
+minifier:
+  remove_comments: true
+  allow_unknown_gcode: true
+`)
+	writeTestFile(t, dir, "petg.toml", `
+inherits = "base.yaml"
+name = "base with PETG"
+hotend_temperature = 240
+
+[limits]
+max_speed_y = 150
+`)
+
+	profile, err := LoadPrinterProfile(filepath.Join(dir, "petg.toml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "base with PETG", profile.Name)
+	assert.Equal(t, 250.0, profile.BedSizeX)
+	assert.Equal(t, 210.0, profile.BedSizeY)
+	assert.Equal(t, 0.6, profile.NozzleDiameter)
+	assert.Equal(t, 240.0, profile.HotendTemperature)
+	assert.Equal(t, 200.0, profile.Limits.MaxSpeedX)
+	assert.Equal(t, 150.0, profile.Limits.MaxSpeedY)
+	// things that aren't in any file keep the defaults
+	assert.Equal(t, DefaultPrinterProfile.FilamentDiameter, profile.FilamentDiameter)
+	assert.Equal(t, DefaultPrinterProfile.Limits.MaxSpeedZ, profile.Limits.MaxSpeedZ)
+	assert.Equal(t, "", profile.Inherits)
+
+	cfg := profile.MinifierConfig()
+	assert.True(t, cfg.RemoveComments)
+	assert.True(t, cfg.AllowUnknownGcode)
+	assert.Equal(t, DefaultGcodeMinifierConfig.XYDecimals, cfg.XYDecimals)
+
+	builder := profile.NewGcodeBuilder()
+	assert.Equal(t, 0.6, builder.NozzleSize)
+
+	writeTestFile(t, dir, "loop.yaml", "inherits: loop.yaml\n")
+	_, err = LoadPrinterProfile(filepath.Join(dir, "loop.yaml"))
+	assert.Error(t, err)
+}
+
+func TestImportPrusaSlicerIni(t *testing.T) {
+	ini := `# generated by PrusaSlicer 2.2.0+linux-x64 on 2020-05-01 at 12:00:00 UTC
+bed_shape = -5x-5,245x-5,245x215,-5x215
+bed_temperature = 90
+end_gcode = M104 S0 ; turn off temperature\nM84
+extruder_clearance_height = 25
+extruder_clearance_radius = 45
+extrusion_width = 0.45
+filament_diameter = 1.75
+first_layer_height = 75%
+gcode_flavor = marlin2
+layer_height = 0.3
+machine_max_acceleration_x = 1250,960
+machine_max_feedrate_z = 12,12
+max_fan_speed = 50
+max_print_height = 205
+nozzle_diameter = 0.4,0.4
+perimeter_speed = 0
+start_gcode = M104 S[first_layer_temperature]\nM140 S{first_layer_bed_temperature[0]}\nG28
+first_layer_temperature = 245
+first_layer_bed_temperature = 85
+temperature = 240
+`
+	profile := DefaultPrinterProfile
+	assert.NoError(t, ImportPrusaSlicerIni(strings.NewReader(ini), &profile))
+
+	assert.Equal(t, -5.0, profile.OriginX)
+	assert.Equal(t, -5.0, profile.OriginY)
+	assert.Equal(t, 250.0, profile.BedSizeX)
+	assert.Equal(t, 220.0, profile.BedSizeY)
+	assert.Equal(t, 205.0, profile.MaxZ)
+	assert.Equal(t, "marlin", profile.Flavor)
+	assert.Equal(t, 240.0, profile.HotendTemperature)
+	assert.Equal(t, 90.0, profile.BedTemperature)
+	assert.Equal(t, 0.5, profile.FanSpeed)
+	// a percentage of layer_height
+	assert.InDelta(t, 0.225, profile.FirstLayerHeight, 1e-9)
+	assert.Equal(t, 1250.0, profile.Limits.MaxAccelerationX)
+	assert.Equal(t, 12.0, profile.Limits.MaxSpeedZ)
+	assert.Equal(t, ClearanceBox{Left: 45, Right: 45, Front: 45, Back: 45, Height: 25}, profile.HeadClearance)
+	// zero means automatic in PrusaSlicer
+	assert.Equal(t, DefaultPrinterProfile.PrintSpeed, profile.PrintSpeed)
+	assert.Equal(t, "M104 S245\nM140 S85\nG28", profile.StartGcode)
+	assert.Equal(t, "M104 S0 ; turn off temperature\nM84", profile.EndGcode)
+
+	assert.Error(t, ImportPrusaSlicerIni(strings.NewReader("temperature = hot\n"), &profile))
+
+	// zero is only automatic for widths and speeds, and otherwise it's what it says
+	profile = DefaultPrinterProfile
+	assert.NoError(t, ImportPrusaSlicerIni(strings.NewReader("retract_length = 0\nbed_temperature = 0\ntravel_speed = 0\n"), &profile))
+	assert.Equal(t, 0.0, profile.RetractLength)
+	assert.Equal(t, 0.0, profile.BedTemperature)
+	assert.Equal(t, DefaultPrinterProfile.TravelSpeed, profile.TravelSpeed)
+
+	for flavor, expected := range map[string]string{
+		"marlin":         "marlin",
+		"klipper":        "klipper",
+		"reprapfirmware": "reprapfirmware",
+		"reprap":         "generic",
+		"repetier":       "generic",
+		"smoothie":       "generic",
+		"sailfish":       "generic",
+		"no-extrusion":   "generic",
+	} {
+		profile := DefaultPrinterProfile
+		assert.NoError(t, ImportPrusaSlicerIni(strings.NewReader("gcode_flavor = "+flavor+"\n"), &profile))
+		assert.Equal(t, expected, profile.Flavor, flavor)
+		_, err := LookupFlavor(profile.Flavor)
+		assert.NoError(t, err, flavor)
+	}
+}
@@ -0,0 +1,187 @@
+package gcodetools
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// ResumeConfig is how Resume gets the printer back to where a print stopped
+type ResumeConfig struct {
+	Dialect Dialect
+	// Flavor is the printer's firmware, which decides how it's told where Z is. Defaults to FlavorGeneric
+	Flavor *Flavor
+	// StartGcode is the printer's start gcode. Only the commands that set the printer up (like M420 to turn bed
+	// leveling on) are kept: anything that moves, homes, probes or heats is left out, since that would hit the print.
+	StartGcode string
+	// Clearance is how far (in mm) the nozzle is raised before it moves anywhere. Defaults to 5
+	Clearance float64
+	// TravelFeedrate and ZFeedrate are how fast to move back to where the print stopped, in mm/min.
+	// They default to 6000 and 600
+	TravelFeedrate float64
+	ZFeedrate      float64
+}
+
+func (cfg *ResumeConfig) init() {
+	if cfg.Flavor == nil {
+		cfg.Flavor = FlavorGeneric
+	}
+	if cfg.Clearance == 0 {
+		cfg.Clearance = 5
+	}
+	if cfg.TravelFeedrate == 0 {
+		cfg.TravelFeedrate = 6000
+	}
+	if cfg.ZFeedrate == 0 {
+		cfg.ZFeedrate = 600
+	}
+}
+
+// ResumeLineAtLayer is the line that a layer starts on, where layers are numbered from 0 like Layer.Index. The first
+// layer starts with the start gcode, so there's no resuming from it
+func ResumeLineAtLayer(layers []Layer, index int) (int, error) {
+	if index < 0 || index >= len(layers) {
+		return 0, fmt.Errorf("there is no layer %d (the print has %d layers, numbered from 0)", index, len(layers))
+	}
+	if index == 0 {
+		return 0, errFirstLayer
+	}
+	return layers[index].StartLine, nil
+}
+
+// ResumeLineAtZ is the line that the first layer at or above z starts on
+func ResumeLineAtZ(layers []Layer, z float64) (int, error) {
+	for _, layer := range layers {
+		if layer.Z >= z-layerZTolerance {
+			if layer.Index == 0 {
+				return 0, errFirstLayer
+			}
+			return layer.StartLine, nil
+		}
+	}
+	return 0, fmt.Errorf("there is no layer at or above Z%v", z)
+}
+
+var errFirstLayer = errors.New("the first layer starts at the start of the file, so the print can just be started again")
+
+// Resume writes a file that carries on with a print from a line (1-based) of it, after it failed or the power went
+// out. Z isn't homed, since it would hit the print, so the nozzle has to be at exactly the line's Z when the file
+// starts (which is where it stopped, if it stopped between layers): that's where the printer is told that it is.
+// Then the nozzle is raised, X and Y are homed, the heaters heat up, and the nozzle moves back to exactly where the
+// line starts, with E, the feedrate, the fan and everything else restored. The rest of the file follows unchanged.
+// It returns the machine's state at the line.
+func Resume(cfg ResumeConfig, r io.Reader, w io.Writer, line int) (MachineState, error) {
+	states, err := Split(cfg, r, []int{line}, []io.Writer{ioutil.Discard, w})
+	if err != nil {
+		return MachineState{}, err
+	}
+	return states[0], nil
+}
+
+// writeResumeStart gets the printer from wherever it stopped to state, without touching the print
+func writeResumeStart(w io.Writer, cfg *ResumeConfig, state *MachineState, line int) error {
+	// the state's lengths are in the file's units
+	mm := 1.0
+	units := "G21"
+	if state.Inches {
+		mm = 1 / 25.4
+		units = "G20"
+	}
+
+	fmt.Fprintf(w, "; resuming from line %d, at X%s Y%s Z%s\n", line, formatNumber(state.X), formatNumber(state.Y), formatNumber(state.Z))
+	fmt.Fprintln(w, units)
+	if state.BedTemperature != 0 {
+		// the bed heats up first, so that the print doesn't come off it while it's cold
+		fmt.Fprintf(w, "M140 S%s\n", formatNumber(state.BedTemperature))
+	}
+	fmt.Fprintf(w, "; the nozzle has to be at exactly Z%s, where the print carries on from\n", formatNumber(state.Z))
+	setZ, err := setZCommand(cfg.Flavor, state.Z, mm)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, setZ)
+	fmt.Fprintln(w, "G91")
+	fmt.Fprintf(w, "G1 Z%s F%s\n", formatNumber(cfg.Clearance*mm), formatNumber(cfg.ZFeedrate*mm))
+	fmt.Fprintln(w, "G90")
+	fmt.Fprintln(w, "G28 X Y")
+
+	if cfg.StartGcode != "" {
+		fmt.Fprintln(w, "; from the start gcode")
+		for i, lineStr := range strings.Split(cfg.StartGcode, "\n") {
+			startLine, err := cfg.Dialect.ParseLine(lineStr)
+			if err != nil {
+				return fmt.Errorf("start gcode line %d: %v", i+1, err)
+			}
+			if keepForResume(&startLine) {
+				fmt.Fprintln(w, strings.TrimSpace(lineStr))
+			}
+		}
+	}
+
+	if state.BedTemperature != 0 {
+		fmt.Fprintf(w, "M190 S%s\n", formatNumber(state.BedTemperature))
+	}
+	for tool := 0; tool < MaxTools; tool++ {
+		if temperature := state.ToolStateOf(tool).HotendTemperature; temperature != 0 && tool != state.Tool {
+			fmt.Fprintf(w, "M104 T%d S%s\n", tool, formatNumber(temperature))
+		}
+	}
+	if state.Tool != 0 {
+		fmt.Fprintf(w, "T%d\n", state.Tool)
+	}
+	if state.HotendTemperature != 0 {
+		fmt.Fprintf(w, "M109 S%s\n", formatNumber(state.HotendTemperature))
+	}
+
+	if state.RelativeExtrusion {
+		fmt.Fprintln(w, "M83")
+	} else {
+		fmt.Fprintln(w, "M82")
+	}
+	fmt.Fprintf(w, "G92 E%s\n", formatNumber(state.E))
+	fmt.Fprintf(w, "G0 X%s Y%s F%s\n", formatNumber(state.X), formatNumber(state.Y), formatNumber(cfg.TravelFeedrate*mm))
+	fmt.Fprintf(w, "G0 Z%s F%s\n", formatNumber(state.Z), formatNumber(cfg.ZFeedrate*mm))
+	if state.Feedrate != 0 {
+		fmt.Fprintf(w, "G1 F%s\n", formatNumber(state.Feedrate))
+	}
+	if state.FanSpeed > 0 {
+		fmt.Fprintf(w, "M106 S%s\n", formatNumber(math.Round(state.FanSpeed)))
+	} else {
+		fmt.Fprintln(w, "M107")
+	}
+	if state.RelativeCoordinates {
+		fmt.Fprintln(w, "G91")
+	}
+	_, err = fmt.Fprintln(w, "; the rest of the print")
+	return err
+}
+
+// setZCommand is the command that tells a flavor of firmware that the nozzle is at z, without homing it. z is in the
+// file's units, of which there are mm to a millimeter
+func setZCommand(flavor *Flavor, z, mm float64) (string, error) {
+	switch flavor {
+	case FlavorKlipper:
+		// Klipper won't move an axis that hasn't been homed, and G92 doesn't count
+		// and it's always in millimeters
+		return "SET_KINEMATIC_POSITION Z=" + formatNumber(z/mm), nil
+	case FlavorGrbl, FlavorLinuxCNC:
+		return "", fmt.Errorf("prints can't be resumed on %s", flavor.Name)
+	}
+	return "G92 Z" + formatNumber(z), nil
+}
+
+// keepForResume is whether a line of start gcode is safe to run over a print that's already partly printed: M codes
+// that set the printer up, but not the ones that heat (which Resume does itself, in a safe order)
+func keepForResume(line *GcodeLine) bool {
+	if line.CmdLetter != M || line.CmdSubcodeValid {
+		return false
+	}
+	switch line.CmdNumber {
+	case 104, 109, 116, 140, 190:
+		return false
+	}
+	return true
+}
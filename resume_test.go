@@ -0,0 +1,104 @@
+package gcodetools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeLine(t *testing.T) {
+	layers, err := ReadLayers(DialectRepRap, strings.NewReader(squaresGcode(3, 20, 215)))
+	assert.NoError(t, err)
+
+	line, err := ResumeLineAtLayer(layers, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 18, line)
+	_, err = ResumeLineAtLayer(layers, 3)
+	assert.EqualError(t, err, "there is no layer 3 (the print has 3 layers, numbered from 0)")
+	_, err = ResumeLineAtLayer(layers, 0)
+	assert.EqualError(t, err, "the first layer starts at the start of the file, so the print can just be started again")
+
+	line, err = ResumeLineAtZ(layers, 0.4)
+	assert.NoError(t, err)
+	assert.Equal(t, 18, line)
+	// between layers, it carries on from the one above
+	line, err = ResumeLineAtZ(layers, 0.3)
+	assert.NoError(t, err)
+	assert.Equal(t, 18, line)
+	_, err = ResumeLineAtZ(layers, 0.7)
+	assert.Error(t, err)
+	_, err = ResumeLineAtZ(layers, 0.1)
+	assert.Error(t, err)
+}
+
+func TestResume(t *testing.T) {
+	original := squaresGcode(3, 20, 215)
+	var out strings.Builder
+	state, err := Resume(ResumeConfig{
+		Dialect:    DialectRepRap,
+		StartGcode: "M140 S60\nG28 ; home\nM420 S1\nG29\nM190 S60\nM900 K0.05\nG1 X0 Y0 E10 ; purge\n",
+	}, strings.NewReader(original), &out, 18)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.4, state.Z, 1e-9)
+
+	lines := strings.Split(original, "\n")
+	assert.Equal(t, strings.Join([]string{
+		"; resuming from line 18, at X10 Y10 Z0.4",
+		"G21",
+		"M140 S60",
+		"; the nozzle has to be at exactly Z0.4, where the print carries on from",
+		"G92 Z0.4",
+		"G91",
+		"G1 Z5 F600",
+		"G90",
+		"G28 X Y",
+		"; from the start gcode",
+		"M420 S1",
+		"M900 K0.05",
+		"M190 S60",
+		"M109 S215",
+		"M83",
+		"G92 E0",
+		"G0 X10 Y10 F6000",
+		"G0 Z0.4 F600",
+		"G1 F6000",
+		"M107",
+		"; the rest of the print",
+	}, "\n")+"\n"+strings.Join(lines[17:], "\n")+"\n", out.String())
+}
+
+func TestResume_absoluteExtrusion(t *testing.T) {
+	original := "M82\nM104 T1 S200\nM104 S210\nM106 S127.5\nG28\nG1 Z0.3 F600\nG1 X10 Y10 E5 F1200\nG91\nG1 X10 E5\n"
+	var out strings.Builder
+	_, err := Resume(ResumeConfig{Dialect: DialectRepRap, Clearance: 2}, strings.NewReader(original), &out, 9)
+	assert.NoError(t, err)
+	resumed := out.String()
+	assert.Contains(t, resumed, "G1 Z2 F600\n")
+	assert.Contains(t, resumed, "M104 T1 S200\nM109 S210\nM82\nG92 E5\nG0 X10 Y10 F6000\nG0 Z0.3 F600\nG1 F1200\nM106 S128\nG91\n")
+	assert.True(t, strings.HasSuffix(resumed, "; the rest of the print\nG1 X10 E5\n"))
+
+	_, err = Resume(ResumeConfig{Dialect: DialectRepRap}, strings.NewReader(original), &out, 11)
+	assert.EqualError(t, err, "line 11 is past the end of the file, which has 9 lines")
+}
+
+func TestResume_flavors(t *testing.T) {
+	original := "G20\nG28\nG1 Z0.5 F30\nG1 X1 Y1 F100\n"
+	var out strings.Builder
+	_, err := Resume(ResumeConfig{Dialect: DialectRepRap, Flavor: FlavorKlipper}, strings.NewReader(original), &out, 4)
+	assert.NoError(t, err)
+	// Klipper is always told in millimeters
+	assert.Contains(t, out.String(), "G20\n; the nozzle has to be at exactly Z0.5, where the print carries on from\nSET_KINEMATIC_POSITION Z=12.7\nG91\n")
+
+	out.Reset()
+	_, err = Resume(ResumeConfig{Dialect: DialectCNC, Flavor: FlavorGrbl}, strings.NewReader(original), &out, 4)
+	assert.EqualError(t, err, "prints can't be resumed on grbl")
+	assert.Empty(t, out.String())
+}
+
+func TestResume_beforeHoming(t *testing.T) {
+	var out strings.Builder
+	_, err := Resume(ResumeConfig{Dialect: DialectRepRap}, strings.NewReader(squaresGcode(3, 20)), &out, 2)
+	assert.EqualError(t, err, "line 2 is before the printer is homed, so there's no print to carry on with")
+	assert.Empty(t, out.String())
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// statusInterval is how often subscribers are told what has changed, like Moonraker's
+const statusInterval = 250 * time.Millisecond
+
+// JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+// dashboards are usually served from somewhere else, so requests from any origin are allowed (the API key still
+// has to match)
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	// ID is missing for notifications, which don't get a response
+	ID json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcNotification struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+// objectStatus is the status of one of Klipper's printer objects, by field
+type objectStatus map[string]interface{}
+
+// moonrakerConn is a websocket connection from a Moonraker client
+type moonrakerConn struct {
+	server *Server
+	ws     *websocket.Conn
+	// writeMu is held while writing, since responses and notifications are written from different goroutines
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+	// subscribed are the objects that the client subscribed to, with the fields it wants (nil for every field), and
+	// sent is what it was last sent for them
+	subscribed map[string][]string
+	sent       map[string]objectStatus
+}
+
+// handleWebsocket serves the parts of Moonraker's JSON-RPC API that dashboards use to show a print's progress
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied
+		return
+	}
+	c := &moonrakerConn{server: s, ws: ws}
+	done := make(chan struct{})
+	go c.notify(done)
+	c.serve()
+	close(done)
+	_ = ws.Close()
+}
+
+func (c *moonrakerConn) write(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.ws.WriteJSON(v)
+}
+
+// serve answers requests until the connection closes
+func (c *moonrakerConn) serve() {
+	for {
+		_, message, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var request rpcRequest
+		response := rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null")}
+		if err := json.Unmarshal(message, &request); err != nil {
+			response.Error = &rpcError{rpcParseError, "Parse error"}
+		} else {
+			if request.ID != nil {
+				response.ID = request.ID
+			}
+			response.Result, response.Error = c.call(request.Method, request.Params)
+			if request.ID == nil {
+				continue
+			}
+		}
+		if err := c.write(response); err != nil {
+			return
+		}
+	}
+}
+
+// call runs a method, and returns its result or an error
+func (c *moonrakerConn) call(method string, params json.RawMessage) (interface{}, *rpcError) {
+	switch method {
+	case "":
+		return nil, &rpcError{rpcInvalidRequest, "Invalid Request"}
+	case "server.info":
+		return map[string]interface{}{
+			"klippy_connected":  true,
+			"klippy_state":      "ready",
+			"components":        []string{},
+			"failed_components": []string{},
+			"moonraker_version": "gcodetools",
+		}, nil
+	case "printer.info":
+		return map[string]interface{}{
+			"state":            "ready",
+			"state_message":    "Printer is ready",
+			"software_version": "gcodetools",
+		}, nil
+	case "printer.objects.list":
+		status := c.server.moonrakerStatus()
+		objects := make([]string, 0, len(status))
+		for name := range status {
+			objects = append(objects, name)
+		}
+		return map[string]interface{}{"objects": objects}, nil
+	case "printer.objects.query", "printer.objects.subscribe":
+		var request struct {
+			Objects map[string][]string `json:"objects"`
+		}
+		if err := json.Unmarshal(params, &request); err != nil || request.Objects == nil {
+			return nil, &rpcError{rpcInvalidParams, "Invalid params: expected objects"}
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		status := c.server.moonrakerQuery(request.Objects)
+		if method == "printer.objects.subscribe" {
+			// a new subscription replaces the old one, like it does in Moonraker
+			c.subscribed = request.Objects
+			c.sent = status
+		}
+		return map[string]interface{}{"eventtime": c.server.eventTime(), "status": status}, nil
+	}
+	return nil, &rpcError{rpcMethodNotFound, "Method not found"}
+}
+
+// notify sends subscribers what has changed every statusInterval, until done is closed
+func (c *moonrakerConn) notify(done chan struct{}) {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		go c.server.pollTemperatures()
+
+		c.mu.Lock()
+		status := c.server.moonrakerQuery(c.subscribed)
+		changed := map[string]objectStatus{}
+		for name, fields := range status {
+			for field, value := range fields {
+				if !reflect.DeepEqual(c.sent[name][field], value) {
+					if changed[name] == nil {
+						changed[name] = objectStatus{}
+					}
+					changed[name][field] = value
+				}
+			}
+		}
+		c.sent = status
+		c.mu.Unlock()
+
+		if len(changed) > 0 {
+			_ = c.write(rpcNotification{
+				JSONRPC: "2.0",
+				Method:  "notify_status_update",
+				Params:  []interface{}{changed, c.server.eventTime()},
+			})
+		}
+	}
+}
+
+// pollTemperatures asks the printer for its temperatures (which Klipper always knows), unless it was asked in the
+// last second or hasn't answered yet
+func (s *Server) pollTemperatures() {
+	s.mu.Lock()
+	if s.polling || time.Since(s.lastPoll) < time.Second {
+		s.mu.Unlock()
+		return
+	}
+	s.polling = true
+	s.lastPoll = time.Now()
+	s.mu.Unlock()
+
+	// the host sends it between the lines of a print, so this can take as long as waiting for a heater does
+	_, _ = s.host.Command(context.Background(), "M105")
+	s.mu.Lock()
+	s.polling = false
+	s.mu.Unlock()
+}
+
+// eventTime is Klipper's idea of the time: seconds since it started
+func (s *Server) eventTime() float64 {
+	return time.Since(s.started).Seconds()
+}
+
+// moonrakerQuery is the status of some of Klipper's printer objects, with only the fields asked for (or all of them
+// for nil). Objects that don't exist are left out.
+func (s *Server) moonrakerQuery(objects map[string][]string) map[string]objectStatus {
+	all := s.moonrakerStatus()
+	status := map[string]objectStatus{}
+	for name, fields := range objects {
+		object, ok := all[name]
+		if !ok {
+			continue
+		}
+		if fields == nil {
+			status[name] = object
+			continue
+		}
+		status[name] = objectStatus{}
+		for _, field := range fields {
+			if value, ok := object[field]; ok {
+				status[name][field] = value
+			}
+		}
+	}
+	return status
+}
+
+// moonrakerStatus is the status of every printer object, as Klipper reports it
+func (s *Server) moonrakerStatus() map[string]objectStatus {
+	state := s.host.State()
+	temperatures := s.host.Temperatures()
+	extruder := objectStatus{"temperature": 0.0, "target": 0.0, "power": 0.0}
+	if state.Tool < len(temperatures.Tools) {
+		t := temperatures.Tools[state.Tool]
+		extruder = objectStatus{"temperature": t.Actual, "target": t.Target, "power": 0.0}
+	}
+	homedAxes := ""
+	if state.IsHomed {
+		homedAxes = "xyz"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	printStats := objectStatus{
+		"filename":       "",
+		"total_duration": 0.0,
+		"print_duration": 0.0,
+		"filament_used":  0.0,
+		"state":          "standby",
+		"message":        s.errorText,
+	}
+	sdcard := objectStatus{
+		"file_path":     nil,
+		"progress":      0.0,
+		"is_active":     s.printing,
+		"file_position": int64(0),
+		"file_size":     int64(0),
+	}
+	if s.file != nil {
+		printStats["filename"] = s.file.name
+		sdcard["file_path"] = s.file.name
+		sdcard["file_size"] = s.file.size
+	}
+	if !s.printStart.IsZero() {
+		end := s.printEnd
+		if end.IsZero() {
+			end = time.Now()
+		}
+		total := end.Sub(s.printStart)
+		paused := s.pausedFor
+		if !s.pausedAt.IsZero() {
+			paused += end.Sub(s.pausedAt)
+		}
+		printStats["total_duration"] = total.Seconds()
+		printStats["print_duration"] = (total - paused).Seconds()
+		printStats["filament_used"] = state.Extruded - s.extrudedAtStart
+
+		filePos := s.host.FilePosition()
+		sdcard["file_position"] = filePos
+		if s.file != nil && s.file.size > 0 {
+			sdcard["progress"] = float64(filePos) / float64(s.file.size)
+		}
+	}
+	switch {
+	case s.state == StatePaused:
+		printStats["state"] = "paused"
+	case s.printing:
+		printStats["state"] = "printing"
+	case s.outcome != "":
+		printStats["state"] = s.outcome
+	}
+
+	return map[string]objectStatus{
+		"toolhead": {
+			"position":   []float64{state.X, state.Y, state.Z, state.EAbsolute},
+			"homed_axes": homedAxes,
+			"extruder":   "extruder",
+			"print_time": s.eventTime(),
+		},
+		"extruder": extruder,
+		"heater_bed": {
+			"temperature": temperatures.Bed.Actual,
+			"target":      temperatures.Bed.Target,
+			"power":       0.0,
+		},
+		"print_stats":    printStats,
+		"virtual_sdcard": sdcard,
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/madewithlinux/gcodetools/host"
+	"github.com/stretchr/testify/assert"
+)
+
+// rpcMessage is a response or a notification
+type rpcMessage struct {
+	ID     *int
+	Method string
+	Result struct {
+		Status  map[string]map[string]interface{}
+		Objects []string
+	}
+	Params []json.RawMessage
+	Error  *rpcError
+}
+
+func dialWebsocket(t *testing.T, url string) *websocket.Conn {
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/websocket?apikey="+testAPIKey, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		_ = ws.Close()
+	})
+	return ws
+}
+
+// call sends a request, and returns the response to it (skipping any notifications on the way)
+func call(t *testing.T, ws *websocket.Conn, id int, method string, params interface{}) rpcMessage {
+	assert.NoError(t, ws.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": id}))
+	for {
+		var message rpcMessage
+		if !assert.NoError(t, ws.ReadJSON(&message)) {
+			t.FailNow()
+		}
+		if message.ID != nil && *message.ID == id {
+			return message
+		}
+	}
+}
+
+func TestMoonraker_query(t *testing.T) {
+	server := newTestServer(t, host.NewEmulator(host.EmulatorConfig{}), Config{})
+	ws := dialWebsocket(t, server.URL)
+
+	response := call(t, ws, 1, "printer.objects.list", nil)
+	assert.Nil(t, response.Error)
+	assert.Contains(t, response.Result.Objects, "toolhead")
+	assert.Contains(t, response.Result.Objects, "virtual_sdcard")
+
+	response = call(t, ws, 2, "printer.objects.query", map[string]interface{}{
+		"objects": map[string]interface{}{"toolhead": []string{"homed_axes"}, "print_stats": nil, "gcode_macro nope": nil},
+	})
+	assert.Nil(t, response.Error)
+	assert.Equal(t, map[string]interface{}{"homed_axes": ""}, response.Result.Status["toolhead"])
+	assert.Equal(t, "standby", response.Result.Status["print_stats"]["state"])
+	assert.Len(t, response.Result.Status, 2)
+
+	response = call(t, ws, 3, "printer.objects.query", nil)
+	assert.Equal(t, rpcInvalidParams, response.Error.Code)
+	response = call(t, ws, 4, "printer.gcode.script", map[string]string{"script": "G28"})
+	assert.Equal(t, rpcMethodNotFound, response.Error.Code)
+}
+
+func TestMoonraker_subscribe(t *testing.T) {
+	// homing and the dwells take half a second, so that there's a notification while it's printing
+	emulator := host.NewEmulator(host.EmulatorConfig{TimeScale: 0.1})
+	server := newTestServer(t, emulator, Config{})
+	ws := dialWebsocket(t, server.URL)
+
+	response := call(t, ws, 1, "printer.objects.subscribe", map[string]interface{}{
+		"objects": map[string]interface{}{
+			"toolhead":       []string{"position", "homed_axes"},
+			"extruder":       nil,
+			"print_stats":    []string{"state", "filename", "filament_used"},
+			"virtual_sdcard": []string{"progress", "is_active"},
+		},
+	})
+	assert.Nil(t, response.Error)
+	assert.Equal(t, []interface{}{0.0, 0.0, 0.0, 0.0}, response.Result.Status["toolhead"]["position"])
+	assert.Equal(t, "standby", response.Result.Status["print_stats"]["state"])
+	assert.Equal(t, false, response.Result.Status["virtual_sdcard"]["is_active"])
+
+	file := "G28\nM104 S200\nM83\nG1 X10 Y20 F6000\nG4 P1000\nG1 X30 E1.5\nG4 P1000\n"
+	resp := upload(t, server.URL, "part.gcode", file, map[string]string{"print": "true"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// put together everything that the notifications say, until the print is complete and the printer has been asked
+	// for its temperatures since the M104
+	status := response.Result.Status
+	states := []interface{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	assert.NoError(t, ws.SetReadDeadline(deadline))
+	for (status["print_stats"]["state"] != "complete" || status["extruder"]["target"] != 200.0) && time.Now().Before(deadline) {
+		var message rpcMessage
+		if !assert.NoError(t, ws.ReadJSON(&message)) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, "notify_status_update", message.Method) || !assert.Len(t, message.Params, 2) {
+			t.FailNow()
+		}
+		var changed map[string]map[string]interface{}
+		assert.NoError(t, json.Unmarshal(message.Params[0], &changed))
+		for name, fields := range changed {
+			if _, ok := status[name]; !assert.True(t, ok, "%s wasn't subscribed to", name) {
+				continue
+			}
+			for field, value := range fields {
+				_, ok := status[name][field]
+				assert.True(t, ok, "%s.%s wasn't subscribed to", name, field)
+				status[name][field] = value
+				if name == "print_stats" && field == "state" {
+					states = append(states, value)
+				}
+			}
+		}
+	}
+
+	assert.Equal(t, []interface{}{"printing", "complete"}, states)
+	assert.Equal(t, []interface{}{30.0, 20.0, 0.0, 1.5}, status["toolhead"]["position"])
+	assert.Equal(t, "xyz", status["toolhead"]["homed_axes"])
+	assert.Equal(t, 200.0, status["extruder"]["target"])
+	assert.Equal(t, "part.gcode", status["print_stats"]["filename"])
+	assert.Equal(t, 1.5, status["print_stats"]["filament_used"])
+	assert.Equal(t, 1.0, status["virtual_sdcard"]["progress"])
+	assert.Equal(t, false, status["virtual_sdcard"]["is_active"])
+}
@@ -0,0 +1,648 @@
+// Package server runs a print host as a network service, with the parts of OctoPrint's REST API that slicers use to
+// upload and start prints, and the parts of Moonraker's websocket API that dashboards use to follow them. Prints are
+// streamed to the printer by a host.Host, which can be talking to a real printer or to an emulated one.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/madewithlinux/gcodetools/host"
+)
+
+// The states that a printer can be in, named like OctoPrint's
+const (
+	StateOperational = "Operational"
+	StatePrinting    = "Printing"
+	StatePaused      = "Paused"
+	StateCancelling  = "Cancelling"
+	StateError       = "Error"
+)
+
+// octoPrintVersion is the version of OctoPrint that the API is compatible with. Slicers check the text of
+// /api/version to see whether they're talking to OctoPrint.
+const octoPrintVersion = "1.9.0"
+
+// Config is how a Server stores and prints files
+type Config struct {
+	// UploadDir is where uploaded files are kept
+	UploadDir string
+	// APIKey has to be sent in the X-Api-Key header (or the apikey query parameter) of every request, when it's set
+	APIKey  string
+	Dialect gcodetools.Dialect
+	// Minifier minifies uploads before they're stored, when it's set
+	Minifier *gcodetools.GcodeMinifierConfig
+	// Limits are the printer's motion limits, for estimating how long prints take
+	Limits gcodetools.KinematicLimits
+	// MaxUploadSize is the biggest upload there can be, in bytes. Defaults to 512MB
+	MaxUploadSize int64
+}
+
+// selectedFile is the file that will be printed (or is being printed)
+type selectedFile struct {
+	name string
+	size int64
+	date int64
+	// estimatedSeconds is how long the time estimator thinks that it takes to print
+	estimatedSeconds float64
+}
+
+// Server serves a print host over HTTP
+type Server struct {
+	cfg     Config
+	host    *host.Host
+	mux     *http.ServeMux
+	started time.Time
+
+	mu        sync.Mutex
+	state     string
+	errorText string
+	file      *selectedFile
+	// printStart is when the current (or last) print started, and printEnd is when it finished
+	printStart time.Time
+	printEnd   time.Time
+	printing   bool
+	// outcome is how the last print finished: "complete", "cancelled" or "error" (like Klipper's print_stats)
+	outcome string
+	// pausedAt is when the print was paused (zero when it isn't), and pausedFor is how long it's been paused before
+	pausedAt  time.Time
+	pausedFor time.Duration
+	// extrudedAtStart is how much had been extruded before the print started
+	extrudedAtStart float64
+	// polling is whether the printer has been asked for its temperatures and hasn't answered yet, and lastPoll is
+	// when it was asked last
+	polling  bool
+	lastPoll time.Time
+}
+
+// New makes a server that prints with h, which should already be connected
+func New(h *host.Host, cfg Config) (*Server, error) {
+	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
+		return nil, err
+	}
+	if cfg.MaxUploadSize == 0 {
+		cfg.MaxUploadSize = 512 << 20
+	}
+	s := &Server{cfg: cfg, host: h, mux: http.NewServeMux(), started: time.Now(), state: StateOperational}
+	s.mux.HandleFunc("/api/version", s.handleVersion)
+	s.mux.HandleFunc("/api/files", s.handleFiles)
+	s.mux.HandleFunc("/api/files/local", s.handleFiles)
+	s.mux.HandleFunc("/api/files/local/", s.handleFile)
+	s.mux.HandleFunc("/downloads/files/local/", s.handleDownload)
+	s.mux.HandleFunc("/api/job", s.handleJob)
+	s.mux.HandleFunc("/api/printer", s.handlePrinter)
+	s.mux.HandleFunc("/websocket", s.handleWebsocket)
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.APIKey != "" {
+		key := r.Header.Get("X-Api-Key")
+		if key == "" {
+			key = r.URL.Query().Get("apikey")
+		}
+		if key != s.cfg.APIKey {
+			http.Error(w, "Invalid API key", http.StatusForbidden)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"api":    "0.1",
+		"server": octoPrintVersion,
+		"text":   "OctoPrint " + octoPrintVersion + " (gcodetools)",
+	})
+}
+
+// fileName checks that a file name doesn't go outside of the upload directory
+func fileName(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return name, nil
+}
+
+type fileRefs struct {
+	Resource string `json:"resource"`
+	Download string `json:"download"`
+}
+
+type fileInfo struct {
+	Name   string   `json:"name"`
+	Path   string   `json:"path"`
+	Type   string   `json:"type"`
+	Origin string   `json:"origin"`
+	Size   int64    `json:"size"`
+	Date   int64    `json:"date"`
+	Refs   fileRefs `json:"refs"`
+}
+
+func (s *Server) fileInfo(r *http.Request, info os.FileInfo) fileInfo {
+	base := "http://" + r.Host
+	return fileInfo{
+		Name:   info.Name(),
+		Path:   info.Name(),
+		Type:   "machinecode",
+		Origin: "local",
+		Size:   info.Size(),
+		Date:   info.ModTime().Unix(),
+		Refs: fileRefs{
+			Resource: base + "/api/files/local/" + info.Name(),
+			Download: base + "/downloads/files/local/" + info.Name(),
+		},
+	}
+}
+
+// handleFiles lists the uploaded files, or takes an upload
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		if r.URL.Path != "/api/files/local" {
+			http.Error(w, "Files can only be uploaded to local", http.StatusNotFound)
+			return
+		}
+		s.upload(w, r)
+		return
+	}
+
+	infos, err := ioutil.ReadDir(s.cfg.UploadDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	files := []fileInfo{}
+	for _, info := range infos {
+		if _, err := fileName(info.Name()); err == nil && info.Mode().IsRegular() {
+			files = append(files, s.fileInfo(r, info))
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"files": files})
+}
+
+// upload stores an uploaded file (minifying it on the way, if there is a minifier), and selects or prints it if
+// it's asked to
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxUploadSize)
+	file, header, err := r.FormFile("file")
+	if err != nil && strings.Contains(err.Error(), "request body too large") {
+		http.Error(w, fmt.Sprintf("The file is bigger than %d bytes", s.cfg.MaxUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "No file included", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	name, err := fileName(filepath.Base(header.Filename))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// parsing it all up front means that a broken file is rejected now, rather than halfway through printing
+	if _, err := s.estimate(bytes.NewReader(content)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.cfg.Minifier != nil {
+		minified, err := minify(s.cfg.Minifier, string(content))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content = []byte(minified)
+	}
+
+	selectFile := r.FormValue("select") == "true"
+	print := r.FormValue("print") == "true"
+	path := filepath.Join(s.cfg.UploadDir, name)
+	s.mu.Lock()
+	if (selectFile || print) && s.printing {
+		s.mu.Unlock()
+		http.Error(w, "The printer is busy", http.StatusConflict)
+		return
+	}
+	s.mu.Unlock()
+	if err := writeFileAtomically(path, content); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if selectFile || print {
+		if status, err := s.selectFile(name, print); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	uploaded := s.fileInfo(r, info)
+	w.Header().Set("Location", uploaded.Refs.Resource)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"done":  true,
+		"files": map[string]fileInfo{"local": uploaded},
+	})
+}
+
+// minify minifies a whole file. The minifier panics on gcode that it can't handle (like moves before homing), which
+// shouldn't take the server down with it.
+func minify(cfg *gcodetools.GcodeMinifierConfig, content string) (minified string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("can't minify: %v", r)
+		}
+	}()
+	minified, _ = cfg.MinifyGcodeStr(gcodetools.MachineState{}, content)
+	return
+}
+
+func writeFileAtomically(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// estimate parses a whole file, and returns how long it takes to print
+func (s *Server) estimate(r io.Reader) (float64, error) {
+	estimator := gcodetools.TimeEstimator{Limits: s.cfg.Limits}
+	scanner := gcodetools.NewLineScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, err := s.cfg.Dialect.ParseLine(scanner.Text())
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		estimator.AddLine(&line)
+	}
+	return estimator.Seconds(), scanner.Err()
+}
+
+// handleFile runs a command on an uploaded file, which can only be select (and maybe print) here
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	name, err := fileName(strings.TrimPrefix(r.URL.Path, "/api/files/local/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var request struct {
+		Command string `json:"command"`
+		Print   bool   `json:"print"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Command != "select" {
+		http.Error(w, fmt.Sprintf("Unknown command %q", request.Command), http.StatusBadRequest)
+		return
+	}
+	if status, err := s.selectFile(name, request.Print); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	name, err := fileName(strings.TrimPrefix(r.URL.Path, "/downloads/files/local/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(s.cfg.UploadDir, name))
+}
+
+// selectFile makes a file the one that gets printed, and starts printing it if print is set. It returns the HTTP
+// status to reply with when it fails.
+func (s *Server) selectFile(name string, print bool) (int, error) {
+	path := filepath.Join(s.cfg.UploadDir, name)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return http.StatusNotFound, fmt.Errorf("File not found: %s", name)
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	estimatedSeconds, err := s.estimate(file)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	s.mu.Lock()
+	if s.printing {
+		s.mu.Unlock()
+		return http.StatusConflict, fmt.Errorf("The printer is busy")
+	}
+	s.file = &selectedFile{name: name, size: info.Size(), date: info.ModTime().Unix(), estimatedSeconds: estimatedSeconds}
+	s.mu.Unlock()
+	if print {
+		return s.startPrint()
+	}
+	return http.StatusOK, nil
+}
+
+// startPrint starts printing the selected file
+func (s *Server) startPrint() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.printing {
+		return http.StatusConflict, fmt.Errorf("The printer is busy")
+	}
+	if s.file == nil {
+		return http.StatusConflict, fmt.Errorf("No file selected")
+	}
+	file, err := os.Open(filepath.Join(s.cfg.UploadDir, s.file.name))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	s.printing = true
+	s.state = StatePrinting
+	s.errorText = ""
+	s.printStart = time.Now()
+	s.printEnd = time.Time{}
+	s.outcome = ""
+	s.pausedAt = time.Time{}
+	s.pausedFor = 0
+	s.extrudedAtStart = s.host.State().Extruded
+
+	go func() {
+		err := s.host.Send(context.Background(), file)
+		_ = file.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.printing = false
+		s.printEnd = time.Now()
+		s.resumed()
+		s.state = StateOperational
+		s.outcome = "complete"
+		if err == host.ErrCancelled {
+			s.outcome = "cancelled"
+		} else if err != nil {
+			s.state = StateError
+			s.errorText = err.Error()
+			s.outcome = "error"
+		}
+	}()
+	return http.StatusOK, nil
+}
+
+type jobFile struct {
+	Name   *string `json:"name"`
+	Path   *string `json:"path"`
+	Origin *string `json:"origin"`
+	Size   *int64  `json:"size"`
+	Date   *int64  `json:"date"`
+}
+
+type jobProgress struct {
+	Completion          *float64 `json:"completion"`
+	FilePos             *int64   `json:"filepos"`
+	PrintTime           *float64 `json:"printTime"`
+	PrintTimeLeft       *float64 `json:"printTimeLeft"`
+	PrintTimeLeftOrigin *string  `json:"printTimeLeftOrigin"`
+}
+
+type jobResponse struct {
+	Job struct {
+		File               jobFile     `json:"file"`
+		EstimatedPrintTime *float64    `json:"estimatedPrintTime"`
+		Filament           interface{} `json:"filament"`
+		User               *string     `json:"user"`
+	} `json:"job"`
+	Progress jobProgress `json:"progress"`
+	State    string      `json:"state"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// handleJob reports on the current print, or starts, pauses, resumes or cancels it
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		s.jobCommand(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response := jobResponse{State: s.state, Error: s.errorText}
+	if file := s.file; file != nil {
+		origin := "local"
+		response.Job.File = jobFile{Name: &file.name, Path: &file.name, Origin: &origin, Size: &file.size, Date: &file.date}
+		response.Job.EstimatedPrintTime = &file.estimatedSeconds
+	}
+	if !s.printStart.IsZero() && s.file != nil {
+		filePos := s.host.FilePosition()
+		completion := 100.0
+		if s.file.size > 0 {
+			completion = math.Min(100, 100*float64(filePos)/float64(s.file.size))
+		}
+		end := s.printEnd
+		if end.IsZero() {
+			end = time.Now()
+		}
+		printTime := end.Sub(s.printStart).Seconds()
+		printTimeLeft := s.file.estimatedSeconds * (1 - completion/100)
+		origin := "linear"
+		response.Progress = jobProgress{
+			Completion:          &completion,
+			FilePos:             &filePos,
+			PrintTime:           &printTime,
+			PrintTimeLeft:       &printTimeLeft,
+			PrintTimeLeftOrigin: &origin,
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) jobCommand(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Command string `json:"command"`
+		Action  string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conflict := func(message string) {
+		http.Error(w, message, http.StatusConflict)
+	}
+	switch request.Command {
+	case "start":
+		if status, err := s.startPrint(); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	case "cancel":
+		s.mu.Lock()
+		if !s.printing {
+			s.mu.Unlock()
+			conflict("Printer is neither printing nor paused")
+			return
+		}
+		s.state = StateCancelling
+		s.mu.Unlock()
+		s.host.Cancel()
+	case "pause":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.state != StatePrinting && s.state != StatePaused {
+			conflict("Printer is neither printing nor paused")
+			return
+		}
+		action := request.Action
+		if action == "" || action == "toggle" {
+			action = "pause"
+			if s.state == StatePaused {
+				action = "resume"
+			}
+		}
+		switch {
+		case action == "pause" && s.state == StatePrinting:
+			s.host.Pause()
+			s.state = StatePaused
+			s.pausedAt = time.Now()
+		case action == "resume" && s.state == StatePaused:
+			s.host.Resume()
+			s.state = StatePrinting
+			s.resumed()
+		case action == "pause" || action == "resume":
+			// already done
+		default:
+			http.Error(w, fmt.Sprintf("Unknown action %q", request.Action), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Unknown command %q", request.Command), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resumed adds the time since the print was paused (if it was) to how long it's been paused for. It has to be
+// called holding mu.
+func (s *Server) resumed() {
+	if !s.pausedAt.IsZero() {
+		s.pausedFor += time.Since(s.pausedAt)
+		s.pausedAt = time.Time{}
+	}
+}
+
+type temperatureResponse struct {
+	Actual float64 `json:"actual"`
+	Target float64 `json:"target"`
+	Offset float64 `json:"offset"`
+}
+
+// handlePrinter reports the temperatures and state of the printer
+func (s *Server) handlePrinter(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	s.mu.Lock()
+	state, printing := s.state, s.printing
+	s.mu.Unlock()
+	if !printing {
+		// while printing, the temperatures come from the reports during heating, or from asking in between lines.
+		// Otherwise the printer isn't doing anything, so it can be asked now.
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		_, _ = s.host.Command(ctx, "M105")
+		cancel()
+	}
+
+	temperatures := s.host.Temperatures()
+	temperature := map[string]temperatureResponse{
+		"bed": {Actual: temperatures.Bed.Actual, Target: temperatures.Bed.Target},
+	}
+	for tool, t := range temperatures.Tools {
+		temperature[fmt.Sprintf("tool%d", tool)] = temperatureResponse{Actual: t.Actual, Target: t.Target}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"temperature": temperature,
+		"sd":          map[string]bool{"ready": false},
+		"state": map[string]interface{}{
+			"text": state,
+			"flags": map[string]bool{
+				"operational":   state != StateError,
+				"printing":      state == StatePrinting,
+				"paused":        state == StatePaused,
+				"pausing":       false,
+				"cancelling":    state == StateCancelling,
+				"resuming":      false,
+				"finishing":     false,
+				"error":         state == StateError,
+				"closedOrError": state == StateError,
+				"ready":         state == StateOperational,
+				"sdReady":       false,
+			},
+		},
+	})
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/madewithlinux/gcodetools"
+	"github.com/madewithlinux/gcodetools/host"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAPIKey = "secret"
+
+func newTestServer(t *testing.T, emulator *host.Emulator, cfg Config) *httptest.Server {
+	h, closer := emulator.Pipe(host.Config{Checksums: true, ConnectWait: time.Second})
+	t.Cleanup(func() {
+		_ = closer.Close()
+	})
+	if !assert.NoError(t, h.Connect(context.Background())) {
+		t.FailNow()
+	}
+	cfg.UploadDir = t.TempDir()
+	cfg.APIKey = testAPIKey
+	cfg.Limits = gcodetools.DefaultPrinterProfile.Limits
+	s, err := New(h, cfg)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func request(t *testing.T, method, url string, body interface{}) *http.Response {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		assert.NoError(t, err)
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	assert.NoError(t, err)
+	req.Header.Set("X-Api-Key", testAPIKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return resp
+}
+
+func getJSON(t *testing.T, url string) map[string]interface{} {
+	resp := request(t, http.MethodGet, url, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var v map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&v))
+	return v
+}
+
+func upload(t *testing.T, url, name, content string, fields map[string]string) *http.Response {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", name)
+	assert.NoError(t, err)
+	_, _ = part.Write([]byte(content))
+	for key, value := range fields {
+		assert.NoError(t, writer.WriteField(key, value))
+	}
+	assert.NoError(t, writer.Close())
+
+	req, err := http.NewRequest(http.MethodPost, url+"/api/files/local", &body)
+	assert.NoError(t, err)
+	req.Header.Set("X-Api-Key", testAPIKey)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return resp
+}
+
+// waitForState waits for the job to get to a state, and returns the job
+func waitForState(t *testing.T, url, state string) map[string]interface{} {
+	var job map[string]interface{}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		job = getJSON(t, url+"/api/job")
+		if job["state"] == state {
+			return job
+		}
+	}
+	t.Fatalf("the job never got to %s: %v", state, job)
+	return nil
+}
+
+func TestServer_version(t *testing.T) {
+	server := newTestServer(t, host.NewEmulator(host.EmulatorConfig{}), Config{})
+	resp, err := http.Get(server.URL + "/api/version")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/api/version?apikey=" + testAPIKey)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var version map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&version))
+	assert.Equal(t, "0.1", version["api"])
+	assert.True(t, strings.HasPrefix(version["text"], "OctoPrint"))
+}
+
+func TestServer_uploadAndPrint(t *testing.T) {
+	emulator := host.NewEmulator(host.EmulatorConfig{})
+	server := newTestServer(t, emulator, Config{})
+	file := "; a comment\nG28\nM104 S200\nM140 S60\nG1 X10 Y20 F3000\nG1 X30 E1\n"
+
+	resp := upload(t, server.URL, "part.gcode", file, map[string]string{"print": "true"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, server.URL+"/api/files/local/part.gcode", resp.Header.Get("Location"))
+	var uploaded struct {
+		Done  bool
+		Files struct{ Local fileInfo }
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&uploaded))
+	assert.True(t, uploaded.Done)
+	assert.Equal(t, "part.gcode", uploaded.Files.Local.Name)
+	assert.Equal(t, int64(len(file)), uploaded.Files.Local.Size)
+
+	job := waitForState(t, server.URL, StateOperational)
+	assert.Equal(t, "part.gcode", job["job"].(map[string]interface{})["file"].(map[string]interface{})["name"])
+	assert.True(t, job["job"].(map[string]interface{})["estimatedPrintTime"].(float64) > 0)
+	progress := job["progress"].(map[string]interface{})
+	assert.Equal(t, 100.0, progress["completion"])
+	assert.Equal(t, float64(len(file)), progress["filepos"])
+	state := emulator.State()
+	assert.Equal(t, 30.0, state.X)
+	assert.Equal(t, 20.0, state.Y)
+
+	printer := getJSON(t, server.URL+"/api/printer")
+	temperature := printer["temperature"].(map[string]interface{})
+	assert.Equal(t, 200.0, temperature["tool0"].(map[string]interface{})["target"])
+	assert.Equal(t, 60.0, temperature["bed"].(map[string]interface{})["target"])
+	assert.Equal(t, StateOperational, printer["state"].(map[string]interface{})["text"])
+
+	files := getJSON(t, server.URL+"/api/files")
+	assert.Len(t, files["files"], 1)
+	resp = request(t, http.MethodGet, server.URL+"/downloads/files/local/part.gcode", nil)
+	content, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, file, string(content))
+}
+
+func TestServer_uploadMinified(t *testing.T) {
+	minifier := gcodetools.DefaultPrinterProfile.Minifier
+	server := newTestServer(t, host.NewEmulator(host.EmulatorConfig{}), Config{Minifier: minifier.Init()})
+	resp := upload(t, server.URL, "part.gcode", "; a comment\nG28\nG1 X10.000 Y20.000\nG1 X10.000 Y30.000\n", nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = request(t, http.MethodGet, server.URL+"/downloads/files/local/part.gcode", nil)
+	content, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "; a comment\nG28\nG1 X10 Y20\nG1 Y30\n", string(content))
+
+	// the minifier can't handle moves before homing
+	resp = upload(t, server.URL, "unhomed.gcode", "G1 X10 Y20\n", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServer_uploadText(t *testing.T) {
+	// messages are kept as they are, even when they look like they have a (comment or a [bracket in them
+	file := "G28\nM117 (50%\nM118 [done\nG1 X10 Y20\n"
+	minifier := gcodetools.GcodeMinifierConfig{Flavor: gcodetools.FlavorMarlin}
+	for _, cfg := range []Config{{}, {Minifier: minifier.Init()}} {
+		server := newTestServer(t, host.NewEmulator(host.EmulatorConfig{}), cfg)
+		resp := upload(t, server.URL, "part.gcode", file, nil)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp = request(t, http.MethodGet, server.URL+"/downloads/files/local/part.gcode", nil)
+		content, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, file, string(content))
+	}
+}
+
+func TestServer_uploadTooLarge(t *testing.T) {
+	server := newTestServer(t, host.NewEmulator(host.EmulatorConfig{}), Config{MaxUploadSize: 1024})
+	resp := upload(t, server.URL, "part.gcode", strings.Repeat("G1 X10 Y20\n", 1000), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	resp = upload(t, server.URL, "part.gcode", "G28\n", nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestServer_uploadInvalid(t *testing.T) {
+	server := newTestServer(t, host.NewEmulator(host.EmulatorConfig{}), Config{})
+	resp := upload(t, server.URL, "part.gcode", "G28\nG1 Xabc\n", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = upload(t, server.URL, ".hidden", "G28\n", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServer_jobCommands(t *testing.T) {
+	// every dwell takes a tenth of a second (in the printer's time), which is 5ms here
+	emulator := host.NewEmulator(host.EmulatorConfig{TimeScale: 0.05})
+	server := newTestServer(t, emulator, Config{})
+	file := strings.Repeat("G4 P100\n", 200)
+
+	resp := request(t, http.MethodPost, server.URL+"/api/job", map[string]string{"command": "start"})
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "there's no file selected")
+
+	resp = upload(t, server.URL, "dwell.gcode", file, map[string]string{"select": "true"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, StateOperational, getJSON(t, server.URL+"/api/job")["state"])
+
+	resp = request(t, http.MethodPost, server.URL+"/api/job", map[string]string{"command": "start"})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = request(t, http.MethodPost, server.URL+"/api/job", map[string]string{"command": "start"})
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "it's already printing")
+	resp = upload(t, server.URL, "other.gcode", "G28\n", map[string]string{"print": "true"})
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "it's already printing")
+
+	resp = request(t, http.MethodPost, server.URL+"/api/job", map[string]string{"command": "pause", "action": "pause"})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	job := waitForState(t, server.URL, StatePaused)
+	time.Sleep(50 * time.Millisecond)
+	filePos := getJSON(t, server.URL+"/api/job")["progress"].(map[string]interface{})["filepos"]
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, filePos, getJSON(t, server.URL+"/api/job")["progress"].(map[string]interface{})["filepos"],
+		"nothing is sent while paused")
+	assert.True(t, job["progress"].(map[string]interface{})["completion"].(float64) < 100)
+
+	resp = request(t, http.MethodPost, server.URL+"/api/job", map[string]string{"command": "pause"})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, StatePrinting, getJSON(t, server.URL+"/api/job")["state"])
+
+	resp = request(t, http.MethodPost, server.URL+"/api/job", map[string]string{"command": "cancel"})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	job = waitForState(t, server.URL, StateOperational)
+	assert.True(t, job["progress"].(map[string]interface{})["completion"].(float64) < 100)
+
+	resp = request(t, http.MethodPost, server.URL+"/api/job", map[string]string{"command": "cancel"})
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "there's nothing to cancel")
+	resp = request(t, http.MethodPost, server.URL+"/api/job", map[string]string{"command": "restart"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestFileName(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../part.gcode", "a/b.gcode", ".hidden"} {
+		_, err := fileName(name)
+		assert.Error(t, err, name)
+	}
+	name, err := fileName("part.gcode")
+	assert.NoError(t, err)
+	assert.Equal(t, "part.gcode", name)
+}
@@ -0,0 +1,57 @@
+package gcodetools
+
+import (
+	"fmt"
+	"math"
+)
+
+// SkewCorrection is how far out of square a printer's axes are, as the same factors as Klipper's SET_SKEW. Each is
+// the tangent of how far the angle between two axes is from 90°, which SkewFactor works out from a calibration print.
+type SkewCorrection struct {
+	XY, XZ, YZ float64
+}
+
+// SkewFactor is the skew factor for a plane, from the lengths of a square printed in it: the diagonals AC and BD, and
+// the side AD (like Klipper's SET_SKEW). See calibrate.Skew for which corner is which.
+func SkewFactor(ac, bd, ad float64) (float64, error) {
+	if ac <= 0 || bd <= 0 || ad <= 0 {
+		return 0, fmt.Errorf("lengths must be more than 0")
+	}
+	// the other side, from the parallelogram law
+	side := math.Sqrt(2*ac*ac+2*bd*bd-4*ad*ad) / 2
+	cos := (ac*ac - side*side - ad*ad) / (2 * side * ad)
+	if math.IsNaN(side) || side == 0 || math.Abs(cos) >= 1 {
+		return 0, fmt.Errorf("the lengths %v, %v and %v aren't from a parallelogram", ac, bd, ad)
+	}
+	return math.Tan(math.Pi/2 - math.Acos(cos)), nil
+}
+
+// Transform is the transform that corrects for the skew, which is the same as what Klipper does to every move
+func (s SkewCorrection) Transform() Transform {
+	return Transform{
+		{1, -s.XY, -(s.XZ - s.XY*s.YZ)},
+		{0, 1, -s.YZ},
+		{0, 0, 1},
+	}
+}
+
+// AxisScale is the factor to scale an axis by, so that it moves by what it's meant to, given how long something was
+// meant to be and how long it came out. It's the same as changing steps per mm (M92) by the same factor.
+func AxisScale(expected, measured float64) (float64, error) {
+	if expected <= 0 || measured <= 0 {
+		return 0, fmt.Errorf("lengths must be more than 0")
+	}
+	return expected / measured, nil
+}
+
+// AxisCorrection corrects a printer's geometry from measurements of calibration prints: its skew, and then how far
+// each axis moves (where 1 is unchanged)
+type AxisCorrection struct {
+	Skew                   SkewCorrection
+	ScaleX, ScaleY, ScaleZ float64
+}
+
+// Transform is the transform that does the correction
+func (c AxisCorrection) Transform() Transform {
+	return c.Skew.Transform().Then(ScaleTransform(c.ScaleX, c.ScaleY, c.ScaleZ))
+}
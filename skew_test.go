@@ -0,0 +1,51 @@
+package gcodetools
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkewFactor(t *testing.T) {
+	// a 100mm square printed with 89° between X and Y, so B and C lean towards +X
+	angle := 89 * math.Pi / 180
+	b := [2]float64{100 * math.Cos(angle), 100 * math.Sin(angle)}
+	ac := math.Hypot(b[0]+100, b[1])
+	bd := math.Hypot(b[0]-100, b[1])
+	factor, err := SkewFactor(ac, bd, 100)
+	assert.NoError(t, err)
+	assert.InDelta(t, math.Tan(math.Pi/180), factor, 1e-9)
+
+	factor, err = SkewFactor(141.42, 141.42, 100)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0, factor, 1e-9)
+
+	_, err = SkewFactor(100, 10, 100)
+	assert.Error(t, err)
+	_, err = SkewFactor(0, 141, 100)
+	assert.Error(t, err)
+}
+
+func TestSkewCorrection_Transform(t *testing.T) {
+	skew := SkewCorrection{XY: 0.01, XZ: 0.02, YZ: 0.03}
+	// the same as Klipper's calc_skew
+	p := skew.Transform().Apply([3]float64{100, 50, 10})
+	assert.InDelta(t, 100-50*0.01-10*(0.02-0.01*0.03), p[0], 1e-9)
+	assert.InDelta(t, 50-10*0.03, p[1], 1e-9)
+	assert.InDelta(t, 10, p[2], 1e-9)
+}
+
+func TestAxisScale(t *testing.T) {
+	scale, err := AxisScale(100, 101)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.990099, scale, 1e-6)
+	_, err = AxisScale(100, 0)
+	assert.Error(t, err)
+}
+
+func TestAxisCorrection_Transform(t *testing.T) {
+	correction := AxisCorrection{Skew: SkewCorrection{XY: 0.01}, ScaleX: 2, ScaleY: 1, ScaleZ: 0.5}
+	// skew first, then scale
+	assert.Equal(t, [3]float64{2 * (10 - 0.2), 20, 1.5}, correction.Transform().Apply([3]float64{10, 20, 3}))
+}
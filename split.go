@@ -0,0 +1,81 @@
+package gcodetools
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Split splits a print into files that are printed one after another, where each of starts is the line (1-based)
+// that the next file starts on. The first file is everything before the first of them. Each of the others starts
+// like a resumed print (see Resume), since the printer could have been turned off in between, and the nozzle is
+// left where the file before it finished. There has to be an output for every file, and it returns the machine's
+// state at each of starts.
+func Split(cfg ResumeConfig, r io.Reader, starts []int, outputs []io.Writer) ([]MachineState, error) {
+	cfg.init()
+	if _, err := setZCommand(cfg.Flavor, 0, 1); err != nil && len(starts) > 0 {
+		return nil, err
+	}
+	if len(outputs) != len(starts)+1 {
+		return nil, fmt.Errorf("there are %d outputs for %d files", len(outputs), len(starts)+1)
+	}
+	for i, start := range starts {
+		if start < 1 {
+			return nil, fmt.Errorf("line %d is before the start of the file", start)
+		}
+		if i > 0 && start <= starts[i-1] {
+			return nil, fmt.Errorf("line %d is before line %d, where the file before it starts", start, starts[i-1])
+		}
+	}
+
+	states := make([]MachineState, 0, len(starts))
+	state := MachineState{}
+	out := bufio.NewWriter(outputs[0])
+	scanner := NewLineScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(states) < len(starts) && lineNumber == starts[len(states)] {
+			if err := out.Flush(); err != nil {
+				return states, err
+			}
+			if !state.IsHomed {
+				// the start gcode would home Z into the print
+				return states, fmt.Errorf("line %d is before the printer is homed, so there's no print to carry on with", lineNumber)
+			}
+			states = append(states, state)
+			out = bufio.NewWriter(outputs[len(states)])
+			if err := writeResumeStart(out, &cfg, &state, lineNumber); err != nil {
+				return states, err
+			}
+		}
+		line, err := cfg.Dialect.ParseLine(scanner.Text())
+		if err != nil {
+			return states, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		state.Apply(&line)
+		_, _ = out.WriteString(scanner.Text())
+		_ = out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return states, err
+	}
+	if len(states) < len(starts) {
+		return states, fmt.Errorf("line %d is past the end of the file, which has %d lines", starts[len(states)], lineNumber)
+	}
+	return states, out.Flush()
+}
+
+// SplitLinesAtLayers are the lines that layers start on (numbered from 0, like Layer.Index), for splitting a print
+// into files that start at each of them
+func SplitLinesAtLayers(layers []Layer, indexes []int) ([]int, error) {
+	starts := make([]int, len(indexes))
+	for i, index := range indexes {
+		line, err := ResumeLineAtLayer(layers, index)
+		if err != nil {
+			return nil, err
+		}
+		starts[i] = line
+	}
+	return starts, nil
+}
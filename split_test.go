@@ -0,0 +1,47 @@
+package gcodetools
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	original := squaresGcode(3, 20, 215)
+	layers, err := ReadLayers(DialectRepRap, strings.NewReader(original))
+	assert.NoError(t, err)
+	starts, err := SplitLinesAtLayers(layers, []int{1, 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{18, 26}, starts)
+
+	outputs := []strings.Builder{{}, {}, {}}
+	states, err := Split(ResumeConfig{Dialect: DialectRepRap}, strings.NewReader(original), starts,
+		[]io.Writer{&outputs[0], &outputs[1], &outputs[2]})
+	assert.NoError(t, err)
+	assert.Len(t, states, 2)
+	assert.InDelta(t, 0.4, states[0].Z, 1e-9)
+	assert.InDelta(t, 0.6, states[1].Z, 1e-9)
+
+	lines := strings.Split(original, "\n")
+	assert.Equal(t, strings.Join(lines[:17], "\n")+"\n", outputs[0].String())
+	for i, output := range outputs[1:] {
+		assert.True(t, strings.HasPrefix(output.String(), "; resuming from line "))
+		end := len(lines)
+		if i == 0 {
+			end = 25
+		}
+		assert.True(t, strings.HasSuffix(output.String(), "; the rest of the print\n"+
+			strings.Join(lines[starts[i]-1:end], "\n")+"\n"))
+	}
+
+	_, err = Split(ResumeConfig{Dialect: DialectRepRap}, strings.NewReader(original), []int{26, 18},
+		[]io.Writer{&outputs[0], &outputs[1], &outputs[2]})
+	assert.EqualError(t, err, "line 18 is before line 26, where the file before it starts")
+	_, err = Split(ResumeConfig{Dialect: DialectRepRap}, strings.NewReader(original), []int{18},
+		[]io.Writer{&outputs[0]})
+	assert.EqualError(t, err, "there are 1 outputs for 2 files")
+	_, err = SplitLinesAtLayers(layers, []int{3})
+	assert.Error(t, err)
+}
@@ -0,0 +1,132 @@
+package gcodetools
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Transform is a linear transform of positions, as a matrix: a point (x, y, z) ends up at Transform·(x, y, z)
+type Transform [3][3]float64
+
+// IdentityTransform leaves every point where it is
+var IdentityTransform = Transform{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+// ScaleTransform scales each axis by a factor
+func ScaleTransform(x, y, z float64) Transform {
+	return Transform{{x, 0, 0}, {0, y, 0}, {0, 0, z}}
+}
+
+// Apply is where a point ends up
+func (t Transform) Apply(p [3]float64) [3]float64 {
+	var out [3]float64
+	for row := range t {
+		out[row] = t[row][0]*p[0] + t[row][1]*p[1] + t[row][2]*p[2]
+	}
+	return out
+}
+
+// Then is the transform that does t, and then next
+func (t Transform) Then(next Transform) Transform {
+	var out Transform
+	for row := range out {
+		for column := range out[row] {
+			for i := range t {
+				out[row][column] += next[row][i] * t[i][column]
+			}
+		}
+	}
+	return out
+}
+
+// transformTolerance is how much an axis has to move by, after it's been transformed, to be written on a line that
+// didn't have it
+const transformTolerance = 1e-6
+
+// PositionTransform moves every position in a program through a Transform, such as a skew or scale correction. It
+// works on the positions the program asks for, so the result is the same whether or not the printer has a
+// transform of its own.
+type PositionTransform struct {
+	Dialect Dialect
+	Matrix  Transform
+}
+
+// Rewrite transforms every move (and G92) once the printer is homed, including the centers of arcs, which are
+// always written as I/J. An arc stays an arc, so it's only exact for transforms that don't change its shape (the
+// small corrections for skew or steps per mm are well within what firmware allows for). Other lines are kept
+// exactly as they were.
+func (c *PositionTransform) Rewrite(r io.Reader, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	scanner := NewLineScanner(r)
+	state := MachineState{}
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, err := c.Dialect.ParseLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		isArc := line.IsG(2) || line.IsG(3)
+		isMove := line.IsMove()
+		hasAxes := line.Xvalid || line.Yvalid || line.Zvalid
+		if !state.IsHomed || !(isArc || (isMove || line.IsG(92)) && hasAxes) {
+			state.Apply(&line)
+			_, _ = out.WriteString(scanner.Text())
+			_ = out.WriteByte('\n')
+			continue
+		}
+		if err := c.transformLine(&state, &line); err != nil {
+			return fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		_, _ = out.WriteString(plainLineFormat.FormatGcode(&line))
+		_ = out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// transformLine transforms the axes of a move or G92, and updates the state for it. Axes that the line didn't have
+// are added if the transform moves them.
+func (c *PositionTransform) transformLine(state *MachineState, line *GcodeLine) error {
+	before := *state
+	var center Point
+	isArc := line.IsG(2) || line.IsG(3)
+	if isArc {
+		var err error
+		if center, err = ArcCenter(&before, line); err != nil {
+			return err
+		}
+	}
+	state.Apply(line)
+
+	from := c.Matrix.Apply([3]float64{before.X, before.Y, before.Z})
+	to := c.Matrix.Apply([3]float64{state.X, state.Y, state.Z})
+	relative := before.RelativeCoordinates && !line.IsG(92)
+	given := []*bool{&line.Xvalid, &line.Yvalid, &line.Zvalid}
+	values := []*float64{&line.X, &line.Y, &line.Z}
+	for axis := range values {
+		if !*given[axis] && math.Abs(to[axis]-from[axis]) < transformTolerance {
+			continue
+		}
+		*given[axis] = true
+		*values[axis] = to[axis]
+		if relative {
+			*values[axis] = to[axis] - from[axis]
+		}
+	}
+
+	if isArc {
+		// the center moves with everything else, and it's always relative to where the arc starts
+		offset := c.Matrix.Apply([3]float64{center.X - before.X, center.Y - before.Y, 0})
+		if line.NumericParams == nil {
+			line.NumericParams = map[uint8]float64{}
+		}
+		delete(line.NumericParams, 'R')
+		line.NumericParams['I'] = offset[0]
+		line.NumericParams['J'] = offset[1]
+	}
+	return nil
+}
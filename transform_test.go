@@ -0,0 +1,83 @@
+package gcodetools
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransform_Then(t *testing.T) {
+	scale := ScaleTransform(2, 3, 4)
+	assert.Equal(t, scale, IdentityTransform.Then(scale))
+	assert.Equal(t, scale, scale.Then(IdentityTransform))
+
+	skew := SkewCorrection{XY: 0.5}.Transform()
+	p := [3]float64{1, 2, 3}
+	assert.Equal(t, scale.Apply(skew.Apply(p)), skew.Then(scale).Apply(p))
+}
+
+func rewriteStr(t *testing.T, transform Transform, gcode string) string {
+	c := PositionTransform{Dialect: DialectRepRap, Matrix: transform}
+	var out bytes.Buffer
+	assert.NoError(t, c.Rewrite(strings.NewReader(gcode), &out))
+	return out.String()
+}
+
+func TestPositionTransform_Rewrite(t *testing.T) {
+	skew := SkewCorrection{XY: 0.1}.Transform()
+	gcode := strings.Join([]string{
+		"G1 X10 Y10 ; before homing",
+		"G28",
+		"G1 X10 Y10 E1 F1200 ; a move",
+		"G1 Y20",
+		"G1 X20",
+		"G1 E-1",
+		"G92 E0",
+		"G91",
+		"G1 Y10",
+		"G90",
+		"G92 Y0",
+		"",
+	}, "\n")
+	assert.Equal(t, strings.Join([]string{
+		"G1 X10 Y10 ; before homing",
+		"G28",
+		"G1 X9 Y10 E1 F1200 ; a move",
+		// moving only in Y moves in X too
+		"G1 X8 Y20",
+		"G1 X18",
+		"G1 E-1",
+		"G92 E0",
+		"G91",
+		"G1 X-1 Y10",
+		"G90",
+		"G92 X20 Y0",
+		"",
+	}, "\n"), rewriteStr(t, skew, gcode))
+}
+
+func TestPositionTransform_Arcs(t *testing.T) {
+	scale := ScaleTransform(2, 2, 1)
+	gcode := strings.Join([]string{
+		"G28",
+		"G1 X10 Y0",
+		"G2 X0 Y-10 I-10 J0 E1",
+		"G3 X10 Y0 R10",
+		"G17",
+		"",
+	}, "\n")
+	assert.Equal(t, strings.Join([]string{
+		"G28",
+		"G1 X20 Y0",
+		"G2 X0 Y-20 E1 I-20 J0",
+		"G3 X20 Y0 I0 J20",
+		"G17",
+		"",
+	}, "\n"), rewriteStr(t, scale, gcode))
+
+	c := PositionTransform{Dialect: DialectRepRap, Matrix: scale}
+	err := c.Rewrite(strings.NewReader("G28\nG18\nG2 X10 Z10 I5 K5\n"), &bytes.Buffer{})
+	assert.EqualError(t, err, "line 3: only arcs in the XY plane (G17) are supported")
+}
@@ -0,0 +1,155 @@
+package gcodetools
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MmPerInch is for converting between G20 (inches) and G21 (mm)
+const MmPerInch = 25.4
+
+// UnitConversion rewrites a whole program from inches to mm, or the other way around.
+// Programs are assumed to start in mm (like every firmware does), until they have a G20.
+type UnitConversion struct {
+	// ToInches converts to inches (G20), otherwise it converts to mm (G21)
+	ToInches bool
+	Dialect  Dialect
+	// Decimals is how many decimals lengths are written with, which defaults to 4 for mm and 5 for inches
+	Decimals int
+}
+
+// lengthParams are the parameters, other than X/Y/Z/E/F, that are lengths: arc offsets and radius,
+// canned cycle depths, and the extra linear axes
+var lengthParams = []uint8{'I', 'J', 'K', 'R', 'Q', 'U', 'V', 'W'}
+
+func (c *UnitConversion) format() gcodeFormat {
+	decimals := c.Decimals
+	feedrateDecimals := 1
+	if decimals == 0 {
+		decimals = 4
+		if c.ToInches {
+			decimals = 5
+		}
+	}
+	if c.ToInches {
+		feedrateDecimals = 2
+	}
+	return gcodeFormat{xyDecimals: decimals, zDecimals: decimals, eDecimals: 5, feedrateDecimals: feedrateDecimals}
+}
+
+func (c *UnitConversion) unitsCommand() GcodeLine {
+	if c.ToInches {
+		return GcodeLine{CmdLetter: G, CmdNumber: 20}
+	}
+	return GcodeLine{CmdLetter: G, CmdNumber: 21}
+}
+
+// ConvertStr converts every line of a program. Lines that don't have any lengths on them are kept exactly as they were.
+func (c *UnitConversion) ConvertStr(gcodeStr string) (string, error) {
+	f := c.format()
+	unitsCommand := c.unitsCommand()
+	inches := false
+	inverseTime := false
+	wroteUnits := false
+
+	strLines := strings.Split(gcodeStr, "\n")
+	outputLines := make([]string, 0, len(strLines)+1)
+	for i, strLine := range strLines {
+		line, err := c.Dialect.ParseLine(strings.TrimRight(strLine, "\r"))
+		if err != nil {
+			return "", fmt.Errorf("line %d: %v", i+1, err)
+		}
+
+		// in CNC gcode, the other commands on a line (like G20 in G20 G0 X1) run first
+		changed := false
+		for j := range line.ExtraCmds {
+			if c.convertModal(&line.ExtraCmds[j], &inches, &inverseTime) {
+				changed = true
+				wroteUnits = true
+			}
+		}
+		if c.convertModal(&line, &inches, &inverseTime) {
+			changed = true
+			wroteUnits = true
+		}
+
+		factor := 1.0
+		if inches && !c.ToInches {
+			factor = MmPerInch
+		} else if !inches && c.ToInches {
+			factor = 1 / MmPerInch
+		}
+		if factor != 1 && hasLengths(&line) {
+			if !wroteUnits {
+				outputLines = append(outputLines, f.format(&unitsCommand))
+				wroteUnits = true
+			}
+			scaleLine(&line, factor, !inverseTime)
+			changed = true
+		}
+
+		if changed {
+			outputLines = append(outputLines, f.format(&line))
+		} else {
+			outputLines = append(outputLines, strLine)
+		}
+	}
+	return strings.Join(outputLines, "\n"), nil
+}
+
+// convertModal keeps track of the modes that matter for converting, and changes G20/G21 to the units being converted to
+func (c *UnitConversion) convertModal(cmd *GcodeLine, inches, inverseTime *bool) bool {
+	switch {
+	case cmd.IsG(20), cmd.IsG(21):
+		*inches = cmd.IsG(20)
+		*cmd = GcodeLine{
+			CmdLetter: G, CmdNumber: c.unitsCommand().CmdNumber,
+			// keep everything else about the line
+			Comment: cmd.Comment, InlineComments: cmd.InlineComments, ExtraCmds: cmd.ExtraCmds,
+			LineNumber: cmd.LineNumber, LineNumberValid: cmd.LineNumberValid, ChecksumValid: cmd.ChecksumValid,
+			BlockDelete: cmd.BlockDelete,
+		}
+		return true
+	case cmd.IsG(93): // inverse time feedrates, F isn't a speed
+		*inverseTime = true
+	case cmd.IsG(94), cmd.IsG(95):
+		*inverseTime = false
+	}
+	return false
+}
+
+// hasLengths is whether a line is a command that has lengths for parameters (like a move), rather than something
+// else that happens to use the same letters (like M92 X80, which is steps per mm)
+func hasLengths(line *GcodeLine) bool {
+	if line.CmdLetter == 0 {
+		// CNC lines with only axis words (or a feedrate) are moves
+		return line.ExtendedCmd == "" && line.MetaCmd == "" && (hasMotionWords(line) || line.Feedrate != 0)
+	}
+	if line.CmdLetter != G {
+		return false
+	}
+	switch line.CmdNumber {
+	case 0, 1, 2, 3, 5, 28, 30, 38, 52, 53, 81, 82, 83, 84, 85, 86, 87, 88, 89:
+		return true
+	case 10: // tool offsets and work offsets, but not G10 retraction
+		return len(line.NumericParams) > 0
+	case 92:
+		return !line.CmdSubcodeValid
+	}
+	return false
+}
+
+func scaleLine(line *GcodeLine, factor float64, feedrate bool) {
+	line.X *= factor
+	line.Y *= factor
+	line.Z *= factor
+	line.E *= factor
+	if feedrate {
+		line.Feedrate *= factor
+	}
+	for _, param := range lengthParams {
+		if value, ok := line.NumericParams[param]; ok {
+			line.NumericParams[param] = value * factor
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package gcodetools
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestUnitConversion_ConvertStr_toMm(t *testing.T) {
+	conversion := UnitConversion{Dialect: DialectCNC}
+	gcodeStr := strings.Join([]string{
+		"%",
+		"G20 G90 (setup)",
+		"G0 X1 Y2",
+		"G1 Z-.1 F10",
+		"X1.5",
+		"G2 X2 Y2.5 I.5 J0",
+		"M3 S1000",
+		"%",
+	}, "\n")
+	output, err := conversion.ConvertStr(gcodeStr)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"%",
+		"G21 G90 (setup)",
+		"G0 X25.4 Y50.8",
+		"G1 Z-2.54 F254",
+		"X38.1",
+		"G2 X50.8 Y63.5 I12.7 J0",
+		"M3 S1000",
+		"%",
+	}, "\n"), output)
+}
+
+func TestUnitConversion_ConvertStr_toInches(t *testing.T) {
+	conversion := UnitConversion{ToInches: true}
+	gcodeStr := strings.Join([]string{
+		"M92 X80 ; steps per mm, not a length",
+		"G28",
+		"G1 X25.4 Y10 F1500",
+		"G93",
+		"G1 X50.8 F2",
+		"",
+	}, "\n")
+	output, err := conversion.ConvertStr(gcodeStr)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"M92 X80 ; steps per mm, not a length",
+		"G20",
+		"G28",
+		"G1 X1 Y.3937 F59.06",
+		"G93",
+		// inverse time feedrates aren't lengths
+		"G1 X2 F2",
+		"",
+	}, "\n"), output)
+}
+
+func TestUnitConversion_ConvertStr_sameUnits(t *testing.T) {
+	conversion := UnitConversion{}
+	gcodeStr := "G21\nG1 X10.00 Y20 ; already in mm\n"
+	output, err := conversion.ConvertStr(gcodeStr)
+	assert.NoError(t, err)
+	assert.Equal(t, gcodeStr, output)
+}
+
+func TestMachineState_Apply_units(t *testing.T) {
+	state := MachineState{}
+	applyAll(&state, "G28\nG1 X25.4 Y50.8 F254\nG20")
+	assert.True(t, state.Inches)
+	assert.InDelta(t, 1.0, state.X, 1e-9)
+	assert.InDelta(t, 2.0, state.Y, 1e-9)
+	assert.InDelta(t, 10.0, state.Feedrate, 1e-9)
+
+	applyAll(&state, "G1 X3\nG21")
+	assert.False(t, state.Inches)
+	assert.InDelta(t, 76.2, state.X, 1e-9)
+}
+
+func TestGcodeMinifierConfig_MinifyGcodeStr_inches(t *testing.T) {
+	cfg := (&GcodeMinifierConfig{}).Init()
+
+	gcodeStr := strings.Join([]string{
+		"G28",
+		"G20",
+		"G1 X1.123456 Y2 F10.5",
+		// less than the threshold if it was in mm, but not in inches
+		"G1 X1.1235 Y2",
+		"G1 X1.1235 Y2.000001",
+	}, "\n")
+	output, _ := cfg.MinifyGcodeStr(MachineState{}, gcodeStr)
+	assert.Equal(t, strings.Join([]string{
+		"G28",
+		"G20",
+		"G1 X1.123456 Y2 F10.5",
+		"G1 X1.1235",
+		"",
+	}, "\n"), output)
+}
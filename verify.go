@@ -0,0 +1,280 @@
+package gcodetools
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// VerifyConfig is how closely a minified file has to match the original for Verify
+type VerifyConfig struct {
+	Dialect Dialect
+	// PositionTolerance is how far (in mm) any point of the toolpath may move. Defaults to 0.01mm
+	PositionTolerance float64
+	// ExtrusionTolerance is how much the total filament extruded may differ by, at any point. Defaults to 0.05mm
+	ExtrusionTolerance float64
+	// FeedrateTolerance is how much the feedrate of a move may change by. Defaults to 1mm/min
+	FeedrateTolerance float64
+}
+
+func (cfg *VerifyConfig) init() {
+	if cfg.PositionTolerance == 0 {
+		cfg.PositionTolerance = 0.01
+	}
+	if cfg.ExtrusionTolerance == 0 {
+		cfg.ExtrusionTolerance = 0.05
+	}
+	if cfg.FeedrateTolerance == 0 {
+		cfg.FeedrateTolerance = 1
+	}
+}
+
+// VerifyCommand is a command that isn't a move, as it's compared between the files
+type VerifyCommand struct {
+	Line    int    `json:"line"` // 1-based
+	Command string `json:"command"`
+}
+
+// FeedrateChange is a move that ends up at the same place in both files, but at a different speed
+type FeedrateChange struct {
+	OriginalLine int     `json:"original_line"`
+	MinifiedLine int     `json:"minified_line"`
+	Original     float64 `json:"original"`
+	Minified     float64 `json:"minified"`
+}
+
+// VerifyReport is how the minified file differs from the original
+type VerifyReport struct {
+	// Moves is how many points of the toolpath were compared
+	Moves int `json:"moves"`
+	// MaxDeviation is the furthest that any point of the toolpath moved, and MaxDeviationLine is where it is in the original
+	MaxDeviation     float64 `json:"max_deviation"`
+	MaxDeviationLine int     `json:"max_deviation_line"`
+	// ExtrusionDifference is the total filament extruded by the minified file, less the original's
+	ExtrusionDifference float64 `json:"extrusion_difference"`
+	// MaxExtrusionDeviation is the most that the total extruded so far differed by, at any point
+	MaxExtrusionDeviation float64          `json:"max_extrusion_deviation"`
+	FeedrateChanges       []FeedrateChange `json:"feedrate_changes"`
+	// DroppedCommands are commands (other than moves) in the original that aren't in the minified file,
+	// and AddedCommands are the other way around
+	DroppedCommands []VerifyCommand `json:"dropped_commands"`
+	AddedCommands   []VerifyCommand `json:"added_commands"`
+	// Problems are all of the ways that the minified file is out of tolerance (or that the files couldn't be compared)
+	Problems []string `json:"problems"`
+}
+
+// OK is whether the minified file is within tolerance
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Verify checks that a minified file does the same as the original: both are replayed through machine state tracking,
+// and their toolpaths and other commands are compared. Moves that the minifier dropped (for being within its
+// threshold of the last position) line up with wherever the machine already was.
+func Verify(cfg VerifyConfig, original, minified io.Reader) (*VerifyReport, error) {
+	cfg.init()
+	originalPath, originalCommands, err := replayForVerify(cfg.Dialect, original)
+	if err != nil {
+		return nil, fmt.Errorf("original: %v", err)
+	}
+	minifiedPath, minifiedCommands, err := replayForVerify(cfg.Dialect, minified)
+	if err != nil {
+		return nil, fmt.Errorf("minified: %v", err)
+	}
+
+	report := &VerifyReport{}
+	compareToolpaths(&cfg, report, originalPath, minifiedPath)
+	compareCommands(report, originalCommands, minifiedCommands)
+
+	if report.MaxDeviation > cfg.PositionTolerance {
+		report.problem("the toolpath moved by up to %.4gmm (on line %d of the original), more than %vmm",
+			report.MaxDeviation, report.MaxDeviationLine, cfg.PositionTolerance)
+	}
+	if report.MaxExtrusionDeviation > cfg.ExtrusionTolerance {
+		report.problem("the filament extruded differs by up to %.4gmm (%.4gmm in total), more than %vmm",
+			report.MaxExtrusionDeviation, report.ExtrusionDifference, cfg.ExtrusionTolerance)
+	}
+	if len(report.FeedrateChanges) > 0 {
+		change := report.FeedrateChanges[0]
+		report.problem("%d moves have a different feedrate, starting with line %d of the original (F%v, minified F%v)",
+			len(report.FeedrateChanges), change.OriginalLine, change.Original, change.Minified)
+	}
+	for _, command := range report.DroppedCommands {
+		report.problem("%s on line %d of the original isn't in the minified file", command.Command, command.Line)
+	}
+	for _, command := range report.AddedCommands {
+		report.problem("%s on line %d of the minified file isn't in the original", command.Command, command.Line)
+	}
+	return report, nil
+}
+
+// toolpathPoint is where a move ends up
+type toolpathPoint struct {
+	line     int
+	x, y, z  float64
+	extruded float64 // total filament so far, for every tool
+	feedrate float64
+}
+
+// verifyFormat writes out commands for comparing them, with more decimals than the minifier would round them to
+var verifyFormat = gcodeFormat{xyDecimals: 6, zDecimals: 6, eDecimals: 8, feedrateDecimals: 3}
+
+// replayForVerify runs a file through a MachineState, and returns where each move goes (leaving out moves that don't
+// go anywhere), and every other command
+func replayForVerify(dialect Dialect, r io.Reader) (path []toolpathPoint, commands []VerifyCommand, err error) {
+	state := MachineState{}
+	extruded := 0.0
+	path = []toolpathPoint{{}}
+
+	scanner := NewLineScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, err := dialect.ParseLine(scanner.Text())
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		if line.CommentOnly() || line.Empty() {
+			continue
+		}
+		for i := range line.ExtraCmds {
+			commands = append(commands, VerifyCommand{lineNumber, verifyCommandString(&line.ExtraCmds[i])})
+			state.Apply(&line.ExtraCmds[i])
+		}
+		line.ExtraCmds = nil
+
+		if line.CmdLetter == 0 && state.MotionMode != "" && hasMotionWords(&line) {
+			// a CNC line with only axis words is another move like the last one
+			_ = parseWord(&line, 0, state.MotionMode)
+		}
+		if !line.IsMove() {
+			if !line.Empty() {
+				commands = append(commands, VerifyCommand{lineNumber, verifyCommandString(&line)})
+			}
+			state.Apply(&line)
+			continue
+		}
+
+		extruded += state.ExtrusionDelta(&line)
+		state.Apply(&line)
+		point := toolpathPoint{line: lineNumber, x: state.X, y: state.Y, z: state.Z, extruded: extruded, feedrate: state.Feedrate}
+		last := path[len(path)-1]
+		if !(sameFloat(point.x, last.x) && sameFloat(point.y, last.y) && sameFloat(point.z, last.z) && point.extruded == last.extruded) {
+			path = append(path, point)
+		}
+	}
+	return path, commands, scanner.Err()
+}
+
+func verifyCommandString(line *GcodeLine) string {
+	command := *line
+	command.Comment = nil
+	command.InlineComments = nil
+	command.LineNumberValid = false
+	command.ChecksumValid = false
+	return verifyFormat.format(&command)
+}
+
+// sameFloat is ==, except that NaN (a position that isn't known) is the same as NaN
+func sameFloat(a, b float64) bool {
+	return a == b || (math.IsNaN(a) && math.IsNaN(b))
+}
+
+func axisDistance(a, b float64) float64 {
+	if sameFloat(a, b) {
+		return 0
+	}
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.Inf(1)
+	}
+	return a - b
+}
+
+func pointDistance(a, b *toolpathPoint) float64 {
+	return math.Sqrt(math.Pow(axisDistance(a.x, b.x), 2) + math.Pow(axisDistance(a.y, b.y), 2) + math.Pow(axisDistance(a.z, b.z), 2))
+}
+
+// compareToolpaths lines up the points of the toolpaths. Every point of the minified path should be close to one in
+// the original, in the same order, and the original's points in between (which were dropped) should be close to
+// where the minified path already was.
+func compareToolpaths(cfg *VerifyConfig, report *VerifyReport, original, minified []toolpathPoint) {
+	near := func(a, b *toolpathPoint, withExtrusion bool) bool {
+		return pointDistance(a, b) <= cfg.PositionTolerance &&
+			(!withExtrusion || math.Abs(a.extruded-b.extruded) <= cfg.ExtrusionTolerance)
+	}
+	deviation := func(o, m *toolpathPoint) {
+		if distance := pointDistance(o, m); distance > report.MaxDeviation {
+			report.MaxDeviation = distance
+			report.MaxDeviationLine = o.line
+		}
+		report.MaxExtrusionDeviation = math.Max(report.MaxExtrusionDeviation, math.Abs(o.extruded-m.extruded))
+	}
+
+	// the first point of both is where the machine starts
+	j := 1
+	for i := 1; i < len(original); i++ {
+		o := &original[i]
+		matched := false
+		// a point where the extrusion matches too is the best match, but extrusion being off is reported as that,
+		// rather than as the toolpaths not lining up
+		for _, withExtrusion := range []bool{true, false} {
+			if j < len(minified) && near(o, &minified[j], withExtrusion) {
+				m := &minified[j]
+				deviation(o, m)
+				if math.Abs(o.feedrate-m.feedrate) > cfg.FeedrateTolerance {
+					report.FeedrateChanges = append(report.FeedrateChanges, FeedrateChange{o.line, m.line, o.feedrate, m.feedrate})
+				}
+				report.Moves++
+				j++
+				matched = true
+				break
+			}
+			if previous := &minified[j-1]; near(o, previous, withExtrusion) {
+				// dropped by the minifier
+				deviation(o, previous)
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		m := &minified[len(minified)-1]
+		if j < len(minified) {
+			m = &minified[j]
+		}
+		report.problem("the toolpaths diverge at line %d of the original (X%v Y%v Z%v), which doesn't line up with line %d of the minified file (X%v Y%v Z%v)",
+			o.line, o.x, o.y, o.z, m.line, m.x, m.y, m.z)
+		return
+	}
+	if j < len(minified) {
+		m := &minified[j]
+		report.problem("the minified file keeps moving after the original ends, from line %d (X%v Y%v Z%v)", m.line, m.x, m.y, m.z)
+		return
+	}
+	report.ExtrusionDifference = minified[len(minified)-1].extruded - original[len(original)-1].extruded
+	report.MaxExtrusionDeviation = math.Max(report.MaxExtrusionDeviation, math.Abs(report.ExtrusionDifference))
+}
+
+// compareCommands finds the commands that were dropped from the original or added to the minified file.
+// The minifier never reorders anything, so it's enough to look ahead for each command of the original.
+func compareCommands(report *VerifyReport, original, minified []VerifyCommand) {
+	j := 0
+	for _, command := range original {
+		k := j
+		for k < len(minified) && minified[k].Command != command.Command {
+			k++
+		}
+		if k == len(minified) {
+			report.DroppedCommands = append(report.DroppedCommands, command)
+			continue
+		}
+		report.AddedCommands = append(report.AddedCommands, minified[j:k]...)
+		j = k + 1
+	}
+	report.AddedCommands = append(report.AddedCommands, minified[j:]...)
+}
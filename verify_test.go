@@ -0,0 +1,87 @@
+package gcodetools
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func verifyStrings(t *testing.T, cfg VerifyConfig, original, minified string) *VerifyReport {
+	report, err := Verify(cfg, strings.NewReader(original), strings.NewReader(minified))
+	assert.NoError(t, err)
+	return report
+}
+
+func TestVerify_minified(t *testing.T) {
+	original := parallelTestGcode(5000, false)
+	minified, _ := (&GcodeMinifierConfig{RemoveComments: true}).Init().MinifyGcodeStr(MachineState{}, original)
+
+	report := verifyStrings(t, VerifyConfig{}, original, minified)
+	assert.Empty(t, report.Problems)
+	assert.True(t, report.OK())
+	assert.True(t, report.Moves > 4000)
+	assert.True(t, report.MaxDeviation > 0, "G1 X10.0001 is dropped")
+	assert.True(t, report.MaxDeviation < 0.001)
+	// absolute E that moves by less than the threshold is dropped
+	assert.InDelta(t, 0, report.ExtrusionDifference, 0.001)
+}
+
+func TestVerify_differences(t *testing.T) {
+	original := strings.Join([]string{
+		"G28",
+		"M83",
+		"M104 S200",
+		"G1 X10 Y10 F1200",
+		"G1 X20 E1",
+		"G1 X20.0001 E0", // a repeated position, which the minifier would drop
+		"M106 S255",
+		"G1 Y20 E1",
+		"G1 X10 E1 F600",
+	}, "\n")
+
+	report := verifyStrings(t, VerifyConfig{}, original, strings.Join([]string{
+		"G28",
+		"M83",
+		"M104 S200",
+		"G1 X10 Y10 F1200",
+		"G1 X20 E1",
+		"G1 Y20.005 E1",
+		"G1 X10 E.9 F900",
+		"M107",
+	}, "\n"))
+	assert.False(t, report.OK())
+	assert.Equal(t, 4, report.Moves)
+	// X is still at 20.0001 from the move that was dropped
+	assert.InDelta(t, 0.005, report.MaxDeviation, 1e-5)
+	assert.Equal(t, 8, report.MaxDeviationLine)
+	assert.InDelta(t, -0.1, report.ExtrusionDifference, 1e-9)
+	assert.Equal(t, []FeedrateChange{{OriginalLine: 9, MinifiedLine: 7, Original: 600, Minified: 900}}, report.FeedrateChanges)
+	assert.Equal(t, []VerifyCommand{{7, "M106 S255"}}, report.DroppedCommands)
+	assert.Equal(t, []VerifyCommand{{8, "M107"}}, report.AddedCommands)
+	assert.Equal(t, []string{
+		"the filament extruded differs by up to 0.1mm (-0.1mm in total), more than 0.05mm",
+		"1 moves have a different feedrate, starting with line 9 of the original (F600, minified F900)",
+		"M106 S255 on line 7 of the original isn't in the minified file",
+		"M107 on line 8 of the minified file isn't in the original",
+	}, report.Problems)
+}
+
+func TestVerify_diverges(t *testing.T) {
+	report := verifyStrings(t, VerifyConfig{}, "G28\nG1 X10\nG1 X20\nG1 X30", "G28\nG1 X10\nG1 X30")
+	assert.Equal(t, []string{
+		"the toolpaths diverge at line 3 of the original (X20 Y0 Z0), which doesn't line up with line 3 of the minified file (X30 Y0 Z0)",
+	}, report.Problems)
+
+	report = verifyStrings(t, VerifyConfig{}, "G28\nG1 X10", "G28\nG1 X10\nG1 X20")
+	assert.Equal(t, []string{
+		"the minified file keeps moving after the original ends, from line 3 (X20 Y0 Z0)",
+	}, report.Problems)
+}
+
+func TestVerify_cnc(t *testing.T) {
+	original := "%\nG21 G90\nG0 X0 Y0 (start)\nG1 X10 F100\nG1 X10 Y10\nG1 X0\n%"
+	minified, _ := (&GcodeMinifierConfig{CNC: true}).Init().MinifyGcodeStr(MachineState{}, original)
+	report := verifyStrings(t, VerifyConfig{Dialect: DialectCNC}, original, minified)
+	assert.Empty(t, report.Problems)
+	assert.Equal(t, 3, report.Moves)
+}
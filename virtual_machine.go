@@ -1,10 +1,163 @@
 package gcodetools
 
-import "github.com/go-gl/mathgl/mgl64"
+import (
+	"math"
+
+	"github.com/go-gl/mathgl/mgl64"
+)
 
 type vec3 mgl64.Vec3
 
+// temperatureWindow is how close a heater has to get to its target for M109 or M190 to stop waiting, like Marlin's TEMP_WINDOW
+const temperatureWindow = 1.0
+
+// homingSeconds is how long G28 takes. The time estimator doesn't know about homing, so it's a guess.
+const homingSeconds = 3.0
+
+// HeaterModel is how a heater heats up and cools down. Its temperature approaches where it's heading (the target,
+// or the ambient temperature when it's off) exponentially, but can't heat up faster than the heater allows.
+type HeaterModel struct {
+	Ambient float64
+	// TimeConstant is how long (in seconds) it takes to get 63% of the way to where it's heading
+	TimeConstant float64
+	// MaxHeatingRate is the most it can heat up by in a second
+	MaxHeatingRate float64
+}
+
+var DefaultHotendModel = HeaterModel{Ambient: 25, TimeConstant: 20, MaxHeatingRate: 4}
+var DefaultBedModel = HeaterModel{Ambient: 25, TimeConstant: 60, MaxHeatingRate: 1}
+
+// step is the temperature after a number of seconds, starting at temperature
+func (m *HeaterModel) step(temperature, target, seconds float64) float64 {
+	// a heater can't cool anything down, so a target below the ambient temperature is as good as off
+	heading := math.Max(target, m.Ambient)
+	next := heading + (temperature-heading)*math.Exp(-seconds/m.TimeConstant)
+	if m.MaxHeatingRate > 0 && next > temperature {
+		next = math.Min(next, temperature+m.MaxHeatingRate*seconds)
+	}
+	return next
+}
+
+// temperatureWait is an M109 or M190 that hasn't finished waiting
+type temperatureWait struct {
+	bed  bool
+	tool int
+	// heatOnly is a wait that's over once the heater is hot enough, even if it's hotter (M109 S, rather than M109 R)
+	heatOnly bool
+}
+
+// GcodeVirtualMachine runs gcode like a printer would: it keeps track of the machine state, how long each command
+// takes (with the time estimator), and the actual temperatures of the heaters as they heat up and cool down
 type GcodeVirtualMachine struct {
 	Position vec3
 	Feedrate float64
+
+	State     MachineState
+	Estimator TimeEstimator
+	// Time is how many seconds have passed since the machine started
+	Time float64
+
+	HotendModel HeaterModel
+	BedModel    HeaterModel
+	// HotendTemperatures are the actual temperatures of every tool's hotend, and BedTemperature is the bed's
+	HotendTemperatures [MaxTools]float64
+	BedTemperature     float64
+
+	waits []temperatureWait
+}
+
+// NewGcodeVirtualMachine makes a machine with the given motion limits, with every heater at the ambient temperature
+func NewGcodeVirtualMachine(limits KinematicLimits) *GcodeVirtualMachine {
+	vm := &GcodeVirtualMachine{
+		Estimator:   TimeEstimator{Limits: limits},
+		HotendModel: DefaultHotendModel,
+		BedModel:    DefaultBedModel,
+	}
+	for i := range vm.HotendTemperatures {
+		vm.HotendTemperatures[i] = vm.HotendModel.Ambient
+	}
+	vm.BedTemperature = vm.BedModel.Ambient
+	return vm
+}
+
+// Run runs one line, and returns how many seconds it takes to move (or dwell). Time doesn't pass until Advance is
+// called, since a printer plans moves ahead of running them. Waiting for a heater (M109, M190) isn't included
+// either: it starts a wait, which Advance finishes once the heater gets to temperature.
+func (vm *GcodeVirtualMachine) Run(line *GcodeLine) float64 {
+	seconds := vm.Estimator.AddLine(line)
+	switch {
+	case line.IsG(28):
+		seconds = homingSeconds
+	case line.IsM(109):
+		tool := vm.State.Tool
+		if t, ok := line.NumericParams['T']; ok {
+			tool = int(t)
+		}
+		_, heatOnly := line.NumericParams['S']
+		if tool >= 0 && tool < MaxTools {
+			vm.waits = append(vm.waits, temperatureWait{tool: tool, heatOnly: heatOnly})
+		}
+	case line.IsM(190):
+		_, heatOnly := line.NumericParams['S']
+		vm.waits = append(vm.waits, temperatureWait{bed: true, heatOnly: heatOnly})
+	}
+	vm.State.Apply(line)
+	vm.Position = vec3{vm.State.X, vm.State.Y, vm.State.Z}
+	vm.Feedrate = vm.State.Feedrate
+	vm.updateWaits()
+	return seconds
+}
+
+// HotendTarget is the target temperature of a tool's hotend, 0 when it's off
+func (vm *GcodeVirtualMachine) HotendTarget(tool int) float64 {
+	return vm.State.ToolStateOf(tool).HotendTemperature
+}
+
+// Waiting is whether the machine is waiting for a heater to get to temperature
+func (vm *GcodeVirtualMachine) Waiting() bool {
+	return len(vm.waits) > 0
+}
+
+// Advance lets time pass, so that the heaters heat up or cool down, and anything waiting for them finishes waiting
+func (vm *GcodeVirtualMachine) Advance(seconds float64) {
+	// in small steps, so that a wait finishes at about the right time
+	const maxStep = 0.1
+	for seconds > 0 {
+		step := math.Min(seconds, maxStep)
+		for tool := range vm.HotendTemperatures {
+			vm.HotendTemperatures[tool] = vm.HotendModel.step(vm.HotendTemperatures[tool], vm.HotendTarget(tool), step)
+		}
+		vm.BedTemperature = vm.BedModel.step(vm.BedTemperature, vm.State.BedTemperature, step)
+		vm.Time += step
+		seconds -= step
+		vm.updateWaits()
+	}
+}
+
+// WaitForTemperatures advances time until nothing is waiting for a heater, and returns how long that took
+func (vm *GcodeVirtualMachine) WaitForTemperatures() float64 {
+	start := vm.Time
+	for vm.Waiting() {
+		vm.Advance(1)
+	}
+	return vm.Time - start
+}
+
+func (vm *GcodeVirtualMachine) updateWaits() {
+	waits := vm.waits[:0]
+	for _, wait := range vm.waits {
+		temperature, target, model := vm.HotendTemperatures[wait.tool], vm.HotendTarget(wait.tool), &vm.HotendModel
+		if wait.bed {
+			temperature, target, model = vm.BedTemperature, vm.State.BedTemperature, &vm.BedModel
+		}
+		// waiting for a heater that's off is over straight away, like it is in Marlin. A target below the ambient
+		// temperature can't be reached, so it's over once the heater has cooled down as far as it can.
+		off := target == 0
+		target = math.Max(target, model.Ambient)
+		reached := off || math.Abs(temperature-target) <= temperatureWindow || (wait.heatOnly && temperature > target)
+		if !reached {
+			waits = append(waits, wait)
+		}
+	}
+	vm.waits = waits
 }
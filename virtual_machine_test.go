@@ -0,0 +1,70 @@
+package gcodetools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGcodeVirtualMachine_Run(t *testing.T) {
+	vm := NewGcodeVirtualMachine(KinematicLimits{})
+	assert.Equal(t, homingSeconds, vm.Run(mustParseLine("G28")))
+	assert.InDelta(t, 1, vm.Run(mustParseLine("G1 X10 F600")), 1e-9)
+	assert.InDelta(t, 0.5, vm.Run(mustParseLine("G4 P500")), 1e-9)
+	assert.Equal(t, vec3{10, 0, 0}, vm.Position)
+	assert.Equal(t, 600.0, vm.Feedrate)
+	// running lines doesn't take any time until it's advanced
+	assert.Equal(t, 0.0, vm.Time)
+}
+
+func TestGcodeVirtualMachine_heating(t *testing.T) {
+	vm := NewGcodeVirtualMachine(KinematicLimits{})
+	vm.Run(mustParseLine("M140 S60"))
+	vm.Run(mustParseLine("M109 S200"))
+	assert.True(t, vm.Waiting())
+	vm.Advance(10)
+	assert.InDelta(t, 65, vm.HotendTemperatures[0], 1e-6, "limited by how fast the heater can heat up")
+	assert.True(t, vm.Waiting())
+
+	seconds := vm.WaitForTemperatures()
+	assert.False(t, vm.Waiting())
+	assert.InDelta(t, 200, vm.HotendTemperatures[0], temperatureWindow)
+	assert.True(t, seconds > 60 && seconds < 120, "took %vs", seconds)
+	// the bed was heating up the whole time, without being waited for
+	assert.True(t, vm.BedTemperature > 40 && vm.BedTemperature < 60, "bed is at %v", vm.BedTemperature)
+
+	// M109 S doesn't wait to cool down, M109 R does
+	vm.Run(mustParseLine("M109 S180"))
+	assert.False(t, vm.Waiting())
+	vm.Run(mustParseLine("M109 R180"))
+	assert.True(t, vm.Waiting())
+	vm.WaitForTemperatures()
+	assert.InDelta(t, 180, vm.HotendTemperatures[0], temperatureWindow)
+
+	// turning a heater off cools it down to the ambient temperature, and waiting for it is over straight away
+	vm.Run(mustParseLine("M190 S0"))
+	assert.False(t, vm.Waiting())
+	vm.Run(mustParseLine("M104 S0"))
+	vm.Advance(600)
+	assert.InDelta(t, DefaultHotendModel.Ambient, vm.HotendTemperatures[0], 0.1)
+
+	// nothing can cool down below the ambient temperature, so waiting for that is over once it's as cool as it gets
+	vm.Run(mustParseLine("M140 S60"))
+	vm.Advance(600)
+	vm.Run(mustParseLine("M190 R10"))
+	assert.True(t, vm.Waiting())
+	seconds = vm.WaitForTemperatures()
+	assert.True(t, seconds < 3600, "took %vs", seconds)
+	assert.InDelta(t, DefaultBedModel.Ambient, vm.BedTemperature, temperatureWindow)
+	vm.Run(mustParseLine("M109 R25"))
+	assert.False(t, vm.Waiting())
+}
+
+func TestGcodeVirtualMachine_tools(t *testing.T) {
+	vm := NewGcodeVirtualMachine(KinematicLimits{})
+	vm.Run(mustParseLine("M104 T1 S150"))
+	vm.Run(mustParseLine("M109 T1 S150"))
+	vm.WaitForTemperatures()
+	assert.InDelta(t, 150, vm.HotendTemperatures[1], temperatureWindow)
+	assert.Equal(t, DefaultHotendModel.Ambient, vm.HotendTemperatures[0])
+}